@@ -10,10 +10,14 @@ import (
 )
 
 var cloneLocalVolume string
+var cloneDryRun bool
+var cloneDepth int
+var cloneSince string
+var cloneAllBranches bool
 
 func NewCmdClone(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "clone <remote> [<dot> [<branch>]] [--local-name=<dot>]",
+		Use:   "clone <remote> [<dot> [<branch>]] [--local-name=<dot>] [--depth=<n> | --since=<commit> | --all-branches] [--dry-run]",
 		Short: `Make a complete copy of a remote dot`,
 		// XXX should this specify a branch?
 		Long: `Make a complete copy on the current active cluster of the given
@@ -26,6 +30,19 @@ copy of 'app_billing_postgres' at all yet:
 
     dm clone devdata billing_postgres repro_bug_1131
 
+'--depth=1' copies only the latest commit, and '--depth=<n>' the latest <n>,
+instead of the whole history. '--since=<commit>' copies <commit> and every
+commit after it. Later pulls carry on from the copied commits as normal.
+Only the first branch transferred can be shallow: when cloning a branch,
+that's the master branch up to where the branch starts.
+
+'--all-branches' copies every branch of <dot>, each one after the branch it
+was made from. A branch which fails to copy doesn't stop the others, except
+for branches made from it, and 'clone' reports how each branch went.
+
+'--dry-run' reports which commits would be copied and how much data that is,
+or why the clone would fail, without copying anything.
+
 Online help: https://docs.dotmesh.com/references/cli/#clone-dm-clone-local-name-local-dot-remote-dot-branch
 `,
 		Run: func(cmd *cobra.Command, args []string) {
@@ -40,10 +57,37 @@ Online help: https://docs.dotmesh.com/references/cli/#clone-dm-clone-local-name-
 				if err != nil {
 					return err
 				}
+				if cloneDepth != 0 && cloneSince != "" {
+					return fmt.Errorf("Please specify at most one of --depth and --since.")
+				}
+				if cloneAllBranches {
+					if cloneDepth != 0 || cloneSince != "" {
+						return fmt.Errorf("Please don't use --depth or --since with --all-branches.")
+					}
+					if len(args) > 2 {
+						return fmt.Errorf("Please don't name a branch to clone with --all-branches.")
+					}
+				}
+				opts := remotes.TransferOptions{
+					Depth: cloneDepth, Since: cloneSince, AllBranches: cloneAllBranches,
+				}
+				if cloneDryRun {
+					plan, err := dm.PlanTransfer(
+						"pull", peer,
+						cloneLocalVolume, branchName,
+						filesystemName, branchName,
+						opts,
+					)
+					if err != nil {
+						return err
+					}
+					return printTransferPlan(out, plan)
+				}
 				transferId, err := dm.RequestTransfer(
 					"pull", peer,
 					cloneLocalVolume, branchName,
 					filesystemName, branchName,
+					opts,
 					// TODO also switch to the remote?
 				)
 				if err != nil {
@@ -65,6 +109,14 @@ Online help: https://docs.dotmesh.com/references/cli/#clone-dm-clone-local-name-
 
 	cmd.PersistentFlags().StringVarP(&cloneLocalVolume, "local-name", "", "",
 		"Local dot name to create")
+	cmd.PersistentFlags().BoolVarP(&cloneDryRun, "dry-run", "", false,
+		"Show what would be copied without copying it")
+	cmd.PersistentFlags().IntVarP(&cloneDepth, "depth", "", 0,
+		"Only copy this many of the latest commits")
+	cmd.PersistentFlags().StringVarP(&cloneSince, "since", "", "",
+		"Only copy this commit and the ones after it")
+	cmd.PersistentFlags().BoolVarP(&cloneAllBranches, "all-branches", "", false,
+		"Copy every branch of the dot")
 
 	return cmd
 }
@@ -6,6 +6,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,6 +17,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"golang.org/x/net/context"
@@ -34,6 +36,10 @@ const DOTMESH_DOCKER_IMAGE = "quay.io/dotmesh/dotmesh-server"
 const DOTMESH_UPGRADES_URL = "https://checkpoint.dotmesh.com/"
 const DOTMESH_UPGRADES_INTERVAL_SECONDS = 14400 // 4 hours
 
+// What a certificate given with --tls-cert is called in the PKI directory.
+// MUST MATCH USER_CERTIFICATE_NAME in cmd/dotmesh-server/pkg/main/tls.go
+const USER_CERTIFICATE_NAME = "dotmesh-api"
+
 // The following consts MUST MATCH those defined in cmd/dotmesh-server/pkg/main/users.go
 //
 // FIXME: When we have a shared library betwixt client and server, we can put all this in there.
@@ -62,6 +68,12 @@ var (
 	dotmeshDockerImage string
 	checkpointUrl      string
 	checkpointInterval int
+	preferredSubnets   string
+	tlsCert            string
+	tlsKey             string
+	requireTLS         bool
+	failoverGrace      string
+	replicationFactor  int
 	etcdDockerImage    string
 	dockerApiVersion   string
 	usePoolDir         string
@@ -75,6 +87,8 @@ var (
 var inheritedEnvironment = []string{
 	"FILESYSTEM_METADATA_TIMEOUT",
 	"EXTRA_HOST_COMMANDS",
+	"DOTMESH_METADATA_STORE",
+	"DOTMESH_REQUEST_TIMEOUT",
 }
 
 var timings map[string]float64
@@ -123,6 +137,14 @@ another.`,
 	cmd.AddCommand(NewCmdClusterJoin(os.Stdout))
 	cmd.AddCommand(NewCmdClusterReset(os.Stdout))
 	cmd.AddCommand(NewCmdClusterUpgrade(os.Stdout))
+	cmd.AddCommand(NewCmdClusterRevokeNode(os.Stdout))
+	cmd.AddCommand(NewCmdClusterReadmitNode(os.Stdout))
+	cmd.AddCommand(NewCmdClusterFailovers(os.Stdout))
+	cmd.AddCommand(NewCmdClusterDrain(os.Stdout))
+	cmd.AddCommand(NewCmdClusterStatus(os.Stdout))
+	cmd.AddCommand(NewCmdClusterRemoveNode(os.Stdout))
+	cmd.AddCommand(NewCmdClusterBackup(os.Stdout))
+	cmd.AddCommand(NewCmdClusterRestore(os.Stdout))
 	cmd.PersistentFlags().StringVar(
 		&traceAddr, "trace", "",
 		"Hostname for Zipkin host to enable distributed tracing",
@@ -143,6 +165,36 @@ another.`,
 		&checkpointInterval, "dotmesh-upgrades-seconds", DOTMESH_UPGRADES_INTERVAL_SECONDS,
 		"How many seconds to wait been polls for new version data",
 	)
+	cmd.PersistentFlags().StringVar(
+		&preferredSubnets, "preferred-subnets", "",
+		"Comma-separated subnets (e.g. 10.0.0.0/8) whose addresses nodes should "+
+			"try first when connecting to each other or to other clusters",
+	)
+	cmd.PersistentFlags().StringVar(
+		&tlsCert, "tls-cert", "",
+		"PEM certificate for this node to serve its API with, e.g. one signed "+
+			"by a public CA, instead of the one generated for it",
+	)
+	cmd.PersistentFlags().StringVar(
+		&tlsKey, "tls-key", "",
+		"PEM private key for --tls-cert",
+	)
+	cmd.PersistentFlags().BoolVar(
+		&requireTLS, "require-tls", false,
+		"Refuse plain HTTP connections to the API, which are otherwise still "+
+			"accepted alongside HTTPS for older clients",
+	)
+	cmd.PersistentFlags().StringVar(
+		&failoverGrace, "failover-grace-period", "5m",
+		"How long a node can be gone before the dots it's master of are "+
+			"failed over to their most up-to-date replicas, or 'off'",
+	)
+	cmd.PersistentFlags().IntVar(
+		&replicationFactor, "replication-factor", 0,
+		"How many nodes should keep a copy of each dot, the master included, "+
+			"unless set for the dot with 'dm dot set-replication-factor'. 0 "+
+			"means every node. Use the same value on every node.",
+	)
 	cmd.PersistentFlags().StringVar(
 		&etcdDockerImage, "etcd-image",
 		"quay.io/dotmesh/etcd:v3.0.15",
@@ -233,6 +285,499 @@ func NewCmdClusterUpgrade(out io.Writer) *cobra.Command {
 	return cmd
 }
 
+func NewCmdClusterRevokeNode(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revoke-node <node-name>",
+		Short: "Stop the current remote's cluster trusting a node",
+		Long: `Refuse the node certificates a node in the current remote's cluster has
+been issued from now on, e.g. because it's been compromised, and don't issue
+it any more. Node names are the hostnames of the docker hosts they were set up
+on.
+
+Once the node has been rebuilt, run 'dm cluster readmit-node' so that it can be
+issued a new certificate when it rejoins the cluster. A node which is reset and
+rejoined without being compromised must also be revoked and readmitted to be
+issued a new certificate, until then it authenticates with the admin API key.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the name of the node to revoke")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				revokedAt, err := dm.RevokeNode(args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Revoked node %s at %s.\n", args[0], revokedAt.Format(time.RFC3339))
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdClusterReadmitNode(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "readmit-node <node-name>",
+		Short: "Allow a revoked node to be issued a new node certificate",
+		Long: `Allow a node revoked with 'dm cluster revoke-node' to be issued a new node
+certificate, e.g. once it's been rebuilt. The certificates it had been issued
+before it was revoked stay revoked.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the name of the node to readmit")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				err = dm.ReadmitNode(args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Readmitted node %s.\n", args[0])
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdClusterStatus(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show an overview of the current remote's cluster",
+		Long: `List every node in the current remote's cluster with its addresses, whether
+it's up, whether it's the leader which runs the cluster-wide background jobs,
+its version, how much space its pool has left and how many dots it's the
+master of and has copies of, as of when it last reported them. Then show
+whether etcd is healthy, and any transfers to or from other clusters in
+progress.
+
+In scripting mode, each line starts with what it's about: "node", "leader",
+"etcd" or "transfer".`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				if len(args) > 0 {
+					return fmt.Errorf("Please specify no arguments.")
+				}
+				status, err := dm.ClusterStatus()
+				if err != nil {
+					return err
+				}
+				if scriptingMode {
+					printClusterStatusForScripts(out, status)
+				} else {
+					printClusterStatus(out, status)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	return cmd
+}
+
+func printClusterStatus(out io.Writer, status remotes.ClusterStatus) {
+	w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NODE\tADDRESSES\tSTATUS\tVERSION\tPOOL FREE\tMASTERS\tREPLICAS\n")
+	for _, n := range status.Nodes {
+		state := "down"
+		if n.Live {
+			state = "up"
+		}
+		if n.Draining {
+			state += ", draining"
+		}
+		if n.Id == status.Leader {
+			state += ", leader"
+		}
+		free := "-"
+		if n.StatusUpdatedAt > 0 {
+			free = fmt.Sprintf("%s of %s", prettyPrintSize(n.PoolFree), prettyPrintSize(n.PoolSize))
+		}
+		version := n.Version
+		if version == "" {
+			version = "-"
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			n.Id, strings.Join(n.Addresses, ","), state, version, free, n.Masters, n.Replicas,
+		)
+	}
+	w.Flush()
+
+	fmt.Fprintln(out)
+	if status.Etcd.Healthy {
+		fmt.Fprintf(
+			out, "etcd: healthy, leader %s, members %s\n",
+			status.Etcd.Leader, strings.Join(status.Etcd.Members, ", "),
+		)
+	} else {
+		fmt.Fprintf(out, "etcd: unhealthy: %s\n", status.Etcd.Error)
+	}
+
+	if len(status.Transfers) == 0 {
+		fmt.Fprintln(out, "No transfers in progress.")
+		return
+	}
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "TRANSFER\tDIRECTION\tNODE\tPEER\tSTATUS\tPROGRESS\n")
+	for _, t := range status.Transfers {
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%d/%d, %s of %s\n",
+			t.TransferRequestId, t.Direction, t.InitiatorNodeId, t.Peer, t.Status,
+			t.Index, t.Total, prettyPrintSize(t.Sent), prettyPrintSize(t.Size),
+		)
+	}
+	w.Flush()
+}
+
+func printClusterStatusForScripts(out io.Writer, status remotes.ClusterStatus) {
+	for _, n := range status.Nodes {
+		fmt.Fprintf(
+			out, "node\t%s\t%s\t%t\t%t\t%s\t%d\t%d\t%d\t%d\n",
+			n.Id, strings.Join(n.Addresses, ","), n.Live, n.Draining, n.Version,
+			n.PoolFree, n.PoolSize, n.Masters, n.Replicas,
+		)
+	}
+	fmt.Fprintf(out, "leader\t%s\n", status.Leader)
+	health := "unhealthy"
+	if status.Etcd.Healthy {
+		health = "healthy"
+	}
+	fmt.Fprintf(
+		out, "etcd\t%s\t%s\t%s\n",
+		health, status.Etcd.Leader, strings.Join(status.Etcd.Members, ","),
+	)
+	for _, t := range status.Transfers {
+		fmt.Fprintf(
+			out, "transfer\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+			t.TransferRequestId, t.Direction, t.InitiatorNodeId, t.Peer, t.Status,
+			t.Index, t.Total, t.Sent, t.Size,
+		)
+	}
+}
+
+func NewCmdClusterDrain(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "drain <node-name>",
+		Short: "Move every dot off a node in the current remote's cluster",
+		Long: `Stop creating dots on a node, or moving them or their replicas to it, and
+move every dot (and branch) it's the master of to the other node with the most
+up-to-date copy of it. Then wait for the other nodes to catch up with every
+dot it has a copy of, after which it's safe to stop it and remove it from the
+cluster with 'dm cluster remove-node'.
+
+Refuses to move dots while containers are using them, unless
+--stop-containers is given.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the name of the node to drain")
+				}
+				node := args[0]
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				moves, err := dm.DrainNode(node, stopContainers)
+				if err != nil {
+					return err
+				}
+				failed := 0
+				for _, move := range moves {
+					dot := move.Name.String()
+					if move.Branch != "" {
+						dot += " (branch " + move.Branch + ")"
+					}
+					if move.Error == "" {
+						fmt.Fprintf(out, "Moving %s to %s...\n", dot, move.Target)
+						err = dm.PollMove(
+							remotes.MoveRequest{
+								FilesystemId: move.FilesystemId, RequestId: move.RequestId,
+							},
+							out,
+						)
+						if err == nil {
+							continue
+						}
+						move.Error = err.Error()
+					}
+					fmt.Fprintf(out, "Unable to move %s: %s\n", dot, move.Error)
+					failed++
+				}
+				if failed > 0 {
+					return fmt.Errorf(
+						"%d dots are still on %s, please deal with them and drain it again",
+						failed, node,
+					)
+				}
+
+				lastCatchingUp := -1
+				for {
+					status, err := dm.DrainStatus(node)
+					if err != nil {
+						return err
+					}
+					if status.Masters > 0 {
+						return fmt.Errorf(
+							"%s has become the master of %d dots since, please drain it again",
+							node, status.Masters,
+						)
+					}
+					if status.CatchingUp == 0 {
+						break
+					}
+					if status.CatchingUp != lastCatchingUp {
+						fmt.Fprintf(
+							out, "Waiting for other nodes to catch up with %d dots...\n",
+							status.CatchingUp,
+						)
+						lastCatchingUp = status.CatchingUp
+					}
+					time.Sleep(time.Second)
+				}
+				fmt.Fprintf(
+					out, "Drained %s. Stop it, then run 'dm cluster remove-node %s'.\n",
+					node, node,
+				)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&stopContainers, "stop-containers", "", false,
+		"stop any containers using the node's dots, rather than refusing to move them")
+	return cmd
+}
+
+func NewCmdClusterRemoveNode(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove-node <node-name>",
+		Short: "Forget a node in the current remote's cluster",
+		Long: `Forget everything the current remote's cluster knows about a node which
+has been drained with 'dm cluster drain' and then stopped: its addresses, and
+which commits of which dots it had. Its etcd server is removed from the
+cluster's etcd, so that it no longer counts towards the quorum, and its node
+certificates are revoked. The node which issues node certificates can't be
+removed.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the name of the node to remove")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				err = dm.RemoveNode(args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Removed node %s.\n", args[0])
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdClusterBackup(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup -o <file>",
+		Short: "Back up the current remote's cluster's metadata",
+		Long: `Write everything the current remote's cluster knows besides the contents of
+its dots to a file, as of a single point in time: the names of its dots and
+their branches, its users and collaborators, which node is master of each dot,
+and its transfers to and from other clusters. If the cluster loses its etcd,
+restore it with 'dm cluster restore'.
+
+The file holds credentials, so keep it somewhere safe: the users' API keys
+and password hashes, and the API keys of the other clusters its dots are
+pushed to and pulled from. They're needed for the cluster to work as before
+once it's restored.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 0 {
+					return fmt.Errorf("Please specify no arguments.")
+				}
+				if backupFile == "" {
+					return fmt.Errorf("Please specify a file to write the backup to with -o")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				backup, err := dm.BackupMetadata()
+				if err != nil {
+					return err
+				}
+				serialized, err := json.MarshalIndent(backup, "", "  ")
+				if err != nil {
+					return err
+				}
+				err = ioutil.WriteFile(backupFile, serialized, 0600)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Backed up %d keys to %s.\n", len(backup.Keys), backupFile)
+				fmt.Fprintf(
+					out, "It holds the users' API keys and password hashes, and the API keys "+
+						"of other clusters, so keep it somewhere safe.\n",
+				)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&backupFile, "output", "o", "", "file to write the backup to")
+	return cmd
+}
+
+func NewCmdClusterRestore(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore <file>",
+		Short: "Restore the current remote's cluster's metadata from a backup",
+		Long: `Write the metadata backed up with 'dm cluster backup' into the current
+remote's cluster, e.g. after it's lost its etcd and been set up again with the
+same nodes. The admin user the cluster was set up with is kept.
+
+Each dot then gets the node it was master of in the backup as its master if
+that node still has it, or otherwise the node with the longest history of it.
+Dots no node has, and filesystems on the nodes the backup doesn't name, are
+listed.
+
+Refuses to overwrite any dots the cluster already has unless --force is given.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the backup file to restore")
+				}
+				serialized, err := ioutil.ReadFile(args[0])
+				if err != nil {
+					return err
+				}
+				var backup remotes.MetadataBackup
+				err = json.Unmarshal(serialized, &backup)
+				if err != nil {
+					return fmt.Errorf("%s isn't a backup from 'dm cluster backup': %s", args[0], err)
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				result, err := dm.RestoreMetadata(backup, forceMode)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(
+					out, "Restored %d keys from the backup taken at %s.\n",
+					result.Keys, time.Unix(backup.CreatedAt, 0).Format(time.RFC3339),
+				)
+				for _, fs := range result.Filesystems {
+					dot := fs.Name.String()
+					if fs.Branch != "" {
+						dot += "@" + fs.Branch
+					}
+					if fs.Master == "" {
+						fmt.Fprintf(
+							out, "No node has %s (%s), it will be unavailable until one does.\n",
+							dot, fs.FilesystemId,
+						)
+					} else if fs.OldMaster == "" {
+						fmt.Fprintf(out, "%s is now mastered on %s.\n", dot, fs.Master)
+					} else if fs.Master != fs.OldMaster {
+						fmt.Fprintf(
+							out, "%s is now mastered on %s, as %s doesn't have it.\n",
+							dot, fs.Master, fs.OldMaster,
+						)
+					}
+				}
+				for _, id := range result.Unregistered {
+					fmt.Fprintf(out, "Filesystem %s isn't in the backup, so has no name.\n", id)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&forceMode, "force", "f", false,
+		"overwrite any dots the cluster already has")
+	return cmd
+}
+
+func NewCmdClusterFailovers(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "failovers",
+		Short: "List the automatic failovers in the current remote's cluster",
+		Long: `List the times a node was gone for longer than its cluster's
+--failover-grace-period, and one of the dots (or branches) it was master of
+was failed over to another node's replica, oldest first. LOST is how many of
+the old master's commits the new master didn't have; if the old master comes
+back, it keeps them on a new branch.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				if len(args) > 0 {
+					return fmt.Errorf("Please specify no arguments.")
+				}
+				events, err := dm.Failovers()
+				if err != nil {
+					return err
+				}
+
+				columnNames := []string{"WHEN", "DOT", "FROM", "TO", "LOST"}
+				var target io.Writer
+				if scriptingMode {
+					target = out
+				} else {
+					target = tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+					fmt.Fprintf(target, "%s\n", strings.Join(columnNames, "\t"))
+				}
+				for _, e := range events {
+					when := time.Unix(e.At, 0).Format(time.RFC3339)
+					if scriptingMode {
+						when = fmt.Sprintf("%d", e.At)
+					}
+					dot := e.Name.String()
+					if e.Name.Name == "" {
+						dot = e.FilesystemId
+					} else if e.Branch != "" {
+						dot += "@" + e.Branch
+					}
+					cells := []string{when, dot, e.From, e.To, fmt.Sprintf("%d", e.LostCommits)}
+					fmt.Fprintf(target, "%s\n", strings.Join(cells, "\t"))
+				}
+				w, ok := target.(*tabwriter.Writer)
+				if ok {
+					w.Flush()
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	return cmd
+}
+
 func NewCmdClusterReset(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "reset",
@@ -289,12 +834,33 @@ func clusterUpgrade(cmd *cobra.Command, args []string, out io.Writer) error {
 	}
 
 	pkiPath := getPkiPath()
+	err = installUserCertificate(pkiPath)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Starting dotmesh server... ")
 	err = startDotmeshContainer(pkiPath)
 	if err != nil {
 		return err
 	}
 	fmt.Printf("done.\n")
+
+	// the server now serves HTTPS, so make sure the local remote knows how to
+	// check its certificate
+	config, err := remotes.NewConfiguration(configPath)
+	if err != nil {
+		return err
+	}
+	if _, err := config.GetRemote("local"); err == nil {
+		localTLS, err := localRemoteTLS(pkiPath)
+		if err != nil {
+			return err
+		}
+		err = config.SetRemoteTLS("local", localTLS)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -544,6 +1110,11 @@ func startDotmeshContainer(pkiPath string) error {
 		fmt.Printf("Log address: %s\n", logAddr)
 	}
 
+	requireTLSSetting := ""
+	if requireTLS {
+		requireTLSSetting = "true"
+	}
+
 	args := []string{
 		"run", "--restart=always",
 		"--privileged", "--pid=host", "--net=host",
@@ -577,6 +1148,10 @@ func startDotmeshContainer(pkiPath string) error {
 		"-e", fmt.Sprintf("DOTMESH_DOCKER_IMAGE=%s", dotmeshDockerImage),
 		"-e", fmt.Sprintf("DOTMESH_UPGRADES_URL=%s", checkpointUrl),
 		"-e", fmt.Sprintf("DOTMESH_UPGRADES_INTERVAL_SECONDS=%d", checkpointInterval),
+		"-e", fmt.Sprintf("DOTMESH_PREFERRED_SUBNETS=%s", preferredSubnets),
+		"-e", fmt.Sprintf("DOTMESH_REQUIRE_TLS=%s", requireTLSSetting),
+		"-e", fmt.Sprintf("DOTMESH_FAILOVER_GRACE_PERIOD=%s", failoverGrace),
+		"-e", fmt.Sprintf("DOTMESH_REPLICATION_FACTOR=%d", replicationFactor),
 	}
 
 	// inject the inherited env variables from the context of the dm binary into require_zfs.sh
@@ -785,7 +1360,15 @@ func clusterCommonSetup(clusterUrl, adminPassword, adminKey, pkiPath, clusterSec
 	if err != nil {
 		return err
 	}
-	err = config.AddRemote("local", "admin", getHostFromEnv(), adminKey)
+	err = installUserCertificate(pkiPath)
+	if err != nil {
+		return err
+	}
+	localTLS, err := localRemoteTLS(pkiPath)
+	if err != nil {
+		return err
+	}
+	err = config.AddRemote("local", "admin", getHostFromEnv(), adminKey, localTLS)
 	if err != nil {
 		return err
 	}
@@ -959,6 +1542,11 @@ func generatePkiJsonEncoded(pkiPath string) (string, error) {
 	}
 	for _, file := range files {
 		name := file.Name()
+		// each node has its own node certificate, and only the node which
+		// issues them has the node CA's key
+		if strings.HasPrefix(name, "node") || strings.HasPrefix(name, USER_CERTIFICATE_NAME) {
+			continue
+		}
 		c, err := ioutil.ReadFile(pkiPath + "/" + name)
 		if err != nil {
 			return "", err
@@ -1039,6 +1627,58 @@ func generatePKI(extantCA bool) error {
 	return nil
 }
 
+// Copy the certificate and key given with --tls-cert and --tls-key into the
+// PKI directory, where the server prefers them to the generated apiserver
+// ones.
+func installUserCertificate(pkiPath string) error {
+	if tlsCert == "" && tlsKey == "" {
+		return nil
+	}
+	if tlsCert == "" || tlsKey == "" {
+		return fmt.Errorf("Please specify both --tls-cert and --tls-key")
+	}
+	if _, err := tls.LoadX509KeyPair(tlsCert, tlsKey); err != nil {
+		return fmt.Errorf("Unable to use --tls-cert and --tls-key: %s", err)
+	}
+	for from, to := range map[string]string{
+		tlsCert: fmt.Sprintf("%s/%s.pem", pkiPath, USER_CERTIFICATE_NAME),
+		tlsKey:  fmt.Sprintf("%s/%s-key.pem", pkiPath, USER_CERTIFICATE_NAME),
+	} {
+		contents, err := ioutil.ReadFile(from)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(to, contents, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// How the local remote should check the local server's certificate: by its
+// fingerprint if it's one the user gave us, which needn't name the local
+// address, otherwise against the cluster's CA.
+func localRemoteTLS(pkiPath string) (remotes.PeerTLS, error) {
+	userCert := fmt.Sprintf("%s/%s.pem", pkiPath, USER_CERTIFICATE_NAME)
+	if _, err := os.Stat(userCert); err == nil {
+		contents, err := ioutil.ReadFile(userCert)
+		if err != nil {
+			return remotes.PeerTLS{}, err
+		}
+		block, _ := pem.Decode(contents)
+		if block == nil {
+			return remotes.PeerTLS{}, fmt.Errorf("No certificate found in %s", userCert)
+		}
+		return remotes.PeerTLS{Fingerprint: remotes.CertificateFingerprint(block.Bytes)}, nil
+	}
+	ca, err := ioutil.ReadFile(pkiPath + "/ca.pem")
+	if err != nil {
+		return remotes.PeerTLS{}, err
+	}
+	return remotes.PeerTLS{CACertificates: string(ca)}, nil
+}
+
 func clusterInit(cmd *cobra.Command, args []string, out io.Writer) error {
 	// - Run clusterCommonPreflight.
 	err := clusterCommonPreflight()
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
@@ -72,6 +73,53 @@ func NewCmdDotDelete(out io.Writer) *cobra.Command {
 	return cmd
 }
 
+func NewCmdDotSetReplicationFactor(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set-replication-factor [<dot>] <copies>",
+		Short: "Change how many nodes keep a copy of a dot",
+		Long: `Keep <copies> up-to-date copies of a dot and its branches in the cluster,
+the master's included, on different nodes, replacing those on nodes which go
+away. 0 goes back to the cluster's default, set with 'dm cluster init
+--replication-factor', which unless set is every node.`,
+
+		Run: func(cmd *cobra.Command, args []string) {
+			err := dotSetReplicationFactor(cmd, args, out)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+	return cmd
+}
+
+func NewCmdDotMove(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "move [<dot>] --to <node>",
+		Short: "Move a dot to another node",
+		Long: `Make <node> the master of a branch of a dot (the current one, unless
+--branch is given), once it has all of the dot's commits. Refuses to move it
+while containers are using it, unless --stop-containers is given, in which
+case they're only stopped once as much of the dot as possible has been copied
+to <node> while they ran, to keep the downtime short.`,
+
+		Run: func(cmd *cobra.Command, args []string) {
+			err := dotMove(cmd, args, out)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&moveTarget, "to", "", "",
+		"the node to move the dot to")
+	cmd.Flags().StringVarP(&moveBranch, "branch", "", "",
+		"the branch to move, rather than the current one")
+	cmd.Flags().BoolVarP(&stopContainers, "stop-containers", "", false,
+		"stop any containers using the dot, rather than refusing to move it")
+	return cmd
+}
+
 func NewCmdDot(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "dot",
@@ -83,6 +131,11 @@ change the default remote dot for <dot> on <remote>.
 
 Run 'dm dot show [<dot>]' to show information about the dot.
 
+Run 'dm dot set-replication-factor [<dot>] <copies>' to change how
+many nodes in the cluster keep a copy of <dot>.
+
+Run 'dm dot move [<dot>] --to <node>' to move <dot> to another node.
+
 Where '[<dot>]' is omitted, the current dot (selected by 'dm switch')
 is used.`,
 	}
@@ -90,6 +143,8 @@ is used.`,
 	cmd.AddCommand(NewCmdDotSetUpstream(os.Stdout))
 	cmd.AddCommand(NewCmdDotShow(os.Stdout))
 	cmd.AddCommand(NewCmdDotDelete(os.Stdout))
+	cmd.AddCommand(NewCmdDotSetReplicationFactor(os.Stdout))
+	cmd.AddCommand(NewCmdDotMove(os.Stdout))
 
 	return cmd
 }
@@ -129,7 +184,9 @@ func dotSetUpstream(cmd *cobra.Command, args []string, out io.Writer) error {
 		return err
 	}
 
-	remoteNamespace, remoteDot, err := remotes.ParseNamespacedVolumeWithDefault(remoteDot, remote.User)
+	remoteNamespace, remoteDot, err := remotes.ParseNamespacedVolumeWithDefault(
+		remoteDot, remote.DefaultNamespace(localNamespace),
+	)
 	if err != nil {
 		return err
 	}
@@ -138,6 +195,72 @@ func dotSetUpstream(cmd *cobra.Command, args []string, out io.Writer) error {
 	return nil
 }
 
+func dotSetReplicationFactor(cmd *cobra.Command, args []string, out io.Writer) error {
+	dm, err := remotes.NewDotmeshAPI(configPath)
+	if err != nil {
+		return err
+	}
+
+	var dot, copies string
+	switch len(args) {
+	case 1:
+		dot, err = dm.CurrentVolume()
+		if err != nil {
+			return err
+		}
+		copies = args[0]
+	case 2:
+		dot = args[0]
+		copies = args[1]
+	default:
+		return fmt.Errorf("Please specify [<dot>] <copies> as arguments.")
+	}
+
+	factor, err := strconv.Atoi(copies)
+	if err != nil || factor < 0 {
+		return fmt.Errorf("Please specify a number of copies, or 0 for the cluster's default.")
+	}
+	return dm.SetReplicationFactor(dot, factor)
+}
+
+func dotMove(cmd *cobra.Command, args []string, out io.Writer) error {
+	dm, err := remotes.NewDotmeshAPI(configPath)
+	if err != nil {
+		return err
+	}
+	if moveTarget == "" {
+		return fmt.Errorf("Please specify the node to move the dot to with --to.")
+	}
+
+	var dot string
+	switch len(args) {
+	case 0:
+		dot, err = dm.CurrentVolume()
+		if err != nil {
+			return err
+		}
+	case 1:
+		dot = args[0]
+	default:
+		return fmt.Errorf("Please specify at most one dot to move.")
+	}
+
+	branch := moveBranch
+	if branch == "" {
+		branch, err = dm.CurrentBranch(dot)
+		if err != nil {
+			return err
+		}
+	}
+
+	request, err := dm.Move(dot, branch, moveTarget, stopContainers)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Moving %s (branch %s) to %s...\n", dot, branch, moveTarget)
+	return dm.PollMove(request, out)
+}
+
 func dotDelete(cmd *cobra.Command, args []string, out io.Writer) error {
 	dm, err := remotes.NewDotmeshAPI(configPath)
 	if err != nil {
@@ -250,6 +373,23 @@ func dotShow(cmd *cobra.Command, args []string, out io.Writer) error {
 		}
 	}
 
+	if scriptingMode {
+		fmt.Fprintf(out, "replicationFactor\t%d\nupToDateCopies\t%d\n",
+			dotmeshDot.ReplicationFactor,
+			dotmeshDot.UpToDateCopies)
+		if dotmeshDot.UnderReplicated() {
+			fmt.Fprintf(out, "underReplicated\n")
+		}
+	} else if dotmeshDot.ReplicationFactor == 0 {
+		fmt.Fprintf(out, "Copies: on every node (%d up to date)\n", dotmeshDot.UpToDateCopies)
+	} else if dotmeshDot.UnderReplicated() {
+		fmt.Fprintf(out, "Copies: %d of %d up to date (under-replicated)\n",
+			dotmeshDot.UpToDateCopies, dotmeshDot.ReplicationFactor)
+	} else {
+		fmt.Fprintf(out, "Copies: %d of %d up to date\n",
+			dotmeshDot.UpToDateCopies, dotmeshDot.ReplicationFactor)
+	}
+
 	currentBranch, err := dm.CurrentBranch(localDot)
 	if err != nil {
 		return err
@@ -301,6 +441,15 @@ func dotShow(cmd *cobra.Command, args []string, out io.Writer) error {
 		}
 	}
 
+	tracking, err := dm.RemoteTrackingBranches(localDot, currentBranch)
+	if err != nil {
+		return err
+	}
+	fetched := map[string]remotes.RemoteTrackingBranch{}
+	for _, b := range tracking {
+		fetched[b.Remote] = b
+	}
+
 	remotes := dm.Configuration.GetRemotes()
 	keys := []string{}
 	// sort the keys so we can iterate over in human friendly order
@@ -320,6 +469,16 @@ func dotShow(cmd *cobra.Command, args []string, out io.Writer) error {
 				fmt.Fprintf(out, "Tracks dot %s/%s on remote %s\n", remoteNamespace, remoteDot, k)
 			}
 		}
+		b, ok := fetched[k]
+		if ok {
+			if scriptingMode {
+				fmt.Fprintf(out, "remoteTracking\t%s\t%d\t%d\t%d\n",
+					k, b.Ahead, b.Behind, b.FetchedAt)
+			} else {
+				fmt.Fprintf(out, "Branch %s compared to remote %s: %s (fetched %s)\n",
+					currentBranch, k, prettyPrintAheadBehind(b), prettyPrintAgo(b.FetchedAt))
+			}
+		}
 	}
 	return nil
 }
@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var fetchRemoteVolume string
+
+func NewCmdFetch(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "fetch <remote> [<dot> [<branch>]] [--remote-name=<dot>]",
+		Short: `Find out what a pull from a remote dot would do, without pulling`,
+		Long: `Records the commits on the remote dot which 'dm pull' would pull
+from, without transferring any data, and reports how many commits <branch>
+of <dot> is ahead of and behind it, and how much data a pull would transfer.
+
+The remote dot is chosen in the same way as for 'dm pull'.
+
+Afterwards, 'dm log --remote <remote>' shows the fetched commits and 'dm dot
+show' shows how far ahead and behind the branch is, until the next fetch.
+
+Example: to see whether there's anything new on cluster 'backups':
+
+    dm fetch backups
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				peer, filesystemName, branchName, err := resolveTransferArgs(args)
+				if err != nil {
+					return err
+				}
+				b, err := dm.Fetch(peer, filesystemName, branchName, fetchRemoteVolume)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Fetched %d commits from %s:%s/%s\n",
+					len(b.Commits), peer, b.RemoteNamespace, b.RemoteName,
+				)
+				fmt.Fprintf(out, "%s\n", prettyPrintAheadBehind(b))
+				if b.Behind > 0 {
+					fmt.Fprintf(out, "A pull would transfer %s\n", prettyPrintSize(b.PredictedSize))
+				}
+				return nil
+			}()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.PersistentFlags().StringVarP(&fetchRemoteVolume, "remote-name", "", "",
+		"Remote dot name to fetch from")
+	return cmd
+}
+
+func prettyPrintAheadBehind(b remotes.RemoteTrackingBranch) string {
+	switch {
+	case b.Ahead == 0 && b.Behind == 0:
+		return "Up to date"
+	case b.Ahead > 0 && b.Behind > 0:
+		return fmt.Sprintf(
+			"Diverged: %d commits ahead and %d behind", b.Ahead, b.Behind,
+		)
+	case b.Ahead > 0:
+		return fmt.Sprintf("%d commits ahead", b.Ahead)
+	default:
+		return fmt.Sprintf("%d commits behind", b.Behind)
+	}
+}
@@ -1,9 +1,12 @@
 package commands
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"sort"
@@ -14,6 +17,7 @@ import (
 	"github.com/howeyc/gopass"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var configPath string
@@ -22,6 +26,11 @@ var forceMode bool
 var scriptingMode bool
 var commitMsg string
 var resetHard bool
+var logRemote string
+var moveTarget string
+var moveBranch string
+var stopContainers bool
+var backupFile string
 
 var MainCmd = &cobra.Command{
 	Use:   "dm",
@@ -63,8 +72,10 @@ func Initialise() {
 	MainCmd.AddCommand(NewCmdClone(os.Stdout))
 	MainCmd.AddCommand(NewCmdPull(os.Stdout))
 	MainCmd.AddCommand(NewCmdPush(os.Stdout))
+	MainCmd.AddCommand(NewCmdFetch(os.Stdout))
 	MainCmd.AddCommand(NewCmdDebug(os.Stdout))
 	MainCmd.AddCommand(NewCmdDot(os.Stdout))
+	MainCmd.AddCommand(NewCmdMirror(os.Stdout))
 	MainCmd.AddCommand(NewCmdVersion(os.Stdout))
 
 	MainCmd.PersistentFlags().StringVarP(
@@ -106,6 +117,13 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 						} else {
 							current = "  "
 						}
+						if s3 := remotes[k].S3; s3 != nil {
+							fmt.Fprintf(
+								out, "%s%s\ts3://%s/%s at %s\n",
+								current, k, s3.Bucket, s3.Prefix, s3.Endpoint,
+							)
+							continue
+						}
 						fmt.Fprintf(
 							out, "%s%s\t%s@%s\n",
 							current, k, remotes[k].User, remotes[k].Hostname,
@@ -120,10 +138,70 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 			})
 		},
 	}
+	cmd.AddCommand(NewCmdRemoteAdd(out))
+	cmd.AddCommand(NewCmdRemoteAddS3(out))
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rm <remote>",
+		Short: "Remove a remote",
+		Long:  "Online help: https://docs.dotmesh.com/references/cli/#remove-a-remote-dm-remote-rm-name",
+
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				if len(args) != 1 {
+					return fmt.Errorf(
+						"Please specify <remote-name>",
+					)
+				}
+				return dm.Configuration.RemoveRemote(args[0])
+			})
+		},
+	})
 	cmd.AddCommand(&cobra.Command{
+		Use:   "switch <remote>",
+		Short: "Switch to a remote",
+		Long:  "Online help: https://docs.dotmesh.com/references/cli/#select-the-current-remote-dm-remote-switch-name",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				if len(args) != 1 {
+					return fmt.Errorf(
+						"Please specify <remote-name>",
+					)
+				}
+				return dm.Configuration.SetCurrentRemote(args[0])
+			})
+		},
+	})
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose list of remotes")
+	return cmd
+}
+
+func NewCmdRemoteAdd(out io.Writer) *cobra.Command {
+	var caBundle, fingerprint string
+	var insecure bool
+	cmd := &cobra.Command{
 		Use:   "add <remote-name> <user@cluster-hostname>",
 		Short: "Add a remote",
-		Long:  "Online help: https://docs.dotmesh.com/references/cli/#add-a-new-remote-dm-remote-add-name-user-hostname",
+		Long: `Add a remote, which is a dotmesh cluster.
+
+The cluster's certificate must be signed by a CA this machine trusts, or one
+in the --ca-bundle file. Otherwise its SHA-256 fingerprint is pinned: checked
+against --fingerprint if given, or shown for you to confirm. If there's no
+terminal to ask on, one of --ca-bundle or --fingerprint must be given. A
+cluster on this machine which doesn't support TLS is connected to over plain
+HTTP.
+
+Remotes added before dotmesh supported TLS keep connecting over plain HTTP.
+Remove and add them again to connect over HTTPS.
+
+Online help: https://docs.dotmesh.com/references/cli/#add-a-new-remote-dm-remote-add-name-user-hostname`,
 
 		Run: func(cmd *cobra.Command, args []string) {
 			runHandlingError(func() error {
@@ -145,6 +223,11 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 				if err != nil {
 					return err
 				}
+				// check who we're talking to before handing over the API key
+				peerTLS, err := resolveRemoteTLS(hostname, caBundle, fingerprint, insecure)
+				if err != nil {
+					return err
+				}
 				// allow this to be used be a script
 				apiKey := os.Getenv("DOTMESH_PASSWORD")
 				if apiKey == "" {
@@ -160,13 +243,14 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 					User:     user,
 					Hostname: hostname,
 					ApiKey:   apiKey,
+					TLS:      peerTLS,
 				}
 				var result bool
 				err = client.CallRemote(context.Background(), "DotmeshRPC.Ping", nil, &result)
 				if err != nil {
 					return err
 				}
-				err = dm.Configuration.AddRemote(remote, user, hostname, string(apiKey))
+				err = dm.Configuration.AddRemote(remote, user, hostname, string(apiKey), peerTLS)
 				if err != nil {
 					return err
 				}
@@ -182,47 +266,151 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 				return nil
 			})
 		},
-	})
-	cmd.AddCommand(&cobra.Command{
-		Use:   "rm <remote>",
-		Short: "Remove a remote",
-		Long:  "Online help: https://docs.dotmesh.com/references/cli/#remove-a-remote-dm-remote-rm-name",
+	}
+	cmd.Flags().StringVarP(&caBundle, "ca-bundle", "", "",
+		"PEM file of CAs to trust the cluster's certificate from, e.g. the ca.pem "+
+			"in its PKI directory")
+	cmd.Flags().StringVarP(&fingerprint, "fingerprint", "", "",
+		"SHA-256 fingerprint of the cluster's certificate, to pin it")
+	cmd.Flags().BoolVarP(&insecure, "insecure", "", false,
+		"Connect over plain HTTP, for clusters which don't support TLS")
+	return cmd
+}
+
+// Work out how to check a cluster's certificate when adding a remote for it.
+func resolveRemoteTLS(hostname, caBundle, fingerprint string, insecure bool) (remotes.PeerTLS, error) {
+	switch {
+	case insecure:
+		return remotes.PeerTLS{Insecure: true}, nil
+	case caBundle != "":
+		cas, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return remotes.PeerTLS{}, err
+		}
+		return remotes.PeerTLS{CACertificates: string(cas)}, nil
+	}
+	cert, trusted, err := remotes.FetchCertificate(hostname)
+	if err != nil && isLoopback(hostname) {
+		// plain HTTP to this machine doesn't cross the network, e.g. for the
+		// local remote on a Kubernetes node whose dotmesh has no certificate
+		return remotes.PeerTLS{Insecure: true}, nil
+	}
+	if err != nil {
+		return remotes.PeerTLS{}, fmt.Errorf(
+			"Unable to connect to %s over TLS: %s. If it's running a version of "+
+				"dotmesh which doesn't support TLS, use --insecure.", hostname, err,
+		)
+	}
+	actual := remotes.CertificateFingerprint(cert.Raw)
+	if fingerprint != "" {
+		if remotes.NormalizeFingerprint(fingerprint) != actual {
+			return remotes.PeerTLS{}, fmt.Errorf(
+				"The certificate of %s has fingerprint %s, not %s.", hostname, actual, fingerprint,
+			)
+		}
+		return remotes.PeerTLS{Fingerprint: actual}, nil
+	}
+	if trusted {
+		return remotes.PeerTLS{}, nil
+	}
+	fmt.Printf(
+		"The certificate of %s isn't signed by a CA this machine trusts.\n"+
+			"Its SHA-256 fingerprint is %s\n", hostname, actual,
+	)
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return remotes.PeerTLS{}, fmt.Errorf(
+			"There's no terminal to confirm it on. Use --ca-bundle or --fingerprint " +
+				"to say how to check it.",
+		)
+	}
+	fmt.Printf("Please confirm that you trust it (enter Y to continue): ")
+	reader := bufio.NewReader(os.Stdin)
+	text, _ := reader.ReadString('\n')
+	if text != "Y\n" {
+		return remotes.PeerTLS{}, fmt.Errorf(
+			"Aborted. Use --ca-bundle or --fingerprint to say how to check it.",
+		)
+	}
+	return remotes.PeerTLS{Fingerprint: actual}, nil
+}
+
+func isLoopback(hostname string) bool {
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
 
+func NewCmdRemoteAddS3(out io.Writer) *cobra.Command {
+	var endpoint, region, accessKeyId string
+	cmd := &cobra.Command{
+		Use:   "add-s3 <remote-name> <bucket>[/<prefix>]",
+		Short: "Add a remote which is an S3-compatible bucket",
+		Long: `Add a remote which is an S3-compatible bucket rather than a dotmesh cluster.
+
+Dots can be pushed to it with 'dm push', and pulled or cloned from it with
+'dm pull' and 'dm clone', just as with a cluster. Each push uploads the
+commits the bucket doesn't have yet as a ZFS send stream, alongside an index
+of the dot's streams and branches, under the given prefix. The transfers are
+run by the current remote, which must be able to reach the endpoint.
+
+The secret access key is read from $DOTMESH_S3_SECRET_ACCESS_KEY, or prompted
+for.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			runHandlingError(func() error {
-				dm, err := remotes.NewDotmeshAPI(configPath)
-				if err != nil {
-					return err
-				}
-				if len(args) != 1 {
+				if len(args) != 2 {
 					return fmt.Errorf(
-						"Please specify <remote-name>",
+						"Please specify <remote-name> <bucket>[/<prefix>]",
 					)
 				}
-				return dm.Configuration.RemoveRemote(args[0])
-			})
-		},
-	})
-	cmd.AddCommand(&cobra.Command{
-		Use:   "switch <remote>",
-		Short: "Switch to a remote",
-		Long:  "Online help: https://docs.dotmesh.com/references/cli/#select-the-current-remote-dm-remote-switch-name",
-		Run: func(cmd *cobra.Command, args []string) {
-			runHandlingError(func() error {
+				if endpoint == "" || accessKeyId == "" {
+					return fmt.Errorf("Please specify --endpoint and --access-key-id")
+				}
+				remote := args[0]
+				shrapnel := strings.SplitN(args[1], "/", 2)
+				target := remotes.S3Target{
+					Endpoint:    endpoint,
+					Region:      region,
+					Bucket:      shrapnel[0],
+					AccessKeyId: accessKeyId,
+				}
+				if len(shrapnel) == 2 && shrapnel[1] != "" {
+					target.Prefix = strings.TrimSuffix(shrapnel[1], "/") + "/"
+				}
 				dm, err := remotes.NewDotmeshAPI(configPath)
 				if err != nil {
 					return err
 				}
-				if len(args) != 1 {
-					return fmt.Errorf(
-						"Please specify <remote-name>",
-					)
+				// allow this to be used be a script
+				target.SecretAccessKey = os.Getenv("DOTMESH_S3_SECRET_ACCESS_KEY")
+				if target.SecretAccessKey == "" {
+					fmt.Printf("Secret access key: ")
+					enteredKey, err := gopass.GetPasswd()
+					fmt.Printf("\n")
+					if err != nil {
+						return err
+					}
+					target.SecretAccessKey = string(enteredKey)
 				}
-				return dm.Configuration.SetCurrentRemote(args[0])
+				err = dm.Configuration.AddS3Remote(remote, target)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(out, "Remote added.")
+				return nil
 			})
 		},
-	})
-	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose list of remotes")
+	}
+	cmd.Flags().StringVarP(&endpoint, "endpoint", "", "",
+		"URL of the S3-compatible service, e.g. https://s3.amazonaws.com")
+	cmd.Flags().StringVarP(&region, "region", "", "us-east-1",
+		"Region the bucket is in")
+	cmd.Flags().StringVarP(&accessKeyId, "access-key-id", "", "",
+		"Access key id to use with the bucket")
 	return cmd
 }
 
@@ -289,7 +477,7 @@ func NewCmdList(out io.Writer) *cobra.Command {
 					)
 				}
 
-				columnNames := []string{"  DOT", "BRANCH", "SERVER", "CONTAINERS", "SIZE", "COMMITS", "DIRTY"}
+				columnNames := []string{"  DOT", "BRANCH", "SERVER", "CONTAINERS", "SIZE", "COMMITS", "DIRTY", "COPIES"}
 
 				var target io.Writer
 				if scriptingMode {
@@ -351,9 +539,17 @@ func NewCmdList(out io.Writer) *cobra.Command {
 						sizeString = prettyPrintSize(v.SizeBytes)
 					}
 
+					copiesString := "-"
+					if v.ReplicationFactor > 0 {
+						copiesString = fmt.Sprintf("%d/%d", v.UpToDateCopies, v.ReplicationFactor)
+						if v.UnderReplicated() && !scriptingMode {
+							copiesString += " (under-replicated)"
+						}
+					}
+
 					cells := []string{
 						v.Name.String(), b, v.Master, strings.Join(containerNames, ","),
-						sizeString, fmt.Sprintf("%d", v.CommitCount), dirtyString,
+						sizeString, fmt.Sprintf("%d", v.CommitCount), dirtyString, copiesString,
 					}
 					fmt.Fprintf(target, start)
 					for _, cell := range cells {
@@ -536,7 +732,7 @@ func NewCmdLog(out io.Writer) *cobra.Command {
 					return err
 				}
 
-				commits, err := dm.ListCommits(activeVolume, activeBranch)
+				commits, err := dm.ListCommitsFrom(logRemote, activeVolume, activeBranch)
 				if err != nil {
 					return err
 				}
@@ -554,6 +750,8 @@ func NewCmdLog(out io.Writer) *cobra.Command {
 			}
 		},
 	}
+	cmd.Flags().StringVarP(&logRemote, "remote", "", "",
+		"Show the commits on <remote> as of the last 'dm fetch' instead")
 	return cmd
 }
 
@@ -0,0 +1,219 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
+	"github.com/spf13/cobra"
+)
+
+var mirrorRemoteVolume string
+var mirrorInterval time.Duration
+
+func NewCmdMirror(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "mirror",
+		Short: `Manage mirrors of dots on remotes`,
+		Long: `Manage mirrors of dots on remotes.
+
+A mirror keeps a dot on a remote up to date with a branch of a dot on the
+current remote: whenever a new commit is made, the node which is master for
+the dot pushes it to the remote, exactly as 'dm push' would.
+
+Run 'dm mirror add <remote> [<dot> [<branch>]]' to start mirroring.
+
+Run 'dm mirror ls' to show mirrors, how many commits they are behind and the
+last error, if any.
+
+Run 'dm mirror rm <id>' to stop mirroring.`,
+	}
+
+	cmd.AddCommand(NewCmdMirrorAdd(os.Stdout))
+	cmd.AddCommand(NewCmdMirrorList(os.Stdout))
+	cmd.AddCommand(NewCmdMirrorRemove(os.Stdout))
+
+	return cmd
+}
+
+func NewCmdMirrorAdd(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add <remote> [<dot> [<branch>]] [--remote-name=<dot>] [--interval=<duration>]",
+		Short: "Continuously push new commits from a branch of a dot to a remote dot",
+		Long: `Push new commits from the branch <branch> of <dot> to a dot on <remote>
+every time a commit is made, creating the remote dot if necessary. If <dot>
+and <branch> are not specified, the current dot and branch are used.
+
+The remote dot is chosen in the same way as for 'dm push', and can be
+overridden with '--remote-name'.
+
+The remote is also checked every '--interval' even if there are no new
+commits, which is how soon a failed push is retried.
+
+Example: to keep a copy of the master branch of dot 'postgres' on cluster
+'backups':
+
+    dm mirror add backups postgres master
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				peer, filesystemName, branchName, err := resolveTransferArgs(args)
+				if err != nil {
+					return err
+				}
+				mirror, err := dm.AddMirror(
+					peer, filesystemName, branchName, mirrorRemoteVolume, mirrorInterval,
+				)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Mirroring %s to %s:%s/%s (id %s)\n",
+					mirrorLocalName(mirror), peer,
+					mirror.RemoteNamespace, mirror.RemoteName,
+					mirror.Id,
+				)
+				return nil
+			}()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&mirrorRemoteVolume, "remote-name", "", "",
+		"Remote dot name to mirror to, including remote namespace e.g. alice/apples")
+	cmd.Flags().DurationVarP(&mirrorInterval, "interval", "", 0,
+		"How often to check the remote when there are no new commits (default 1m)")
+	return cmd
+}
+
+func NewCmdMirrorList(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List mirrors on the current remote",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := mirrorList(cmd, args, out)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	return cmd
+}
+
+func NewCmdMirrorRemove(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "rm <id>",
+		Aliases: []string{"remove"},
+		Short:   "Stop mirroring",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the id of the mirror to remove (see 'dm mirror ls').")
+				}
+				dm, err := remotes.NewDotmeshAPI(configPath)
+				if err != nil {
+					return err
+				}
+				return dm.RemoveMirror(args[0])
+			})
+		},
+	}
+	return cmd
+}
+
+func mirrorList(cmd *cobra.Command, args []string, out io.Writer) error {
+	dm, err := remotes.NewDotmeshAPI(configPath)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("Please specify no arguments.")
+	}
+
+	mirrors, err := dm.Mirrors()
+	if err != nil {
+		return err
+	}
+
+	columnNames := []string{"ID", "DOT", "REMOTE", "STATUS", "BEHIND", "LAST SYNC", "LAST ERROR"}
+
+	var target io.Writer
+	if scriptingMode {
+		target = out
+	} else {
+		target = tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+		fmt.Fprintf(target, "%s\n", strings.Join(columnNames, "\t"))
+	}
+
+	for _, m := range mirrors {
+		var lastSync, lastError string
+		if scriptingMode {
+			lastSync = fmt.Sprintf("%d", m.LastSyncedAt)
+			lastError = m.LastError
+		} else {
+			lastSync = "never"
+			if m.LastSyncedAt > 0 {
+				lastSync = prettyPrintAgo(m.LastSyncedAt)
+			}
+			lastError = "-"
+			if m.LastError != "" {
+				lastError = fmt.Sprintf("%s (%s)", m.LastError, prettyPrintAgo(m.LastErrorAt))
+			}
+		}
+		remote := fmt.Sprintf("%s:%s/%s",
+			mirrorRemoteName(dm, m), m.RemoteNamespace, m.RemoteName,
+		)
+		if m.RemoteBranchName != "" {
+			remote += "@" + m.RemoteBranchName
+		}
+		cells := []string{
+			m.Id, mirrorLocalName(m), remote, m.Status,
+			fmt.Sprintf("%d", m.CommitsBehind), lastSync, lastError,
+		}
+		fmt.Fprintf(target, "%s\n", strings.Join(cells, "\t"))
+	}
+	w, ok := target.(*tabwriter.Writer)
+	if ok {
+		w.Flush()
+	}
+	return nil
+}
+
+func mirrorLocalName(m remotes.Mirror) string {
+	name := remotes.VolumeName{Namespace: m.LocalNamespace, Name: m.LocalName}.String()
+	if m.LocalBranchName != "" {
+		name += "@" + m.LocalBranchName
+	}
+	return name
+}
+
+// The name of the remote in our configuration which the mirror pushes to, or
+// its hostname if it was set up by someone else.
+func mirrorRemoteName(dm *remotes.DotmeshAPI, m remotes.Mirror) string {
+	for name, r := range dm.Configuration.GetRemotes() {
+		if r.Hostname == m.Peer && r.User == m.User {
+			return name
+		}
+	}
+	return m.Peer
+}
+
+func prettyPrintAgo(timestamp int64) string {
+	return fmt.Sprintf("%s ago", time.Since(time.Unix(timestamp, 0)).Round(time.Second))
+}
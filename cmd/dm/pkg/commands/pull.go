@@ -10,10 +10,14 @@ import (
 )
 
 var pullRemoteVolume string
+var pullBranchOnConflict bool
+var pullDryRun bool
+var pullNamespace string
+var pullResume bool
 
 func NewCmdPull(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "pull <remote> [<dot> [<branch>]] [--remote-name=<dot>]",
+		Use:   "pull <remote> [<dot> [<branch>]] [--remote-name=<dot>] [--branch-on-conflict] [--dry-run] [--namespace=<namespace> [--resume]]",
 		Short: `Pull new commits from a remote dot to a local copy of that dot`,
 		Long: `Pulls commits from a remote dot to <dot>'s given <branch>.
 If <branch> is not specified, try to pull all branches. If <dot> is
@@ -25,6 +29,22 @@ cloned from on the specified <remote>, but any remote dot can be named with
 
 Use 'dm clone' to make an initial copy, 'pull' only updates an existing one.
 
+If <branch> has commits which the remote doesn't, 'pull' fails. With
+'--branch-on-conflict' it instead pulls the remote's commits into a new local
+branch, starting from the latest commit the two have in common, and prints
+its name. <branch> is left as it was, so both lines of history can be
+inspected with 'dm checkout' and 'dm log'.
+
+'--dry-run' reports which commits of each branch would be pulled, how much
+data that is and whether the pull would fail, without pulling anything.
+
+'--namespace' pulls every dot in <namespace> on <remote> that you have
+access to, with all their branches, one at a time, into the same namespace
+here, creating any dots which don't exist here yet. A dot which fails doesn't
+stop the others, and a summary is printed at the end. '--resume' carries on
+with the last '--namespace' pull which didn't finish, skipping the dots it
+has already pulled.
+
 Example: to pull any new commits from the master branch of dot 'postgres' on
 cluster 'backups':
 
@@ -34,6 +54,15 @@ Online help: https://docs.dotmesh.com/references/cli/#pull-dm-pull-remote-dot-br
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 			err := func() error {
+				if pullNamespace != "" {
+					if pullDryRun {
+						return fmt.Errorf("--dry-run can't be used with --namespace.")
+					}
+					return transferNamespace(out, "pull", args, pullNamespace, pullResume)
+				}
+				if pullResume {
+					return fmt.Errorf("--resume can only be used with --namespace.")
+				}
 				dm, err := remotes.NewDotmeshAPI(configPath)
 				if err != nil {
 					return err
@@ -44,10 +73,24 @@ Online help: https://docs.dotmesh.com/references/cli/#pull-dm-pull-remote-dot-br
 				if err != nil {
 					return err
 				}
+				opts := remotes.TransferOptions{BranchOnConflict: pullBranchOnConflict}
+				if pullDryRun {
+					plan, err := dm.PlanTransfer(
+						"pull", peer,
+						filesystemName, branchName,
+						pullRemoteVolume, branchName,
+						opts,
+					)
+					if err != nil {
+						return err
+					}
+					return printTransferPlan(out, plan)
+				}
 				transferId, err := dm.RequestTransfer(
 					"pull", peer,
 					filesystemName, branchName,
 					pullRemoteVolume, branchName,
+					opts,
 				)
 				if err != nil {
 					return err
@@ -67,6 +110,14 @@ Online help: https://docs.dotmesh.com/references/cli/#pull-dm-pull-remote-dot-br
 
 	cmd.PersistentFlags().StringVarP(&pullRemoteVolume, "remote-name", "", "",
 		"Remote dot name to pull from")
+	cmd.PersistentFlags().BoolVarP(&pullBranchOnConflict, "branch-on-conflict", "", false,
+		"If there are local commits the remote doesn't have, pull into a new branch instead of failing")
+	cmd.PersistentFlags().StringVarP(&pullNamespace, "namespace", "", "",
+		"Pull every dot in this namespace")
+	cmd.PersistentFlags().BoolVarP(&pullResume, "resume", "", false,
+		"Resume the last --namespace pull which didn't finish")
+	cmd.PersistentFlags().BoolVarP(&pullDryRun, "dry-run", "", false,
+		"Show what would be pulled without pulling it")
 
 	return cmd
 }
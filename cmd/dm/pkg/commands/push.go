@@ -10,10 +10,16 @@ import (
 )
 
 var pushRemoteVolume string
+var pushForce bool
+var pushDryRun bool
+var pushNamespace string
+var pushResume bool
+var pushAllBranches bool
+var pushFrom string
 
 func NewCmdPush(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "push <remote> [<dot> [<branch>]] [--remote-name=<dot>]",
+		Use:   "push <remote> [<dot> [<branch>]] [--remote-name=<dot>] [--force] [--all-branches] [--from=<remote>] [--dry-run] [--namespace=<namespace> [--resume]]",
 		Short: `Push new commits from the specified dot and branch to a remote dot (creating it if necessary)`,
 		Long: `Pushes new commits to a <remote> from the branch <branch> of <dot>.
 If <branch> is not specified, try to pull all branches. If <dot> is
@@ -25,6 +31,31 @@ cloned from on the specified <remote>, but any remote dot can be named with
 
 If the remote dot does not exist, it will be created on-demand.
 
+If the remote dot has commits which the local one doesn't, 'push' fails.
+'--force' pushes anyway: the remote's extra commits are kept on a new branch
+of the remote dot, whose name is printed, and the remote branch is rolled
+back to the latest commit the two have in common before the new commits are
+applied.
+
+'--all-branches' pushes every branch of <dot>, each one after the branch it
+was made from. A branch which fails to push doesn't stop the others, except
+for branches made from it, and 'push' reports how each branch went.
+
+'--from' asks the cluster of another remote to push its <dot> to <remote>,
+so that the data goes directly between the two clusters rather than through
+the current one. It's given your credentials for <remote> to do so, and
+<dot> must be named.
+
+'--dry-run' reports which commits of each branch would be pushed, how much
+data that is and whether the push would fail, without pushing anything.
+
+'--namespace' pushes every dot in <namespace> that you have access to, with
+all their branches, one at a time, to the same namespace on <remote>,
+creating any dots which don't exist there yet. A dot which fails doesn't stop
+the others, and a summary is printed at the end. '--resume' carries on with
+the last '--namespace' push which didn't finish, skipping the dots it has
+already pushed.
+
 Example: to make a new backup and push new commits from the master branch of
 dot 'postgres' to cluster 'backups':
 
@@ -35,20 +66,61 @@ Online help: https://docs.dotmesh.com/references/cli/#push-dm-push-remote-remote
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 			err := func() error {
+				if pushNamespace != "" {
+					if pushDryRun {
+						return fmt.Errorf("--dry-run can't be used with --namespace.")
+					}
+					if pushFrom != "" {
+						return fmt.Errorf("--from can't be used with --namespace.")
+					}
+					return transferNamespace(out, "push", args, pushNamespace, pushResume)
+				}
+				if pushResume {
+					return fmt.Errorf("--resume can only be used with --namespace.")
+				}
 				dm, err := remotes.NewDotmeshAPI(configPath)
 				if err != nil {
 					return err
 				}
+				if pushFrom != "" {
+					if len(args) < 2 {
+						return fmt.Errorf("Please name the dot to push with --from.")
+					}
+					if pushFrom == args[0] {
+						return fmt.Errorf("Can't push from %s to itself.", pushFrom)
+					}
+				}
 				peer, filesystemName, branchName, err := resolveTransferArgs(args)
 				if err != nil {
 					return err
 				}
+				if pushAllBranches {
+					if len(args) > 2 {
+						return fmt.Errorf("Please don't name a branch to push with --all-branches.")
+					}
+					branchName = remotes.DEFAULT_BRANCH
+				}
+				opts := remotes.TransferOptions{
+					Force: pushForce, AllBranches: pushAllBranches, From: pushFrom,
+				}
+				if pushDryRun {
+					plan, err := dm.PlanTransfer(
+						"push", peer, filesystemName, branchName, pushRemoteVolume, "", opts,
+					)
+					if err != nil {
+						return err
+					}
+					return printTransferPlan(out, plan)
+				}
 				transferId, err := dm.RequestTransfer(
-					"push", peer, filesystemName, branchName, pushRemoteVolume, "",
+					"push", peer, filesystemName, branchName, pushRemoteVolume, "", opts,
 				)
 				if err != nil {
 					return err
 				}
+				if pushFrom != "" {
+					return dm.PollTransferOn(pushFrom, transferId, out)
+				}
 				err = dm.PollTransfer(transferId, out)
 				if err != nil {
 					return err
@@ -63,5 +135,17 @@ Online help: https://docs.dotmesh.com/references/cli/#push-dm-push-remote-remote
 	}
 	cmd.PersistentFlags().StringVarP(&pushRemoteVolume, "remote-name", "", "",
 		"Remote dot name to push to, including remote namespace e.g. alice/apples")
+	cmd.PersistentFlags().BoolVarP(&pushForce, "force", "f", false,
+		"Push even if the remote has diverged, keeping its commits on a new remote branch")
+	cmd.PersistentFlags().BoolVarP(&pushAllBranches, "all-branches", "", false,
+		"Push every branch of the dot")
+	cmd.PersistentFlags().StringVarP(&pushNamespace, "namespace", "", "",
+		"Push every dot in this namespace")
+	cmd.PersistentFlags().BoolVarP(&pushResume, "resume", "", false,
+		"Resume the last --namespace push which didn't finish")
+	cmd.PersistentFlags().StringVarP(&pushFrom, "from", "", "",
+		"Remote whose cluster pushes the dot, instead of the current one")
+	cmd.PersistentFlags().BoolVarP(&pushDryRun, "dry-run", "", false,
+		"Show what would be pushed without pushing it")
 	return cmd
 }
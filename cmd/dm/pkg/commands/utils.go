@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base32"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/dotmesh-io/dotmesh/cmd/dm/pkg/remotes"
@@ -24,6 +25,61 @@ func prettyPrintSize(size int64) string {
 	return s
 }
 
+// Push or pull every dot in namespace to or from <remote>, the only argument
+// allowed with --namespace.
+func transferNamespace(
+	out io.Writer, direction string, args []string, namespace string, resume bool,
+) error {
+	if len(args) != 1 {
+		return fmt.Errorf(
+			"Please specify just the remote to %s, not a dot, with --namespace.", direction,
+		)
+	}
+	dm, err := remotes.NewDotmeshAPI(configPath)
+	if err != nil {
+		return err
+	}
+	t, err := dm.TransferNamespace(direction, args[0], namespace, resume)
+	if err != nil {
+		return err
+	}
+	return dm.PollNamespaceTransfer(t, out)
+}
+
+// Show what a transfer would do, returning an error if it would fail.
+func printTransferPlan(out io.Writer, plan remotes.TransferPlan) error {
+	for _, step := range plan.Steps {
+		branch := step.BranchName
+		if branch == "" {
+			branch = remotes.DEFAULT_BRANCH
+		}
+		switch step.Outcome {
+		case "transfer":
+			fmt.Fprintf(out, "%s: %d commits, %s\n",
+				branch, len(step.Commits), prettyPrintSize(step.Size),
+			)
+			for _, commit := range step.Commits {
+				fmt.Fprintf(out, "    %s %s\n", commit.Id, (*commit.Metadata)["message"])
+			}
+		case "up-to-date":
+			fmt.Fprintf(out, "%s: up to date\n", branch)
+		case "diverged", "ahead":
+			fmt.Fprintf(out, "%s: %s from commit %s\n",
+				branch, step.Outcome, step.LatestCommonCommit,
+			)
+		default:
+			fmt.Fprintf(out, "%s: %s\n", branch, step.Outcome)
+		}
+	}
+	if plan.Error != "" {
+		return fmt.Errorf("The %s would fail: %s", plan.Direction, plan.Error)
+	}
+	fmt.Fprintf(out, "Dry run, nothing was transferred. The %s would transfer %s\n",
+		plan.Direction, prettyPrintSize(plan.Size),
+	)
+	return nil
+}
+
 func resolveTransferArgs(args []string) (returnPeer string, returnFilesystemName string, returnBranchName string, returnError error) {
 
 	// Use:   "{push,pull,clone} <remote>",
@@ -147,8 +147,6 @@ func CreatePKIAssets(pkiPath string, cfg *Configuration) (*rsa.PrivateKey, *x509
 	}
 	altNames.DNSNames = append(altNames.DNSNames, cfg.ExternalDNSNames...)
 
-	_, prv, cert := pathsKeysCerts(pkiPath, "ca")
-
 	if !cfg.ExtantCA {
 		// initialize a new CA
 		caKey, caCert, err = newCertificateAuthority()
@@ -160,27 +158,10 @@ func CreatePKIAssets(pkiPath string, cfg *Configuration) (*rsa.PrivateKey, *x509
 		}
 	} else {
 		// try to load existing CA, and use that to sign new "api" server key
-		caCerts, err := certutil.CertsFromFile(cert)
-		if err != nil {
-			return nil, nil, err
-		}
-		// assume we're dealing with the ca cert that we created, which always
-		// has one item. XXX this will be problematic if we want to support
-		// user-provided cert chains.
-		caCert = caCerts[0]
-		caKeyBytes, err := ioutil.ReadFile(prv)
+		caKey, caCert, err = loadCertificateAuthority(pkiPath)
 		if err != nil {
 			return nil, nil, err
 		}
-		caKeyInterface, err := certutil.ParsePrivateKeyPEM(caKeyBytes)
-		if err != nil {
-			return nil, nil, err
-		}
-		caKeyCasted, ok := caKeyInterface.(*rsa.PrivateKey)
-		if !ok {
-			return nil, nil, fmt.Errorf("Unable to cast %s (from %s) to *rsa.PrivateKey", caKey, prv)
-		}
-		caKey = caKeyCasted
 	}
 
 	apiKey, apiCert, err := newServerKeyAndCert(cfg, caCert, caKey, altNames)
@@ -190,7 +171,31 @@ func CreatePKIAssets(pkiPath string, cfg *Configuration) (*rsa.PrivateKey, *x509
 	if err := writeKeysAndCert(pkiPath, "apiserver", apiKey, apiCert); err != nil {
 		return nil, nil, fmt.Errorf("failure while saving API server keys and certificate - %v", err)
 	}
-	_, prv, cert = pathsKeysCerts(pkiPath, "apiserver")
 
 	return caKey, caCert, nil
 }
+
+func loadCertificateAuthority(pkiPath string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	_, prv, cert := pathsKeysCerts(pkiPath, "ca")
+	caCerts, err := certutil.CertsFromFile(cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	// assume we're dealing with the ca cert that we created, which always
+	// has one item. XXX this will be problematic if we want to support
+	// user-provided cert chains.
+	caCert := caCerts[0]
+	caKeyBytes, err := ioutil.ReadFile(prv)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKeyInterface, err := certutil.ParsePrivateKeyPEM(caKeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKey, ok := caKeyInterface.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("Unable to cast %s (from %s) to *rsa.PrivateKey", caKeyInterface, prv)
+	}
+	return caKey, caCert, nil
+}
@@ -1,6 +1,7 @@
 package remotes
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"regexp"
@@ -39,6 +40,15 @@ type DotmeshVolume struct {
 	SizeBytes   int64
 	DirtyBytes  int64
 	CommitCount int64
+	// the number of copies to keep, or zero for one on every node
+	ReplicationFactor int
+	// the number of live nodes, the master included, with every commit
+	UpToDateCopies int
+}
+
+// Whether fewer nodes have all of the dot's commits than should.
+func (v DotmeshVolume) UnderReplicated() bool {
+	return v.ReplicationFactor > 0 && v.UpToDateCopies < v.ReplicationFactor
 }
 
 func CheckName(name string) bool {
@@ -87,6 +97,188 @@ func (dm *DotmeshAPI) GetVersion() (VersionInfo, error) {
 	return response, nil
 }
 
+type NodeRevocation struct {
+	Node         string
+	RevokedAt    int64
+	Fingerprints []string
+}
+
+// Stop the current remote's cluster accepting the node certificates it's
+// issued node so far, returning when it did.
+func (dm *DotmeshAPI) RevokeNode(node string) (time.Time, error) {
+	var revocation NodeRevocation
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.RevokeNode", struct{ Node string }{node}, &revocation,
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(revocation.RevokedAt, 0), nil
+}
+
+// Allow a revoked node to be issued a new node certificate.
+func (dm *DotmeshAPI) ReadmitNode(node string) error {
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.ReadmitNode", struct{ Node string }{node}, &result,
+	)
+}
+
+type ClusterNode struct {
+	Id              string
+	Addresses       []string
+	Live            bool
+	Draining        bool
+	Version         string
+	PoolSize        int64
+	PoolFree        int64
+	StatusUpdatedAt int64
+	Masters         int
+	Replicas        int
+}
+
+type EtcdStatus struct {
+	Healthy bool
+	Error   string
+	Leader  string
+	Members []string
+}
+
+type ClusterStatus struct {
+	Nodes     []ClusterNode
+	Leader    string
+	Etcd      EtcdStatus
+	Transfers []TransferPollResult
+}
+
+// An overview of the current remote's cluster.
+func (dm *DotmeshAPI) ClusterStatus() (ClusterStatus, error) {
+	var status ClusterStatus
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.ClusterStatus", struct{}{}, &status,
+	)
+	return status, err
+}
+
+type DrainMove struct {
+	FilesystemId string
+	Name         VolumeName
+	Branch       string
+	Target       string
+	RequestId    string
+	Error        string
+}
+
+type DrainStatus struct {
+	Draining   bool
+	Masters    int
+	CatchingUp int
+}
+
+// Stop the current remote's cluster placing dots on a node, and start moving
+// the ones it's the master of to other nodes.
+func (dm *DotmeshAPI) DrainNode(node string, stopContainers bool) ([]DrainMove, error) {
+	var moves []DrainMove
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.DrainNode",
+		struct {
+			Node           string
+			StopContainers bool
+		}{node, stopContainers},
+		&moves,
+	)
+	if err != nil {
+		return []DrainMove{}, err
+	}
+	return moves, nil
+}
+
+func (dm *DotmeshAPI) DrainStatus(node string) (DrainStatus, error) {
+	var status DrainStatus
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.DrainStatus", struct{ Node string }{node}, &status,
+	)
+	return status, err
+}
+
+// Forget a node which has been drained and stopped.
+func (dm *DotmeshAPI) RemoveNode(node string) error {
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.RemoveNode", struct{ Node string }{node}, &result,
+	)
+}
+
+type FailoverEvent struct {
+	FilesystemId string
+	Name         VolumeName
+	Branch       string
+	From         string
+	To           string
+	SnapshotId   string
+	LostCommits  int
+	At           int64
+}
+
+// Every automatic failover in the current remote's cluster, oldest first.
+func (dm *DotmeshAPI) Failovers() ([]FailoverEvent, error) {
+	var events []FailoverEvent
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.Failovers", struct{}{}, &events,
+	)
+	if err != nil {
+		return []FailoverEvent{}, err
+	}
+	return events, nil
+}
+
+// The current remote's cluster's metadata, to be written to a file as it is
+// and restored from with RestoreMetadata.
+type MetadataBackup struct {
+	Version        int
+	DotmeshVersion string
+	CreatedAt      int64
+	Index          uint64
+	Keys           map[string]string
+}
+
+type RestoredFilesystem struct {
+	FilesystemId string
+	Name         VolumeName
+	Branch       string
+	OldMaster    string
+	Master       string
+}
+
+type RestoreResult struct {
+	Keys         int
+	Filesystems  []RestoredFilesystem
+	Unregistered []string
+}
+
+func (dm *DotmeshAPI) BackupMetadata() (MetadataBackup, error) {
+	var backup MetadataBackup
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.BackupMetadata", struct{}{}, &backup,
+	)
+	return backup, err
+}
+
+// Write a backup's metadata into the current remote's cluster, overwriting any
+// dots it already has only if forced.
+func (dm *DotmeshAPI) RestoreMetadata(backup MetadataBackup, force bool) (RestoreResult, error) {
+	var result RestoreResult
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.RestoreMetadata",
+		struct {
+			Backup MetadataBackup
+			Force  bool
+		}{backup, force},
+		&result,
+	)
+	return result, err
+}
+
 func (dm *DotmeshAPI) NewVolume(volumeName string) error {
 	var response bool
 	namespace, name, err := ParseNamespacedVolume(volumeName)
@@ -302,6 +494,90 @@ func (dm *DotmeshAPI) DeleteVolume(volumeName string) error {
 	return nil
 }
 
+// Set how many nodes in the cluster keep a copy of a dot, or zero to go back
+// to the cluster's default.
+func (dm *DotmeshAPI) SetReplicationFactor(volumeName string, factor int) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.SetReplicationFactor",
+		struct {
+			Namespace, Name string
+			Factor          int
+		}{namespace, name, factor},
+		&result,
+	)
+}
+
+type MoveRequest struct {
+	FilesystemId string
+	RequestId    string
+}
+
+type MovePollResult struct {
+	Done     bool
+	Error    string
+	Downtime float64
+	Master   string
+	State    string
+	Status   string
+}
+
+// Ask the master of a branch of a dot to hand it off to the target node,
+// stopping any containers using it if stopContainers. Follow it with
+// PollMove.
+func (dm *DotmeshAPI) Move(
+	volumeName, branch, target string, stopContainers bool,
+) (MoveRequest, error) {
+	var request MoveRequest
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return request, err
+	}
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.Move",
+		struct {
+			Namespace, Name, Branch, Target string
+			StopContainers                  bool
+		}{namespace, name, deMasterify(branch), target, stopContainers},
+		&request,
+	)
+	return request, err
+}
+
+// Wait for a move to finish, reporting the master's progress handing the dot
+// off as it changes.
+func (dm *DotmeshAPI) PollMove(request MoveRequest, out io.Writer) error {
+	lastStatus := ""
+	for {
+		var result MovePollResult
+		err := dm.client.CallRemote(
+			context.Background(), "DotmeshRPC.PollMove", request, &result,
+		)
+		if err != nil {
+			return err
+		}
+		if result.Done {
+			if result.Error != "" {
+				return fmt.Errorf("Unable to move: %s", result.Error)
+			}
+			fmt.Fprintf(
+				out, "Moved to %s, with %.2fs of downtime\n", result.Master, result.Downtime,
+			)
+			return nil
+		}
+		status := fmt.Sprintf("%s on %s: %s", result.State, result.Master, result.Status)
+		if result.State != "" && status != lastStatus {
+			fmt.Fprintln(out, status)
+			lastStatus = status
+		}
+		time.Sleep(time.Second)
+	}
+}
+
 func (dm *DotmeshAPI) SwitchVolume(volumeName string) error {
 	return dm.setCurrentVolume(volumeName)
 }
@@ -550,26 +826,73 @@ type TransferPollResult struct {
 	Size               int64 // size of current segment in bytes
 	Sent               int64 // number of bytes of current segment sent so far
 	Message            string
+
+	// Branches created on the remote by a forced push to keep the commits it
+	// overwrote.
+	PreservedBranches []string
+	// Branches created locally by a pull with BranchOnConflict.
+	ConflictBranches []string
+	// How each branch went, when transferring all branches.
+	Branches []BranchTransferResult
+}
+
+type BranchTransferResult struct {
+	Name    string // "" for master
+	Status  string // "waiting", "finished", "error" or "skipped"
+	Message string
+}
+
+// Whether a transfer of all branches has any left to do, in which case an
+// error only applies to the branch it happened on.
+func (t *TransferPollResult) branchesWaiting() bool {
+	for _, branch := range t.Branches {
+		if branch.Status == "waiting" {
+			return true
+		}
+	}
+	return false
+}
+
+// Print how each branch of a transfer of all branches went.
+func (t *TransferPollResult) printBranches(out io.Writer) {
+	for _, branch := range t.Branches {
+		name := branch.Name
+		if name == "" {
+			name = DEFAULT_BRANCH
+		}
+		if branch.Message != "" {
+			fmt.Fprintf(out, "  %s: %s (%s)\n", name, branch.Status, branch.Message)
+		} else {
+			fmt.Fprintf(out, "  %s: %s\n", name, branch.Status)
+		}
+	}
 }
 
 func (dm *DotmeshAPI) PollTransfer(transferId string, out io.Writer) error {
+	return dm.pollTransfer(dm.client, transferId, out)
+}
+
+// Like PollTransfer, for a transfer run by the given remote rather than the
+// current one.
+func (dm *DotmeshAPI) PollTransferOn(remote, transferId string, out io.Writer) error {
+	client, err := dm.Configuration.ClusterFromRemote(remote)
+	if err != nil {
+		return err
+	}
+	return dm.pollTransfer(client, transferId, out)
+}
+
+func (dm *DotmeshAPI) pollTransfer(
+	client *JsonRpcClient, transferId string, out io.Writer,
+) error {
 
 	out.Write([]byte("Calculating...\n"))
 
 	var bar *pb.ProgressBar
 	started := false
 
-	for {
-		time.Sleep(time.Second)
-		result := &TransferPollResult{}
-		err := dm.client.CallRemote(
-			context.Background(), "DotmeshRPC.GetTransfer", transferId, result,
-		)
-		if err != nil {
-			if !strings.Contains(fmt.Sprintf("%s", err), "No such intercluster transfer") {
-				out.Write([]byte(fmt.Sprintf("Got error, trying again: %s\n", err)))
-			}
-		}
+	// show a poll result, returning true once the transfer is over
+	show := func(result *TransferPollResult) (bool, error) {
 		if result.Size > 0 {
 			if !started {
 				bar = pb.New64(result.Size)
@@ -605,10 +928,26 @@ func (dm *DotmeshAPI) PollTransfer(transferId string, out io.Writer) error {
 			quotient := fmt.Sprintf(" (%d/%d)", result.Index, result.Total)
 			bar.Postfix(speed + quotient)
 		}
+		if result.branchesWaiting() {
+			return false, nil
+		}
 		if result.Index == result.Total && result.Status == "finished" {
 			if started {
 				bar.FinishPrint("Done!")
 			}
+			result.printBranches(out)
+			for _, branch := range result.PreservedBranches {
+				out.Write([]byte(fmt.Sprintf(
+					"Commits which were overwritten on the remote have been kept "+
+						"in the remote branch '%s'\n", branch,
+				)))
+			}
+			for _, branch := range result.ConflictBranches {
+				out.Write([]byte(fmt.Sprintf(
+					"Local commits conflicted with the remote, so its commits have been "+
+						"pulled into the new branch '%s'\n", branch,
+				)))
+			}
 			// A terrible hack: many of the tests race the next 'dm log' or
 			// similar command against snapshots received by a push/pull/clone
 			// updating etcd which updates nodes' local caches of state. Give
@@ -619,16 +958,58 @@ func (dm *DotmeshAPI) PollTransfer(transferId string, out io.Writer) error {
 			// potentially out-of-date global caches. This might help with
 			// scaling, too.
 			time.Sleep(time.Second)
-			return nil
+			return true, nil
 		}
 		if result.Status == "error" {
 			if started {
 				bar.FinishPrint(fmt.Sprintf("error: %s", result.Message))
 			}
 			out.Write([]byte(result.Message + "\n"))
+			result.printBranches(out)
 			// A similarly terrible hack. See comment above.
 			time.Sleep(time.Second)
-			return fmt.Errorf(result.Message)
+			return true, fmt.Errorf(result.Message)
+		}
+		return false, nil
+	}
+
+	// Follow the server's stream of updates if it has one, falling back to
+	// polling if it doesn't or the stream breaks.
+	var finished bool
+	var transferErr error
+	err := client.StreamEvents(
+		context.Background(), fmt.Sprintf("/transfers/%s/stream", transferId),
+		func(data []byte) (bool, error) {
+			result := &TransferPollResult{}
+			err := json.Unmarshal(data, result)
+			if err != nil {
+				return false, err
+			}
+			finished, transferErr = show(result)
+			return finished, nil
+		},
+	)
+	if finished {
+		return transferErr
+	}
+	if err != nil && !strings.Contains(err.Error(), "404") {
+		out.Write([]byte(fmt.Sprintf("Lost progress stream, polling instead: %s\n", err)))
+	}
+
+	for {
+		time.Sleep(time.Second)
+		result := &TransferPollResult{}
+		err := client.CallRemote(
+			context.Background(), "DotmeshRPC.GetTransfer", transferId, result,
+		)
+		if err != nil {
+			if !strings.Contains(fmt.Sprintf("%s", err), "No such intercluster transfer") {
+				out.Write([]byte(fmt.Sprintf("Got error, trying again: %s\n", err)))
+			}
+		}
+		finished, transferErr = show(result)
+		if finished {
+			return transferErr
 		}
 	}
 }
@@ -655,6 +1036,7 @@ type TransferRequest struct {
 	Peer             string
 	User             string
 	ApiKey           string
+	PeerTLS          PeerTLS
 	Direction        string
 	LocalNamespace   string
 	LocalName        string
@@ -663,6 +1045,41 @@ type TransferRequest struct {
 	RemoteName       string
 	RemoteBranchName string
 	TargetCommit     string
+	Force            bool
+	BranchOnConflict bool
+	Depth            int
+	Since            string
+	AllBranches      bool
+	S3               *S3Target
+}
+
+// Options for a transfer which don't affect which dots are transferred.
+type TransferOptions struct {
+	// push only: if the remote dot has commits which the local one doesn't,
+	// keep them on a new branch on the remote instead of failing
+	Force bool
+	// pull only: if the local dot has commits which the remote doesn't, pull
+	// into a new local branch instead of failing
+	BranchOnConflict bool
+	// clone only: just the last Depth commits, or the commits from Since
+	// onwards, rather than the whole history
+	Depth int
+	Since string
+	// push and clone only: transfer every branch of the dot, each after the
+	// branch it was made from
+	AllBranches bool
+	// push only: the remote whose cluster pushes the dot, if not the current
+	// one. It's given our credentials for the peer, so that the data goes
+	// straight from one to the other.
+	From string
+}
+
+// The remote whose cluster runs a transfer, and so holds its local end.
+func (dm *DotmeshAPI) transferInitiator(opts TransferOptions) string {
+	if opts.From != "" {
+		return opts.From
+	}
+	return dm.Configuration.CurrentRemote
 }
 
 // attempt to get the latest commits in filesystemId (which may be a branch)
@@ -674,8 +1091,9 @@ func (dm *DotmeshAPI) RequestTransfer(
 	direction, peer,
 	localFilesystemName, localBranchName,
 	remoteFilesystemName, remoteBranchName string,
+	opts TransferOptions,
 ) (string, error) {
-	connectionInitiator := dm.Configuration.CurrentRemote
+	connectionInitiator := dm.transferInitiator(opts)
 
 	/*
 		fmt.Printf("[DEBUG RequestTransfer] dir=%s peer=%s lfs=%s lb=%s rfs=%s rb=%s\n",
@@ -684,11 +1102,129 @@ func (dm *DotmeshAPI) RequestTransfer(
 			remoteFilesystemName, remoteBranchName)
 	*/
 
+	transferRequest, err := dm.resolveTransferRequest(
+		direction, peer,
+		localFilesystemName, localBranchName,
+		remoteFilesystemName, remoteBranchName,
+	)
+	if err != nil {
+		return "", err
+	}
+	transferRequest.Force = opts.Force
+	transferRequest.BranchOnConflict = opts.BranchOnConflict
+	transferRequest.Depth = opts.Depth
+	transferRequest.Since = opts.Since
+	transferRequest.AllBranches = opts.AllBranches
+
+	if direction == "push" && opts.From != "" {
+		fmt.Printf("Pushing %s:%s/%s to %s:%s/%s\n",
+			opts.From, transferRequest.LocalNamespace, transferRequest.LocalName,
+			peer,
+			transferRequest.RemoteNamespace, transferRequest.RemoteName,
+		)
+	} else if direction == "push" {
+		fmt.Printf("Pushing %s/%s to %s:%s/%s\n",
+			transferRequest.LocalNamespace, transferRequest.LocalName,
+			peer,
+			transferRequest.RemoteNamespace, transferRequest.RemoteName,
+		)
+	} else {
+		fmt.Printf("Pulling %s/%s from %s:%s/%s\n",
+			transferRequest.LocalNamespace, transferRequest.LocalName,
+			peer,
+			transferRequest.RemoteNamespace, transferRequest.RemoteName,
+		)
+	}
+
+	// connect to connectionInitiator
+	client, err := dm.Configuration.ClusterFromRemote(connectionInitiator)
+	if err != nil {
+		return "", err
+	}
+	var transferId string
+	// TODO make ApiKey time- and domain- (filesystem?) limited
+	// cryptographically somehow
+	// TODO add TargetSnapshot here, to support specifying "push to a given
+	// snapshot" rather than just "push all snapshots up to the latest"
+	err = client.CallRemote(context.Background(),
+		"DotmeshRPC.Transfer", transferRequest, &transferId)
+	if err != nil {
+		return "", err
+	}
+	return transferId, nil
+}
+
+// What a transfer would do, as worked out by the cluster without doing it.
+type TransferPlan struct {
+	Direction string
+	// One per branch on the way from master to the branch being
+	// transferred, in the order they'd be transferred.
+	Steps []TransferPlanStep
+	Size  int64
+	// Why the transfer would fail, "" if it wouldn't.
+	Error string
+}
+
+type TransferPlanStep struct {
+	FilesystemId       string
+	BranchName         string
+	Outcome            string // "transfer", "up-to-date", "diverged", "ahead", ...
+	LatestCommonCommit string
+	StartingCommit     string
+	TargetCommit       string
+	Commits            []snapshot
+	SendArgs           [][]string
+	Size               int64
+}
+
+// Ask the current cluster what RequestTransfer would do with the same
+// arguments, without transferring anything.
+func (dm *DotmeshAPI) PlanTransfer(
+	direction, peer,
+	localFilesystemName, localBranchName,
+	remoteFilesystemName, remoteBranchName string,
+	opts TransferOptions,
+) (TransferPlan, error) {
+	transferRequest, err := dm.resolveTransferRequest(
+		direction, peer,
+		localFilesystemName, localBranchName,
+		remoteFilesystemName, remoteBranchName,
+	)
+	if err != nil {
+		return TransferPlan{}, err
+	}
+	transferRequest.Force = opts.Force
+	transferRequest.BranchOnConflict = opts.BranchOnConflict
+	transferRequest.Depth = opts.Depth
+	transferRequest.Since = opts.Since
+	transferRequest.AllBranches = opts.AllBranches
+
+	client, err := dm.Configuration.ClusterFromRemote(dm.transferInitiator(opts))
+	if err != nil {
+		return TransferPlan{}, err
+	}
+	var plan TransferPlan
+	err = client.CallRemote(context.Background(),
+		"DotmeshRPC.PlanTransfer", transferRequest, &plan)
+	if err != nil {
+		return TransferPlan{}, err
+	}
+	return plan, nil
+}
+
+// Work out the full names of the local and remote dots involved in a transfer
+// with peer, filling in defaults for anything not specified. The defaults
+// depend on whether we're pushing or pulling.
+func (dm *DotmeshAPI) resolveTransferRequest(
+	direction, peer,
+	localFilesystemName, localBranchName,
+	remoteFilesystemName, remoteBranchName string,
+) (TransferRequest, error) {
 	var err error
 
 	remote, err := dm.Configuration.GetRemote(peer)
 	if err != nil {
-		return "", err
+		return TransferRequest{}, err
 	}
 
 	// Let's replace any missing things with defaults.
@@ -700,14 +1236,14 @@ func (dm *DotmeshAPI) RequestTransfer(
 		if localFilesystemName == "" {
 			localFilesystemName, err = dm.Configuration.CurrentVolume()
 			if err != nil {
-				return "", err
+				return TransferRequest{}, err
 			}
 		}
 
 		if localBranchName == "" {
 			localBranchName, err = dm.Configuration.CurrentBranch()
 			if err != nil {
-				return "", err
+				return TransferRequest{}, err
 			}
 		}
 	} else if direction == "pull" {
@@ -718,7 +1254,7 @@ func (dm *DotmeshAPI) RequestTransfer(
 		if localFilesystemName == "" && remoteFilesystemName != "" {
 			_, localFilesystemName, err = ParseNamespacedVolume(remoteFilesystemName)
 			if err != nil {
-				return "", err
+				return TransferRequest{}, err
 			}
 		}
 	}
@@ -726,7 +1262,7 @@ func (dm *DotmeshAPI) RequestTransfer(
 	// Split the local volume name's namespace out
 	localNamespace, localVolume, err := ParseNamespacedVolume(localFilesystemName)
 	if err != nil {
-		return "", err
+		return TransferRequest{}, err
 	}
 
 	// Guess defaults for the remote filesystem
@@ -743,14 +1279,16 @@ func (dm *DotmeshAPI) RequestTransfer(
 			// If not, default to the un-namespaced local filesystem name.
 			// This causes it to default into the user's own namespace
 			// when we parse the name, too.
-			remoteNamespace = remote.User
+			remoteNamespace = remote.DefaultNamespace(localNamespace)
 			remoteVolume = localVolume
 		}
 	} else {
 		// Default namespace for remote volume is the username on this remote
-		remoteNamespace, remoteVolume, err = ParseNamespacedVolumeWithDefault(remoteFilesystemName, remote.User)
+		remoteNamespace, remoteVolume, err = ParseNamespacedVolumeWithDefault(
+			remoteFilesystemName, remote.DefaultNamespace(localNamespace),
+		)
 		if err != nil {
-			return "", err
+			return TransferRequest{}, err
 		}
 	}
 
@@ -765,53 +1303,319 @@ func (dm *DotmeshAPI) RequestTransfer(
 	}
 
 	if remoteBranchName != "" && remoteVolume == "" {
-		return "", fmt.Errorf(
+		return TransferRequest{}, fmt.Errorf(
 			"It's dubious to specify a remote branch name " +
 				"without specifying a remote filesystem name.",
 		)
 	}
 
-	if direction == "push" {
-		fmt.Printf("Pushing %s/%s to %s:%s/%s\n",
-			localNamespace, localVolume,
-			peer,
-			remoteNamespace, remoteVolume,
+	return TransferRequest{
+		Peer:             remote.Hostname,
+		User:             remote.User,
+		ApiKey:           remote.ApiKey,
+		PeerTLS:          remote.TLSSettings(),
+		Direction:        direction,
+		LocalNamespace:   localNamespace,
+		LocalName:        localVolume,
+		LocalBranchName:  deMasterify(localBranchName),
+		RemoteNamespace:  remoteNamespace,
+		RemoteName:       remoteVolume,
+		RemoteBranchName: deMasterify(remoteBranchName),
+		S3:               remote.S3,
+	}, nil
+}
+
+type Mirror struct {
+	Id               string
+	FilesystemId     string
+	Peer             string
+	User             string
+	ApiKey           string
+	PeerTLS          PeerTLS
+	LocalNamespace   string
+	LocalName        string
+	LocalBranchName  string
+	RemoteNamespace  string
+	RemoteName       string
+	RemoteBranchName string
+	IntervalSeconds  int64
+
+	Status           string // one of "idle", "pushing", "error"
+	CommitsBehind    int
+	LastSyncedCommit string
+	LastSyncedAt     int64
+	LastTransferId   string
+	LastError        string
+	LastErrorAt      int64
+}
+
+// Ask the current remote to keep pushing a branch of a dot to peer whenever it
+// gets new commits. Names are defaulted in the same way as for 'dm push'.
+func (dm *DotmeshAPI) AddMirror(
+	peer, localFilesystemName, localBranchName, remoteFilesystemName string,
+	interval time.Duration,
+) (Mirror, error) {
+	transferRequest, err := dm.resolveTransferRequest(
+		"push", peer,
+		localFilesystemName, localBranchName,
+		remoteFilesystemName, "",
+	)
+	if err != nil {
+		return Mirror{}, err
+	}
+	if transferRequest.S3 != nil {
+		return Mirror{}, fmt.Errorf("Can't mirror to %s, which is an S3 bucket", peer)
+	}
+	mirror := Mirror{
+		Peer:             transferRequest.Peer,
+		User:             transferRequest.User,
+		ApiKey:           transferRequest.ApiKey,
+		PeerTLS:          transferRequest.PeerTLS,
+		LocalNamespace:   transferRequest.LocalNamespace,
+		LocalName:        transferRequest.LocalName,
+		LocalBranchName:  transferRequest.LocalBranchName,
+		RemoteNamespace:  transferRequest.RemoteNamespace,
+		RemoteName:       transferRequest.RemoteName,
+		RemoteBranchName: transferRequest.RemoteBranchName,
+		IntervalSeconds:  int64(interval / time.Second),
+	}
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.AddMirror", mirror, &mirror.Id,
+	)
+	if err != nil {
+		return Mirror{}, err
+	}
+	return mirror, nil
+}
+
+func (dm *DotmeshAPI) Mirrors() ([]Mirror, error) {
+	var mirrors []Mirror
+	err := dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.Mirrors", struct{}{}, &mirrors,
+	)
+	if err != nil {
+		return []Mirror{}, err
+	}
+	return mirrors, nil
+}
+
+func (dm *DotmeshAPI) RemoveMirror(mirrorId string) error {
+	var result bool
+	return dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.RemoveMirror", mirrorId, &result,
+	)
+}
+
+type NamespaceTransfer struct {
+	Id              string
+	Peer            string
+	User            string
+	ApiKey          string
+	PeerTLS         PeerTLS
+	Direction       string
+	LocalNamespace  string
+	RemoteNamespace string
+	Resume          bool
+
+	NodeId     string
+	Status     string // one of "running", "finished", "error"
+	StartedAt  int64
+	FinishedAt int64
+	Dots       []NamespaceTransferDot
+}
+
+type NamespaceTransferDot struct {
+	Name       string
+	Status     string // one of "waiting", "transferring", "finished", "error"
+	TransferId string
+	Message    string
+}
+
+// Ask the current remote to push or pull every dot in namespace, with all
+// their branches, to or from the same namespace on peer. If resume is set,
+// carry on from where the last such transfer which didn't finish got to.
+func (dm *DotmeshAPI) TransferNamespace(
+	direction, peer, namespace string, resume bool,
+) (NamespaceTransfer, error) {
+	remote, err := dm.Configuration.GetRemote(peer)
+	if err != nil {
+		return NamespaceTransfer{}, err
+	}
+	if remote.S3 != nil {
+		return NamespaceTransfer{}, fmt.Errorf(
+			"Can't transfer a namespace to or from %s, which is an S3 bucket", peer,
 		)
-	} else {
-		fmt.Printf("Pulling %s/%s from %s:%s/%s\n",
-			localNamespace, localVolume,
-			peer,
-			remoteNamespace, remoteVolume,
+	}
+	t := NamespaceTransfer{
+		Peer:            remote.Hostname,
+		User:            remote.User,
+		ApiKey:          remote.ApiKey,
+		PeerTLS:         remote.TLSSettings(),
+		Direction:       direction,
+		LocalNamespace:  namespace,
+		RemoteNamespace: namespace,
+		Resume:          resume,
+	}
+	var result NamespaceTransfer
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.TransferNamespace", t, &result,
+	)
+	if err != nil {
+		return NamespaceTransfer{}, err
+	}
+	return result, nil
+}
+
+// Report each dot of a namespace transfer as it finishes, and then a summary.
+// Returns an error if any dot failed.
+func (dm *DotmeshAPI) PollNamespaceTransfer(t NamespaceTransfer, out io.Writer) error {
+	reported := map[string]string{}
+	for _, dot := range t.Dots {
+		if dot.Status == "finished" {
+			// by an earlier attempt
+			reported[dot.Name] = dot.Status
+		}
+	}
+	fmt.Fprintf(out, "Transferring %d of %d dots in namespace %s\n",
+		len(t.Dots)-len(reported), len(t.Dots), t.LocalNamespace,
+	)
+	for t.Status == "running" {
+		time.Sleep(time.Second)
+		var latest NamespaceTransfer
+		err := dm.client.CallRemote(
+			context.Background(), "DotmeshRPC.GetNamespaceTransfer", t.Id, &latest,
 		)
+		if err != nil {
+			fmt.Fprintf(out, "Got error, trying again: %s\n", err)
+			continue
+		}
+		t = latest
+		for _, dot := range t.Dots {
+			if reported[dot.Name] == dot.Status {
+				continue
+			}
+			reported[dot.Name] = dot.Status
+			switch dot.Status {
+			case "transferring":
+				fmt.Fprintf(out, "%s...\n", dot.Name)
+			case "finished":
+				fmt.Fprintf(out, "%s: done\n", dot.Name)
+			case "error":
+				fmt.Fprintf(out, "%s: %s\n", dot.Name, dot.Message)
+			}
+		}
 	}
 
-	// connect to connectionInitiator
-	client, err := dm.Configuration.ClusterFromRemote(connectionInitiator)
+	failed := []string{}
+	for _, dot := range t.Dots {
+		if dot.Status != "finished" {
+			failed = append(failed, dot.Name)
+		}
+	}
+	fmt.Fprintf(out, "%d of %d dots in namespace %s transferred\n",
+		len(t.Dots)-len(failed), len(t.Dots), t.LocalNamespace,
+	)
+	if len(failed) > 0 {
+		return fmt.Errorf(
+			"Failed to transfer %s. Run the same command with --resume to retry them.",
+			strings.Join(failed, ", "),
+		)
+	}
+	return nil
+}
+
+// What a remote branch looked like when it was last fetched.
+type RemoteTrackingBranch struct {
+	FilesystemId string
+	Remote       string
+	Peer         string
+	User         string
+
+	RemoteNamespace    string
+	RemoteName         string
+	RemoteBranchName   string
+	RemoteFilesystemId string
+
+	Commits       []snapshot
+	PredictedSize int64
+	FetchedAt     int64
+
+	// Relative to the local branch as it is now, not when it was fetched.
+	Ahead  int
+	Behind int
+}
+
+// Record the commits on the remote dot that a pull from peer would pull from,
+// without transferring any data. Names are defaulted as for 'dm pull'.
+func (dm *DotmeshAPI) Fetch(
+	peer, localFilesystemName, localBranchName, remoteFilesystemName string,
+) (RemoteTrackingBranch, error) {
+	transferRequest, err := dm.resolveTransferRequest(
+		"pull", peer,
+		localFilesystemName, localBranchName,
+		remoteFilesystemName, localBranchName,
+	)
 	if err != nil {
-		return "", err
+		return RemoteTrackingBranch{}, err
 	}
-	var transferId string
-	// TODO make ApiKey time- and domain- (filesystem?) limited
-	// cryptographically somehow
-	err = client.CallRemote(context.Background(),
-		"DotmeshRPC.Transfer", TransferRequest{
-			Peer:             remote.Hostname,
-			User:             remote.User,
-			ApiKey:           remote.ApiKey,
-			Direction:        direction,
-			LocalNamespace:   localNamespace,
-			LocalName:        localVolume,
-			LocalBranchName:  deMasterify(localBranchName),
-			RemoteNamespace:  remoteNamespace,
-			RemoteName:       remoteVolume,
-			RemoteBranchName: deMasterify(remoteBranchName),
-			// TODO add TargetSnapshot here, to support specifying "push to a given
-			// snapshot" rather than just "push all snapshots up to the latest"
-		}, &transferId)
+	var result RemoteTrackingBranch
+	err = dm.client.CallRemote(
+		context.Background(), "DotmeshRPC.Fetch", struct {
+			Remote string
+			TransferRequest
+		}{peer, transferRequest}, &result,
+	)
 	if err != nil {
-		return "", err
+		return RemoteTrackingBranch{}, err
 	}
-	return transferId, nil
+	return result, nil
+}
+
+// The commits on a branch of a dot or, if remote isn't empty, on the remote
+// branch it was last fetched from there.
+func (dm *DotmeshAPI) ListCommitsFrom(
+	remote, volumeName, branch string,
+) ([]snapshot, error) {
+	if remote == "" {
+		return dm.ListCommits(volumeName, branch)
+	}
+	bs, err := dm.RemoteTrackingBranches(volumeName, branch)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bs {
+		if b.Remote == remote {
+			return b.Commits, nil
+		}
+	}
+	return nil, fmt.Errorf(
+		"Nothing has been fetched from %s for %s, try 'dm fetch %s'.",
+		remote, volumeName, remote,
+	)
+}
+
+func (dm *DotmeshAPI) RemoteTrackingBranches(
+	volumeName, branch string,
+) ([]RemoteTrackingBranch, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	var result []RemoteTrackingBranch
+	err = dm.client.CallRemote(
+		context.Background(),
+		"DotmeshRPC.RemoteTrackingBranches",
+		map[string]string{
+			"Namespace": namespace,
+			"Name":      name,
+			"Branch":    deMasterify(branch),
+		},
+		&result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // FIXME: Put this in a shared library, as it duplicates the copy in
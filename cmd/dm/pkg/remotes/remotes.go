@@ -23,12 +23,14 @@ matter?
 */
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 
 	"golang.org/x/net/context"
@@ -46,6 +48,44 @@ type Remote struct {
 	CurrentVolume        string
 	CurrentBranches      map[string]string
 	DefaultRemoteVolumes map[string]map[string]VolumeName
+	// how to check the cluster's certificate, nil for remotes added before
+	// dotmesh supported TLS, see TLSSettings
+	TLS *PeerTLS
+	// set for a remote which is an S3-compatible bucket rather than a
+	// dotmesh cluster, which dots can only be pushed to and pulled from
+	S3 *S3Target
+}
+
+type S3Target struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyId     string
+	SecretAccessKey string
+}
+
+// How to connect to the cluster. Remotes added before dotmesh supported TLS
+// keep connecting as they always did: over plain HTTP, except to the hub.
+// Adding the remote again says how to check its certificate instead.
+func (r *Remote) TLSSettings() PeerTLS {
+	if r.TLS != nil {
+		return *r.TLS
+	}
+	if isHub(r.Hostname) {
+		return PeerTLS{}
+	}
+	return PeerTLS{Insecure: true}
+}
+
+// The namespace dots on the remote are in when none is given: the user's own
+// on a cluster, and the same as the local dot's in a bucket, which has no
+// users.
+func (r *Remote) DefaultNamespace(localNamespace string) string {
+	if r.S3 != nil {
+		return localNamespace
+	}
+	return r.User
 }
 
 type Configuration struct {
@@ -123,10 +163,13 @@ func (c *Configuration) GetCurrentRemote() string {
 func (c *Configuration) SetCurrentRemote(remote string) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	_, ok := c.Remotes[remote]
+	r, ok := c.Remotes[remote]
 	if !ok {
 		return fmt.Errorf("No such remote '%s'", remote)
 	}
+	if r.S3 != nil {
+		return fmt.Errorf("Remote '%s' is an S3 bucket, not a cluster", remote)
+	}
 	c.CurrentRemote = remote
 	return c.save()
 }
@@ -263,7 +306,7 @@ func (c *Configuration) SetCurrentBranchForVolume(volume, branch string) error {
 	return c.save()
 }
 
-func (c *Configuration) AddRemote(remote, user, hostname, apiKey string) error {
+func (c *Configuration) AddRemote(remote, user, hostname, apiKey string, peerTLS PeerTLS) error {
 	_, ok := c.Remotes[remote]
 	if ok {
 		return fmt.Errorf("Remote exists '%s'", remote)
@@ -272,7 +315,28 @@ func (c *Configuration) AddRemote(remote, user, hostname, apiKey string) error {
 		User:     user,
 		Hostname: hostname,
 		ApiKey:   apiKey,
+		TLS:      &peerTLS,
+	}
+	return c.save()
+}
+
+func (c *Configuration) SetRemoteTLS(remote string, peerTLS PeerTLS) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r, ok := c.Remotes[remote]
+	if !ok {
+		return fmt.Errorf("No such remote '%s'", remote)
 	}
+	r.TLS = &peerTLS
+	return c.save()
+}
+
+func (c *Configuration) AddS3Remote(remote string, target S3Target) error {
+	_, ok := c.Remotes[remote]
+	if ok {
+		return fmt.Errorf("Remote exists '%s'", remote)
+	}
+	c.Remotes[remote] = &Remote{S3: &target}
 	return c.save()
 }
 
@@ -295,10 +359,14 @@ func (c *Configuration) ClusterFromRemote(remote string) (*JsonRpcClient, error)
 	if !ok {
 		return nil, fmt.Errorf("No such remote '%s'", remote)
 	}
+	if remoteCreds.S3 != nil {
+		return nil, fmt.Errorf("Remote '%s' is an S3 bucket, not a cluster", remote)
+	}
 	return &JsonRpcClient{
 		User:     remoteCreds.User,
 		Hostname: remoteCreds.Hostname,
 		ApiKey:   remoteCreds.ApiKey,
+		TLS:      remoteCreds.TLSSettings(),
 	}, nil
 }
 
@@ -310,6 +378,7 @@ type JsonRpcClient struct {
 	User     string
 	Hostname string
 	ApiKey   string
+	TLS      PeerTLS
 }
 
 // call a method with string args, and attempt to decode it into result
@@ -334,15 +403,7 @@ func (j *JsonRpcClient) CallRemote(
 		)
 	}
 
-	scheme := "http"
-	port := "6969"
-
-	if j.Hostname == "saas.dotmesh.io" || j.Hostname == "dothub.com" {
-		scheme = "https"
-		port = "443"
-	}
-
-	url := fmt.Sprintf("%s://%s:%s/rpc", scheme, j.Hostname, port)
+	url := j.url("/rpc")
 	message, err := json2.EncodeClientRequest(method, args)
 	if err != nil {
 		return err
@@ -358,7 +419,10 @@ func (j *JsonRpcClient) CallRemote(
 
 	req.Header.Set("Content-Type", "application/json")
 	req.SetBasicAuth(j.User, j.ApiKey)
-	client := new(http.Client)
+	client, err := j.TLS.httpClient()
+	if err != nil {
+		return err
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -384,3 +448,81 @@ func (j *JsonRpcClient) CallRemote(
 	}
 	return nil
 }
+
+func isHub(hostname string) bool {
+	return hostname == "saas.dotmesh.io" || hostname == "dothub.com"
+}
+
+// The scheme and host:port of a cluster's API.
+func clusterAddress(hostname string) (string, string) {
+	port := "6969"
+
+	if isHub(hostname) {
+		port = "443"
+	}
+
+	return "https", fmt.Sprintf("%s:%s", hostname, port)
+}
+
+func (j *JsonRpcClient) url(path string) string {
+	scheme, address := clusterAddress(j.Hostname)
+	if j.TLS.Insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, address, path)
+}
+
+// Follow a stream of server-sent events from path, passing the data of each
+// event to handle until it returns true or an error. Returns an error if the
+// stream ends before then.
+func (j *JsonRpcClient) StreamEvents(
+	ctx context.Context, path string, handle func(data []byte) (bool, error),
+) error {
+	if j == nil {
+		return fmt.Errorf("No remote cluster specified.")
+	}
+	req, err := http.NewRequest("GET", j.url(path), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	req.SetBasicAuth(j.User, j.ApiKey)
+	client, err := j.TLS.httpClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 401 {
+		return fmt.Errorf("Permission denied. Please check that your API key is still valid.")
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unable to stream %s: %s", path, resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	// poll results with lots of branches in can be longer than the default
+	// 64kB line limit
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// anything else is a comment, a blank line between events or a field
+		// we don't use
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		done, err := handle([]byte(strings.TrimPrefix(line, "data: ")))
+		if err != nil || done {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("Stream %s ended unexpectedly", path)
+}
@@ -0,0 +1,100 @@
+package remotes
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// How to check a cluster's certificate. With none of these set, it must be
+// signed by a CA in the system bundle.
+type PeerTLS struct {
+	CACertificates string // PEM, trusted as well as the system CAs
+	Fingerprint    string // hex SHA-256 of the only certificate to accept
+	Insecure       bool   // connect over plain HTTP
+}
+
+// The hex SHA-256 of a DER-encoded certificate, as pinned in
+// PeerTLS.Fingerprint.
+func CertificateFingerprint(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Accept fingerprints with colons between the bytes and in either case, as
+// openssl prints them.
+func NormalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
+
+func (t PeerTLS) config() (*tls.Config, error) {
+	if t.Fingerprint != "" {
+		fingerprint := NormalizeFingerprint(t.Fingerprint)
+		return &tls.Config{
+			// the pinned fingerprint is checked instead
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return fmt.Errorf("No certificate presented")
+				}
+				if got := CertificateFingerprint(rawCerts[0]); got != fingerprint {
+					return fmt.Errorf(
+						"The cluster's certificate has changed! Its fingerprint is now %s, "+
+							"not %s as when the remote was added.", got, fingerprint,
+					)
+				}
+				return nil
+			},
+		}, nil
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if t.CACertificates != "" && !roots.AppendCertsFromPEM([]byte(t.CACertificates)) {
+		return nil, fmt.Errorf("No certificates found in the remote's CA bundle")
+	}
+	return &tls.Config{RootCAs: roots}, nil
+}
+
+func (t PeerTLS) httpClient() (*http.Client, error) {
+	tlsConfig, err := t.config()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// Fetch the certificate a cluster presents, without checking it, and say
+// whether it's signed by a CA in the system bundle for hostname. An error
+// probably means the cluster doesn't do TLS.
+func FetchCertificate(hostname string) (*x509.Certificate, bool, error) {
+	_, address := clusterAddress(hostname)
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, false, fmt.Errorf("%s presented no certificate", hostname)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Intermediates: intermediates,
+	})
+	return certs[0], err == nil, nil
+}
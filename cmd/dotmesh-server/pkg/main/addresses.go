@@ -0,0 +1,250 @@
+package main
+
+// Choosing which of a node's addresses to connect to.
+//
+// Each node publishes all the addresses it guesses it can be reached on (see
+// updateAddressesInEtcd), but not all of them are necessarily routable from
+// every other node: docker bridges and the like get in the way. So rather
+// than using the first one, we try each in turn, remembering which ones
+// worked and which didn't so that next time we try the good ones first.
+// checkPeerAddresses keeps that up to date in the background.
+//
+// Addresses in the subnets listed in DOTMESH_PREFERRED_SUBNETS (comma
+// separated CIDRs) are always tried first, in the order the subnets are
+// listed. The same goes for connections to other clusters, whose hostnames
+// may resolve to several addresses.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long to wait for each address to answer before trying the next
+const ADDRESS_DIAL_TIMEOUT = 3 * time.Second
+
+// how often to check whether the other nodes' addresses are reachable
+const ADDRESS_CHECK_INTERVAL = 30 * time.Second
+
+var preferredSubnets []*net.IPNet
+
+// Read DOTMESH_PREFERRED_SUBNETS, which is checked once at startup.
+func loadPreferredSubnets() error {
+	preferredSubnets = []*net.IPNet{}
+	setting := os.Getenv("DOTMESH_PREFERRED_SUBNETS")
+	if setting == "" {
+		return nil
+	}
+	for _, cidr := range strings.Split(setting, ",") {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("Invalid subnet in DOTMESH_PREFERRED_SUBNETS: %s", err)
+		}
+		preferredSubnets = append(preferredSubnets, subnet)
+	}
+	return nil
+}
+
+// when we last managed to connect to each address, and when we last failed
+var addressHealth = struct {
+	sync.Mutex
+	succeeded map[string]time.Time
+	failed    map[string]time.Time
+}{
+	succeeded: map[string]time.Time{},
+	failed:    map[string]time.Time{},
+}
+
+func recordAddressHealth(address string, err error) {
+	addressHealth.Lock()
+	defer addressHealth.Unlock()
+	if err == nil {
+		addressHealth.succeeded[address] = time.Now()
+	} else {
+		addressHealth.failed[address] = time.Now()
+	}
+}
+
+// Sort addresses into the order to try them in: those in preferred subnets
+// first, then those which worked last time we tried them, then those we
+// haven't tried, then those which failed. Otherwise the order is kept.
+func orderAddresses(addresses []string) []string {
+	subnetRank := func(address string) int {
+		ip := net.ParseIP(address)
+		for i, subnet := range preferredSubnets {
+			if ip != nil && subnet.Contains(ip) {
+				return i
+			}
+		}
+		return len(preferredSubnets)
+	}
+	addressHealth.Lock()
+	healthRank := func(address string) int {
+		succeeded, ok := addressHealth.succeeded[address]
+		failed, notOk := addressHealth.failed[address]
+		switch {
+		case ok && succeeded.After(failed):
+			return 0
+		case !ok && !notOk:
+			return 1
+		}
+		return 2
+	}
+	type ranked struct {
+		address      string
+		subnet, last int
+	}
+	rankings := []ranked{}
+	for _, address := range addresses {
+		if address == "" {
+			continue
+		}
+		rankings = append(rankings, ranked{address, subnetRank(address), healthRank(address)})
+	}
+	addressHealth.Unlock()
+
+	sort.SliceStable(rankings, func(i, j int) bool {
+		if rankings[i].subnet != rankings[j].subnet {
+			return rankings[i].subnet < rankings[j].subnet
+		}
+		return rankings[i].last < rankings[j].last
+	})
+	ordered := []string{}
+	for _, r := range rankings {
+		ordered = append(ordered, r.address)
+	}
+	return ordered
+}
+
+// Check that a node's dotmesh server is answering on an address, recording
+// whether it is. If we serve TLS, HTTPS is always tried first, so that we
+// notice when a node which only served plain HTTP has been upgraded, and
+// plain HTTP only if mayUsePlainHttpWith the node.
+func checkAddress(server, address string) error {
+	client := &http.Client{Transport: internalTransport, Timeout: ADDRESS_DIAL_TIMEOUT}
+	getStatus := func(scheme string) error {
+		resp, err := client.Get(fmt.Sprintf("%s://%s:6969/status", scheme, address))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status check on %s returned %d", address, resp.StatusCode)
+		}
+		return nil
+	}
+	var err error
+	if apiTLSConfig == nil {
+		err = getStatus("http")
+	} else {
+		err = getStatus("https")
+		if err == nil {
+			recordPlainHttpOnly(address, false)
+		} else if !mayUsePlainHttpWith(server) {
+			// whatever answered, it mustn't be sent the admin API key in the
+			// clear
+			recordPlainHttpOnly(address, false)
+		} else if answersWithoutTLS(address) {
+			// a node which hasn't been upgraded yet
+			err = getStatus("http")
+			if err == nil {
+				recordPlainHttpOnly(address, true)
+			}
+		}
+	}
+	recordAddressHealth(address, err)
+	return err
+}
+
+// Whether we've connected to an address since the last health check and not
+// failed to since.
+func addressRecentlyWorked(address string) bool {
+	addressHealth.Lock()
+	defer addressHealth.Unlock()
+	succeeded, ok := addressHealth.succeeded[address]
+	return ok && succeeded.After(addressHealth.failed[address]) &&
+		time.Since(succeeded) < ADDRESS_CHECK_INTERVAL
+}
+
+// The address to connect to another node on: the first one, in the order
+// orderAddresses gives, which answers. An address which has recently worked
+// isn't checked again.
+func (s *InMemoryState) reachableAddressFor(server string) (string, error) {
+	addresses := orderAddresses(s.addressesFor(server))
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("No known address for server %s", server)
+	}
+	errors := []string{}
+	for _, address := range addresses {
+		if addressRecentlyWorked(address) {
+			return address, nil
+		}
+		err := checkAddress(server, address)
+		if err == nil {
+			return address, nil
+		}
+		log.Printf("[reachableAddressFor] %s not reachable on %s: %s", server, address, err)
+		errors = append(errors, err.Error())
+	}
+	return "", fmt.Errorf(
+		"Can't reach server %s on any of its addresses: %s",
+		server, strings.Join(errors, "; "),
+	)
+}
+
+// Check every address of every other node, so that we know which ones work
+// before we need them.
+func (s *InMemoryState) checkPeerAddresses() error {
+	s.serverAddressesCacheLock.Lock()
+	servers := []string{}
+	for server, _ := range *s.serverAddressesCache {
+		if server != s.myNodeId {
+			servers = append(servers, server)
+		}
+	}
+	s.serverAddressesCacheLock.Unlock()
+
+	for _, server := range servers {
+		for _, address := range s.addressesFor(server) {
+			if address == "" {
+				continue
+			}
+			err := checkAddress(server, address)
+			if err != nil {
+				log.Printf("[checkPeerAddresses] %s not reachable on %s: %s", server, address, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Dial each address a hostname resolves to in turn, in the order
+// orderAddresses gives, for connections to other clusters.
+func dialFailover(ctx context.Context, network, hostport string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: ADDRESS_DIAL_TIMEOUT}
+	var conn net.Conn
+	for _, address := range orderAddresses(addresses) {
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(address, port))
+		recordAddressHealth(address, err)
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("[dialFailover] can't connect to %s on %s: %s", host, address, err)
+	}
+	return nil, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadPreferredSubnets(t *testing.T) {
+	defer os.Unsetenv("DOTMESH_PREFERRED_SUBNETS")
+	for _, c := range []struct {
+		setting  string
+		expected []string // the subnets, or nil if the setting is invalid
+	}{
+		{"", []string{}},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}},
+		{"192.168.1.0/24, 10.0.0.0/8", []string{"192.168.1.0/24", "10.0.0.0/8"}},
+		// normalised to the network
+		{"10.1.2.3/16", []string{"10.1.0.0/16"}},
+		{"10.0.0.0", nil},
+		{"10.0.0.0/8,", nil},
+		{"bananas", nil},
+	} {
+		t.Run(c.setting, func(t *testing.T) {
+			os.Setenv("DOTMESH_PREFERRED_SUBNETS", c.setting)
+			err := loadPreferredSubnets()
+			if c.expected == nil {
+				if err == nil {
+					t.Errorf("expected %q to be refused, got %v", c.setting, preferredSubnets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected %q to be accepted, got %s", c.setting, err)
+			}
+			got := []string{}
+			for _, subnet := range preferredSubnets {
+				got = append(got, subnet.String())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestOrderAddresses(t *testing.T) {
+	defer os.Unsetenv("DOTMESH_PREFERRED_SUBNETS")
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+	for _, c := range []struct {
+		name      string
+		subnets   string
+		succeeded map[string]time.Time
+		failed    map[string]time.Time
+		addresses []string
+		expected  []string
+	}{
+		{
+			name:      "empty",
+			addresses: []string{},
+			expected:  []string{},
+		},
+		{
+			name:      "blanks skipped",
+			addresses: []string{"", "10.0.0.1", ""},
+			expected:  []string{"10.0.0.1"},
+		},
+		{
+			name:      "untried keep their order",
+			addresses: []string{"10.0.0.2", "10.0.0.1", "10.0.0.3"},
+			expected:  []string{"10.0.0.2", "10.0.0.1", "10.0.0.3"},
+		},
+		{
+			name:      "succeeded, then untried, then failed",
+			succeeded: map[string]time.Time{"10.0.0.3": now},
+			failed:    map[string]time.Time{"10.0.0.1": now},
+			addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			expected:  []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"},
+		},
+		{
+			name:      "failed since it succeeded",
+			succeeded: map[string]time.Time{"10.0.0.1": earlier, "10.0.0.2": now},
+			failed:    map[string]time.Time{"10.0.0.1": now, "10.0.0.2": earlier},
+			addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			expected:  []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"},
+		},
+		{
+			name:      "preferred subnets first, in the order they're listed",
+			subnets:   "192.168.0.0/16,172.16.0.0/12",
+			addresses: []string{"10.0.0.1", "172.17.0.1", "192.168.1.1", "node.example.com"},
+			expected:  []string{"192.168.1.1", "172.17.0.1", "10.0.0.1", "node.example.com"},
+		},
+		{
+			name:      "preferred subnets before health",
+			subnets:   "192.168.0.0/16",
+			succeeded: map[string]time.Time{"10.0.0.1": now, "192.168.1.2": now},
+			failed:    map[string]time.Time{"192.168.1.1": now},
+			addresses: []string{"10.0.0.1", "192.168.1.1", "192.168.1.2", "10.0.0.2"},
+			expected:  []string{"192.168.1.2", "192.168.1.1", "10.0.0.1", "10.0.0.2"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			os.Setenv("DOTMESH_PREFERRED_SUBNETS", c.subnets)
+			if err := loadPreferredSubnets(); err != nil {
+				t.Fatalf("error loading subnets: %s", err)
+			}
+			addressHealth.Lock()
+			addressHealth.succeeded = map[string]time.Time{}
+			addressHealth.failed = map[string]time.Time{}
+			for address, at := range c.succeeded {
+				addressHealth.succeeded[address] = at
+			}
+			for address, at := range c.failed {
+				addressHealth.failed[address] = at
+			}
+			addressHealth.Unlock()
+
+			got := orderAddresses(c.addresses)
+			if fmt.Sprint(got) != fmt.Sprint(c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+// Transferring every branch of a dot at once (push and clone --all-branches).
+//
+// The branches are transferred one after another in a single transfer, each
+// one after the branch it was made from, so that its origin commit is already
+// on the receiving side. Each branch is a segment of the transfer just as
+// each filesystem on a path is for applyPath, except that every branch is
+// transferred up to its latest commit. A branch which fails doesn't stop the
+// others, apart from those made from it, which are skipped.
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// A branch on the sending side of a transfer, and its path to the top level
+// filesystem. The master branch is named "".
+type branchPath struct {
+	name string
+	path PathToTopLevelFilesystem
+}
+
+// Find every branch of the dot on the sending side of a transfer, sorted so
+// that each one comes after the branch it was made from.
+func (s *InMemoryState) sendingBranches(
+	ctx context.Context, client *JsonRpcClient, args *TransferRequest,
+) ([]branchPath, error) {
+	branches := []branchPath{}
+	if args.Direction == "push" {
+		name := VolumeName{args.LocalNamespace, args.LocalName}
+		tlfId, err := s.registry.IdFromName(name)
+		if err != nil {
+			return nil, err
+		}
+		path, err := s.registry.deducePathToTopLevelFilesystem(name, "")
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, branchPath{"", path})
+		for branch, _ := range s.registry.ClonesFor(tlfId) {
+			path, err := s.registry.deducePathToTopLevelFilesystem(name, branch)
+			if err != nil {
+				return nil, err
+			}
+			branches = append(branches, branchPath{branch, path})
+		}
+	} else {
+		var names []string
+		err := client.CallRemote(ctx,
+			"DotmeshRPC.Branches", VolumeName{args.RemoteNamespace, args.RemoteName}, &names,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for _, branch := range append([]string{""}, names...) {
+			var path PathToTopLevelFilesystem
+			err := client.CallRemote(ctx,
+				"DotmeshRPC.DeducePathToTopLevelFilesystem", map[string]interface{}{
+					"RemoteNamespace":      args.RemoteNamespace,
+					"RemoteFilesystemName": args.RemoteName,
+					"RemoteCloneName":      branch,
+				},
+				&path,
+			)
+			if err != nil {
+				return nil, err
+			}
+			branches = append(branches, branchPath{branch, path})
+		}
+	}
+	// a branch's path is its origin's path plus itself, so sorting by length
+	// puts origins first
+	sort.SliceStable(branches, func(i, j int) bool {
+		if len(branches[i].path.Clones) != len(branches[j].path.Clones) {
+			return len(branches[i].path.Clones) < len(branches[j].path.Clones)
+		}
+		return branches[i].name < branches[j].name
+	})
+	return branches, nil
+}
+
+// The request to transfer just one of the branches of an AllBranches request.
+func branchTransferRequest(args *TransferRequest, branch string) *TransferRequest {
+	branchArgs := *args
+	branchArgs.AllBranches = false
+	if branch != "" {
+		branchArgs.LocalBranchName = branch
+		branchArgs.RemoteBranchName = branch
+	}
+	return &branchArgs
+}
+
+// Check each branch other than master can be transferred, and create the
+// ones which don't exist on the receiving side yet, just as startTransfer has
+// done for master.
+func (d *DotmeshRPC) registerAllBranches(
+	ctx context.Context, client *JsonRpcClient, args *TransferRequest,
+) error {
+	branches, err := d.state.sendingBranches(ctx, client, args)
+	if err != nil {
+		return err
+	}
+	for _, branch := range branches {
+		if branch.name == "" {
+			continue
+		}
+		branchArgs := branchTransferRequest(args, branch.name)
+		ends, err := d.checkTransfer(ctx, client, branchArgs)
+		if err != nil {
+			return fmt.Errorf("Can't transfer branch %s: %s", branch.name, err)
+		}
+		_, err = d.registerTransferDestination(ctx, client, branchArgs, ends)
+		if err != nil {
+			return fmt.Errorf("Can't create branch %s: %s", branch.name, err)
+		}
+	}
+	return nil
+}
+
+// Plan the transfer of each branch in turn. A filesystem shared by several
+// branches is planned along with the first of them, which is the branch it
+// belongs to.
+func (d *DotmeshRPC) planAllBranches(
+	ctx context.Context, client *JsonRpcClient, args *TransferRequest,
+) TransferPlan {
+	plan := TransferPlan{Direction: args.Direction}
+	_, err := d.checkTransfer(ctx, client, args)
+	if err != nil {
+		return failedPlan(plan, err)
+	}
+	branches, err := d.state.sendingBranches(ctx, client, args)
+	if err != nil {
+		return failedPlan(plan, err)
+	}
+	plan.Path = branches[0].path
+
+	planned := map[string]bool{}
+	problems := []string{}
+	for _, branch := range branches {
+		branchPlan := d.planTransfer(ctx, client, branchTransferRequest(args, branch.name))
+		for _, step := range branchPlan.Steps {
+			if planned[step.FilesystemId] {
+				continue
+			}
+			planned[step.FilesystemId] = true
+			plan.Steps = append(plan.Steps, step)
+			plan.Size += step.Size
+		}
+		if branchPlan.Error != "" {
+			problems = append(problems, branchPlan.Error)
+		}
+	}
+	plan.Error = strings.Join(problems, "; ")
+	return plan
+}
+
+// Transfer each branch with transferFn, recording how each one went in
+// pollResult.Branches. The transfer as a whole fails if any branch does.
+func (f *fsMachine) applyBranches(
+	branches []branchPath, transferFn transferFn,
+	transferRequestId string, pollResult *TransferPollResult,
+	client *JsonRpcClient, transferRequest *TransferRequest,
+) (*Event, stateFn) {
+	pollResult.Branches = []BranchTransferResult{}
+	for _, branch := range branches {
+		pollResult.Branches = append(pollResult.Branches, BranchTransferResult{
+			Name: branch.name, Status: "waiting",
+		})
+	}
+
+	var responseEvent *Event
+	var nextState stateFn
+	// filesystems whose branches failed or were skipped
+	failed := map[string]bool{}
+	failedNames := []string{}
+	for i, branch := range branches {
+		result := &pollResult.Branches[i]
+		var fromFilesystemId, fromSnapshotId, toFilesystemId string
+		if len(branch.path.Clones) == 0 {
+			toFilesystemId = branch.path.TopLevelFilesystemId
+		} else {
+			clone := branch.path.Clones[len(branch.path.Clones)-1].Clone
+			fromFilesystemId = clone.Origin.FilesystemId
+			fromSnapshotId = clone.Origin.SnapshotId
+			toFilesystemId = clone.FilesystemId
+		}
+
+		if failed[fromFilesystemId] {
+			failed[toFilesystemId] = true
+			result.Status = "skipped"
+			result.Message = "the branch it was made from wasn't transferred"
+		} else {
+			log.Printf(
+				"[applyBranches] calling transferFn for branch %q with fF=%v, fS=%v, tF=%v",
+				branch.name, fromFilesystemId, fromSnapshotId, toFilesystemId,
+			)
+			branchEvent, branchState := transferFn(f,
+				fromFilesystemId, fromSnapshotId, toFilesystemId, "",
+				transferRequestId, pollResult, client, transferRequest,
+			)
+			var err error
+			if branchEvent.Name == "finished-push" ||
+				branchEvent.Name == "finished-pull" || branchEvent.Name == "peer-up-to-date" {
+				responseEvent, nextState = branchEvent, branchState
+				err = f.state.maybeMountFilesystem(toFilesystemId)
+			} else {
+				err = fmt.Errorf("%s", branchEvent)
+			}
+			if err != nil {
+				failed[toFilesystemId] = true
+				result.Status = "error"
+				result.Message = err.Error()
+			} else {
+				result.Status = "finished"
+			}
+		}
+		if failed[toFilesystemId] {
+			name := branch.name
+			if name == "" {
+				name = DEFAULT_BRANCH
+			}
+			failedNames = append(failedNames, name)
+		}
+
+		err := f.incrementPollResultIndex(transferRequestId, pollResult)
+		if err != nil {
+			return &Event{Name: "error-incrementing-poll-result",
+				Args: &EventArgs{"error": err}}, backoffState
+		}
+	}
+
+	if len(failedNames) > 0 {
+		msg := fmt.Sprintf(
+			"Failed to transfer %d of %d branches: %s",
+			len(failedNames), len(branches), strings.Join(failedNames, ", "),
+		)
+		f.updateTransfer("error", msg)
+		return &Event{
+			Name: "error-in-attempting-apply-branches",
+			Args: &EventArgs{"error": msg, "branches": pollResult.Branches},
+		}, backoffState
+	}
+	f.updateTransfer("finished", "")
+	return responseEvent, nextState
+}
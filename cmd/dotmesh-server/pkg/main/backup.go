@@ -0,0 +1,329 @@
+package main
+
+// Backing up and restoring the cluster's metadata.
+//
+// `dm cluster backup` takes a MetadataBackup: every key under ETCD_PREFIX as of
+// a single index of the metadata store, so that it's consistent, apart from
+// the ones which nodes publish about themselves as they go (see
+// notBackedUp). `dm cluster restore` writes them all back, into a cluster
+// which has lost its etcd, and then reconciles the masters of the dots it
+// knows about with the filesystems the nodes actually have: a dot whose master
+// according to the backup doesn't have it any more gets the node with the
+// longest history of it instead.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// bumped whenever what's in a backup changes in a way older servers won't
+// understand
+const METADATA_BACKUP_VERSION = 1
+
+// Published by each node about itself, or instructions to nodes which only
+// make sense at the time, so they'd be wrong by the time they're restored.
+var notBackedUp = map[string]bool{
+	"filesystems/requests":   true,
+	"filesystems/responses":  true,
+	"filesystems/live":       true,
+	"filesystems/containers": true,
+	"filesystems/dirty":      true,
+	"servers/addresses":      true,
+	"servers/snapshots":      true,
+	"servers/states":         true,
+	"servers/status":         true,
+	"servers/draining":       true,
+	"servers/fenced":         true,
+	"servers/nodecsrs":       true,
+	"leader":                 true,
+}
+
+type MetadataBackup struct {
+	Version        int
+	DotmeshVersion string
+	CreatedAt      int64 // unix timestamp
+	// the index of the metadata store it's a snapshot of
+	Index uint64
+	// relative to ETCD_PREFIX
+	Keys map[string]string
+}
+
+type RestoredFilesystem struct {
+	FilesystemId string
+	Name         VolumeName
+	Branch       string
+	// the master according to the backup, and the master now, which is
+	// different if the old one doesn't have it, and empty if no node does
+	OldMaster string
+	Master    string
+}
+
+type RestoreResult struct {
+	Keys        int
+	Filesystems []RestoredFilesystem
+	// filesystems the nodes have which the backup knows nothing about
+	Unregistered []string
+}
+
+func backupVariant(key string) string {
+	pieces := strings.SplitN(key, "/", 3)
+	if len(pieces) < 2 {
+		return key
+	}
+	return pieces[0] + "/" + pieces[1]
+}
+
+func collectBackupKeys(node *client.Node, keys map[string]string) {
+	if node.Dir {
+		for _, child := range node.Nodes {
+			collectBackupKeys(child, keys)
+		}
+		return
+	}
+	key := strings.TrimPrefix(node.Key, ETCD_PREFIX+"/")
+	if !notBackedUp[backupVariant(key)] {
+		keys[key] = node.Value
+	}
+}
+
+func (s *InMemoryState) backupMetadata() (MetadataBackup, error) {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return MetadataBackup{}, err
+	}
+	// a single get, so that it's all as of the same index
+	resp, err := kapi.Get(
+		context.Background(), ETCD_PREFIX, &client.GetOptions{Recursive: true, Quorum: true},
+	)
+	if err != nil {
+		return MetadataBackup{}, err
+	}
+	backup := MetadataBackup{
+		Version:        METADATA_BACKUP_VERSION,
+		DotmeshVersion: s.versionInfo.InstalledVersion,
+		CreatedAt:      time.Now().Unix(),
+		Index:          resp.Index,
+		Keys:           map[string]string{},
+	}
+	collectBackupKeys(resp.Node, backup.Keys)
+	return backup, nil
+}
+
+// Write a backup's keys back, refusing to overwrite any dots the cluster
+// already has unless forced, then reconcile the masters with what the nodes
+// have.
+func (s *InMemoryState) restoreMetadata(backup MetadataBackup, force bool) (RestoreResult, error) {
+	result := RestoreResult{Filesystems: []RestoredFilesystem{}, Unregistered: []string{}}
+	if backup.Version != METADATA_BACKUP_VERSION {
+		return result, fmt.Errorf(
+			"Unsupported backup version %d, this server understands version %d",
+			backup.Version, METADATA_BACKUP_VERSION,
+		)
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return result, err
+	}
+	if !force {
+		resp, err := kapi.Get(
+			context.Background(), fmt.Sprintf("%s/registry/filesystems", ETCD_PREFIX),
+			&client.GetOptions{Recursive: true},
+		)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return result, err
+		}
+		if err == nil && len(resp.Node.Nodes) > 0 {
+			return result, fmt.Errorf(
+				"This cluster already has dots, please restore with --force " +
+					"to overwrite them with the ones in the backup",
+			)
+		}
+	}
+
+	// keep the admin user the cluster was set up with, so that its API key
+	// keeps working
+	adminKey := fmt.Sprintf("users/%s", ADMIN_USER_UUID)
+	_, err = kapi.Get(
+		context.Background(), fmt.Sprintf("%s/%s", ETCD_PREFIX, adminKey), nil,
+	)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return result, err
+	}
+	keepAdmin := err == nil
+
+	keys := []string{}
+	for key := range backup.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if notBackedUp[backupVariant(key)] || backupVariant(key) == "filesystems/masters" {
+			// masters are set by reconcileMasters
+			continue
+		}
+		if key == adminKey && keepAdmin {
+			continue
+		}
+		_, err = kapi.Set(
+			context.Background(), fmt.Sprintf("%s/%s", ETCD_PREFIX, key), backup.Keys[key], nil,
+		)
+		if err != nil {
+			return result, err
+		}
+		result.Keys++
+	}
+
+	err = s.reconcileMasters(backup, &result)
+	return result, err
+}
+
+// The nodes which have each filesystem, and how many snapshots of it they
+// have.
+func (s *InMemoryState) filesystemHolders() map[string]map[string]int {
+	holders := map[string]map[string]int{}
+	have := func(fs, server string, snaps int) {
+		if _, ok := holders[fs]; !ok {
+			holders[fs] = map[string]int{}
+		}
+		holders[fs][server] = snaps
+	}
+	live := s.liveServers()
+	s.globalSnapshotCacheLock.Lock()
+	for server, filesystems := range *s.globalSnapshotCache {
+		if !live[server] {
+			continue
+		}
+		for fs, snaps := range filesystems {
+			have(fs, server, len(snaps))
+		}
+	}
+	s.globalSnapshotCacheLock.Unlock()
+	// we know for sure what we have, even if we haven't told etcd yet
+	s.filesystemsLock.Lock()
+	for fs := range *s.filesystems {
+		if _, ok := holders[fs][s.myNodeId]; !ok {
+			have(fs, s.myNodeId, 0)
+		}
+	}
+	s.filesystemsLock.Unlock()
+	return holders
+}
+
+func (s *InMemoryState) reconcileMasters(backup MetadataBackup, result *RestoreResult) error {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+
+	registered := map[string]RestoredFilesystem{}
+	deleted := map[string]bool{}
+	for key, value := range backup.Keys {
+		// e.g. registry/filesystems/:namespace/:name, or
+		// filesystems/deleted/:filesystem
+		pieces := strings.Split(key, "/")
+		switch backupVariant(key) {
+		case "registry/filesystems":
+			if len(pieces) != 4 {
+				continue
+			}
+			var entry registryFilesystem
+			if err := json.Unmarshal([]byte(value), &entry); err != nil {
+				return err
+			}
+			name := VolumeName{Namespace: pieces[2], Name: pieces[3]}
+			registered[entry.Id] = RestoredFilesystem{FilesystemId: entry.Id, Name: name}
+		case "filesystems/deleted":
+			if len(pieces) == 3 {
+				deleted[pieces[2]] = true
+			}
+		}
+	}
+	for key, value := range backup.Keys {
+		// registry/clones/:top-level-filesystem/:branch, once we know the
+		// names of the top-level ones
+		pieces := strings.Split(key, "/")
+		if backupVariant(key) != "registry/clones" || len(pieces) != 4 {
+			continue
+		}
+		var clone Clone
+		if err := json.Unmarshal([]byte(value), &clone); err != nil {
+			return err
+		}
+		registered[clone.FilesystemId] = RestoredFilesystem{
+			FilesystemId: clone.FilesystemId,
+			Name:         registered[pieces[2]].Name,
+			Branch:       pieces[3],
+		}
+	}
+
+	holders := s.filesystemHolders()
+	placeable := s.placeableServers()
+	masterCounts := map[string]int{}
+	ids := []string{}
+	for id := range registered {
+		if !deleted[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fs := registered[id]
+		fs.OldMaster = backup.Keys[fmt.Sprintf("filesystems/masters/%s", id)]
+		if _, ok := holders[id][fs.OldMaster]; ok {
+			fs.Master = fs.OldMaster
+		} else {
+			// the longest history, then the fewest masters so far
+			candidates := []string{}
+			for server := range holders[id] {
+				if placeable[server] {
+					candidates = append(candidates, server)
+				}
+			}
+			sort.Slice(candidates, func(i, j int) bool {
+				a, b := candidates[i], candidates[j]
+				if holders[id][a] != holders[id][b] {
+					return holders[id][a] > holders[id][b]
+				}
+				if masterCounts[a] != masterCounts[b] {
+					return masterCounts[a] < masterCounts[b]
+				}
+				return a < b
+			})
+			if len(candidates) > 0 {
+				fs.Master = candidates[0]
+			}
+		}
+		master := fs.Master
+		if master == "" {
+			// leave it to the old master, in case it comes back
+			master = fs.OldMaster
+		}
+		if master != "" {
+			masterCounts[master]++
+			_, err = kapi.Set(
+				context.Background(),
+				fmt.Sprintf("%s/filesystems/masters/%s", ETCD_PREFIX, id),
+				master,
+				nil,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		result.Filesystems = append(result.Filesystems, fs)
+	}
+
+	for id := range holders {
+		if _, ok := registered[id]; !ok && !deleted[id] {
+			result.Unregistered = append(result.Unregistered, id)
+		}
+	}
+	sort.Strings(result.Unregistered)
+	return nil
+}
@@ -19,13 +19,15 @@ type JsonRpcClient struct {
 	User     string
 	Hostname string
 	ApiKey   string
+	TLS      PeerTLS
 }
 
-func NewJsonRpcClient(user, hostname, apiKey string) *JsonRpcClient {
+func NewJsonRpcClient(user, hostname, apiKey string, peerTLS PeerTLS) *JsonRpcClient {
 	return &JsonRpcClient{
 		User:     user,
 		Hostname: hostname,
 		ApiKey:   apiKey,
+		TLS:      peerTLS,
 	}
 }
 
@@ -43,7 +45,7 @@ func (j *JsonRpcClient) CallRemote(
 	defer span.Finish()
 
 	// RPCs are always between clusters, so "external"
-	url := fmt.Sprintf("%s/rpc", deduceUrl(j.Hostname, "external"))
+	url := fmt.Sprintf("%s/rpc", deduceUrl(j.Hostname, j.TLS.urlMode()))
 	message, err := json2.EncodeClientRequest(method, args)
 	if err != nil {
 		return err
@@ -59,8 +61,10 @@ func (j *JsonRpcClient) CallRemote(
 
 	req.Header.Set("Content-Type", "application/json")
 	req.SetBasicAuth(j.User, j.ApiKey)
-	client := new(http.Client)
-
+	client, err := peerHttpClient(j.TLS)
+	if err != nil {
+		return err
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -71,7 +75,7 @@ func (j *JsonRpcClient) CallRemote(
 		// TODO add user mgmt subcommands, then reference them in this error message
 		// annotate our span with the error condition
 		span.SetTag("error", "Permission denied")
-		return fmt.Errorf("Permission denied. Please check that your API key is still valid.")
+		return PermissionDenied{Reason: "Please check that your API key is still valid."}
 	}
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -79,6 +83,11 @@ func (j *JsonRpcClient) CallRemote(
 		return fmt.Errorf("Error reading body: %s", err)
 	}
 	err = json2.DecodeClientResponse(bytes.NewBuffer(b), &result)
+	if jsonErr, ok := err.(*json2.Error); ok && jsonErr.Message == (PermissionDenied{}).Error() {
+		// the peer refused with a PermissionDenied of its own
+		span.SetTag("error", jsonErr.Message)
+		return PermissionDenied{}
+	}
 	if err != nil {
 		span.SetTag("error", fmt.Sprintf("Couldn't decode response '%s': %s", string(b), err))
 		return fmt.Errorf("Couldn't decode response '%s': %s", string(b), err)
@@ -0,0 +1,236 @@
+package main
+
+// An overview of the cluster for `dm cluster status`.
+//
+// Each node publishes what only it knows about itself, such as its version and
+// how much space its pool has left, under servers/status/:node every
+// NODE_STATUS_INTERVAL. The rest comes from our caches of what's in etcd, and
+// from asking the metadata store how it is.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const NODE_STATUS_INTERVAL = 30 * time.Second
+
+type NodeStatus struct {
+	Version   string
+	PoolSize  int64
+	PoolFree  int64
+	UpdatedAt int64 // unix timestamp
+	// the id of the etcd member running alongside it, if any
+	EtcdMember string
+}
+
+type ClusterNode struct {
+	Id        string
+	Addresses []string
+	Live      bool
+	Draining  bool
+	// as of when the node last published its status, see NodeStatus
+	Version         string
+	PoolSize        int64
+	PoolFree        int64
+	StatusUpdatedAt int64
+	// how many dots (and branches) the node is master of, and has a copy of
+	// otherwise
+	Masters  int
+	Replicas int
+}
+
+type EtcdStatus struct {
+	Healthy bool
+	Error   string
+	Leader  string
+	Members []string
+}
+
+type ClusterStatus struct {
+	Nodes []ClusterNode
+	// the node running the cluster-wide background jobs, see leader.go
+	Leader string
+	Etcd   EtcdStatus
+	// the transfers to and from other clusters which haven't finished yet
+	Transfers []TransferPollResult
+}
+
+// How big the pool is, and how much of it is free, in bytes.
+func poolSpace() (int64, int64, error) {
+	output, err := exec.Command(
+		ZPOOL, "list", "-Hp", "-o", "size,free", POOL,
+	).CombinedOutput()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %s", err, output)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("Unexpected output from zpool list: %s", output)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	free, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, free, nil
+}
+
+func (s *InMemoryState) updateStatusInEtcd() error {
+	size, free, err := poolSpace()
+	if err != nil {
+		return err
+	}
+	etcdMember, err := localEtcdMember()
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(NodeStatus{
+		Version:    s.versionInfo.InstalledVersion,
+		PoolSize:   size,
+		PoolFree:   free,
+		UpdatedAt:  time.Now().Unix(),
+		EtcdMember: etcdMember,
+	})
+	if err != nil {
+		return err
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/servers/status/%s", ETCD_PREFIX, s.myNodeId),
+		string(serialized),
+		nil,
+	)
+	return err
+}
+
+func nodeStatuses() (map[string]NodeStatus, error) {
+	statuses := map[string]NodeStatus{}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/servers/status", ETCD_PREFIX),
+		&client.GetOptions{Recursive: true},
+	)
+	if client.IsKeyNotFound(err) {
+		return statuses, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range resp.Node.Nodes {
+		pieces := strings.Split(node.Key, "/")
+		var status NodeStatus
+		err = json.Unmarshal([]byte(node.Value), &status)
+		if err != nil {
+			return nil, err
+		}
+		statuses[pieces[len(pieces)-1]] = status
+	}
+	return statuses, nil
+}
+
+func etcdStatus() EtcdStatus {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return EtcdStatus{Members: []string{}, Error: err.Error()}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return kapi.Status(ctx)
+}
+
+func (s *InMemoryState) clusterStatus() (ClusterStatus, error) {
+	statuses, err := nodeStatuses()
+	if err != nil {
+		return ClusterStatus{}, err
+	}
+	live := s.liveServers()
+
+	nodes := map[string]*ClusterNode{}
+	s.serverAddressesCacheLock.Lock()
+	for server, addresses := range *s.serverAddressesCache {
+		node := &ClusterNode{Id: server, Addresses: []string{}, Live: live[server]}
+		if addresses != "" {
+			node.Addresses = strings.Split(addresses, ",")
+		}
+		nodes[server] = node
+	}
+	s.serverAddressesCacheLock.Unlock()
+	if _, ok := nodes[s.myNodeId]; !ok {
+		nodes[s.myNodeId] = &ClusterNode{Id: s.myNodeId, Addresses: []string{}, Live: true}
+	}
+
+	masters := map[string]string{}
+	s.mastersCacheLock.Lock()
+	for fs, master := range *s.mastersCache {
+		masters[fs] = master
+		if node, ok := nodes[master]; ok {
+			node.Masters++
+		}
+	}
+	s.mastersCacheLock.Unlock()
+
+	s.globalSnapshotCacheLock.Lock()
+	for server, filesystems := range *s.globalSnapshotCache {
+		node, ok := nodes[server]
+		if !ok {
+			continue
+		}
+		for fs, snaps := range filesystems {
+			if len(snaps) > 0 && masters[fs] != server {
+				node.Replicas++
+			}
+		}
+	}
+	s.globalSnapshotCacheLock.Unlock()
+
+	result := ClusterStatus{Nodes: []ClusterNode{}, Transfers: []TransferPollResult{}}
+	for id, node := range nodes {
+		node.Draining = s.isDraining(id)
+		if status, ok := statuses[id]; ok {
+			node.Version = status.Version
+			node.PoolSize = status.PoolSize
+			node.PoolFree = status.PoolFree
+			node.StatusUpdatedAt = status.UpdatedAt
+		}
+		result.Nodes = append(result.Nodes, *node)
+	}
+	sort.Slice(result.Nodes, func(i, j int) bool {
+		return result.Nodes[i].Id < result.Nodes[j].Id
+	})
+
+	s.interclusterTransfersLock.Lock()
+	for _, transfer := range *s.interclusterTransfers {
+		if transfer.Status != "finished" && transfer.Status != "error" {
+			// not for passing around
+			transfer.ApiKey = ""
+			result.Transfers = append(result.Transfers, transfer)
+		}
+	}
+	s.interclusterTransfersLock.Unlock()
+	sort.Slice(result.Transfers, func(i, j int) bool {
+		return result.Transfers[i].TransferRequestId < result.Transfers[j].TransferRequestId
+	})
+
+	result.Leader = s.leaderElection.currentLeader()
+	result.Etcd = etcdStatus()
+	return result, nil
+}
@@ -29,8 +29,10 @@ func NewInMemoryState(localPoolId string, config Config) *InMemoryState {
 		filesystemsLock: &sync.Mutex{},
 		myNodeId:        localPoolId,
 		// filesystem => node id
-		mastersCache:     &map[string]string{},
-		mastersCacheLock: &sync.Mutex{},
+		mastersCache: &map[string]string{},
+		// filesystem => master epoch, see epochs.go
+		masterEpochsCache: &map[string]uint64{},
+		mastersCacheLock:  &sync.Mutex{},
 		// server id => comma-separated IPv[46] addresses
 		serverAddressesCache:     &map[string]string{},
 		serverAddressesCacheLock: &sync.Mutex{},
@@ -60,6 +62,22 @@ func NewInMemoryState(localPoolId string, config Config) *InMemoryState {
 		globalDirtyCacheLock:      &sync.Mutex{},
 		globalDirtyCache:          &map[string]dirtyInfo{},
 		versionInfo:               &VersionInfo{InstalledVersion: serverVersion},
+		// mirror id => standing request to push to a remote, see mirrors.go
+		mirrors:     &map[string]Mirror{},
+		mirrorsLock: &sync.Mutex{},
+		// top-level filesystem id => number of copies to keep, see replicas.go
+		replicationFactors:     &map[string]int{},
+		replicationFactorsLock: &sync.Mutex{},
+		// filesystem id => nodes which should keep copies besides the master
+		replicasCache:     &map[string][]string{},
+		replicasCacheLock: &sync.Mutex{},
+		// nodes which are being drained of their dots, see drain.go
+		drainingServers:     &map[string]bool{},
+		drainingServersLock: &sync.Mutex{},
+		// which node runs the cluster-wide background jobs, see leader.go
+		leaderElection: newLeaderElection(
+			fmt.Sprintf("%s/leader", ETCD_PREFIX), localPoolId, LEADER_TTL,
+		),
 	}
 	// a registry of names of filesystems and branches (clones) mapping to
 	// their ids
@@ -227,6 +245,7 @@ func (s *InMemoryState) getOne(ctx context.Context, fs string) (DotmeshVolume, e
 		if ok {
 			commitCount = int64(len(snapshots))
 		}
+		replicationFactor, upToDateCopies := s.replicationStatus(fs, master)
 
 		d := DotmeshVolume{
 			Name:           tlf.MasterBranch.Name,
@@ -237,6 +256,9 @@ func (s *InMemoryState) getOne(ctx context.Context, fs string) (DotmeshVolume, e
 			Id:             fs,
 			CommitCount:    commitCount,
 			ServerStatuses: map[string]string{},
+
+			ReplicationFactor: replicationFactor,
+			UpToDateCopies:    upToDateCopies,
 		}
 		s.serverAddressesCacheLock.Lock()
 		defer s.serverAddressesCacheLock.Unlock()
@@ -323,7 +345,7 @@ func (s *InMemoryState) insertInitialAdminPassword() error {
 		return err
 	}
 
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -383,7 +405,7 @@ func (s *InMemoryState) findRelatedContainers() error {
 		return err
 	}
 	log.Printf("findRelatedContainers got containerMap %s", containerMap)
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -568,6 +590,11 @@ func (state *InMemoryState) reallyProcureFilesystem(ctx context.Context, name Vo
 	// of time has passed, we should have an inactive filesystem state
 	// machine.
 
+	err := state.ensureNotDraining()
+	if err != nil {
+		return "", err
+	}
+
 	cloneName := ""
 	if strings.Contains(name.Name, "@") {
 		shrapnel := strings.Split(name.Name, "@")
@@ -595,9 +622,19 @@ func (state *InMemoryState) reallyProcureFilesystem(ctx context.Context, name Vo
 		} else if master == "" {
 			return "", fmt.Errorf("Internal error: The volume name exists, but the volume does not (have a master). Name:%s Clone:%s ID:%s", name, cloneName, filesystemId)
 		} else {
+			// make sure we'll be keeping a copy, so that we can catch up
+			err := state.addReplica(filesystemId, state.myNodeId)
+			if err != nil {
+				return "", err
+			}
 			// put in a request for the current master of the filesystem to
 			// move it to me
-			responseChan, err := state.globalFsRequest(
+			// TODO implement some kind of liveness check to avoid timing out
+			// too early on slow transfers.
+			moveCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			responseChan, err := state.globalFsRequestContext(
+				moveCtx,
 				filesystemId,
 				&Event{
 					Name: "move",
@@ -613,20 +650,14 @@ func (state *InMemoryState) reallyProcureFilesystem(ctx context.Context, name Vo
 				state.masterFor(filesystemId),
 				state.myNodeId,
 			)
-			var e *Event
-			select {
-			case <-time.After(30 * time.Second):
-				// something needs to read the response from the
-				// response chan
-				go func() { _ = <-responseChan }()
-				// TODO implement some kind of liveness check to avoid
-				// timing out too early on slow transfers.
+			e := <-responseChan
+			if e.Name == "master-unavailable" {
 				return "", fmt.Errorf(
-					"timed out trying to procure %s, please try again", filesystemId,
+					"timed out trying to procure %s, please try again: %s",
+					filesystemId, (*e.Args)["err"],
 				)
-			case e = <-responseChan:
-				// tally ho!
 			}
+			// tally ho!
 			log.Printf(
 				"Attempting to move %s from %s to me (%s)",
 				filesystemId, state.masterFor(filesystemId), state.myNodeId,
@@ -701,7 +732,12 @@ func (s *InMemoryState) CreateFilesystem(
 	ctx context.Context, filesystemName *VolumeName,
 ) (*fsMachine, chan *Event, error) {
 
-	kapi, err := getEtcdKeysApi()
+	err := s.ensureNotDraining()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return nil, nil, err
 	}
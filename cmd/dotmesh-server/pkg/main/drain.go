@@ -0,0 +1,300 @@
+package main
+
+// Draining and removing nodes.
+//
+// `dm cluster drain <node>` records under servers/draining/:node that the node
+// is being retired. From then on no dots are created or procured on it, or
+// moved or failed over to it, and it stops being picked as a replica. Every
+// dot it's the master of is then moved (see move.go) to the other node with
+// the most up-to-date copy of it, the one which is master of the fewest dots
+// in a tie. Once the other nodes have caught up with everything it had, it can
+// be stopped and forgotten with `dm cluster remove-node <node>`.
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+type DrainMove struct {
+	FilesystemId string
+	Name         VolumeName
+	Branch       string
+	Target       string
+	RequestId    string // to poll with PollMove
+	Error        string // why it couldn't be moved
+}
+
+type DrainStatus struct {
+	Draining bool
+	// how many dots the node is still the master of
+	Masters int
+	// how many dots it has a copy of which the other nodes don't yet have
+	// enough up-to-date copies of
+	CatchingUp int
+}
+
+func (s *InMemoryState) isDraining(server string) bool {
+	s.drainingServersLock.Lock()
+	defer s.drainingServersLock.Unlock()
+	return (*s.drainingServers)[server]
+}
+
+// The live nodes which aren't being drained, which dots can be placed on.
+func (s *InMemoryState) placeableServers() map[string]bool {
+	live := s.liveServers()
+	s.drainingServersLock.Lock()
+	defer s.drainingServersLock.Unlock()
+	for server := range *s.drainingServers {
+		delete(live, server)
+	}
+	return live
+}
+
+// Refuse to become the master of a dot while we're being drained.
+func (s *InMemoryState) ensureNotDraining() error {
+	if s.isDraining(s.myNodeId) {
+		return fmt.Errorf(
+			"This node (%s) is being drained, please use another one", s.myNodeId,
+		)
+	}
+	return nil
+}
+
+// Mark a node as being drained, and start moving the dots it's the master of
+// to other nodes.
+func (s *InMemoryState) drainNode(node string, stopContainers bool) ([]DrainMove, error) {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return nil, err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/servers/draining/%s", ETCD_PREFIX, node),
+		fmt.Sprintf("%d", time.Now().Unix()),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.drainingServersLock.Lock()
+	(*s.drainingServers)[node] = true
+	s.drainingServersLock.Unlock()
+	log.Printf("[drainNode] Draining %s", node)
+
+	placeable := s.placeableServers()
+	filesystems := []string{}
+	masterCounts := map[string]int{}
+	s.mastersCacheLock.Lock()
+	for fs, master := range *s.mastersCache {
+		if master == node {
+			filesystems = append(filesystems, fs)
+		} else {
+			masterCounts[master]++
+		}
+	}
+	s.mastersCacheLock.Unlock()
+	sort.Strings(filesystems)
+
+	moves := []DrainMove{}
+	for _, fs := range filesystems {
+		move := DrainMove{FilesystemId: fs}
+		tlf, branch, err := s.registry.LookupFilesystemById(fs)
+		if err == nil {
+			move.Name = tlf.MasterBranch.Name
+			move.Branch = branch
+		}
+		target, ok := s.drainTarget(fs, node, placeable, masterCounts)
+		if !ok {
+			move.Error = "there are no other nodes to move it to"
+			moves = append(moves, move)
+			continue
+		}
+		masterCounts[target]++
+		move.Target = target
+		move.RequestId, err = s.moveFilesystem(fs, target, stopContainers)
+		if err != nil {
+			move.Error = err.Error()
+		}
+		moves = append(moves, move)
+	}
+	return moves, nil
+}
+
+// The node to move a filesystem to off a node being drained: the one with the
+// most up-to-date copy, and then the one which is master of the fewest
+// filesystems.
+func (s *InMemoryState) drainTarget(
+	filesystemId, node string, placeable map[string]bool, masterCounts map[string]int,
+) (string, bool) {
+	s.globalSnapshotCacheLock.Lock()
+	defer s.globalSnapshotCacheLock.Unlock()
+	masterSnaps := (*s.globalSnapshotCache)[node][filesystemId]
+	position := map[string]int{}
+	candidates := []string{}
+	for server := range placeable {
+		if server == node {
+			continue
+		}
+		position[server] = latestCommonPosition(
+			masterSnaps, (*s.globalSnapshotCache)[server][filesystemId],
+		)
+		candidates = append(candidates, server)
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if position[a] != position[b] {
+			return position[a] > position[b]
+		}
+		if masterCounts[a] != masterCounts[b] {
+			return masterCounts[a] < masterCounts[b]
+		}
+		return a < b
+	})
+	return candidates[0], true
+}
+
+func (s *InMemoryState) drainStatus(node string) DrainStatus {
+	status := DrainStatus{Draining: s.isDraining(node)}
+	placeable := s.placeableServers()
+	masters := map[string]string{}
+	s.mastersCacheLock.Lock()
+	for fs, master := range *s.mastersCache {
+		masters[fs] = master
+	}
+	s.mastersCacheLock.Unlock()
+
+	for fs, master := range masters {
+		if master == node {
+			status.Masters++
+			continue
+		}
+		want := s.replicationFactorFor(fs)
+		if want == 0 || want > len(placeable) {
+			want = len(placeable)
+		}
+		s.globalSnapshotCacheLock.Lock()
+		has := len((*s.globalSnapshotCache)[node][fs]) > 0
+		masterSnaps := (*s.globalSnapshotCache)[master][fs]
+		upToDate := 0
+		for server := range placeable {
+			snaps := (*s.globalSnapshotCache)[server][fs]
+			if len(masterSnaps) > 0 && latestCommonPosition(masterSnaps, snaps) == len(masterSnaps)-1 {
+				upToDate++
+			}
+		}
+		s.globalSnapshotCacheLock.Unlock()
+		if has && upToDate < want {
+			status.CatchingUp++
+		}
+	}
+	return status
+}
+
+// Forget everything about a node which has been drained and stopped.
+func (s *InMemoryState) removeNode(node string) error {
+	if node == s.myNodeId {
+		return fmt.Errorf("This node (%s) can't remove itself, please ask another one", node)
+	}
+	if s.liveServers()[node] {
+		return fmt.Errorf("%s is still running, please stop it first", node)
+	}
+	if masters := s.drainStatus(node).Masters; masters > 0 {
+		return fmt.Errorf(
+			"%s is still the master of %d dots, please drain it first", node, masters,
+		)
+	}
+
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	holder, err := nodeCAHolder(kapi)
+	if err != nil {
+		return err
+	}
+	if holder == node {
+		return fmt.Errorf(
+			"%s holds the node CA's key, without which the cluster can't issue "+
+				"node certificates, so it can't be removed", node,
+		)
+	}
+	// so that nobody who gets hold of its certificate can pass for it
+	err = forgetNodeCertificates(kapi, node)
+	if err != nil {
+		return err
+	}
+	// delete the keys underneath one by one, rather than the directories
+	// themselves, which fetchAndWatchEtcd doesn't expect to see go
+	for _, records := range []string{"snapshots", "states", "fenced"} {
+		resp, err := kapi.Get(
+			context.Background(),
+			fmt.Sprintf("%s/servers/%s/%s", ETCD_PREFIX, records, node),
+			&client.GetOptions{Recursive: true},
+		)
+		if client.IsKeyNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, child := range resp.Node.Nodes {
+			_, err = kapi.Delete(context.Background(), child.Key, nil)
+			if err != nil && !client.IsKeyNotFound(err) {
+				return err
+			}
+		}
+	}
+	// its etcd server would otherwise still count towards the quorum
+	statuses, err := nodeStatuses()
+	if err != nil {
+		return err
+	}
+	if member := statuses[node].EtcdMember; member != "" {
+		err = removeEtcdMember(member)
+		if err != nil {
+			return fmt.Errorf("Unable to remove %s's etcd member %s: %s", node, member, err)
+		}
+		log.Printf("[removeNode] Removed %s's etcd member %s", node, member)
+	}
+	// last of all, so that the other nodes forget it once the rest has gone
+	for _, records := range []string{"draining", "status", "addresses"} {
+		_, err = kapi.Delete(
+			context.Background(),
+			fmt.Sprintf("%s/servers/%s/%s", ETCD_PREFIX, records, node),
+			nil,
+		)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	s.forgetServer(node)
+	log.Printf("[removeNode] Removed %s", node)
+	return nil
+}
+
+// Drop a node which has been removed from the cluster from our caches.
+func (s *InMemoryState) forgetServer(server string) {
+	s.serverAddressesCacheLock.Lock()
+	delete(*s.serverAddressesCache, server)
+	s.serverAddressesCacheLock.Unlock()
+
+	s.globalSnapshotCacheLock.Lock()
+	delete(*s.globalSnapshotCache, server)
+	s.globalSnapshotCacheLock.Unlock()
+
+	s.globalStateCacheLock.Lock()
+	delete(*s.globalStateCache, server)
+	s.globalStateCacheLock.Unlock()
+
+	s.drainingServersLock.Lock()
+	delete(*s.drainingServers, server)
+	s.drainingServersLock.Unlock()
+}
@@ -0,0 +1,146 @@
+package main
+
+// Master epochs, as fencing tokens.
+//
+// Every time a filesystem is assigned a master, by a write to
+// filesystems/masters/:filesystem, the key's ModifiedIndex goes up: that's
+// the filesystem's master epoch. Every node caches the epoch along with the
+// master, and requests to a filesystem's master (see globalFsRequestId) carry
+// the epoch the requester knew about.
+//
+// Before a master changes a filesystem (snapshotting it, rolling it back or
+// receiving into it), it checks with a quorum read that it's still the master,
+// so that a node cut off from the rest of the cluster refuses to rather than
+// carrying on as a second master, and refuses requests made at an older epoch
+// than the current one. A master which sees the filesystem given to
+// another node at a newer epoch, whether then or through the watch on
+// filesystems/masters, demotes itself straight away by fencing the filesystem
+// (see fence in statemachines.go), rather than only unmounting it, which it
+// can't while containers are using it. Replicas check the same way that the
+// node they're about to receive from is still the master.
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func (s *InMemoryState) masterEpochFor(filesystemId string) uint64 {
+	s.mastersCacheLock.Lock()
+	defer s.mastersCacheLock.Unlock()
+	return (*s.masterEpochsCache)[filesystemId]
+}
+
+// Ask the metadata store which node is master of a filesystem, and as of
+// which epoch, updating our cache.
+func (s *InMemoryState) confirmMaster(filesystemId string) (string, uint64, error) {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return "", 0, err
+	}
+	// a quorum read, so that being cut off from the rest of the cluster
+	// means an error rather than stale news
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/masters/%s", ETCD_PREFIX, filesystemId),
+		&client.GetOptions{Quorum: true},
+	)
+	if err != nil {
+		return "", 0, err
+	}
+	s.mastersCacheLock.Lock()
+	defer s.mastersCacheLock.Unlock()
+	(*s.mastersCache)[filesystemId] = resp.Node.Value
+	(*s.masterEpochsCache)[filesystemId] = resp.Node.ModifiedIndex
+	return resp.Node.Value, resp.Node.ModifiedIndex, nil
+}
+
+// The epoch a request to a filesystem's master was made at, or 0 if the
+// requester didn't know.
+func requestedMasterEpoch(e *Event) uint64 {
+	if e.Args == nil {
+		return 0
+	}
+	switch epoch := (*e.Args)["masterEpoch"].(type) {
+	case float64:
+		// having been through json
+		return uint64(epoch)
+	case uint64:
+		return epoch
+	}
+	return 0
+}
+
+// What to do about a request to change a filesystem.
+type epochVerdict int
+
+const (
+	actOnRequest epochVerdict = iota
+	// we're still the master, but the request was made of an earlier one
+	refuseStaleRequest
+	// another node is the master now
+	refuseAndFence
+)
+
+// Judge a request made at the requested master epoch (0 if the requester
+// didn't know), now that master has been the master since epoch.
+func judgeMasterEpoch(myNodeId, master string, epoch, requested uint64) epochVerdict {
+	if master != myNodeId {
+		return refuseAndFence
+	}
+	if requested != 0 && requested < epoch {
+		// e.g. made of us before the filesystem was failed over and back,
+		// so it may have been decided on what we had then
+		return refuseStaleRequest
+	}
+	return actOnRequest
+}
+
+// Make sure we're still the master before acting on a request to change the
+// filesystem, and that the request was made of us as the current master.
+// Returns nil if so, or else the response to the request and the state to go
+// to next, having fenced the filesystem if another node is master now.
+func (f *fsMachine) checkMasterEpoch(e *Event) (*Event, stateFn) {
+	known := f.state.masterEpochFor(f.filesystemId)
+	requested := requestedMasterEpoch(e)
+	master, epoch, err := f.state.confirmMaster(f.filesystemId)
+	if err != nil {
+		log.Printf(
+			"[checkMasterEpoch] Refusing %s on %s, unable to confirm we're still master: %s",
+			e.Name, f.filesystemId, err,
+		)
+		return &Event{
+			Name: "cant-confirm-master",
+			Args: &EventArgs{"err": err, "requestedEpoch": requested},
+		}, backoffState
+	}
+	switch judgeMasterEpoch(f.state.myNodeId, master, epoch, requested) {
+	case actOnRequest:
+		return nil, nil
+	case refuseStaleRequest:
+		log.Printf(
+			"[checkMasterEpoch] Refusing %s on %s, made at epoch %d but we've been "+
+				"master since epoch %d",
+			e.Name, f.filesystemId, requested, epoch,
+		)
+		return &Event{
+			Name: "stale-master-epoch",
+			Args: &EventArgs{"epoch": epoch, "requestedEpoch": requested},
+		}, activeState
+	}
+	log.Printf(
+		"[checkMasterEpoch] Refusing %s on %s, %s has been master since epoch %d "+
+			"(we knew of %d, the request of %d); demoting ourselves",
+		e.Name, f.filesystemId, master, epoch, known, requested,
+	)
+	response, nextState := f.fence()
+	if response.Name != "fenced" {
+		log.Printf("[checkMasterEpoch] Unable to fence %s: %s", f.filesystemId, response)
+	}
+	return &Event{
+		Name: "superseded-master",
+		Args: &EventArgs{"master": master, "epoch": epoch},
+	}, nextState
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func TestJudgeMasterEpoch(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		master    string // who the metadata store says is master now
+		epoch     uint64 // since when
+		requested uint64
+		expected  epochVerdict
+	}{
+		{"current", "me", 7, 7, actOnRequest},
+		{"requester didn't know", "me", 7, 0, actOnRequest},
+		{"made of an earlier master", "me", 7, 3, refuseStaleRequest},
+		// we were failed over while we were gone, and a write request that
+		// was made of us before then turns up when we come back
+		{"old master comes back to an old request", "other", 9, 7, refuseAndFence},
+		// or one made of the new master which we still think is ours
+		{"old master comes back to a new request", "other", 9, 9, refuseAndFence},
+		{"old master comes back to an unknown request", "other", 9, 0, refuseAndFence},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			verdict := judgeMasterEpoch("me", c.master, c.epoch, c.requested)
+			if verdict != c.expected {
+				t.Errorf("expected %d, got %d", c.expected, verdict)
+			}
+		})
+	}
+}
+
+func newRequestingState(master string, epoch uint64) *InMemoryState {
+	return &InMemoryState{
+		myNodeId:                 "requester",
+		mastersCache:             &map[string]string{"fs": master},
+		masterEpochsCache:        &map[string]uint64{"fs": epoch},
+		mastersCacheLock:         &sync.Mutex{},
+		serverAddressesCache:     &map[string]string{master: "10.0.0.1"},
+		serverAddressesCacheLock: &sync.Mutex{},
+	}
+}
+
+// Act as the master of fs for the next request, answering it as a master at
+// the given epoch would.
+func answerRequest(t *testing.T, store MetadataStore, master string, epoch uint64) {
+	watcher := store.Watcher(
+		ETCD_PREFIX+"/filesystems/requests/fs", &client.WatcherOptions{Recursive: true},
+	)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		resp, err := watcher.Next(ctx)
+		if err != nil {
+			t.Errorf("error waiting for the request: %s", err)
+			return
+		}
+		request, err := (&InMemoryState{}).deserializeEvent(resp.Node)
+		if err != nil {
+			t.Errorf("error decoding the request: %s", err)
+			return
+		}
+		response := `{"Name":"snapshotted"}`
+		switch judgeMasterEpoch(master, master, epoch, requestedMasterEpoch(request)) {
+		case refuseStaleRequest:
+			response = `{"Name":"stale-master-epoch"}`
+		case refuseAndFence:
+			response = `{"Name":"superseded-master"}`
+		}
+		pieces := strings.Split(resp.Node.Key, "/")
+		store.Set(context.Background(), responseKey("fs", pieces[len(pieces)-1]), response, nil)
+	}()
+}
+
+func TestRequestCarriesMasterEpoch(t *testing.T) {
+	metadataStore = newMemoryStore()
+	defer func() { metadataStore = nil }()
+
+	for _, c := range []struct {
+		name     string
+		known    uint64 // the epoch the requester knows of
+		current  uint64 // the master's
+		expected string
+	}{
+		{"current", 7, 7, "snapshotted"},
+		{"stale", 3, 7, "stale-master-epoch"},
+		{"unknown", 0, 7, "snapshotted"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := newRequestingState("master", c.known)
+			answerRequest(t, metadataStore, "master", c.current)
+
+			args := EventArgs{"metadata": metadata{"message": "hello"}}
+			e := &Event{Name: "snapshot", Args: &args}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			responses, err := s.globalFsRequestContext(ctx, "fs", e)
+			if err != nil {
+				t.Fatalf("error making the request: %s", err)
+			}
+			if response := <-responses; response.Name != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, response)
+			}
+			if _, ok := args["masterEpoch"]; ok || len(args) != 1 {
+				t.Errorf("expected the caller's args to be left alone, got %s", args)
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -21,14 +22,6 @@ import (
 
 // etcd related pieces, including the parts of InMemoryState which interact with etcd
 
-func getEtcdKeysApi() (client.KeysAPI, error) {
-	c, err := getEtcd()
-	if err != nil {
-		return nil, err
-	}
-	return client.NewKeysAPI(c), nil
-}
-
 var etcdClient client.Client
 var once Once
 var onceAgain Once
@@ -72,10 +65,7 @@ func getEtcd() (client.Client, error) {
 		if endpoint[:5] == "https" {
 			// only try to fetch PKI gubbins if we're creating an encrypted
 			// connection.
-			pkiPath := os.Getenv("DOTMESH_PKI_PATH")
-			if pkiPath == "" {
-				pkiPath = "/pki"
-			}
+			pkiPath := getPkiPath()
 			transport, err = transportFromTLS(
 				fmt.Sprintf("%s/apiserver.pem", pkiPath),
 				fmt.Sprintf("%s/apiserver-key.pem", pkiPath),
@@ -133,6 +123,66 @@ func guessIPv4Addresses() ([]string, error) {
 	return addresses, nil
 }
 
+// The id of the etcd member running alongside us, which is the one whose
+// peer URLs are on one of our addresses, or "" if there isn't one (e.g. on
+// Kubernetes, where etcd runs elsewhere).
+func localEtcdMember() (string, error) {
+	if metadataStore != nil {
+		return "", nil
+	}
+	addresses, err := guessIPv4Addresses()
+	if err != nil {
+		return "", err
+	}
+	c, err := getEtcd()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	members, err := client.NewMembersAPI(c).List(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, member := range members {
+		for _, peerURL := range member.PeerURLs {
+			u, err := url.Parse(peerURL)
+			if err != nil {
+				continue
+			}
+			for _, address := range addresses {
+				if u.Hostname() == address {
+					return member.ID, nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// Remove a member from the etcd cluster, so that it no longer counts towards
+// its quorum.
+func removeEtcdMember(id string) error {
+	c, err := getEtcd()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	membersApi := client.NewMembersAPI(c)
+	members, err := membersApi.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.ID == id {
+			return membersApi.Remove(ctx, id)
+		}
+	}
+	// someone beat us to it
+	return nil
+}
+
 // etcd listener
 func (state *InMemoryState) updateAddressesInEtcd() error {
 	addresses, err := guessIPv4Addresses()
@@ -140,7 +190,7 @@ func (state *InMemoryState) updateAddressesInEtcd() error {
 		return err
 	}
 
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -158,7 +208,7 @@ func (state *InMemoryState) updateAddressesInEtcd() error {
 }
 
 func isFilesystemDeletedInEtcd(fsId string) (bool, error) {
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return false, err
 	}
@@ -189,7 +239,7 @@ func (state *InMemoryState) markFilesystemAsDeletedInEtcd(
 	name VolumeName,
 	tlFsId, branch string,
 ) error {
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -258,7 +308,7 @@ type NameOrClone struct {
 }
 
 func (state *InMemoryState) cleanupDeletedFilesystems() error {
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -284,6 +334,19 @@ func (state *InMemoryState) cleanupDeletedFilesystems() error {
 		del(fmt.Sprintf("%s/filesystems/containers/%s", ETCD_PREFIX, fsId))
 		del(fmt.Sprintf("%s/filesystems/dirty/%s", ETCD_PREFIX, fsId))
 		del(fmt.Sprintf("%s/filesystems/masters/%s", ETCD_PREFIX, fsId))
+		del(fmt.Sprintf("%s/filesystems/replicas/%s", ETCD_PREFIX, fsId))
+		del(fmt.Sprintf("%s/filesystems/replication/%s", ETCD_PREFIX, fsId))
+		for _, mirrorId := range state.mirrorsFor(fsId) {
+			del(fmt.Sprintf("%s/filesystems/mirrors/%s", ETCD_PREFIX, mirrorId))
+		}
+		_, err = kapi.Delete(
+			context.Background(),
+			fmt.Sprintf("%s/filesystems/remotes/%s", ETCD_PREFIX, fsId),
+			&client.DeleteOptions{Recursive: true},
+		)
+		if err != nil && !client.IsKeyNotFound(err) {
+			errors = append(errors, err)
+		}
 
 		if names.Name.Namespace != "" && names.Name.Name != "" {
 			// The name might be blank in the audit trail - this is used
@@ -356,7 +419,7 @@ func (state *InMemoryState) cleanupDeletedFilesystems() error {
 }
 
 // The result is a map from filesystem ID to the VolumeName or branch name it once had.
-func listFilesystemsPendingCleanup(kapi client.KeysAPI) (map[string]NameOrClone, error) {
+func listFilesystemsPendingCleanup(kapi MetadataStore) (map[string]NameOrClone, error) {
 	// list ETCD_PREFIX/filesystems/cleanupPending/ID without corresponding
 	// ETCD_PREFIX/filesystems/live/ID
 
@@ -410,7 +473,7 @@ func listFilesystemsPendingCleanup(kapi client.KeysAPI) (map[string]NameOrClone,
 }
 
 func (state *InMemoryState) markFilesystemAsLiveInEtcd(topLevelFilesystemId string) error {
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -473,7 +536,9 @@ func (s *InMemoryState) dispatchEvent(
 	return rc, nil
 }
 
-func (s *InMemoryState) handleOneFilesystemMaster(node *client.Node) error {
+// Mount or unmount a filesystem according to who its master is now, or if we
+// were master until now, fence it (see epochs.go).
+func (s *InMemoryState) handleOneFilesystemMaster(node *client.Node, demote bool) error {
 	if node.Value == "" {
 		// The filesystem is being deleted, and we need do nothing about it
 	} else {
@@ -489,6 +554,12 @@ func (s *InMemoryState) handleOneFilesystemMaster(node *client.Node) error {
 			if err != nil {
 				return err
 			}
+		} else if demote {
+			log.Printf("FENCING: %s=%s at epoch %d", fs, node.Value, node.ModifiedIndex)
+			responseChan, err = s.dispatchEvent(fs, &Event{Name: "fence"}, requestId)
+			if err != nil {
+				return err
+			}
 		} else {
 			log.Printf("UNMOUNTING: %s=%s", fs, node.Value)
 			responseChan, err = s.dispatchEvent(fs, &Event{Name: "unmount"}, requestId)
@@ -524,99 +595,6 @@ func (s *InMemoryState) handleOneFilesystemDeletion(node *client.Node) error {
 	return nil
 }
 
-// make a global request, returning its id
-func (s *InMemoryState) globalFsRequestId(fs string, e *Event) (chan *Event, string, error) {
-	id, err := uuid.NewV4()
-	if err != nil {
-		return nil, "", err
-	}
-	requestId := id.String()
-	kapi, err := getEtcdKeysApi()
-	if err != nil {
-		return nil, "", err
-	}
-	log.Printf("globalFsRequest %s %s", fs, e)
-	serialized, err := s.serializeEvent(e)
-	if err != nil {
-		log.Printf("globalFsRequest - error serializing %s: %s", e, err)
-		return nil, "", err
-	}
-	log.Printf("globalFsRequest: setting '%s' to '%s'",
-		fmt.Sprintf("%s/filesystems/requests/%s/%s", ETCD_PREFIX, fs, requestId),
-		serialized,
-	)
-	resp, err := kapi.Set(
-		context.Background(),
-		fmt.Sprintf("%s/filesystems/requests/%s/%s", ETCD_PREFIX, fs, requestId),
-		serialized,
-		&client.SetOptions{PrevExist: client.PrevNoExist, TTL: 604800 * time.Second},
-	)
-	if err != nil {
-		log.Printf("globalFsRequest - error setting: %s", e, err)
-		return nil, "", err
-	}
-	responseChan := make(chan *Event)
-	go func() {
-		// TODO become able to cope with becoming disconnected from etcd and
-		// then reconnecting and pick up where we left off (process any new
-		// responses)...
-		watcher := kapi.Watcher(
-			// TODO maybe responses should get their own IDs, so that there can be
-			// multiple responses to a given event (at present we just assume one)
-			fmt.Sprintf("%s/filesystems/responses/%s/%s", ETCD_PREFIX, fs, requestId),
-			&client.WatcherOptions{AfterIndex: resp.Node.CreatedIndex, Recursive: true},
-		)
-		node, err := watcher.Next(context.Background())
-		if err != nil {
-			responseChan <- &Event{
-				Name: "error-watcher-next", Args: &EventArgs{"err": err},
-			}
-			close(responseChan)
-			return
-		}
-		response, err := s.deserializeEvent(node.Node)
-		if err != nil {
-			responseChan <- &Event{
-				Name: "error-deserialize", Args: &EventArgs{"err": err},
-			}
-			close(responseChan)
-			return
-		}
-		responseChan <- response
-
-		// the one-off response chan has done its job here.
-		close(responseChan)
-		// also clean up the request and response nodes in etcd. (TODO: /not/
-		// doing this might actually be a good way to implement a log of all
-		// actions performed on the system). TODO why are we not doing this at
-		// all any more? Something to do with a race where events showed up
-		// empty. (Actually, empty events correspond to a deletion, ie a TTL
-		// timeout, I think.) Oh and we added a TTL.
-		/*
-			for _, cleanup := range []string{"requests", "responses"} {
-				_, err = kapi.Delete(
-					context.Background(),
-					fmt.Sprintf("%s/filesystems/%s/%s/%s", ETCD_PREFIX, cleanup, fs, requestId),
-					nil,
-				)
-				if err != nil {
-					log.Printf("Error while trying to cleanup %s %s %s: %s", cleanup, fs, requestId, err)
-				}
-			}
-		*/
-
-	}()
-	return responseChan, id.String(), nil
-}
-
-// attempt to register an event in etcd upon which the current master for that
-// filesystem will act on it and then respond
-func (s *InMemoryState) globalFsRequest(fs string, e *Event) (chan *Event, error) {
-	c, _, err := s.globalFsRequestId(fs, e)
-	// throw away id
-	return c, err
-}
-
 func (s *InMemoryState) serializeEvent(e *Event) (string, error) {
 	response, err := json.Marshal(e)
 	if err != nil {
@@ -635,7 +613,7 @@ func (s *InMemoryState) deserializeEvent(node *client.Node) (*Event, error) {
 	return e, nil
 }
 
-func (s *InMemoryState) deserializeDispatchAndRespond(fs string, node *client.Node, kapi client.KeysAPI) error {
+func (s *InMemoryState) deserializeDispatchAndRespond(fs string, node *client.Node, kapi MetadataStore) error {
 	// TODO 2-phase commit to avoid doubling up events after
 	// reading them, performing them, and then getting disconnected
 	// before cleaning them up?
@@ -646,12 +624,18 @@ func (s *InMemoryState) deserializeDispatchAndRespond(fs string, node *client.No
 	pieces := strings.Split(node.Key, "/")
 	requestId := pieces[len(pieces)-1]
 
+	// check that the requester hasn't given up on it already, or cleaned up
+	// after it while we were catching up. if so, do nothing.
+	_, err = kapi.Get(context.Background(), requestKey(fs, requestId), nil)
+	if client.IsKeyNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
 	// check that there isn't a stale response already. if so, do nothing.
-	_, err = kapi.Get(
-		context.Background(),
-		fmt.Sprintf("%s/filesystems/responses/%s/%s", ETCD_PREFIX, fs, requestId),
-		nil,
-	)
+	_, err = kapi.Get(context.Background(), responseKey(fs, requestId), nil)
 	if err == nil {
 		// OK, there's a stale response. Leave it alone and don't re-perform
 		// the action. But this is not an error (don't error out and reconnect
@@ -699,14 +683,23 @@ func (s *InMemoryState) deserializeDispatchAndRespond(fs string, node *client.No
 		}
 		_, err = kapi.Set(
 			context.Background(),
-			fmt.Sprintf("%s/filesystems/responses/%s/%s", ETCD_PREFIX, fs, requestId),
+			responseKey(fs, requestId),
 			serialized,
-			&client.SetOptions{PrevExist: client.PrevNoExist, TTL: 604800 * time.Second},
+			&client.SetOptions{PrevExist: client.PrevNoExist, TTL: REQUEST_TTL},
 		)
 		if err != nil {
 			log.Printf("Error while setting event response in etcd: %s", err)
 			return
 		}
+		// if the requester gave up on it meanwhile, nothing else will clean
+		// up the response
+		_, err = kapi.Get(context.Background(), requestKey(fs, requestId), nil)
+		if client.IsKeyNotFound(err) {
+			_, err = kapi.Delete(context.Background(), responseKey(fs, requestId), nil)
+			if err != nil && !client.IsKeyNotFound(err) {
+				log.Printf("Error while cleaning up an abandoned event response: %s", err)
+			}
+		}
 	}()
 	return nil
 }
@@ -809,7 +802,8 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 	filesystemBelongsToMe := map[string]bool{}
 
 	// handy inline funcs to avoid duplication
-	updateMine := func(node *client.Node) {
+	// returns whether we were master until now, and need to demote ourselves
+	updateMine := func(node *client.Node) bool {
 		// (0)/(1)dotmesh.io/(2)servers/(3)masters/(4):filesystem = master
 		pieces := strings.Split(node.Key, "/")
 		fs := pieces[4]
@@ -817,17 +811,23 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 		s.mastersCacheLock.Lock()
 		defer s.mastersCacheLock.Unlock()
 
+		// from the cache rather than filesystemBelongsToMe, so that we find
+		// out when we reconnect after being cut off
+		wasMine := (*s.mastersCache)[fs] == s.myNodeId
 		if node.Value == "" {
 			delete(*s.mastersCache, fs)
+			delete(*s.masterEpochsCache, fs)
 			delete(filesystemBelongsToMe, fs)
 		} else {
 			(*s.mastersCache)[fs] = node.Value
+			(*s.masterEpochsCache)[fs] = node.ModifiedIndex
 			if node.Value == s.myNodeId {
 				filesystemBelongsToMe[fs] = true
 			} else {
 				filesystemBelongsToMe[fs] = false
 			}
 		}
+		return wasMine && node.Value != "" && node.Value != s.myNodeId
 	}
 	updateAddresses := func(node *client.Node) error {
 		// (0)/(1)dotmesh.io/(2)servers/(3)addresses/(4):server = addresses
@@ -1014,6 +1014,7 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 			s.interclusterTransfersLock.Lock()
 			defer s.interclusterTransfersLock.Unlock()
 			delete(*s.interclusterTransfers, transferId)
+			forgetPollResult(transferId)
 		} else {
 			err := json.Unmarshal([]byte(node.Value), transferInfo)
 			if err != nil {
@@ -1022,10 +1023,70 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 			s.interclusterTransfersLock.Lock()
 			defer s.interclusterTransfersLock.Unlock()
 			(*s.interclusterTransfers)[transferId] = *transferInfo
+			publishPollResult(transferId, *transferInfo, false)
+		}
+		return nil
+	}
+	updateMirrors := func(node *client.Node) error {
+		// (0)/(1)dotmesh.io/(2)filesystems/
+		//     (3)mirrors/(4):mirrorId = mirror
+		pieces := strings.Split(node.Key, "/")
+		mirrorId := pieces[4]
+		if node.Value == "" {
+			s.updateMirrorFromEtcd(mirrorId, nil)
+		} else {
+			mirror := &Mirror{}
+			err := json.Unmarshal([]byte(node.Value), mirror)
+			if err != nil {
+				return err
+			}
+			s.updateMirrorFromEtcd(mirrorId, mirror)
+		}
+		return nil
+	}
+	updateReplicationFactor := func(node *client.Node) error {
+		// (0)/(1)dotmesh.io/(2)filesystems/
+		//     (3)replication/(4):topLevelFilesystemId = factor
+		pieces := strings.Split(node.Key, "/")
+		factor := 0
+		if node.Value != "" {
+			var err error
+			factor, err = strconv.Atoi(node.Value)
+			if err != nil {
+				return err
+			}
+		}
+		s.updateReplicationFactorFromEtcd(pieces[4], factor)
+		return nil
+	}
+	updateReplicas := func(node *client.Node) error {
+		// (0)/(1)dotmesh.io/(2)filesystems/
+		//     (3)replicas/(4):filesystem = ["node", ...]
+		pieces := strings.Split(node.Key, "/")
+		var replicas []string
+		if node.Value != "" {
+			replicas = []string{}
+			err := json.Unmarshal([]byte(node.Value), &replicas)
+			if err != nil {
+				return err
+			}
 		}
+		s.updateReplicasFromEtcd(pieces[4], replicas)
 		return nil
 	}
-	var kapi client.KeysAPI
+	updateDraining := func(node *client.Node) error {
+		// (0)/(1)dotmesh.io/(2)servers/(3)draining/(4):server = since
+		pieces := strings.Split(node.Key, "/")
+		s.drainingServersLock.Lock()
+		defer s.drainingServersLock.Unlock()
+		if node.Value == "" {
+			delete(*s.drainingServers, pieces[4])
+		} else {
+			(*s.drainingServers)[pieces[4]] = true
+		}
+		return nil
+	}
+	var kapi MetadataStore
 	maybeDispatchEvent := func(node *client.Node) error {
 		// (0)/(1)dotmesh.io/(2)filesystems/
 		//     (3)requests/(4):filesystem/(5):request_id = request
@@ -1050,7 +1111,7 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 		return ""
 	}
 
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -1074,6 +1135,10 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 	var filesystemsContainers *client.Node
 	var interclusterTransfers *client.Node
 	var dirtyFilesystems *client.Node
+	var filesystemsMirrors *client.Node
+	var replicationFactors *client.Node
+	var filesystemsReplicas *client.Node
+	var drainingServers *client.Node
 	for _, parent := range current.Node.Nodes {
 		// need to iterate in...
 
@@ -1084,15 +1149,9 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 		// cluster so we avoid ever keeping the whole thing anywhere
 		// other than in etcd (and even there it might require pruning
 		// in future); and cleanupNeeded and live are polled for in the
-		// cleanupDeletedFilesystems goroutine. We could, if needed,
-		// rewrite that to make the watcher notice "live" nodes
-		// disappearing and check for a corresponding "cleanupNeeded"
-		// and trigger cleanup, but that makes it almost certain that
-		// multiple nodes (indeed, all nodes) will attempt to do the
-		// cleanup - polling makes it most likely that one random node
-		// will do any given cleanup, avoiding waste without the cost of
-		// an explicit distributed transaction to ensure exactly one
-		// node does it.
+		// cleanupDeletedFilesystems goroutine, which only the leader
+		// runs (see leader.go), so that only one node does any given
+		// cleanup.
 		for _, child := range parent.Nodes {
 			if getVariant(child) == "filesystems/masters" {
 				masters = child
@@ -1112,6 +1171,14 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 				interclusterTransfers = child
 			} else if getVariant(child) == "filesystems/dirty" {
 				dirtyFilesystems = child
+			} else if getVariant(child) == "filesystems/mirrors" {
+				filesystemsMirrors = child
+			} else if getVariant(child) == "filesystems/replication" {
+				replicationFactors = child
+			} else if getVariant(child) == "filesystems/replicas" {
+				filesystemsReplicas = child
+			} else if getVariant(child) == "servers/draining" {
+				drainingServers = child
 			}
 		}
 	}
@@ -1125,8 +1192,8 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 	}
 	if masters != nil {
 		for _, node := range masters.Nodes {
-			updateMine(node)
-			if err = s.handleOneFilesystemMaster(node); err != nil {
+			demote := updateMine(node)
+			if err = s.handleOneFilesystemMaster(node, demote); err != nil {
 				return err
 			}
 		}
@@ -1201,6 +1268,34 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 			}
 		}
 	}
+	if filesystemsMirrors != nil {
+		for _, node := range filesystemsMirrors.Nodes {
+			if err = updateMirrors(node); err != nil {
+				return err
+			}
+		}
+	}
+	if replicationFactors != nil {
+		for _, node := range replicationFactors.Nodes {
+			if err = updateReplicationFactor(node); err != nil {
+				return err
+			}
+		}
+	}
+	if filesystemsReplicas != nil {
+		for _, node := range filesystemsReplicas.Nodes {
+			if err = updateReplicas(node); err != nil {
+				return err
+			}
+		}
+	}
+	if drainingServers != nil {
+		for _, node := range drainingServers.Nodes {
+			if err = updateDraining(node); err != nil {
+				return err
+			}
+		}
+	}
 	// now that our state is initialized, maybe we're in a good place to
 	// interrogate docker for running containers as part of initial
 	// bootstrap, and also start the docker plugin
@@ -1235,8 +1330,8 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 		}
 		variant := getVariant(node.Node)
 		if variant == "filesystems/masters" {
-			updateMine(node.Node)
-			if err = s.handleOneFilesystemMaster(node.Node); err != nil {
+			demote := updateMine(node.Node)
+			if err = s.handleOneFilesystemMaster(node.Node, demote); err != nil {
 				return err
 			}
 		} else if variant == "filesystems/deleted" {
@@ -1244,6 +1339,11 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 				return err
 			}
 		} else if variant == "filesystems/requests" {
+			// requests are deleted once the requester is done with them, or
+			// expire if it gives up, neither of which is a new request
+			if node.Action == "delete" || node.Action == "expire" {
+				continue
+			}
 			if err = maybeDispatchEvent(node.Node); err != nil {
 				return err
 			}
@@ -1251,6 +1351,10 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 			if err = updateAddresses(node.Node); err != nil {
 				return err
 			}
+			if node.Action == "delete" {
+				// rather than expiring, it's been removed from the cluster
+				s.forgetServer(strings.Split(node.Node.Key, "/")[4])
+			}
 		} else if variant == "servers/snapshots" {
 			if err = updateSnapshots(node.Node); err != nil {
 				return err
@@ -1279,6 +1383,22 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 			if err = updateTransfers(node.Node); err != nil {
 				return err
 			}
+		} else if variant == "filesystems/mirrors" {
+			if err = updateMirrors(node.Node); err != nil {
+				return err
+			}
+		} else if variant == "filesystems/replication" {
+			if err = updateReplicationFactor(node.Node); err != nil {
+				return err
+			}
+		} else if variant == "filesystems/replicas" {
+			if err = updateReplicas(node.Node); err != nil {
+				return err
+			}
+		} else if variant == "servers/draining" {
+			if err = updateDraining(node.Node); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -0,0 +1,360 @@
+package main
+
+// Automatic failover.
+//
+// A node's servers/addresses key expires a minute after it stops refreshing
+// it. If a node which is the master of some filesystems stays gone for longer
+// than DOTMESH_FAILOVER_GRACE_PERIOD (five minutes by default, "off" to
+// disable), the leader (see leader.go) promotes the most up-to-date replica
+// of every one of them on a live node, with a compare-and-swap on
+// filesystems/masters in case someone else has moved it meanwhile. It
+// records under servers/fenced/:node/:filesystem that the old master has lost
+// the filesystem, and a FailoverEvent under failovers/ for operators (see `dm
+// cluster failovers`).
+//
+// If the old master comes back, it fences each such filesystem: it stops the
+// containers using it, keeps any commits the new master doesn't have
+// (including any uncommitted changes) on a new branch, and unmounts it, so
+// that it can carry on as a replica.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const DEFAULT_FAILOVER_GRACE_PERIOD = 5 * time.Minute
+
+// how often to check for masters which have gone, and for filesystems we've
+// lost to failovers
+const FAILOVER_CHECK_INTERVAL = 10 * time.Second
+
+// zero if automatic failover is disabled
+var failoverGracePeriod time.Duration
+
+func loadFailoverGracePeriod() error {
+	setting := os.Getenv("DOTMESH_FAILOVER_GRACE_PERIOD")
+	switch setting {
+	case "":
+		failoverGracePeriod = DEFAULT_FAILOVER_GRACE_PERIOD
+	case "off":
+		failoverGracePeriod = 0
+	default:
+		gracePeriod, err := time.ParseDuration(setting)
+		if err != nil || gracePeriod <= 0 {
+			return fmt.Errorf(
+				"Invalid DOTMESH_FAILOVER_GRACE_PERIOD %q, expected e.g. 5m, or off", setting,
+			)
+		}
+		failoverGracePeriod = gracePeriod
+	}
+	return nil
+}
+
+type FailoverEvent struct {
+	FilesystemId string
+	Name         VolumeName
+	Branch       string
+	From         string // the node which was master
+	To           string // the node whose replica was promoted
+	SnapshotId   string // the new master's latest commit
+	LostCommits  int    // how many of the old master's commits the new one lacked
+	At           int64  // unix timestamp
+}
+
+// when we noticed that each master had gone, and which filesystems we've
+// already complained have no replica to fail over to
+var goneMasters = struct {
+	sync.Mutex
+	since    map[string]time.Time
+	stranded map[string]bool
+}{
+	since:    map[string]time.Time{},
+	stranded: map[string]bool{},
+}
+
+// The nodes whose addresses keys haven't expired, and us.
+func (s *InMemoryState) liveServers() map[string]bool {
+	live := map[string]bool{s.myNodeId: true}
+	s.serverAddressesCacheLock.Lock()
+	defer s.serverAddressesCacheLock.Unlock()
+	for server, addresses := range *s.serverAddressesCache {
+		if addresses != "" {
+			live[server] = true
+		}
+	}
+	return live
+}
+
+// Promote replicas of the filesystems whose masters have been gone for longer
+// than the grace period.
+func (s *InMemoryState) failOverGoneMasters() error {
+	live := s.liveServers()
+	orphaned := map[string][]string{}
+	s.mastersCacheLock.Lock()
+	for fs, master := range *s.mastersCache {
+		if !live[master] {
+			orphaned[master] = append(orphaned[master], fs)
+		}
+	}
+	s.mastersCacheLock.Unlock()
+
+	due := []string{}
+	goneMasters.Lock()
+	for server := range goneMasters.since {
+		if _, ok := orphaned[server]; !ok {
+			// it's back, or isn't master of anything any more
+			delete(goneMasters.since, server)
+		}
+	}
+	for server, filesystems := range orphaned {
+		since, ok := goneMasters.since[server]
+		if !ok {
+			log.Printf(
+				"[failOverGoneMasters] %s, master of %d filesystems, has gone; "+
+					"failing them over in %s unless it comes back",
+				server, len(filesystems), failoverGracePeriod,
+			)
+			goneMasters.since[server] = time.Now()
+		} else if time.Since(since) >= failoverGracePeriod {
+			due = append(due, server)
+		}
+	}
+	goneMasters.Unlock()
+
+	// every node keeps track of which masters have gone, so that a new
+	// leader knows how long they've been gone for, but only the leader
+	// fails them over
+	if !s.leaderElection.isLeader() {
+		return nil
+	}
+	// not to nodes being drained
+	placeable := s.placeableServers()
+	for _, server := range due {
+		for _, fs := range orphaned[server] {
+			err := s.failOver(fs, server, placeable)
+			if err != nil {
+				log.Printf("[failOverGoneMasters] Unable to fail over %s from %s: %s", fs, server, err)
+			}
+		}
+	}
+	return nil
+}
+
+// The live node with the most up-to-date replica of filesystem: the one whose
+// latest commit in common with the old master is the latest. Returns that
+// commit's id, and how many of the old master's commits come after it.
+func (s *InMemoryState) bestReplica(
+	filesystem, oldMaster string, live map[string]bool,
+) (string, string, int, bool) {
+	s.globalSnapshotCacheLock.Lock()
+	defer s.globalSnapshotCacheLock.Unlock()
+
+	masterSnaps := (*s.globalSnapshotCache)[oldMaster][filesystem]
+
+	// in order, so that every node picks the same one in a tie
+	servers := []string{}
+	for server := range *s.globalSnapshotCache {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	best, bestSnapshotId, bestPosition := "", "", -1
+	for _, server := range servers {
+		if server == oldMaster || !live[server] {
+			continue
+		}
+		snaps, ok := (*s.globalSnapshotCache)[server][filesystem]
+		if !ok || len(snaps) == 0 {
+			continue
+		}
+		if len(masterSnaps) == 0 {
+			// we don't know what the old master had, so the longest history
+			// will have to do
+			if len(snaps)-1 > bestPosition {
+				best, bestSnapshotId, bestPosition = server, snaps[len(snaps)-1].Id, len(snaps)-1
+			}
+			continue
+		}
+		if p := latestCommonPosition(masterSnaps, snaps); p > bestPosition {
+			best, bestSnapshotId, bestPosition = server, masterSnaps[p].Id, p
+		}
+	}
+	if best == "" {
+		return "", "", 0, false
+	}
+	lost := 0
+	if len(masterSnaps) > 0 {
+		lost = len(masterSnaps) - 1 - bestPosition
+	}
+	return best, bestSnapshotId, lost, true
+}
+
+func (s *InMemoryState) failOver(filesystem, oldMaster string, live map[string]bool) error {
+	newMaster, snapshotId, lost, ok := s.bestReplica(filesystem, oldMaster, live)
+	goneMasters.Lock()
+	complained := goneMasters.stranded[filesystem]
+	goneMasters.stranded[filesystem] = !ok
+	goneMasters.Unlock()
+	if !ok {
+		if !complained {
+			log.Printf(
+				"[failOver] No live replica of %s to fail over to from %s, it will "+
+					"stay unavailable until %s comes back", filesystem, oldMaster, oldMaster,
+			)
+		}
+		return nil
+	}
+
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/masters/%s", ETCD_PREFIX, filesystem),
+		newMaster,
+		// only if it's still the old master, otherwise another node beat us
+		// to it (and fenced it), or someone moved it by hand
+		&client.SetOptions{PrevValue: oldMaster},
+	)
+	if err != nil {
+		if isCompareFailed(err) {
+			return nil
+		}
+		return err
+	}
+	// only once it's ours to give away, so that the record names the master
+	// which actually replaced it
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/servers/fenced/%s/%s", ETCD_PREFIX, oldMaster, filesystem),
+		newMaster,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	log.Printf(
+		"[failOver] Promoted %s's replica of %s at %s in place of %s, losing %d commits",
+		newMaster, filesystem, snapshotId, oldMaster, lost,
+	)
+
+	event := FailoverEvent{
+		FilesystemId: filesystem,
+		From:         oldMaster,
+		To:           newMaster,
+		SnapshotId:   snapshotId,
+		LostCommits:  lost,
+		At:           time.Now().Unix(),
+	}
+	tlf, branch, err := s.registry.LookupFilesystemById(filesystem)
+	if err == nil {
+		event.Name = tlf.MasterBranch.Name
+		event.Branch = branch
+	}
+	serialized, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = kapi.CreateInOrder(
+		context.Background(), fmt.Sprintf("%s/failovers", ETCD_PREFIX), string(serialized), nil,
+	)
+	return err
+}
+
+// Every failover so far, oldest first.
+func failoverEvents() ([]FailoverEvent, error) {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/failovers", ETCD_PREFIX),
+		&client.GetOptions{Sort: true},
+	)
+	if client.IsKeyNotFound(err) {
+		return []FailoverEvent{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	events := []FailoverEvent{}
+	for _, node := range resp.Node.Nodes {
+		var event FailoverEvent
+		err = json.Unmarshal([]byte(node.Value), &event)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Fence the filesystems which were failed over to other nodes while we were
+// gone.
+func (s *InMemoryState) fenceFailedOverFilesystems() error {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/servers/fenced/%s", ETCD_PREFIX, s.myNodeId),
+		&client.GetOptions{Recursive: true},
+	)
+	if client.IsKeyNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, node := range resp.Node.Nodes {
+		pieces := strings.Split(node.Key, "/")
+		fs := pieces[len(pieces)-1]
+		master := s.masterFor(fs)
+		if master == "" {
+			// we haven't heard about it yet, or it's been deleted since
+			if deleted, err := isFilesystemDeletedInEtcd(fs); err != nil || !deleted {
+				continue
+			}
+		} else if master != s.myNodeId {
+			if _, err := s.maybeFilesystem(fs); err != nil {
+				// not started up yet
+				continue
+			}
+			responseChan, err := s.dispatchEvent(fs, &Event{Name: "fence"}, "")
+			if err != nil {
+				return err
+			}
+			e := <-responseChan
+			if e.Name != "fenced" {
+				log.Printf("[fenceFailedOverFilesystems] Unable to fence %s: %s", fs, e)
+				continue
+			}
+			log.Printf("[fenceFailedOverFilesystems] Fenced %s, now mastered by %s: %s", fs, master, e)
+		}
+		// done with, or it's been given back to us since
+		_, err = kapi.Delete(
+			context.Background(), node.Key, &client.DeleteOptions{PrevValue: node.Value},
+		)
+		if err != nil && !client.IsKeyNotFound(err) && !isCompareFailed(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func isCompareFailed(err error) bool {
+	etcdErr, ok := err.(client.Error)
+	return ok && etcdErr.Code == client.ErrorCodeTestFailed
+}
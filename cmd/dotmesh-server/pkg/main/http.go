@@ -73,8 +73,15 @@ func (state *InMemoryState) runServer() {
 		),
 	).Methods("POST")
 
+	router.Handle(
+		"/transfers/{transferId}/stream",
+		middleware.FromHTTPRequest(tracer, "transfer-stream")(
+			NewAuthHandler(state.NewTransferStreamingServer()),
+		),
+	).Methods("GET")
+
 	loggedRouter := handlers.LoggingHandler(getLogfile("requests"), router)
-	err = http.ListenAndServe(":6969", loggedRouter)
+	err = serveApi(":6969", loggedRouter)
 	if err != nil {
 		out(fmt.Sprintf("Unable to listen on port 6969: '%s'\n", err))
 		log.Fatalf("Unable to listen on port 6969: '%s'", err)
@@ -123,6 +130,21 @@ func auth(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
 	notAuth := func(w http.ResponseWriter) {
 		http.Error(w, "Unauthorized.", 401)
 	}
+	// other nodes in the cluster present their node certificates instead,
+	// see nodeidentity.go
+	if node, cert, ok := requestingNode(r); ok {
+		err := checkNodeCertificate(node, cert, r.RemoteAddr)
+		if err != nil {
+			log.Printf("[AuthHandler] Refusing node %s: %s", node, err)
+			notAuth(w)
+			return r, fmt.Errorf("Permission denied.")
+		}
+		r = r.WithContext(
+			context.WithValue(context.WithValue(AdminContext(r.Context()), "authenticated-node", node),
+				"password-authenticated", false),
+		)
+		return r, nil
+	}
 	// check for empty username, if so show a login box
 	user, pass, _ := r.BasicAuth()
 	if user == "" {
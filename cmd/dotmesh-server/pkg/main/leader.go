@@ -0,0 +1,135 @@
+package main
+
+// Leader election.
+//
+// Some background jobs only need doing once for the whole cluster, such as
+// cleaning up after deleted filesystems, failing over gone masters and keeping
+// every filesystem's replicas topped up. Rather than every node racing to do
+// them, the nodes elect a leader to do them: the node whose id is in the
+// leader key. A node becomes the leader by creating the key with a TTL of
+// LEADER_TTL when there isn't one, and stays the leader by refreshing it every
+// LEADER_RENEW_INTERVAL, so if the leader goes, the key expires and another
+// node takes over.
+//
+// A leader which can't refresh the key stops acting as the leader once the
+// key could have expired, so that two nodes never both think they're leading.
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const LEADER_TTL = 15 * time.Second
+const LEADER_RENEW_INTERVAL = 5 * time.Second
+
+type leaderElection struct {
+	sync.Mutex
+	key  string
+	node string
+	ttl  time.Duration
+	// as of the last campaign
+	leader string
+	// when the key could expire, if we're the leader
+	until time.Time
+}
+
+func newLeaderElection(key, node string, ttl time.Duration) *leaderElection {
+	return &leaderElection{key: key, node: node, ttl: ttl}
+}
+
+func isNodeExist(err error) bool {
+	etcdErr, ok := err.(client.Error)
+	return ok && etcdErr.Code == client.ErrorCodeNodeExist
+}
+
+// Become the leader if there isn't one, or stay the leader if we are, finding
+// out who is otherwise. Call more often than the TTL.
+func (e *leaderElection) campaign() error {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	e.Lock()
+	leading := e.leader == e.node
+	e.Unlock()
+
+	// the key can't expire until at least a TTL after we ask
+	start := time.Now()
+	if leading {
+		_, err = kapi.Set(
+			context.Background(), e.key, e.node,
+			&client.SetOptions{PrevValue: e.node, TTL: e.ttl},
+		)
+	}
+	if !leading || client.IsKeyNotFound(err) {
+		_, err = kapi.Set(
+			context.Background(), e.key, e.node,
+			&client.SetOptions{PrevExist: client.PrevNoExist, TTL: e.ttl},
+		)
+	}
+	if err == nil {
+		e.Lock()
+		defer e.Unlock()
+		if !leading {
+			log.Printf("[campaign] %s is now the leader", e.node)
+		}
+		e.leader = e.node
+		e.until = start.Add(e.ttl)
+		return nil
+	}
+	if !isNodeExist(err) && !isCompareFailed(err) {
+		// we don't know whether we're still the leader, so carry on until
+		// we can't be sure
+		return err
+	}
+
+	// someone else is the leader
+	current, err := kapi.Get(context.Background(), e.key, nil)
+	e.Lock()
+	defer e.Unlock()
+	if leading {
+		log.Printf("[campaign] %s is no longer the leader", e.node)
+	}
+	e.until = time.Time{}
+	if client.IsKeyNotFound(err) {
+		// expired since, we'll try again next time
+		e.leader = ""
+		return nil
+	}
+	if err != nil {
+		e.leader = ""
+		return err
+	}
+	e.leader = current.Node.Value
+	return nil
+}
+
+func (e *leaderElection) isLeader() bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.leader == e.node && time.Now().Before(e.until)
+}
+
+// The leader as of the last campaign, or "" if we don't know.
+func (e *leaderElection) currentLeader() string {
+	e.Lock()
+	defer e.Unlock()
+	if e.leader == e.node && !time.Now().Before(e.until) {
+		return ""
+	}
+	return e.leader
+}
+
+// A cluster-singleton job, which does nothing unless we're the leader.
+func (s *InMemoryState) onLeader(f func() error) func() error {
+	return func() error {
+		if !s.leaderElection.isLeader() {
+			return nil
+		}
+		return f()
+	}
+}
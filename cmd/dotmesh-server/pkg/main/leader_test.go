@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const testLeaderTTL = 300 * time.Millisecond
+
+// A metadata store which can't be written to, as when etcd has lost quorum.
+type unwritableStore struct {
+	MetadataStore
+}
+
+func (unwritableStore) Set(
+	ctx context.Context, key, value string, opts *client.SetOptions,
+) (*client.Response, error) {
+	return nil, fmt.Errorf("no quorum")
+}
+
+func newTestElections() (*leaderElection, *leaderElection) {
+	metadataStore = newMemoryStore()
+	return newLeaderElection(ETCD_PREFIX+"/leader", "a", testLeaderTTL),
+		newLeaderElection(ETCD_PREFIX+"/leader", "b", testLeaderTTL)
+}
+
+func campaign(t *testing.T, e *leaderElection) {
+	if err := e.campaign(); err != nil {
+		t.Fatalf("error campaigning as %s: %s", e.node, err)
+	}
+}
+
+func expectLeader(t *testing.T, leader string, elections ...*leaderElection) {
+	for _, e := range elections {
+		if e.isLeader() != (e.node == leader) {
+			t.Errorf("expected %s to be the leader, %s thinks it is: %t", leader, e.node, e.isLeader())
+		}
+		if got := e.currentLeader(); got != leader {
+			t.Errorf("expected %s to see %s as the leader, got %q", e.node, leader, got)
+		}
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	defer func() { metadataStore = nil }()
+
+	t.Run("first to campaign leads", func(t *testing.T) {
+		a, b := newTestElections()
+		campaign(t, a)
+		campaign(t, b)
+		expectLeader(t, "a", a, b)
+	})
+
+	t.Run("leader renews", func(t *testing.T) {
+		a, b := newTestElections()
+		campaign(t, a)
+		for i := 0; i < 6; i++ {
+			time.Sleep(testLeaderTTL / 3)
+			campaign(t, a)
+			campaign(t, b)
+			expectLeader(t, "a", a, b)
+		}
+	})
+
+	t.Run("takeover once the TTL expires", func(t *testing.T) {
+		a, b := newTestElections()
+		campaign(t, a)
+		campaign(t, b)
+		// a goes away
+		time.Sleep(testLeaderTTL + testLeaderTTL/3)
+		if a.isLeader() {
+			t.Error("expected a to stop leading once its key could have expired")
+		}
+		campaign(t, b)
+		campaign(t, a)
+		expectLeader(t, "b", a, b)
+	})
+
+	t.Run("failed renewal", func(t *testing.T) {
+		a, _ := newTestElections()
+		campaign(t, a)
+		metadataStore = unwritableStore{metadataStore}
+		if err := a.campaign(); err == nil {
+			t.Fatal("expected renewing to fail")
+		}
+		// the key can't have expired yet
+		if !a.isLeader() {
+			t.Error("expected a to carry on leading until its key could expire")
+		}
+		time.Sleep(testLeaderTTL)
+		if a.isLeader() {
+			t.Error("expected a to stop leading once its key could have expired")
+		}
+		if got := a.currentLeader(); got != "" {
+			t.Errorf("expected the leader to be unknown, got %q", got)
+		}
+	})
+}
+
+func TestOnLeader(t *testing.T) {
+	defer func() { metadataStore = nil }()
+	a, b := newTestElections()
+	campaign(t, a)
+	campaign(t, b)
+	for _, e := range []*leaderElection{a, b} {
+		ran := false
+		s := &InMemoryState{leaderElection: e}
+		err := s.onLeader(func() error {
+			ran = true
+			return nil
+		})()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if ran != (e.node == "a") {
+			t.Errorf("expected the job to run only on the leader, ran on %s: %t", e.node, ran)
+		}
+	}
+}
@@ -117,6 +117,36 @@ func main() {
 			"On other distributions, follow the instructions at http://zfsonlinux.org/\n")
 		log.Fatalf("Unable to find pool ID, I don't know who I am :( %s %s", err, localPoolId)
 	}
+	err = loadPreferredSubnets()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = loadTLSConfig()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = loadFailoverGracePeriod()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = loadReplicationFactor()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = loadMetadataStore()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = loadRequestTimeout()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	ips, _ := guessIPv4Addresses()
 	log.Printf("Detected my node ID as %s (%s)", localPoolId, ips)
 	s := NewInMemoryState(localPoolId, config)
@@ -155,12 +185,46 @@ func main() {
 		// (hopefully updating them doesn't take >30 seconds)
 		1*time.Second, 30*time.Second,
 	)
+	// elect a leader to run the cluster-wide jobs, see leader.go
+	go runForever(
+		s.leaderElection.campaign, "campaign",
+		LEADER_RENEW_INTERVAL, LEADER_RENEW_INTERVAL,
+	)
+	go runForever(
+		s.updateStatusInEtcd, "updateStatusInEtcd",
+		NODE_STATUS_INTERVAL, NODE_STATUS_INTERVAL,
+	)
+	go runForever(
+		s.checkPeerAddresses, "checkPeerAddresses",
+		ADDRESS_CHECK_INTERVAL, ADDRESS_CHECK_INTERVAL,
+	)
+	go runForever(
+		s.maintainNodeIdentity, "maintainNodeIdentity",
+		NODE_IDENTITY_INTERVAL, NODE_IDENTITY_INTERVAL,
+	)
+	if failoverGracePeriod > 0 {
+		go runForever(
+			s.failOverGoneMasters, "failOverGoneMasters",
+			FAILOVER_CHECK_INTERVAL, FAILOVER_CHECK_INTERVAL,
+		)
+	}
+	go runForever(
+		s.fenceFailedOverFilesystems, "fenceFailedOverFilesystems",
+		FAILOVER_CHECK_INTERVAL, FAILOVER_CHECK_INTERVAL,
+	)
+	go runForever(
+		s.onLeader(s.maintainReplicas), "maintainReplicas",
+		REPLICA_CHECK_INTERVAL, REPLICA_CHECK_INTERVAL,
+	)
+	go runForever(expirePollResults, "expirePollResults",
+		TRANSFER_EXPIRY_INTERVAL, TRANSFER_EXPIRY_INTERVAL,
+	)
 	// kick off an on-startup perusal of which dm containers are running
 	go runForever(s.fetchRelatedContainers, "fetchRelatedContainers",
 		1*time.Second, 1*time.Second,
 	)
 	// kick off cleanup of deleted filesystems
-	go runForever(s.cleanupDeletedFilesystems, "cleanupDeletedFilesystems",
+	go runForever(s.onLeader(s.cleanupDeletedFilesystems), "cleanupDeletedFilesystems",
 		1*time.Second, 1*time.Second,
 	)
 	// TODO proper flag parsing
@@ -0,0 +1,375 @@
+package main
+
+// An in-memory MetadataStore, for single-node setups and tests. It follows
+// etcd's v2 keys API closely enough for everything dotmesh does with it (see
+// store.go): directories only exist as the keys underneath them, and watchers
+// can start from any of the last MEMORY_STORE_HISTORY changes.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// how many changes to remember, for watchers to catch up on
+const MEMORY_STORE_HISTORY = 1000
+
+type memoryEntry struct {
+	value         string
+	createdIndex  uint64
+	modifiedIndex uint64
+	expiration    *time.Time
+}
+
+type memoryStore struct {
+	mutex   sync.Mutex
+	changed *sync.Cond
+	index   uint64
+	entries map[string]*memoryEntry
+	// the latest changes, oldest first, one per index
+	history []*client.Response
+}
+
+func newMemoryStore() *memoryStore {
+	m := &memoryStore{entries: map[string]*memoryEntry{}, history: []*client.Response{}}
+	m.changed = sync.NewCond(&m.mutex)
+	go m.expireForever()
+	return m
+}
+
+func cleanKey(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+func childKey(dir, name string) string {
+	if dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
+
+func storeError(code int, message, key string, index uint64) error {
+	return client.Error{Code: code, Message: message, Cause: key, Index: index}
+}
+
+func (e *memoryEntry) node(key string) *client.Node {
+	node := &client.Node{
+		Key: key, Value: e.value, CreatedIndex: e.createdIndex, ModifiedIndex: e.modifiedIndex,
+	}
+	if e.expiration != nil {
+		expiration := *e.expiration
+		node.Expiration = &expiration
+		node.TTL = int64(time.Until(expiration)/time.Second) + 1
+	}
+	return node
+}
+
+func (m *memoryStore) Get(
+	ctx context.Context, key string, opts *client.GetOptions,
+) (*client.Response, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+	key = cleanKey(key)
+	if entry, ok := m.entries[key]; ok {
+		return &client.Response{Action: "get", Node: entry.node(key), Index: m.index}, nil
+	}
+	node, ok := m.dir(key, opts != nil && opts.Recursive)
+	if !ok {
+		return nil, storeError(client.ErrorCodeKeyNotFound, "Key not found", key, m.index)
+	}
+	return &client.Response{Action: "get", Node: node, Index: m.index}, nil
+}
+
+// The directory key, with what's in it (and what's in that, if recursive), if
+// there's anything in it.
+func (m *memoryStore) dir(key string, recursive bool) (*client.Node, bool) {
+	prefix := childKey(key, "")
+	root := &client.Node{Key: key, Dir: true, Nodes: client.Nodes{}}
+	dirs := map[string]*client.Node{key: root}
+	found := false
+	for k, entry := range m.entries {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		found = true
+		pieces := strings.Split(k[len(prefix):], "/")
+		parent := root
+		for i, piece := range pieces[:len(pieces)-1] {
+			path := childKey(parent.Key, piece)
+			d, ok := dirs[path]
+			if !ok {
+				d = &client.Node{Key: path, Dir: true, Nodes: client.Nodes{}}
+				dirs[path] = d
+				parent.Nodes = append(parent.Nodes, d)
+			}
+			parent = d
+			if !recursive && i == 0 {
+				break
+			}
+		}
+		if recursive || len(pieces) == 1 {
+			parent.Nodes = append(parent.Nodes, entry.node(k))
+		}
+	}
+	for _, d := range dirs {
+		sort.Sort(d.Nodes)
+	}
+	return root, found
+}
+
+func (m *memoryStore) Set(
+	ctx context.Context, key, value string, opts *client.SetOptions,
+) (*client.Response, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+	if opts == nil {
+		opts = &client.SetOptions{}
+	}
+	return m.set(cleanKey(key), value, opts)
+}
+
+func (m *memoryStore) set(key, value string, opts *client.SetOptions) (*client.Response, error) {
+	if opts.Dir {
+		return nil, storeError(
+			client.ErrorCodeNotFile, "Directories are made by the keys in them", key, m.index,
+		)
+	}
+	if _, isDir := m.dir(key, false); isDir {
+		return nil, storeError(client.ErrorCodeNotFile, "Not a file", key, m.index)
+	}
+	existing, exists := m.entries[key]
+	action := "set"
+	switch opts.PrevExist {
+	case client.PrevExist:
+		if !exists {
+			return nil, storeError(client.ErrorCodeKeyNotFound, "Key not found", key, m.index)
+		}
+		action = "update"
+	case client.PrevNoExist:
+		if exists {
+			return nil, storeError(client.ErrorCodeNodeExist, "Key already exists", key, m.index)
+		}
+		action = "create"
+	}
+	if opts.PrevValue != "" || opts.PrevIndex != 0 {
+		if !exists {
+			return nil, storeError(client.ErrorCodeKeyNotFound, "Key not found", key, m.index)
+		}
+		if (opts.PrevValue != "" && opts.PrevValue != existing.value) ||
+			(opts.PrevIndex != 0 && opts.PrevIndex != existing.modifiedIndex) {
+			return nil, storeError(client.ErrorCodeTestFailed, "Compare failed", key, m.index)
+		}
+		action = "compareAndSwap"
+	}
+
+	m.index++
+	entry := &memoryEntry{value: value, createdIndex: m.index, modifiedIndex: m.index}
+	if exists {
+		entry.createdIndex = existing.createdIndex
+	}
+	if opts.TTL > 0 {
+		expiration := time.Now().Add(opts.TTL)
+		entry.expiration = &expiration
+	}
+	m.entries[key] = entry
+	response := &client.Response{Action: action, Node: entry.node(key), Index: m.index}
+	if exists {
+		response.PrevNode = existing.node(key)
+	}
+	m.record(response)
+	return response, nil
+}
+
+func (m *memoryStore) Delete(
+	ctx context.Context, key string, opts *client.DeleteOptions,
+) (*client.Response, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+	if opts == nil {
+		opts = &client.DeleteOptions{}
+	}
+	key = cleanKey(key)
+	existing, exists := m.entries[key]
+	if !exists {
+		if _, isDir := m.dir(key, false); !isDir {
+			return nil, storeError(client.ErrorCodeKeyNotFound, "Key not found", key, m.index)
+		}
+		if !opts.Recursive {
+			return nil, storeError(client.ErrorCodeDirNotEmpty, "Directory not empty", key, m.index)
+		}
+		m.index++
+		prefix := childKey(key, "")
+		for k := range m.entries {
+			if strings.HasPrefix(k, prefix) {
+				delete(m.entries, k)
+			}
+		}
+		response := &client.Response{
+			Action: "delete",
+			Node:   &client.Node{Key: key, Dir: true, ModifiedIndex: m.index},
+			Index:  m.index,
+		}
+		m.record(response)
+		return response, nil
+	}
+
+	action := "delete"
+	if opts.PrevValue != "" || opts.PrevIndex != 0 {
+		if (opts.PrevValue != "" && opts.PrevValue != existing.value) ||
+			(opts.PrevIndex != 0 && opts.PrevIndex != existing.modifiedIndex) {
+			return nil, storeError(client.ErrorCodeTestFailed, "Compare failed", key, m.index)
+		}
+		action = "compareAndDelete"
+	}
+	m.index++
+	delete(m.entries, key)
+	response := &client.Response{
+		Action: action,
+		Node: &client.Node{
+			Key: key, CreatedIndex: existing.createdIndex, ModifiedIndex: m.index,
+		},
+		PrevNode: existing.node(key),
+		Index:    m.index,
+	}
+	m.record(response)
+	return response, nil
+}
+
+func (m *memoryStore) CreateInOrder(
+	ctx context.Context, dir, value string, opts *client.CreateInOrderOptions,
+) (*client.Response, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire()
+	setOpts := &client.SetOptions{PrevExist: client.PrevNoExist}
+	if opts != nil {
+		setOpts.TTL = opts.TTL
+	}
+	// named after the index it's created at, like etcd does
+	return m.set(fmt.Sprintf("%s/%020d", cleanKey(dir), m.index+1), value, setOpts)
+}
+
+// Call with the mutex held.
+func (m *memoryStore) record(response *client.Response) {
+	m.history = append(m.history, response)
+	if len(m.history) > MEMORY_STORE_HISTORY {
+		m.history = m.history[len(m.history)-MEMORY_STORE_HISTORY:]
+	}
+	m.changed.Broadcast()
+}
+
+// Delete the keys whose TTLs have run out. Call with the mutex held.
+func (m *memoryStore) expire() {
+	now := time.Now()
+	expired := []string{}
+	for key, entry := range m.entries {
+		if entry.expiration != nil && !now.Before(*entry.expiration) {
+			expired = append(expired, key)
+		}
+	}
+	sort.Strings(expired)
+	for _, key := range expired {
+		entry := m.entries[key]
+		m.index++
+		delete(m.entries, key)
+		m.record(&client.Response{
+			Action: "expire",
+			Node: &client.Node{
+				Key: key, CreatedIndex: entry.createdIndex, ModifiedIndex: m.index,
+			},
+			PrevNode: entry.node(key),
+			Index:    m.index,
+		})
+	}
+}
+
+// So that watchers hear about keys expiring even when nothing else is going
+// on.
+func (m *memoryStore) expireForever() {
+	for {
+		time.Sleep(time.Second)
+		m.mutex.Lock()
+		m.expire()
+		m.mutex.Unlock()
+	}
+}
+
+// There's no etcd to ask about, just what's in our memory.
+func (m *memoryStore) Status(ctx context.Context) EtcdStatus {
+	return EtcdStatus{Healthy: true, Members: []string{"in-memory"}}
+}
+
+type memoryWatcher struct {
+	store      *memoryStore
+	key        string
+	recursive  bool
+	afterIndex uint64
+}
+
+func (m *memoryStore) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	w := &memoryWatcher{store: m, key: cleanKey(key)}
+	if opts != nil {
+		w.recursive = opts.Recursive
+		w.afterIndex = opts.AfterIndex
+	}
+	if w.afterIndex == 0 {
+		// from now on
+		m.mutex.Lock()
+		w.afterIndex = m.index
+		m.mutex.Unlock()
+	}
+	return w
+}
+
+func (w *memoryWatcher) matches(key string) bool {
+	return key == w.key || (w.recursive && strings.HasPrefix(key, childKey(w.key, "")))
+}
+
+func (w *memoryWatcher) Next(ctx context.Context) (*client.Response, error) {
+	m := w.store
+	// wake the wait below up if we're cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.mutex.Lock()
+			m.changed.Broadcast()
+			m.mutex.Unlock()
+		case <-done:
+		}
+	}()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for {
+		if len(m.history) > 0 && m.history[0].Index > w.afterIndex+1 {
+			return nil, storeError(
+				client.ErrorCodeEventIndexCleared,
+				"The event in requested index is outdated and cleared",
+				w.key, m.index,
+			)
+		}
+		for _, response := range m.history {
+			if response.Index <= w.afterIndex {
+				continue
+			}
+			w.afterIndex = response.Index
+			if w.matches(response.Node.Key) {
+				return response, nil
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		m.changed.Wait()
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+func errorCode(err error) int {
+	if e, ok := err.(client.Error); ok {
+		return e.Code
+	}
+	return 0
+}
+
+func TestMemoryStoreSet(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		existing string // "" if the key doesn't exist beforehand
+		opts     *client.SetOptions
+		code     int // the error code expected, 0 for none
+		action   string
+	}{
+		{"create", "", nil, 0, "set"},
+		{"overwrite", "old", nil, 0, "set"},
+		{"prevExist", "old", &client.SetOptions{PrevExist: client.PrevExist}, 0, "update"},
+		{"prevExist missing", "", &client.SetOptions{PrevExist: client.PrevExist},
+			client.ErrorCodeKeyNotFound, ""},
+		{"prevNoExist", "", &client.SetOptions{PrevExist: client.PrevNoExist}, 0, "create"},
+		{"prevNoExist existing", "old", &client.SetOptions{PrevExist: client.PrevNoExist},
+			client.ErrorCodeNodeExist, ""},
+		{"prevValue", "old", &client.SetOptions{PrevValue: "old"}, 0, "compareAndSwap"},
+		{"prevValue wrong", "old", &client.SetOptions{PrevValue: "other"},
+			client.ErrorCodeTestFailed, ""},
+		{"prevValue missing", "", &client.SetOptions{PrevValue: "old"},
+			client.ErrorCodeKeyNotFound, ""},
+		{"prevIndex", "old", &client.SetOptions{PrevIndex: 1}, 0, "compareAndSwap"},
+		{"prevIndex wrong", "old", &client.SetOptions{PrevIndex: 2},
+			client.ErrorCodeTestFailed, ""},
+		{"dir", "", &client.SetOptions{Dir: true}, client.ErrorCodeNotFile, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := newMemoryStore()
+			ctx := context.Background()
+			if c.existing != "" {
+				if _, err := m.Set(ctx, "/a/b", c.existing, nil); err != nil {
+					t.Fatalf("error setting up: %s", err)
+				}
+			}
+			resp, err := m.Set(ctx, "/a/b", "new", c.opts)
+			if errorCode(err) != c.code {
+				t.Fatalf("expected error code %d, got %v", c.code, err)
+			}
+			expected := "new"
+			if c.code != 0 {
+				expected = c.existing
+			} else if resp.Action != c.action {
+				t.Errorf("expected action %s, got %s", c.action, resp.Action)
+			}
+			got, err := m.Get(ctx, "/a/b", nil)
+			if expected == "" {
+				if !client.IsKeyNotFound(err) {
+					t.Errorf("expected no key, got %v, %v", got, err)
+				}
+				return
+			}
+			if err != nil || got.Node.Value != expected {
+				t.Errorf("expected %q, got %v, %v", expected, got, err)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSetOnDirectory(t *testing.T) {
+	m := newMemoryStore()
+	ctx := context.Background()
+	m.Set(ctx, "/a/b", "x", nil)
+	_, err := m.Set(ctx, "/a", "y", nil)
+	if errorCode(err) != client.ErrorCodeNotFile {
+		t.Errorf("expected not a file, got %v", err)
+	}
+}
+
+func TestMemoryStoreGet(t *testing.T) {
+	m := newMemoryStore()
+	ctx := context.Background()
+	for _, key := range []string{"/a/b", "/a/c/d", "/a/c/e", "/f"} {
+		m.Set(ctx, key, key, nil)
+	}
+	for _, c := range []struct {
+		name      string
+		key       string
+		recursive bool
+		code      int
+		value     string   // for a key
+		children  []string // for a directory, in order
+		leaves    int      // for a directory, how many keys there are in it
+	}{
+		{"key", "/a/b", false, 0, "/a/b", nil, 0},
+		{"key without leading slash", "a/b", false, 0, "/a/b", nil, 0},
+		{"missing", "/a/x", false, client.ErrorCodeKeyNotFound, "", nil, 0},
+		{"directory", "/a", false, 0, "", []string{"/a/b", "/a/c"}, 1},
+		{"recursive", "/a", true, 0, "", []string{"/a/b", "/a/c"}, 3},
+		{"root", "/", false, 0, "", []string{"/a", "/f"}, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			resp, err := m.Get(ctx, c.key, &client.GetOptions{Recursive: c.recursive, Sort: true})
+			if errorCode(err) != c.code {
+				t.Fatalf("expected error code %d, got %v", c.code, err)
+			}
+			if c.code != 0 {
+				return
+			}
+			if c.children == nil {
+				if resp.Node.Dir || resp.Node.Value != c.value {
+					t.Errorf("expected %q, got %+v", c.value, resp.Node)
+				}
+				return
+			}
+			if !resp.Node.Dir || len(resp.Node.Nodes) != len(c.children) {
+				t.Fatalf("expected a directory of %v, got %+v", c.children, resp.Node)
+			}
+			for i, child := range resp.Node.Nodes {
+				if child.Key != c.children[i] {
+					t.Errorf("expected %s, got %s", c.children[i], child.Key)
+				}
+			}
+			if leaves := countLeaves(resp.Node); leaves != c.leaves {
+				t.Errorf("expected %d keys, got %d", c.leaves, leaves)
+			}
+		})
+	}
+}
+
+func countLeaves(node *client.Node) int {
+	if !node.Dir {
+		return 1
+	}
+	leaves := 0
+	for _, child := range node.Nodes {
+		leaves += countLeaves(child)
+	}
+	return leaves
+}
+
+func TestMemoryStoreDelete(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		key    string
+		opts   *client.DeleteOptions
+		code   int
+		action string
+		left   []string // the keys left afterwards
+	}{
+		{"key", "/a/b", nil, 0, "delete", []string{"/a/c/d", "/f"}},
+		{"missing", "/a/x", nil, client.ErrorCodeKeyNotFound, "",
+			[]string{"/a/b", "/a/c/d", "/f"}},
+		{"prevValue", "/a/b", &client.DeleteOptions{PrevValue: "/a/b"}, 0, "compareAndDelete",
+			[]string{"/a/c/d", "/f"}},
+		{"prevValue wrong", "/a/b", &client.DeleteOptions{PrevValue: "other"},
+			client.ErrorCodeTestFailed, "", []string{"/a/b", "/a/c/d", "/f"}},
+		{"prevIndex", "/a/b", &client.DeleteOptions{PrevIndex: 1}, 0, "compareAndDelete",
+			[]string{"/a/c/d", "/f"}},
+		{"directory", "/a", nil, client.ErrorCodeDirNotEmpty, "",
+			[]string{"/a/b", "/a/c/d", "/f"}},
+		{"recursive", "/a", &client.DeleteOptions{Recursive: true}, 0, "delete",
+			[]string{"/f"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := newMemoryStore()
+			ctx := context.Background()
+			for _, key := range []string{"/a/b", "/a/c/d", "/f"} {
+				m.Set(ctx, key, key, nil)
+			}
+			resp, err := m.Delete(ctx, c.key, c.opts)
+			if errorCode(err) != c.code {
+				t.Fatalf("expected error code %d, got %v", c.code, err)
+			}
+			if c.code == 0 && resp.Action != c.action {
+				t.Errorf("expected action %s, got %s", c.action, resp.Action)
+			}
+			all, err := m.Get(ctx, "/", &client.GetOptions{Recursive: true})
+			if err != nil {
+				t.Fatalf("error listing keys: %s", err)
+			}
+			left := []string{}
+			var collect func(node *client.Node)
+			collect = func(node *client.Node) {
+				if !node.Dir {
+					left = append(left, node.Key)
+				}
+				for _, child := range node.Nodes {
+					collect(child)
+				}
+			}
+			collect(all.Node)
+			if len(left) != len(c.left) {
+				t.Fatalf("expected %v left, got %v", c.left, left)
+			}
+			for i := range left {
+				if left[i] != c.left[i] {
+					t.Errorf("expected %v left, got %v", c.left, left)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreCreateInOrder(t *testing.T) {
+	m := newMemoryStore()
+	ctx := context.Background()
+	// something else changing in between doesn't upset the order
+	first, err := m.CreateInOrder(ctx, "/queue", "first", nil)
+	if err != nil {
+		t.Fatalf("error creating: %s", err)
+	}
+	m.Set(ctx, "/other", "x", nil)
+	second, err := m.CreateInOrder(ctx, "/queue", "second", nil)
+	if err != nil {
+		t.Fatalf("error creating: %s", err)
+	}
+	if first.Action != "create" || first.Node.Key >= second.Node.Key {
+		t.Errorf("expected keys in order, got %s then %s", first.Node.Key, second.Node.Key)
+	}
+	resp, err := m.Get(ctx, "/queue", &client.GetOptions{Sort: true})
+	if err != nil {
+		t.Fatalf("error listing: %s", err)
+	}
+	if len(resp.Node.Nodes) != 2 ||
+		resp.Node.Nodes[0].Value != "first" || resp.Node.Nodes[1].Value != "second" {
+		t.Errorf("expected first then second, got %+v", resp.Node.Nodes)
+	}
+}
+
+func TestMemoryStoreTTL(t *testing.T) {
+	m := newMemoryStore()
+	ctx := context.Background()
+	m.Set(ctx, "/short", "x", &client.SetOptions{TTL: 100 * time.Millisecond})
+	m.Set(ctx, "/long", "y", &client.SetOptions{TTL: time.Hour})
+	m.Set(ctx, "/forever", "z", nil)
+
+	resp, err := m.Get(ctx, "/long", nil)
+	if err != nil || resp.Node.Expiration == nil || resp.Node.TTL <= 0 {
+		t.Errorf("expected an expiration, got %+v, %v", resp, err)
+	}
+	w := m.Watcher("/short", nil)
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := m.Get(ctx, "/short", nil); !client.IsKeyNotFound(err) {
+		t.Errorf("expected /short to have expired, got %v", err)
+	}
+	for _, key := range []string{"/long", "/forever"} {
+		if _, err := m.Get(ctx, key, nil); err != nil {
+			t.Errorf("expected %s to be kept, got %v", key, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	expired, err := w.Next(ctx)
+	if err != nil || expired.Action != "expire" || expired.PrevNode.Value != "x" {
+		t.Errorf("expected to see /short expire, got %+v, %v", expired, err)
+	}
+}
+
+func TestMemoryStoreWatcher(t *testing.T) {
+	m := newMemoryStore()
+	ctx := context.Background()
+	// watching after index 0 means from now on, like etcd
+	before, _ := m.Set(ctx, "/setup", "0", nil)
+	m.Set(ctx, "/a/b", "1", nil)
+	m.Set(ctx, "/a/c/d", "2", nil)
+	m.Set(ctx, "/x", "3", nil)
+	m.Delete(ctx, "/a/b", nil)
+
+	for _, c := range []struct {
+		name      string
+		key       string
+		recursive bool
+		expected  []string // the actions and keys seen, in order
+	}{
+		{"key", "/a/b", false, []string{"set /a/b", "delete /a/b"}},
+		{"directory", "/a", false, []string{}},
+		{"recursive", "/a", true, []string{"set /a/b", "set /a/c/d", "delete /a/b"}},
+		{"everything", "/", true, []string{"set /a/b", "set /a/c/d", "set /x", "delete /a/b"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// so that it catches up on the changes since
+			w := m.Watcher(c.key, &client.WatcherOptions{
+				AfterIndex: before.Index, Recursive: c.recursive,
+			})
+			seen := []string{}
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				resp, err := w.Next(ctx)
+				cancel()
+				if err == context.DeadlineExceeded {
+					break
+				}
+				if err != nil {
+					t.Fatalf("error watching: %s", err)
+				}
+				seen = append(seen, resp.Action+" "+resp.Node.Key)
+			}
+			if len(seen) != len(c.expected) {
+				t.Fatalf("expected %v, got %v", c.expected, seen)
+			}
+			for i := range seen {
+				if seen[i] != c.expected[i] {
+					t.Errorf("expected %v, got %v", c.expected, seen)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreWatcherWaitsForChanges(t *testing.T) {
+	m := newMemoryStore()
+	w := m.Watcher("/a", nil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.Set(context.Background(), "/a", "later", nil)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := w.Next(ctx)
+	if err != nil || resp.Node.Value != "later" {
+		t.Errorf("expected to see the change, got %+v, %v", resp, err)
+	}
+}
+
+func TestMemoryStoreWatcherHistoryCleared(t *testing.T) {
+	m := newMemoryStore()
+	ctx := context.Background()
+	for i := 0; i < MEMORY_STORE_HISTORY+10; i++ {
+		m.Set(ctx, "/a", "x", nil)
+	}
+	w := m.Watcher("/a", &client.WatcherOptions{AfterIndex: 1})
+	_, err := w.Next(ctx)
+	if errorCode(err) != client.ErrorCodeEventIndexCleared {
+		t.Errorf("expected the index to have been cleared, got %v", err)
+	}
+}
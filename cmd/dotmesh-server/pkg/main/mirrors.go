@@ -0,0 +1,231 @@
+package main
+
+// Continuous mirroring of a branch of a dot to a remote cluster.
+//
+// A mirror is stored in etcd under filesystems/mirrors/:mirrorId. Every node
+// learns about it in fetchAndWatchEtcd and starts a runMirror goroutine for
+// it, but only the node which is currently master for the mirrored filesystem
+// actually pushes. This means mirroring follows the filesystem around the
+// cluster as it moves.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// How often to compare a mirror with its remote when no new commits have
+// shown up on the master. This is also how soon a failed push is retried.
+const DEFAULT_MIRROR_INTERVAL_SECONDS = 60
+
+func (s *InMemoryState) getMirror(mirrorId string) (Mirror, bool) {
+	s.mirrorsLock.Lock()
+	defer s.mirrorsLock.Unlock()
+	m, ok := (*s.mirrors)[mirrorId]
+	return m, ok
+}
+
+// ids of the mirrors of the given filesystem
+func (s *InMemoryState) mirrorsFor(filesystemId string) []string {
+	s.mirrorsLock.Lock()
+	defer s.mirrorsLock.Unlock()
+	ids := []string{}
+	for id, m := range *s.mirrors {
+		if m.FilesystemId == filesystemId {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Called from fetchAndWatchEtcd, start a runner for a mirror we haven't seen
+// before. Runners notice by themselves when their mirror goes away.
+func (s *InMemoryState) updateMirrorFromEtcd(mirrorId string, m *Mirror) {
+	s.mirrorsLock.Lock()
+	defer s.mirrorsLock.Unlock()
+	if m == nil {
+		delete(*s.mirrors, mirrorId)
+		return
+	}
+	_, running := (*s.mirrors)[mirrorId]
+	(*s.mirrors)[mirrorId] = *m
+	if !running {
+		go s.runMirror(mirrorId)
+	}
+}
+
+func (s *InMemoryState) runMirror(mirrorId string) {
+	log.Printf("[runMirror:%s] starting", mirrorId)
+	for {
+		m, ok := s.getMirror(mirrorId)
+		if !ok {
+			log.Printf("[runMirror:%s] mirror was removed, stopping", mirrorId)
+			return
+		}
+		// subscribe before syncing, so that we don't miss commits which show
+		// up while we're pushing.
+		newSnaps := make(chan interface{})
+		s.newSnapsOnMaster.Subscribe(m.FilesystemId, newSnaps)
+
+		if s.masterFor(m.FilesystemId) == s.myNodeId {
+			err := s.syncMirror(m)
+			if err != nil {
+				log.Printf("[runMirror:%s] error syncing %s: %s", mirrorId, m.FilesystemId, err)
+				e := s.updateMirrorStatus(mirrorId, func(m *Mirror) {
+					m.Status = "error"
+					m.LastError = err.Error()
+					m.LastErrorAt = time.Now().Unix()
+				})
+				if e != nil {
+					log.Printf("[runMirror:%s] error recording error: %s", mirrorId, e)
+				}
+			}
+		}
+
+		interval := time.Duration(m.IntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = DEFAULT_MIRROR_INTERVAL_SECONDS * time.Second
+		}
+		select {
+		case _ = <-newSnaps:
+		case <-time.After(interval):
+		}
+		s.newSnapsOnMaster.Unsubscribe(m.FilesystemId, newSnaps)
+	}
+}
+
+// Bring the remote up to date with the master's copy of the mirrored
+// filesystem, using the same code path as a 'dm push'.
+func (s *InMemoryState) syncMirror(m Mirror) error {
+	localSnaps, err := s.snapshotsForCurrentMaster(m.FilesystemId)
+	if err != nil {
+		return err
+	}
+	if len(localSnaps) == 0 {
+		// nothing to push yet
+		return nil
+	}
+	latest := localSnaps[len(localSnaps)-1].Id
+
+	client := NewJsonRpcClient(m.User, m.Peer, m.ApiKey, m.PeerTLS)
+	var remoteFilesystemId string
+	err = client.CallRemote(context.Background(),
+		"DotmeshRPC.Exists", map[string]string{
+			"Namespace": m.RemoteNamespace,
+			"Name":      m.RemoteName,
+			"Branch":    m.RemoteBranchName,
+		}, &remoteFilesystemId)
+	if err != nil {
+		return err
+	}
+	remoteSnaps := []snapshot{}
+	if remoteFilesystemId != "" {
+		err = client.CallRemote(context.Background(),
+			"DotmeshRPC.CommitsById", remoteFilesystemId, &remoteSnaps,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// if the remote has diverged, the push will fail and say why
+	behind, diverged := aheadBehind(localSnaps, remoteSnaps)
+	if behind == 0 && diverged == 0 {
+		return s.updateMirrorStatus(m.Id, func(m *Mirror) {
+			m.Status = "idle"
+			m.CommitsBehind = 0
+			m.LastSyncedCommit = latest
+			m.LastSyncedAt = time.Now().Unix()
+		})
+	}
+
+	transfer := TransferRequest{
+		Peer:             m.Peer,
+		User:             m.User,
+		ApiKey:           m.ApiKey,
+		PeerTLS:          m.PeerTLS,
+		Direction:        "push",
+		LocalNamespace:   m.LocalNamespace,
+		LocalName:        m.LocalName,
+		LocalBranchName:  m.LocalBranchName,
+		RemoteNamespace:  m.RemoteNamespace,
+		RemoteName:       m.RemoteName,
+		RemoteBranchName: m.RemoteBranchName,
+	}
+	responseChan, transferId, err := NewDotmeshRPC(s).startTransfer(
+		context.Background(), &transfer,
+	)
+	if err != nil {
+		return err
+	}
+	err = s.updateMirrorStatus(m.Id, func(m *Mirror) {
+		m.Status = "pushing"
+		m.CommitsBehind = behind
+		m.LastTransferId = transferId
+	})
+	if err != nil {
+		log.Printf("[syncMirror:%s] error recording status: %s", m.Id, err)
+	}
+
+	log.Printf(
+		"[syncMirror:%s] pushing %d commits of %s to %s as transfer %s",
+		m.Id, behind, m.FilesystemId, m.Peer, transferId,
+	)
+	e := <-responseChan
+	if e.Name != "finished-push" && e.Name != "peer-up-to-date" {
+		return fmt.Errorf("Transfer %s failed: %s", transferId, e)
+	}
+	return s.updateMirrorStatus(m.Id, func(m *Mirror) {
+		m.Status = "idle"
+		m.CommitsBehind = 0
+		m.LastSyncedCommit = latest
+		m.LastSyncedAt = time.Now().Unix()
+	})
+}
+
+// Apply update to our cached copy of a mirror and write it back to etcd. Only
+// updates the record if it still exists, so a mirror which is removed while
+// it is pushing stays removed.
+func (s *InMemoryState) updateMirrorStatus(mirrorId string, update func(*Mirror)) error {
+	m, ok := s.getMirror(mirrorId)
+	if !ok {
+		return nil
+	}
+	update(&m)
+	serialized, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/mirrors/%s", ETCD_PREFIX, mirrorId),
+		string(serialized),
+		&client.SetOptions{PrevExist: client.PrevExist},
+	)
+	if client.IsKeyNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// don't wait for the watch to come back around before the next update
+	s.mirrorsLock.Lock()
+	defer s.mirrorsLock.Unlock()
+	if _, ok := (*s.mirrors)[mirrorId]; ok {
+		(*s.mirrors)[mirrorId] = m
+	}
+	return nil
+}
+
+func safeMirror(m Mirror) Mirror {
+	m.ApiKey = "<redacted>"
+	return m
+}
@@ -0,0 +1,136 @@
+package main
+
+// Moving dots between nodes on request.
+//
+// A move is the same "move" event on the master that procuring a dot on
+// another node sends, which puts the master into handoffState: it waits for
+// the target to have all its commits and then makes the target the master.
+// Unlike a procure, the caller doesn't wait for it, but polls the master's
+// response (and its progress through handoffState in the meantime) with the
+// request id.
+//
+// To keep the downtime short, handoffState pre-copies the filesystem while
+// it's still in use: it snapshots it and waits for the target to catch up,
+// over and over, until there's less than PRECOPY_DIRTY_THRESHOLD left to send
+// (or it's tried PRECOPY_MAX_ROUNDS times, if it's being written to faster
+// than it can be sent). Only then does it stop any containers using it,
+// unmount it, and send the rest.
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const PRECOPY_DIRTY_THRESHOLD = 16 * 1024 * 1024
+
+const PRECOPY_MAX_ROUNDS = 5
+
+type MoveRequest struct {
+	FilesystemId string
+	RequestId    string
+}
+
+type MovePollResult struct {
+	Done     bool
+	Error    string  // why the move failed, once it's done
+	Downtime float64 // seconds the dot was unavailable for, once it's done
+	Master   string
+	// the master's state and status, e.g. "handoff" and how far it's got
+	State  string
+	Status string
+}
+
+// Ask the master of a filesystem to move it to target, stopping any
+// containers using it if stopContainers, otherwise refusing to move it while
+// there are any. Returns the id of the request, to poll with pollMove.
+func (s *InMemoryState) moveFilesystem(
+	filesystemId, target string, stopContainers bool,
+) (string, error) {
+	master := s.masterFor(filesystemId)
+	if master == "" {
+		return "", fmt.Errorf("Unable to find the master of %s", filesystemId)
+	}
+	if master == target {
+		return "", fmt.Errorf("%s is already on %s", filesystemId, target)
+	}
+	if !s.placeableServers()[target] {
+		return "", fmt.Errorf(
+			"No such node %s, or it isn't running, or it's being drained", target,
+		)
+	}
+	// the target has to be keeping a copy, to catch up before the handoff
+	err := s.addReplica(filesystemId, target)
+	if err != nil {
+		return "", err
+	}
+	// keeping the response in etcd for pollMove
+	responseChan, requestId, err := s.sendGlobalFsRequest(
+		context.Background(),
+		filesystemId,
+		&Event{
+			Name: "move",
+			Args: &EventArgs{"target": target, "stopContainers": stopContainers},
+		},
+		true,
+	)
+	if err != nil {
+		return "", err
+	}
+	// the response is read back from etcd by pollMove, but something needs
+	// to read it from the response chan too
+	go func() { _ = <-responseChan }()
+	log.Printf(
+		"[moveFilesystem] Asked %s to move %s to %s (request %s)",
+		master, filesystemId, target, requestId,
+	)
+	return requestId, nil
+}
+
+func (s *InMemoryState) pollMove(filesystemId, requestId string) (MovePollResult, error) {
+	master := s.masterFor(filesystemId)
+	result := MovePollResult{Master: master}
+	s.globalStateCacheLock.Lock()
+	state, ok := (*s.globalStateCache)[master][filesystemId]
+	if ok {
+		result.State = state["state"]
+		result.Status = state["status"]
+	}
+	s.globalStateCacheLock.Unlock()
+
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return result, err
+	}
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/responses/%s/%s", ETCD_PREFIX, filesystemId, requestId),
+		nil,
+	)
+	if client.IsKeyNotFound(err) {
+		// not done yet
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	e, err := s.deserializeEvent(resp.Node)
+	if err != nil {
+		return result, err
+	}
+	result.Done = true
+	switch e.Name {
+	case "moved":
+		result.Downtime, _ = (*e.Args)["downtime"].(float64)
+	case "cannot-move-while-containers-running":
+		result.Error = fmt.Sprintf(
+			"Containers are using it, stop them or ask for them to be stopped: %s",
+			(*e.Args)["containers"],
+		)
+	default:
+		result.Error = e.String()
+	}
+	return result, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+// Pushing or pulling every dot in a namespace (dm push/pull --namespace).
+//
+// A namespace transfer is stored in etcd under
+// filesystems/namespacetransfers/:id and is run by the node it was requested
+// from, which transfers each dot in turn, with all its branches, exactly as
+// 'dm push/pull --all-branches' would. Dots missing on the receiving side
+// are created. The record is written after each dot, and is the checkpoint
+// from which a failed or interrupted transfer is resumed: finished dots are
+// skipped, and dots which have appeared in the namespace since are added.
+// Resuming claims the record with a compare-and-swap, so that only one node
+// resumes a given transfer.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// namespace transfers running on this node
+var runningNamespaceTransfers = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: map[string]bool{}}
+
+// Names of the dots in the namespace on the sending side of a transfer which
+// the user may transfer.
+func (s *InMemoryState) namespaceDots(
+	ctx context.Context, t *NamespaceTransfer,
+) ([]string, error) {
+	names := []string{}
+	if t.Direction == "push" {
+		for _, name := range s.registry.Filesystems() {
+			if name.Namespace != t.LocalNamespace {
+				continue
+			}
+			tlf, err := s.registry.LookupFilesystem(name)
+			if err != nil {
+				return nil, err
+			}
+			authorized, err := tlf.Authorize(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if authorized {
+				names = append(names, name.Name)
+			}
+		}
+		return names, nil
+	}
+	// the peer only lists the dots we're allowed to see
+	var dots map[string]map[string]DotmeshVolume
+	err := NewJsonRpcClient(t.User, t.Peer, t.ApiKey, t.PeerTLS).CallRemote(
+		ctx, "DotmeshRPC.List", struct{}{}, &dots,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for name, _ := range dots[t.RemoteNamespace] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// The latest namespace transfer between the same namespaces of the same
+// clusters as t which didn't finish, if any, and the etcd index of its record.
+func unfinishedNamespaceTransfer(t *NamespaceTransfer) (*NamespaceTransfer, uint64, error) {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/namespacetransfers", ETCD_PREFIX),
+		&client.GetOptions{Recursive: true},
+	)
+	if client.IsKeyNotFound(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var latest *NamespaceTransfer
+	var latestIndex uint64
+	for _, node := range resp.Node.Nodes {
+		other := &NamespaceTransfer{}
+		err := json.Unmarshal([]byte(node.Value), other)
+		if err != nil {
+			return nil, 0, err
+		}
+		if other.Status == "finished" || other.Direction != t.Direction ||
+			other.Peer != t.Peer || other.LocalNamespace != t.LocalNamespace ||
+			other.RemoteNamespace != t.RemoteNamespace {
+			continue
+		}
+		if latest == nil || other.StartedAt > latest.StartedAt {
+			latest, latestIndex = other, node.ModifiedIndex
+		}
+	}
+	return latest, latestIndex, nil
+}
+
+func getNamespaceTransfer(id string) (*NamespaceTransfer, error) {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/namespacetransfers/%s", ETCD_PREFIX, id),
+		nil,
+	)
+	if client.IsKeyNotFound(err) {
+		return nil, fmt.Errorf("No such namespace transfer %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &NamespaceTransfer{}
+	err = json.Unmarshal([]byte(resp.Node.Value), t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func saveNamespaceTransfer(t *NamespaceTransfer) error {
+	return setNamespaceTransfer(t, nil)
+}
+
+// Save a transfer being resumed, as long as its record hasn't changed since
+// we read it at index, so that two nodes can't both resume it.
+func claimResumedNamespaceTransfer(t *NamespaceTransfer, index uint64) error {
+	err := setNamespaceTransfer(t, &client.SetOptions{PrevIndex: index})
+	if isCompareFailed(err) {
+		return fmt.Errorf(
+			"Namespace transfer %s was resumed by someone else in the meantime", t.Id,
+		)
+	}
+	return err
+}
+
+func setNamespaceTransfer(t *NamespaceTransfer, opts *client.SetOptions) error {
+	serialized, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/namespacetransfers/%s", ETCD_PREFIX, t.Id),
+		string(serialized),
+		opts,
+	)
+	return err
+}
+
+// Add any dots which aren't in the transfer yet, to be transferred last.
+func addNamespaceDots(t *NamespaceTransfer, names []string) {
+	known := map[string]bool{}
+	for _, dot := range t.Dots {
+		known[dot.Name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			t.Dots = append(t.Dots, NamespaceTransferDot{Name: name, Status: "waiting"})
+		}
+	}
+}
+
+// Claim a namespace transfer for this node, returning false if it's already
+// running here.
+func claimNamespaceTransfer(id string) bool {
+	runningNamespaceTransfers.Lock()
+	defer runningNamespaceTransfers.Unlock()
+	if runningNamespaceTransfers.ids[id] {
+		return false
+	}
+	runningNamespaceTransfers.ids[id] = true
+	return true
+}
+
+func releaseNamespaceTransfer(id string) {
+	runningNamespaceTransfers.Lock()
+	defer runningNamespaceTransfers.Unlock()
+	delete(runningNamespaceTransfers.ids, id)
+}
+
+// Transfer each dot which hasn't been transferred yet, one at a time, as the
+// user who requested it. A dot which fails doesn't stop the others.
+func (s *InMemoryState) runNamespaceTransfer(t *NamespaceTransfer) {
+	defer releaseNamespaceTransfer(t.Id)
+	ctx := context.WithValue(context.Background(), "authenticated-user-id", t.InitiatorId)
+	save := func() {
+		err := saveNamespaceTransfer(t)
+		if err != nil {
+			log.Printf("[runNamespaceTransfer:%s] error saving checkpoint: %s", t.Id, err)
+		}
+	}
+
+	failed := 0
+	for i := range t.Dots {
+		dot := &t.Dots[i]
+		if dot.Status == "finished" {
+			continue
+		}
+		dot.Status = "transferring"
+		dot.Message = ""
+		save()
+
+		err := func() error {
+			transfer := TransferRequest{
+				Peer:            t.Peer,
+				User:            t.User,
+				ApiKey:          t.ApiKey,
+				PeerTLS:         t.PeerTLS,
+				Direction:       t.Direction,
+				LocalNamespace:  t.LocalNamespace,
+				LocalName:       dot.Name,
+				RemoteNamespace: t.RemoteNamespace,
+				RemoteName:      dot.Name,
+				AllBranches:     true,
+			}
+			responseChan, transferId, err := NewDotmeshRPC(s).startTransfer(ctx, &transfer)
+			if err != nil {
+				return err
+			}
+			dot.TransferId = transferId
+			save()
+			log.Printf(
+				"[runNamespaceTransfer:%s] transferring %s as transfer %s",
+				t.Id, dot.Name, transferId,
+			)
+			e := <-responseChan
+			if e.Name != "finished-push" && e.Name != "finished-pull" &&
+				e.Name != "peer-up-to-date" {
+				return fmt.Errorf("Transfer %s failed: %s", transferId, e)
+			}
+			return nil
+		}()
+		if err != nil {
+			log.Printf("[runNamespaceTransfer:%s] error transferring %s: %s", t.Id, dot.Name, err)
+			failed++
+			dot.Status = "error"
+			dot.Message = err.Error()
+		} else {
+			dot.Status = "finished"
+		}
+		save()
+	}
+
+	t.Status = "finished"
+	if failed > 0 {
+		t.Status = "error"
+	}
+	t.FinishedAt = time.Now().Unix()
+	save()
+}
+
+func safeNamespaceTransfer(t NamespaceTransfer) NamespaceTransfer {
+	t.ApiKey = "<redacted>"
+	return t
+}
@@ -0,0 +1,718 @@
+package main
+
+// Node identities.
+//
+// Each node has a client certificate, node.pem in the PKI directory, with a
+// CommonName of NODE_CERTIFICATE_PREFIX followed by the node's name. Nodes
+// present it when they connect to each other, and requests made with it act
+// as the admin user, so internal traffic doesn't need the admin API key. A
+// certificate is only accepted from one of the addresses its node publishes,
+// so one node can't pass itself off as another. Nodes without one (clusters
+// without any PKI, or nodes still waiting for theirs) use the admin API key.
+//
+// Node certificates are signed by a node CA of their own, not the cluster's
+// CA, whose key every node has. The first node to start creates the node CA,
+// publishes its certificate under servers/nodeca and keeps its key,
+// node-ca-key.pem, to itself: it's the only node which can issue node
+// certificates, and says so under servers/nodecaholder. The others ask for theirs by publishing a certificate signing
+// request under servers/nodecsrs/:nodeName, and it issues one, recording it
+// under servers/nodecerts/:nodeName, unless the node already has a
+// certificate which hasn't been revoked, or has been revoked itself.
+//
+// `dm cluster revoke-node` records the fingerprints of all the certificates
+// issued to a node under servers/revokedcerts/:fingerprint, so that they're
+// refused from then on, and records under servers/revoked/:nodeName that the
+// node mustn't be issued another. `dm cluster readmit-node` undoes the
+// latter, so that a node which has been rebuilt can rejoin with its old name.
+// `dm cluster remove-node` revokes a node's certificates too, but forgets
+// them, so that a new node can join with the same name.
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// the common name of a node certificate is this followed by the node name
+const NODE_CERTIFICATE_PREFIX = "dotmesh-node:"
+
+// how often to check on our node certificate, and on requests for them if
+// we're the node which issues them
+const NODE_IDENTITY_INTERVAL = 10 * time.Second
+
+const NODE_CERTIFICATE_VALIDITY = 365 * 24 * time.Hour
+
+// Our node certificate, and the node CA other nodes' certificates must be
+// signed by, once we have them. Both are nil if we aren't using TLS.
+var nodeIdentity = struct {
+	sync.Mutex
+	certificate *tls.Certificate
+	cas         *x509.CertPool
+}{}
+
+func nodePkiPath(name string) string {
+	return fmt.Sprintf("%s/%s", getPkiPath(), name)
+}
+
+// Have the API ask other nodes for their certificates, and present ours to
+// them once we have it. The certificates are checked by requestingNode,
+// rather than during the handshake, as the node CA may not be known yet.
+func loadNodeCertificate() error {
+	apiTLSConfig.ClientAuth = tls.RequestClientCert
+	internalTransport.TLSClientConfig.GetClientCertificate = func(
+		*tls.CertificateRequestInfo,
+	) (*tls.Certificate, error) {
+		nodeIdentity.Lock()
+		defer nodeIdentity.Unlock()
+		if nodeIdentity.certificate == nil {
+			// no certificate, so authenticateInternal uses the admin API key
+			return &tls.Certificate{}, nil
+		}
+		return nodeIdentity.certificate, nil
+	}
+	if !fileExists(nodePkiPath("node.pem")) {
+		return nil
+	}
+	return useNodeCertificate()
+}
+
+func useNodeCertificate() error {
+	cert, err := tls.LoadX509KeyPair(nodePkiPath("node.pem"), nodePkiPath("node-key.pem"))
+	if err != nil {
+		return fmt.Errorf("Unable to load node certificate: %s", err)
+	}
+	nodeIdentity.Lock()
+	nodeIdentity.certificate = &cert
+	nodeIdentity.Unlock()
+	return nil
+}
+
+func haveNodeCertificate() bool {
+	nodeIdentity.Lock()
+	defer nodeIdentity.Unlock()
+	return nodeIdentity.certificate != nil
+}
+
+// Authenticate a request to another node in the cluster: with our node
+// certificate, which the transport presents, if we have one, otherwise as
+// the admin user.
+func authenticateInternal(req *http.Request) error {
+	if haveNodeCertificate() {
+		return nil
+	}
+	_, _, apiKey, err := getPasswords("admin")
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("admin", apiKey)
+	return nil
+}
+
+// The node which made a request, if it presented a node certificate signed
+// by the node CA.
+func requestingNode(r *http.Request) (string, *x509.Certificate, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", nil, false
+	}
+	nodeIdentity.Lock()
+	cas := nodeIdentity.cas
+	nodeIdentity.Unlock()
+	if cas == nil {
+		return "", nil, false
+	}
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         cas,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil || !strings.HasPrefix(cert.Subject.CommonName, NODE_CERTIFICATE_PREFIX) {
+		return "", nil, false
+	}
+	return strings.TrimPrefix(cert.Subject.CommonName, NODE_CERTIFICATE_PREFIX), cert, true
+}
+
+func certificateFingerprintOf(cert *x509.Certificate) string {
+	return certificateFingerprint(cert.Raw)
+}
+
+// Check that a node certificate hasn't been revoked, and that it's being
+// presented from one of its node's addresses.
+func checkNodeCertificate(node string, cert *x509.Certificate, remoteAddr string) error {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	revoked, err := isCertificateRevoked(kapi, cert)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return fmt.Errorf("The certificate of node %s has been revoked", node)
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return err
+	}
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/servers/addresses/%s", ETCD_PREFIX, node),
+		nil,
+	)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return err
+	}
+	if err == nil {
+		for _, address := range strings.Split(resp.Node.Value, ",") {
+			if address == host {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("The certificate of node %s was presented from %s, which isn't one of its addresses", node, host)
+}
+
+type NodeRevocation struct {
+	Node         string
+	RevokedAt    int64    // unix timestamp
+	Fingerprints []string // of the certificates revoked
+}
+
+// The certificates issued to a node, most recent last.
+type NodeCertificates struct {
+	Node         string
+	Certificates []string // PEM
+}
+
+func getNodeCertificates(kapi MetadataStore, node string) (NodeCertificates, uint64, error) {
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/servers/nodecerts/%s", ETCD_PREFIX, node),
+		nil,
+	)
+	if client.IsKeyNotFound(err) {
+		return NodeCertificates{Node: node}, 0, nil
+	}
+	if err != nil {
+		return NodeCertificates{}, 0, err
+	}
+	var certs NodeCertificates
+	err = json.Unmarshal([]byte(resp.Node.Value), &certs)
+	if err != nil {
+		return NodeCertificates{}, 0, err
+	}
+	return certs, resp.Node.ModifiedIndex, nil
+}
+
+func parseCertificatePEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("No certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func isCertificateRevoked(kapi MetadataStore, cert *x509.Certificate) (bool, error) {
+	_, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/servers/revokedcerts/%s", ETCD_PREFIX, certificateFingerprintOf(cert)),
+		nil,
+	)
+	if client.IsKeyNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func isNodeRevoked(kapi MetadataStore, node string) (bool, error) {
+	_, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/servers/revoked/%s", ETCD_PREFIX, node),
+		nil,
+	)
+	if client.IsKeyNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func certificateFingerprints(certs NodeCertificates) ([]string, error) {
+	fingerprints := []string{}
+	for _, certPEM := range certs.Certificates {
+		cert, err := parseCertificatePEM(certPEM)
+		if err != nil {
+			return nil, err
+		}
+		fingerprints = append(fingerprints, certificateFingerprintOf(cert))
+	}
+	return fingerprints, nil
+}
+
+func revokeCertificates(kapi MetadataStore, node string, fingerprints []string) error {
+	for _, fingerprint := range fingerprints {
+		_, err := kapi.Set(
+			context.Background(),
+			fmt.Sprintf("%s/servers/revokedcerts/%s", ETCD_PREFIX, fingerprint),
+			node,
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refuse every certificate issued to a node so far, and don't issue it
+// another until it's readmitted.
+func revokeNode(node string) (NodeRevocation, error) {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return NodeRevocation{}, err
+	}
+	certs, _, err := getNodeCertificates(kapi, node)
+	if err != nil {
+		return NodeRevocation{}, err
+	}
+	fingerprints, err := certificateFingerprints(certs)
+	if err != nil {
+		return NodeRevocation{}, err
+	}
+	revocation := NodeRevocation{
+		Node: node, RevokedAt: time.Now().Unix(), Fingerprints: fingerprints,
+	}
+	// block new certificates first, so that the node can't be issued one in
+	// between
+	serialized, err := json.Marshal(revocation)
+	if err != nil {
+		return NodeRevocation{}, err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/servers/revoked/%s", ETCD_PREFIX, node),
+		string(serialized),
+		nil,
+	)
+	if err != nil {
+		return NodeRevocation{}, err
+	}
+	err = revokeCertificates(kapi, node, revocation.Fingerprints)
+	if err != nil {
+		return NodeRevocation{}, err
+	}
+	return revocation, nil
+}
+
+// Refuse every certificate issued to a node which has been removed from the
+// cluster, and forget about them, so that a new node with the same name can
+// be issued one.
+func forgetNodeCertificates(kapi MetadataStore, node string) error {
+	certs, _, err := getNodeCertificates(kapi, node)
+	if err != nil {
+		return err
+	}
+	fingerprints, err := certificateFingerprints(certs)
+	if err != nil {
+		return err
+	}
+	err = revokeCertificates(kapi, node, fingerprints)
+	if err != nil {
+		return err
+	}
+	for _, records := range []string{"nodecerts", "nodecsrs"} {
+		_, err = kapi.Delete(
+			context.Background(),
+			fmt.Sprintf("%s/servers/%s/%s", ETCD_PREFIX, records, node),
+			nil,
+		)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// The node which holds the node CA's key, or "" if we don't know.
+func nodeCAHolder(kapi MetadataStore) (string, error) {
+	resp, err := kapi.Get(
+		context.Background(), fmt.Sprintf("%s/servers/nodecaholder", ETCD_PREFIX), nil,
+	)
+	if client.IsKeyNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Node.Value, nil
+}
+
+// Allow a revoked node to be issued a new certificate, e.g. once it's been
+// rebuilt. Its old certificates stay revoked.
+func readmitNode(node string) error {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Delete(
+		context.Background(),
+		fmt.Sprintf("%s/servers/revoked/%s", ETCD_PREFIX, node),
+		nil,
+	)
+	if client.IsKeyNotFound(err) {
+		return fmt.Errorf("Node %s hasn't been revoked", node)
+	}
+	return err
+}
+
+// Make sure we know the node CA, have a node certificate, and, if we're the
+// node which issues them, issue any which have been asked for.
+func (s *InMemoryState) maintainNodeIdentity() error {
+	if apiTLSConfig == nil {
+		return nil
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	caKey, caCert, err := s.ensureNodeCA(kapi)
+	if err != nil {
+		return err
+	}
+	err = s.ensureNodeCertificate(kapi)
+	if err != nil {
+		return err
+	}
+	if caKey != nil {
+		return issueNodeCertificates(kapi, caKey, caCert)
+	}
+	return nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	return ioutil.WriteFile(
+		path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600,
+	)
+}
+
+func isPublicKeyOf(key *rsa.PrivateKey, cert *x509.Certificate) bool {
+	public, ok := cert.PublicKey.(*rsa.PublicKey)
+	return ok && public.N.Cmp(key.N) == 0 && public.E == key.E
+}
+
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("No key found in %s", path)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// Load the node CA from etcd, creating it if no node has yet. Returns its key
+// too if we're the node which created it.
+func (s *InMemoryState) ensureNodeCA(kapi MetadataStore) (*rsa.PrivateKey, *x509.Certificate, error) {
+	key := nodePkiPath("node-ca-key.pem")
+	resp, err := kapi.Get(
+		context.Background(), fmt.Sprintf("%s/servers/nodeca", ETCD_PREFIX), nil,
+	)
+	if client.IsKeyNotFound(err) {
+		err = s.createNodeCA(kapi)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err = kapi.Get(
+			context.Background(), fmt.Sprintf("%s/servers/nodeca", ETCD_PREFIX), nil,
+		)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	caCert, err := parseCertificatePEM(resp.Node.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	cas := x509.NewCertPool()
+	cas.AddCert(caCert)
+	nodeIdentity.Lock()
+	nodeIdentity.cas = cas
+	nodeIdentity.Unlock()
+
+	if !fileExists(key) {
+		return nil, caCert, nil
+	}
+	caKey, err := loadRSAKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isPublicKeyOf(caKey, caCert) {
+		// left over from losing the race to create it
+		return nil, caCert, nil
+	}
+	// checked every time, for node CAs created before the holder was recorded
+	holder, err := nodeCAHolder(kapi)
+	if err != nil {
+		return nil, nil, err
+	}
+	if holder != s.myNodeId {
+		_, err = kapi.Set(
+			context.Background(),
+			fmt.Sprintf("%s/servers/nodecaholder", ETCD_PREFIX),
+			s.myNodeId,
+			nil,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return caKey, caCert, nil
+}
+
+func (s *InMemoryState) createNodeCA(kapi MetadataStore) error {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "dotmesh-node-ca"},
+		NotBefore:             now.Add(-time.Minute).UTC(),
+		NotAfter:              now.Add(10 * NODE_CERTIFICATE_VALIDITY).UTC(),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, caKey.Public(), caKey)
+	if err != nil {
+		return err
+	}
+	// the key is written first, so that it's not lost if we win the race
+	err = writePEM(nodePkiPath("node-ca-key.pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(caKey))
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/servers/nodeca", ETCD_PREFIX),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		&client.SetOptions{PrevExist: client.PrevNoExist},
+	)
+	if err != nil && !isCompareFailed(err) {
+		return err
+	}
+	if err != nil {
+		// another node got there first
+		os.Remove(nodePkiPath("node-ca-key.pem"))
+		return nil
+	}
+	log.Printf("[createNodeCA] Created the node CA, node certificates will be issued by %s", s.myNodeId)
+	return nil
+}
+
+// Pick up our node certificate once it's been issued, asking for one if need
+// be.
+func (s *InMemoryState) ensureNodeCertificate(kapi MetadataStore) error {
+	if haveNodeCertificate() {
+		return nil
+	}
+	keyPath := nodePkiPath("node-key.pem")
+	if !fileExists(keyPath) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		err = writePEM(keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+		if err != nil {
+			return err
+		}
+	}
+	key, err := loadRSAKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	certs, _, err := getNodeCertificates(kapi, s.myNodeId)
+	if err != nil {
+		return err
+	}
+	for _, certPEM := range certs.Certificates {
+		cert, err := parseCertificatePEM(certPEM)
+		if err != nil {
+			return err
+		}
+		if !isPublicKeyOf(key, cert) {
+			continue
+		}
+		err = ioutil.WriteFile(nodePkiPath("node.pem"), []byte(certPEM), 0600)
+		if err != nil {
+			return err
+		}
+		log.Printf("[ensureNodeCertificate] Issued node certificate %s", certificateFingerprintOf(cert))
+		return useNodeCertificate()
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: NODE_CERTIFICATE_PREFIX + s.myNodeId},
+	}, key)
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/servers/nodecsrs/%s", ETCD_PREFIX, s.myNodeId),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+		&client.SetOptions{TTL: 10 * NODE_IDENTITY_INTERVAL},
+	)
+	return err
+}
+
+// Issue the node certificates which have been asked for, as the node which
+// holds the node CA's key.
+func issueNodeCertificates(kapi MetadataStore, caKey *rsa.PrivateKey, caCert *x509.Certificate) error {
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/servers/nodecsrs", ETCD_PREFIX),
+		&client.GetOptions{Recursive: true},
+	)
+	if client.IsKeyNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, csrNode := range resp.Node.Nodes {
+		node := csrNode.Key[strings.LastIndex(csrNode.Key, "/")+1:]
+		err := issueNodeCertificate(kapi, caKey, caCert, node, csrNode.Value)
+		if err != nil {
+			log.Printf("[issueNodeCertificates] Not issuing a certificate to node %s: %s", node, err)
+		}
+		_, err = kapi.Delete(context.Background(), csrNode.Key, nil)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func issueNodeCertificate(
+	kapi MetadataStore, caKey *rsa.PrivateKey, caCert *x509.Certificate, node, csrPEM string,
+) error {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		return fmt.Errorf("No certificate signing request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return err
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		return err
+	}
+	if csr.Subject.CommonName != NODE_CERTIFICATE_PREFIX+node {
+		return fmt.Errorf("The request is for %s", csr.Subject.CommonName)
+	}
+	revoked, err := isNodeRevoked(kapi, node)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return fmt.Errorf("The node has been revoked, and not readmitted")
+	}
+	// a node can only have one certificate at once, so that nobody else can
+	// get one in its name
+	certs, index, err := getNodeCertificates(kapi, node)
+	if err != nil {
+		return err
+	}
+	for _, certPEM := range certs.Certificates {
+		cert, err := parseCertificatePEM(certPEM)
+		if err != nil {
+			return err
+		}
+		revoked, err := isCertificateRevoked(kapi, cert)
+		if err != nil {
+			return err
+		}
+		if !revoked {
+			return fmt.Errorf(
+				"It already has certificate %s, which must be revoked first",
+				certificateFingerprintOf(cert),
+			)
+		}
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		Subject:      pkix.Name{CommonName: NODE_CERTIFICATE_PREFIX + node},
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Minute).UTC(),
+		NotAfter:     time.Now().Add(NODE_CERTIFICATE_VALIDITY).UTC(),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	certs.Certificates = append(
+		certs.Certificates,
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	)
+	serialized, err := json.Marshal(certs)
+	if err != nil {
+		return err
+	}
+	opts := &client.SetOptions{PrevExist: client.PrevNoExist}
+	if index != 0 {
+		opts = &client.SetOptions{PrevIndex: index}
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/servers/nodecerts/%s", ETCD_PREFIX, node),
+		string(serialized),
+		opts,
+	)
+	if err != nil {
+		return err
+	}
+	log.Printf("[issueNodeCertificate] Issued node %s certificate %s", node, certificateFingerprint(der))
+	return nil
+}
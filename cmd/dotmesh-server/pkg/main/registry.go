@@ -210,7 +210,7 @@ type registryFilesystem struct {
 
 // update a filesystem, including updating etcd and our local state
 func (r *Registry) RegisterFilesystem(ctx context.Context, name VolumeName, filesystemId string) error {
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -247,7 +247,7 @@ func (r *Registry) RegisterFilesystem(ctx context.Context, name VolumeName, file
 
 // Remove a filesystem from the registry
 func (r *Registry) UnregisterFilesystem(name VolumeName) error {
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -283,7 +283,7 @@ func (r *Registry) UpdateCollaborators(
 	if err != nil {
 		return err
 	}
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -307,7 +307,7 @@ func (r *Registry) UpdateCollaborators(
 // update a clone, including updating our local record and etcd
 func (r *Registry) RegisterClone(name string, topLevelFilesystemId string, clone Clone) error {
 	r.UpdateCloneFromEtcd(name, topLevelFilesystemId, clone)
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -326,6 +326,24 @@ func (r *Registry) RegisterClone(name string, topLevelFilesystemId string, clone
 	return nil
 }
 
+// remove a clone, including from our local record and etcd
+func (r *Registry) UnregisterClone(name string, topLevelFilesystemId string) error {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Delete(
+		context.Background(),
+		fmt.Sprintf("%s/registry/clones/%s/%s", ETCD_PREFIX, topLevelFilesystemId, name),
+		&client.DeleteOptions{},
+	)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return err
+	}
+	r.DeleteCloneFromEtcd(name, topLevelFilesystemId)
+	return nil
+}
+
 func safeUser(u User) SafeUser {
 	h := md5.New()
 	io.WriteString(h, u.Email)
@@ -404,7 +422,8 @@ func (r *Registry) DeleteCloneFromEtcd(name string, topLevelFilesystemId string)
 	r.ClonesLock.Lock()
 	defer r.ClonesLock.Unlock()
 
-	delete(r.Clones, topLevelFilesystemId)
+	// just this one, the filesystem's other clones are still there
+	delete(r.Clones[topLevelFilesystemId], name)
 }
 
 func (r *Registry) LookupFilesystem(name VolumeName) (TopLevelFilesystem, error) {
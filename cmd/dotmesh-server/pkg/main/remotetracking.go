@@ -0,0 +1,165 @@
+package main
+
+// Remote-tracking branches: a record of the commits on a branch of a dot on
+// another cluster, made by 'dm fetch' without transferring any data.
+//
+// They are stored in etcd under filesystems/remotes/:filesystemId/:remote,
+// where :filesystemId is the local branch and :remote is whatever the user
+// calls the peer. Nothing watches them, they're only read on demand.
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Ask the peer for the commits on a branch of one of its dots, and for the
+// size of the stream a pull would need to catch up with it.
+func (s *InMemoryState) fetchRemoteBranch(
+	filesystemId string, args *FetchRequest,
+) (RemoteTrackingBranch, error) {
+	localSnaps, err := s.snapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return RemoteTrackingBranch{}, err
+	}
+
+	client := NewJsonRpcClient(args.User, args.Peer, args.ApiKey, args.PeerTLS)
+	var remoteFilesystemId string
+	err = client.CallRemote(context.Background(),
+		"DotmeshRPC.Exists", map[string]string{
+			"Namespace": args.RemoteNamespace,
+			"Name":      args.RemoteName,
+			"Branch":    args.RemoteBranchName,
+		}, &remoteFilesystemId)
+	if err != nil {
+		return RemoteTrackingBranch{}, err
+	}
+	if remoteFilesystemId == "" {
+		return RemoteTrackingBranch{}, fmt.Errorf(
+			"No such dot %s/%s on %s", args.RemoteNamespace, args.RemoteName, args.Peer,
+		)
+	}
+	remoteSnaps := []snapshot{}
+	err = client.CallRemote(context.Background(),
+		"DotmeshRPC.CommitsById", remoteFilesystemId, &remoteSnaps,
+	)
+	if err != nil {
+		return RemoteTrackingBranch{}, err
+	}
+
+	var size int64
+	ahead, behind := aheadBehind(localSnaps, remoteSnaps)
+	if behind > 0 {
+		// a pull sends everything after the latest common snapshot, or
+		// everything if there isn't one.
+		var fromSnapshotId string
+		if behind < len(remoteSnaps) {
+			fromSnapshotId = remoteSnaps[len(remoteSnaps)-behind-1].Id
+		}
+		err = client.CallRemote(context.Background(),
+			"DotmeshRPC.PredictSize", map[string]interface{}{
+				"FromFilesystemId": "",
+				"FromSnapshotId":   fromSnapshotId,
+				"ToFilesystemId":   remoteFilesystemId,
+				"ToSnapshotId":     remoteSnaps[len(remoteSnaps)-1].Id,
+			},
+			&size,
+		)
+		if err != nil {
+			return RemoteTrackingBranch{}, err
+		}
+	}
+
+	return RemoteTrackingBranch{
+		FilesystemId:       filesystemId,
+		Remote:             args.Remote,
+		Peer:               args.Peer,
+		User:               args.User,
+		RemoteNamespace:    args.RemoteNamespace,
+		RemoteName:         args.RemoteName,
+		RemoteBranchName:   args.RemoteBranchName,
+		RemoteFilesystemId: remoteFilesystemId,
+		Commits:            remoteSnaps,
+		PredictedSize:      size,
+		FetchedAt:          time.Now().Unix(),
+		Ahead:              ahead,
+		Behind:             behind,
+	}, nil
+}
+
+func saveRemoteTrackingBranch(b RemoteTrackingBranch) error {
+	// counts go stale as soon as someone commits, so don't keep them
+	b.Ahead, b.Behind = 0, 0
+	serialized, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf(
+			"%s/filesystems/remotes/%s/%s", ETCD_PREFIX, b.FilesystemId, b.Remote,
+		),
+		string(serialized),
+		nil,
+	)
+	return err
+}
+
+// All the remote-tracking branches of a local branch, with Ahead and Behind
+// filled in against its current commits.
+func (s *InMemoryState) remoteTrackingBranchesFor(
+	filesystemId string,
+) ([]RemoteTrackingBranch, error) {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/remotes/%s", ETCD_PREFIX, filesystemId),
+		&client.GetOptions{Recursive: true, Sort: true},
+	)
+	if client.IsKeyNotFound(err) {
+		return []RemoteTrackingBranch{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	localSnaps, err := s.snapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	branches := []RemoteTrackingBranch{}
+	for _, node := range resp.Node.Nodes {
+		var b RemoteTrackingBranch
+		err = json.Unmarshal([]byte(node.Value), &b)
+		if err != nil {
+			return nil, err
+		}
+		b.Ahead, b.Behind = aheadBehind(localSnaps, b.Commits)
+		branches = append(branches, b)
+	}
+	return branches, nil
+}
+
+// How many commits local has after the latest snapshot it has in common with
+// remote, and vice versa. With nothing in common, everything on each side.
+func aheadBehind(local, remote []snapshot) (int, int) {
+	remoteIndex := map[string]int{}
+	for i, snap := range remote {
+		remoteIndex[snap.Id] = i
+	}
+	for i := len(local) - 1; i >= 0; i-- {
+		if j, ok := remoteIndex[local[i].Id]; ok {
+			return len(local) - 1 - i, len(remote) - 1 - j
+		}
+	}
+	return len(local), len(remote)
+}
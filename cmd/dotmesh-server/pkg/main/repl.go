@@ -191,7 +191,7 @@ func (s *InMemoryState) repl() {
 				s.serverAddressesCacheLock.Unlock()
 			case "promote":
 				// TODO maybe move setting a master into controller.go
-				kapi, err := getEtcdKeysApi()
+				kapi, err := getMetadataStore()
 				if err != nil {
 					out(err)
 					break
@@ -0,0 +1,353 @@
+package main
+
+// Replication factors.
+//
+// By default every node keeps a copy of every dot, receiving each commit from
+// the master as it's made. With a replication factor of N, set for the
+// cluster with DOTMESH_REPLICATION_FACTOR or for a dot (and its branches)
+// with `dm dot set-replication-factor`, only N nodes do: the master, and the
+// N-1 replicas listed under filesystems/replicas/:filesystem. The nodes keep
+// those lists topped up from the live nodes with the most up-to-date copies
+// as replicas come and go; other nodes keep any copies they already have, but
+// stop updating them. A node which a dot is about to be moved to puts itself
+// at the front of the list, so that it can catch up first.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// how often to check that every filesystem has enough replicas
+const REPLICA_CHECK_INTERVAL = 10 * time.Second
+
+// zero means every node keeps a copy
+var defaultReplicationFactor int
+
+func loadReplicationFactor() error {
+	setting := os.Getenv("DOTMESH_REPLICATION_FACTOR")
+	if setting == "" {
+		return nil
+	}
+	factor, err := strconv.Atoi(setting)
+	if err != nil || factor < 0 {
+		return fmt.Errorf(
+			"Invalid DOTMESH_REPLICATION_FACTOR %q, expected a number of copies, or 0 for every node",
+			setting,
+		)
+	}
+	defaultReplicationFactor = factor
+	return nil
+}
+
+func (s *InMemoryState) updateReplicationFactorFromEtcd(topLevelFilesystemId string, factor int) {
+	s.replicationFactorsLock.Lock()
+	defer s.replicationFactorsLock.Unlock()
+	if factor == 0 {
+		delete(*s.replicationFactors, topLevelFilesystemId)
+	} else {
+		(*s.replicationFactors)[topLevelFilesystemId] = factor
+	}
+}
+
+func (s *InMemoryState) updateReplicasFromEtcd(filesystemId string, replicas []string) {
+	s.replicasCacheLock.Lock()
+	wasReplica := false
+	for _, node := range (*s.replicasCache)[filesystemId] {
+		wasReplica = wasReplica || node == s.myNodeId
+	}
+	if replicas == nil {
+		delete(*s.replicasCache, filesystemId)
+	} else {
+		(*s.replicasCache)[filesystemId] = replicas
+	}
+	s.replicasCacheLock.Unlock()
+
+	if !wasReplica && s.replicates(filesystemId) && s.masterFor(filesystemId) != s.myNodeId {
+		// catch up now, rather than when the master's next commit is made
+		snapshots, err := s.snapshotsForCurrentMaster(filesystemId)
+		if err == nil && len(snapshots) > 0 {
+			go s.newSnapsOnMaster.Publish(filesystemId, snapshots[len(snapshots)-1])
+		}
+	}
+}
+
+// The number of copies of a filesystem to keep, or zero for one on every
+// node.
+func (s *InMemoryState) replicationFactorFor(filesystemId string) int {
+	tlf, _, err := s.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return defaultReplicationFactor
+	}
+	s.replicationFactorsLock.Lock()
+	defer s.replicationFactorsLock.Unlock()
+	factor, ok := (*s.replicationFactors)[tlf.MasterBranch.Id]
+	if !ok {
+		return defaultReplicationFactor
+	}
+	return factor
+}
+
+func (s *InMemoryState) replicasFor(filesystemId string) ([]string, bool) {
+	s.replicasCacheLock.Lock()
+	defer s.replicasCacheLock.Unlock()
+	replicas, ok := (*s.replicasCache)[filesystemId]
+	return replicas, ok
+}
+
+// Whether we should keep our copy of a filesystem up to date.
+func (s *InMemoryState) replicates(filesystemId string) bool {
+	if s.replicationFactorFor(filesystemId) == 0 {
+		return true
+	}
+	replicas, _ := s.replicasFor(filesystemId)
+	for _, node := range replicas {
+		if node == s.myNodeId {
+			return true
+		}
+	}
+	return false
+}
+
+// How far through masterSnaps the latest of snaps which is also in it is, or
+// -1 if none of them are.
+func latestCommonPosition(masterSnaps, snaps []snapshot) int {
+	position := map[string]int{}
+	for i, snap := range masterSnaps {
+		position[snap.Id] = i
+	}
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if p, ok := position[snaps[i].Id]; ok {
+			return p
+		}
+	}
+	return -1
+}
+
+// The number of copies of a filesystem to keep (or zero for one on every
+// node), and the number of live nodes, the master included, which have all of
+// its commits.
+func (s *InMemoryState) replicationStatus(filesystemId, master string) (int, int) {
+	live := s.liveServers()
+	s.globalSnapshotCacheLock.Lock()
+	defer s.globalSnapshotCacheLock.Unlock()
+	masterSnaps := (*s.globalSnapshotCache)[master][filesystemId]
+	upToDate := 0
+	for server := range live {
+		if server == master {
+			upToDate++
+			continue
+		}
+		snaps, ok := (*s.globalSnapshotCache)[server][filesystemId]
+		if ok && len(masterSnaps) > 0 && latestCommonPosition(masterSnaps, snaps) == len(masterSnaps)-1 {
+			upToDate++
+		}
+	}
+	return s.replicationFactorFor(filesystemId), upToDate
+}
+
+// Make sure each filesystem with a replication factor has enough replicas on
+// live nodes, and not too many.
+func (s *InMemoryState) maintainReplicas() error {
+	// nodes being drained don't count
+	live := s.placeableServers()
+	masters := map[string]string{}
+	s.mastersCacheLock.Lock()
+	for fs, master := range *s.mastersCache {
+		masters[fs] = master
+	}
+	s.mastersCacheLock.Unlock()
+
+	for fs, master := range masters {
+		factor := s.replicationFactorFor(fs)
+		current, existed := s.replicasFor(fs)
+		if factor == 0 && !existed {
+			continue
+		}
+		want := factor - 1
+		if factor == 0 {
+			// every node has a copy again, the list isn't needed
+			want = 0
+		}
+
+		replicas := []string{}
+		for _, node := range current {
+			if live[node] && node != master {
+				replicas = append(replicas, node)
+			}
+		}
+		if len(replicas) > want {
+			// the ones at the front are the ones which were asked for first
+			replicas = replicas[:want]
+		}
+		if len(replicas) < want {
+			replicas = append(replicas, s.replicaCandidates(fs, master, live, replicas)...)
+			if len(replicas) > want {
+				replicas = replicas[:want]
+			}
+			if len(replicas) < want {
+				log.Printf(
+					"[maintainReplicas] Only %d live nodes to keep %d copies of %s on",
+					len(replicas)+1, factor, fs,
+				)
+			}
+		}
+
+		if factor == 0 {
+			replicas = nil
+		} else if existed && equalStrings(replicas, current) {
+			continue
+		}
+		err := s.setReplicas(fs, current, existed, replicas)
+		if err != nil && !isCompareFailed(err) {
+			log.Printf("[maintainReplicas] Unable to update replicas of %s: %s", fs, err)
+		}
+	}
+	return nil
+}
+
+// Live nodes which could become replicas of a filesystem, most up-to-date
+// first.
+func (s *InMemoryState) replicaCandidates(
+	filesystemId, master string, live map[string]bool, replicas []string,
+) []string {
+	already := map[string]bool{master: true}
+	for _, node := range replicas {
+		already[node] = true
+	}
+	s.globalSnapshotCacheLock.Lock()
+	defer s.globalSnapshotCacheLock.Unlock()
+	masterSnaps := (*s.globalSnapshotCache)[master][filesystemId]
+	position := map[string]int{}
+	candidates := []string{}
+	for node := range live {
+		if already[node] {
+			continue
+		}
+		position[node] = latestCommonPosition(
+			masterSnaps, (*s.globalSnapshotCache)[node][filesystemId],
+		)
+		candidates = append(candidates, node)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if position[candidates[i]] != position[candidates[j]] {
+			return position[candidates[i]] > position[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	return candidates
+}
+
+// Replace the list of replicas of a filesystem, if it's still current.
+func (s *InMemoryState) setReplicas(
+	filesystemId string, current []string, existed bool, replicas []string,
+) error {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s/filesystems/replicas/%s", ETCD_PREFIX, filesystemId)
+	serializedCurrent, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	if replicas == nil {
+		_, err = kapi.Delete(
+			context.Background(), key, &client.DeleteOptions{PrevValue: string(serializedCurrent)},
+		)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	} else {
+		serialized, err := json.Marshal(replicas)
+		if err != nil {
+			return err
+		}
+		opts := &client.SetOptions{PrevExist: client.PrevNoExist}
+		if existed {
+			opts = &client.SetOptions{PrevValue: string(serializedCurrent)}
+		}
+		_, err = kapi.Set(context.Background(), key, string(serialized), opts)
+		if err != nil {
+			return err
+		}
+		log.Printf("[setReplicas] Replicas of %s are now %s", filesystemId, replicas)
+	}
+	s.updateReplicasFromEtcd(filesystemId, replicas)
+	return nil
+}
+
+// Put node at the front of the list of replicas of a filesystem, if it has a
+// replication factor, e.g. so that it can catch up before the filesystem is
+// moved to it.
+func (s *InMemoryState) addReplica(filesystemId, node string) error {
+	if s.replicationFactorFor(filesystemId) == 0 {
+		return nil
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	// read it afresh, our cache may be behind
+	current := []string{}
+	existed := true
+	resp, err := kapi.Get(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/replicas/%s", ETCD_PREFIX, filesystemId),
+		nil,
+	)
+	if client.IsKeyNotFound(err) {
+		existed = false
+	} else if err != nil {
+		return err
+	} else {
+		err = json.Unmarshal([]byte(resp.Node.Value), &current)
+		if err != nil {
+			return err
+		}
+	}
+	replicas := []string{node}
+	for _, replica := range current {
+		if replica == node {
+			return nil
+		}
+		replicas = append(replicas, replica)
+	}
+	return s.setReplicas(filesystemId, current, existed, replicas)
+}
+
+func setReplicationFactor(topLevelFilesystemId string, factor int) error {
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s/filesystems/replication/%s", ETCD_PREFIX, topLevelFilesystemId)
+	if factor == 0 {
+		_, err = kapi.Delete(context.Background(), key, nil)
+		if client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	_, err = kapi.Set(context.Background(), key, fmt.Sprintf("%d", factor), nil)
+	return err
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -15,8 +15,9 @@ import (
 
 // machinery for remote zfs replication
 
-const BUF_LEN = 131072         // 128kb of replication data sent per update (of etcd)
+const BUF_LEN = 131072         // 128kb of replication data sent per progress update
 const START_SNAPSHOT = "START" // meaning "the start of the filesystem"
+const BASE_SNAPSHOT = "BASE"   // meaning "just toSnap, without its history"
 
 func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// respond to GET requests with a ZFS data stream
@@ -39,13 +40,12 @@ func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	master := z.state.masterFor(z.filesystem)
 
 	if master != z.state.myNodeId {
-		addresses := z.state.addressesFor(master)
-		// XXX hack, IPv4 happens to come before IPv6 and happens to be routeable
-		// on my network (whereas IPv6 isn't), but this depends on the enumeration
-		// order of network cards in servers :/
-		// TODO we should really attempt each address in turn until we find one
-		// that works.
-		peerAddress := addresses[0]
+		peerAddress, err := z.state.reachableAddressFor(master)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(fmt.Sprintf("Can't proxy pull from %s: %s.\n", master, err)))
+			return
+		}
 
 		url := fmt.Sprintf(
 			"%s/filesystems/%s/%s/%s",
@@ -61,18 +61,13 @@ func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			r.Body,
 		)
 
-		_, _, apiKey, err := getPasswords("admin")
+		err = authenticateInternal(req)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(fmt.Sprintf("Can't establish API key to proxy pull: %+v.\n", err)))
 			return
 		}
-
-		req.SetBasicAuth(
-			"admin",
-			apiKey,
-		)
-		postClient := new(http.Client)
+		postClient := internalHttpClient
 		log.Printf("[ZFSSender:ServeHTTP] Proxying pull from %s: %s", master, url)
 		resp, err := postClient.Do(req)
 		finished := make(chan bool)
@@ -121,6 +116,11 @@ func (z ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// -R sends interim snapshots as well
 			"zfs", "send", "-p", "-R", fq(z.filesystem)+"@"+z.toSnap,
 		)
+	} else if z.fromSnap == BASE_SNAPSHOT {
+		// the start of a shallow transfer
+		cmd = exec.Command(
+			"zfs", "send", "-p", fq(z.filesystem)+"@"+z.toSnap,
+		)
 	} else {
 		var fromSnap string
 		// in clone case, z.fromSnap must be fully qualified
@@ -234,13 +234,12 @@ func (z ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		// else OK, we can proceed
 	} else {
-		addresses := z.state.addressesFor(master)
-		// XXX hack, IPv4 happens to come before IPv6 and happens to be routeable
-		// on my network (whereas IPv6 isn't), but this depends on the enumeration
-		// order of network cards in servers :/
-		// TODO we should really attempt each address in turn until we find one
-		// that works.
-		peerAddress := addresses[0]
+		peerAddress, err := z.state.reachableAddressFor(master)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(fmt.Sprintf("Can't proxy push to %s: %s.\n", master, err)))
+			return
+		}
 
 		url := fmt.Sprintf(
 			"%s/filesystems/%s/%s/%s",
@@ -256,18 +255,13 @@ func (z ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			r.Body,
 		)
 
-		_, _, apiKey, err := getPasswords("admin")
+		err = authenticateInternal(req)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(fmt.Sprintf("Can't establish API key to proxy push: %+v.\n", err)))
 			return
 		}
-
-		req.SetBasicAuth(
-			"admin",
-			apiKey,
-		)
-		postClient := new(http.Client)
+		postClient := internalHttpClient
 		log.Printf("[ZFSReceiver] Proxying push to %s: %s", master, url)
 		resp, err := postClient.Do(req)
 		finished := make(chan bool)
@@ -0,0 +1,226 @@
+package main
+
+// Requests to a filesystem's master.
+//
+// To have whichever node is master of a filesystem act on an event, a node
+// writes it under filesystems/requests/:filesystem/:request_id, and the
+// master, which watches for requests for the filesystems it's master of,
+// writes its response under filesystems/responses/:filesystem/:request_id.
+//
+// Requests made on behalf of an API call (see globalFsRequestContext) stop
+// waiting when the call's context is done, which withRequestTimeout bounds by
+// DOTMESH_REQUEST_TIMEOUT (two minutes by default, "off" to wait for as long
+// as the call does), and respond with "master-unavailable" rather than hang.
+// Such requests expire at the same time, so that a master which turns up
+// later doesn't act on them.
+//
+// Once the requester has had its response, or has given up, it deletes both
+// the request and the response. A master only acts on requests which are
+// still there, and deletes its response to a request which has gone while it
+// was acting on it. Moves keep theirs, for pollMove to find, until they
+// expire.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+)
+
+const DEFAULT_REQUEST_TIMEOUT = 2 * time.Minute
+
+// how long requests and responses are kept when nothing is waiting for them
+// with a deadline
+const REQUEST_TTL = 7 * 24 * time.Hour
+
+// zero if requests wait for as long as the API call does
+var requestTimeout time.Duration
+
+func loadRequestTimeout() error {
+	setting := os.Getenv("DOTMESH_REQUEST_TIMEOUT")
+	switch setting {
+	case "":
+		requestTimeout = DEFAULT_REQUEST_TIMEOUT
+	case "off":
+		requestTimeout = 0
+	default:
+		timeout, err := time.ParseDuration(setting)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf(
+				"Invalid DOTMESH_REQUEST_TIMEOUT %q, expected e.g. 2m, or off", setting,
+			)
+		}
+		requestTimeout = timeout
+	}
+	return nil
+}
+
+// Bound how long an API call waits for a filesystem's master by
+// requestTimeout.
+func withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if requestTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, requestTimeout)
+}
+
+func requestKey(fs, requestId string) string {
+	return fmt.Sprintf("%s/filesystems/requests/%s/%s", ETCD_PREFIX, fs, requestId)
+}
+
+func responseKey(fs, requestId string) string {
+	return fmt.Sprintf("%s/filesystems/responses/%s/%s", ETCD_PREFIX, fs, requestId)
+}
+
+// make a global request, returning its id
+func (s *InMemoryState) globalFsRequestId(fs string, e *Event) (chan *Event, string, error) {
+	return s.sendGlobalFsRequest(context.Background(), fs, e, false)
+}
+
+// attempt to register an event in etcd upon which the current master for that
+// filesystem will act on it and then respond, however long that takes
+func (s *InMemoryState) globalFsRequest(fs string, e *Event) (chan *Event, error) {
+	c, _, err := s.sendGlobalFsRequest(context.Background(), fs, e, false)
+	// throw away id
+	return c, err
+}
+
+// Like globalFsRequest, but respond with "master-unavailable" if the master
+// hasn't responded by the time ctx is done.
+func (s *InMemoryState) globalFsRequestContext(
+	ctx context.Context, fs string, e *Event,
+) (chan *Event, error) {
+	c, _, err := s.sendGlobalFsRequest(ctx, fs, e, false)
+	return c, err
+}
+
+// Make a global request, returning its id, and leaving the request and the
+// response in etcd until they expire if keep is set.
+func (s *InMemoryState) sendGlobalFsRequest(
+	ctx context.Context, fs string, e *Event, keep bool,
+) (chan *Event, string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, "", err
+	}
+	requestId := id.String()
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return nil, "", err
+	}
+	log.Printf("globalFsRequest %s %s", fs, e)
+	if epoch := s.masterEpochFor(fs); epoch > 0 {
+		// so that the master can tell if it's been superseded, on a copy so
+		// as not to change the caller's event
+		args := EventArgs{}
+		if e.Args != nil {
+			for k, v := range *e.Args {
+				args[k] = v
+			}
+		}
+		args["masterEpoch"] = epoch
+		e = &Event{Name: e.Name, Args: &args}
+	}
+	serialized, err := s.serializeEvent(e)
+	if err != nil {
+		log.Printf("globalFsRequest - error serializing %s: %s", e, err)
+		return nil, "", err
+	}
+	ttl := REQUEST_TTL
+	if deadline, ok := ctx.Deadline(); ok {
+		// nobody will be waiting for a response after that, in whole seconds
+		// for etcd
+		ttl = (time.Until(deadline)/time.Second + 1) * time.Second
+	}
+	log.Printf("globalFsRequest: setting '%s' to '%s'", requestKey(fs, requestId), serialized)
+	resp, err := kapi.Set(
+		context.Background(),
+		requestKey(fs, requestId),
+		serialized,
+		&client.SetOptions{PrevExist: client.PrevNoExist, TTL: ttl},
+	)
+	if err != nil {
+		log.Printf("globalFsRequest - error setting %s: %s", e, err)
+		return nil, "", err
+	}
+	// buffered, so that nothing has to wait for the response if it's not
+	// interested
+	responseChan := make(chan *Event, 1)
+	go func() {
+		// TODO become able to cope with becoming disconnected from etcd and
+		// then reconnecting and pick up where we left off (process any new
+		// responses)...
+		watcher := kapi.Watcher(
+			// TODO maybe responses should get their own IDs, so that there can be
+			// multiple responses to a given event (at present we just assume one)
+			responseKey(fs, requestId),
+			&client.WatcherOptions{AfterIndex: resp.Node.CreatedIndex, Recursive: true},
+		)
+		var response *Event
+		node, err := watcher.Next(ctx)
+		if err != nil && ctx.Err() != nil {
+			response = s.masterUnavailable(ctx, fs)
+		} else if err != nil {
+			response = &Event{
+				Name: "error-watcher-next", Args: &EventArgs{"err": err},
+			}
+		} else {
+			response, err = s.deserializeEvent(node.Node)
+			if err != nil {
+				response = &Event{
+					Name: "error-deserialize", Args: &EventArgs{"err": err},
+				}
+			}
+		}
+		// the one-off response chan has done its job here.
+		responseChan <- response
+		close(responseChan)
+
+		if !keep {
+			for _, key := range []string{requestKey(fs, requestId), responseKey(fs, requestId)} {
+				_, err = kapi.Delete(context.Background(), key, nil)
+				if err != nil && !client.IsKeyNotFound(err) {
+					log.Printf("Error while trying to clean up %s: %s", key, err)
+				}
+			}
+		}
+	}()
+	return responseChan, requestId, nil
+}
+
+// The response to a request whose requester gave up waiting for the master.
+func (s *InMemoryState) masterUnavailable(ctx context.Context, fs string) *Event {
+	master := s.masterFor(fs)
+	var err error
+	switch {
+	case ctx.Err() != context.DeadlineExceeded:
+		err = fmt.Errorf(
+			"Gave up waiting for the master of %s to respond: %s", fs, ctx.Err(),
+		)
+	case master == "":
+		err = fmt.Errorf(
+			"No node is master of %s, so nothing responded in time, please try again later", fs,
+		)
+	case !s.liveServers()[master]:
+		err = fmt.Errorf(
+			"The master of %s, %s, is unavailable: it hasn't been seen for a while. "+
+				"Please try again once it's back, or once %s has failed over to another node",
+			fs, master, fs,
+		)
+	default:
+		err = fmt.Errorf(
+			"The master of %s, %s, didn't respond in time, it may be unavailable or busy, "+
+				"please try again",
+			fs, master,
+		)
+	}
+	log.Printf("[masterUnavailable] %s", err)
+	return &Event{
+		Name: "master-unavailable",
+		Args: &EventArgs{"err": err, "master": master},
+	}
+}
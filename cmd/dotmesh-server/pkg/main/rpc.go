@@ -7,10 +7,12 @@ import (
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/coreos/etcd/client"
+	"github.com/nu7hatch/gouuid"
 )
 
 // TODO ensure contexts are threaded through in all RPC calls for correct
@@ -557,7 +559,7 @@ func (d *DotmeshRPC) Commits(
 	if err != nil {
 		return err
 	}
-	*result = snapshots
+	*result = visibleCommits(snapshots)
 	return nil
 }
 
@@ -570,10 +572,24 @@ func (d *DotmeshRPC) CommitsById(
 	if err != nil {
 		return err
 	}
+	// all of them, hidden or not, since this is what pushes and pulls compare
 	*result = snapshots
 	return nil
 }
 
+// Leave out the commits marked HIDDEN_COMMIT, such as those made while
+// pre-copying a dot being moved between nodes, from those shown to users.
+func visibleCommits(snapshots []snapshot) []snapshot {
+	visible := []snapshot{}
+	for _, snap := range snapshots {
+		if snap.Metadata != nil && (*snap.Metadata)[HIDDEN_COMMIT] == "true" {
+			continue
+		}
+		visible = append(visible, snap)
+	}
+	return visible
+}
+
 // Acknowledge that an authenticated connection had been successfully established.
 func (d *DotmeshRPC) Ping(r *http.Request, args *struct{}, result *bool) error {
 	*result = true
@@ -612,7 +628,10 @@ func (d *DotmeshRPC) Commit(
 	user, _, _ := r.BasicAuth()
 	meta := metadata{"message": args.Message, "author": user}
 
-	responseChan, err := d.state.globalFsRequest(
+	ctx, cancel := withRequestTimeout(r.Context())
+	defer cancel()
+	responseChan, err := d.state.globalFsRequestContext(
+		ctx,
 		filesystemId,
 		&Event{Name: "snapshot",
 			Args: &EventArgs{"metadata": meta}},
@@ -622,8 +641,6 @@ func (d *DotmeshRPC) Commit(
 		return err
 	}
 
-	// TODO this may never succeed, if the master for it never shows up. maybe
-	// this response should have a timeout associated with it.
 	e := <-responseChan
 	if e.Name == "snapshotted" {
 		log.Printf("Snapshotted %s", filesystemId)
@@ -656,7 +673,10 @@ func (d *DotmeshRPC) Rollback(
 	if err != nil {
 		return err
 	}
-	responseChan, err := d.state.globalFsRequest(
+	ctx, cancel := withRequestTimeout(r.Context())
+	defer cancel()
+	responseChan, err := d.state.globalFsRequestContext(
+		ctx,
 		filesystemId,
 		&Event{Name: "rollback",
 			Args: &EventArgs{"rollbackTo": args.SnapshotId}},
@@ -665,8 +685,6 @@ func (d *DotmeshRPC) Rollback(
 		return err
 	}
 
-	// TODO this may never succeed, if the master for it never shows up. maybe
-	// this response should have a timeout associated with it.
 	e := <-responseChan
 	if e.Name == "rolled-back" {
 		log.Printf(
@@ -685,9 +703,10 @@ func (d *DotmeshRPC) Rollback(
 
 func maybeError(e *Event) error {
 	log.Printf("Unexpected response %s - %s", e.Name, e.Args)
-	err, ok := (*e.Args)["err"]
+	// only an error as such if it hasn't been through json
+	err, ok := (*e.Args)["err"].(error)
 	if ok {
-		return err.(error)
+		return err
 	} else {
 		return fmt.Errorf("Unexpected response %s - %s", e.Name, e.Args)
 	}
@@ -748,7 +767,10 @@ func (d *DotmeshRPC) Branch(
 	// target node is responsible for creating registry entry (so that they're
 	// as close as possible to eachother), so give it all the info it needs to
 	// do that.
-	responseChan, err := d.state.globalFsRequest(
+	ctx, cancel := withRequestTimeout(r.Context())
+	defer cancel()
+	responseChan, err := d.state.globalFsRequestContext(
+		ctx,
 		originFilesystemId,
 		&Event{Name: "clone",
 			Args: &EventArgs{
@@ -763,8 +785,6 @@ func (d *DotmeshRPC) Branch(
 		return err
 	}
 
-	// TODO this may never succeed, if the master for it never shows up. maybe
-	// this response should have a timeout associated with it.
 	e := <-responseChan
 	if e.Name == "cloned" {
 		log.Printf(
@@ -791,6 +811,303 @@ func (d *DotmeshRPC) Version(
 	return nil
 }
 
+// Refuse the node certificates a node has been issued until now, e.g. because
+// it's been compromised. See nodeidentity.go.
+func (d *DotmeshRPC) RevokeNode(
+	r *http.Request, args *struct{ Node string }, result *NodeRevocation) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+	// the nodes themselves act as admin, but mustn't be able to shut each
+	// other out
+	if node, ok := r.Context().Value("authenticated-node").(string); ok {
+		return fmt.Errorf("Node %s can't revoke other nodes", node)
+	}
+	if args.Node == "" {
+		return fmt.Errorf("Please specify the node to revoke")
+	}
+
+	revocation, err := revokeNode(args.Node)
+	if err != nil {
+		return err
+	}
+	log.Printf("[RevokeNode] Revoked node %s", args.Node)
+	*result = revocation
+	return nil
+}
+
+// Allow a revoked node to be issued a new node certificate, e.g. once it's
+// been rebuilt. See nodeidentity.go.
+func (d *DotmeshRPC) ReadmitNode(
+	r *http.Request, args *struct{ Node string }, result *bool) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+	// a revoked node mustn't be able to let itself back in
+	if node, ok := r.Context().Value("authenticated-node").(string); ok {
+		return fmt.Errorf("Node %s can't readmit other nodes", node)
+	}
+	if args.Node == "" {
+		return fmt.Errorf("Please specify the node to readmit")
+	}
+
+	err = readmitNode(args.Node)
+	if err != nil {
+		return err
+	}
+	log.Printf("[ReadmitNode] Readmitted node %s", args.Node)
+	*result = true
+	return nil
+}
+
+// An overview of every node in the cluster, etcd, and the transfers in
+// progress. See clusterstatus.go.
+func (d *DotmeshRPC) ClusterStatus(
+	r *http.Request, args *struct{}, result *ClusterStatus) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+
+	status, err := d.state.clusterStatus()
+	if err != nil {
+		return err
+	}
+	*result = status
+	return nil
+}
+
+// Stop placing dots on a node, and move the ones it's the master of to other
+// nodes. Poll each move with PollMove, and the drain as a whole with
+// DrainStatus. See drain.go.
+func (d *DotmeshRPC) DrainNode(
+	r *http.Request,
+	args *struct {
+		Node           string
+		StopContainers bool
+	},
+	result *[]DrainMove,
+) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+	if node, ok := r.Context().Value("authenticated-node").(string); ok {
+		return fmt.Errorf("Node %s can't drain other nodes", node)
+	}
+	if args.Node == "" {
+		return fmt.Errorf("Please specify the node to drain")
+	}
+
+	moves, err := d.state.drainNode(args.Node, args.StopContainers)
+	if err != nil {
+		return err
+	}
+	*result = moves
+	return nil
+}
+
+func (d *DotmeshRPC) DrainStatus(
+	r *http.Request, args *struct{ Node string }, result *DrainStatus) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+
+	*result = d.state.drainStatus(args.Node)
+	return nil
+}
+
+// Forget a node which has been drained and stopped. See drain.go.
+func (d *DotmeshRPC) RemoveNode(
+	r *http.Request, args *struct{ Node string }, result *bool) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+	if node, ok := r.Context().Value("authenticated-node").(string); ok {
+		return fmt.Errorf("Node %s can't remove other nodes", node)
+	}
+	if args.Node == "" {
+		return fmt.Errorf("Please specify the node to remove")
+	}
+
+	err = d.state.removeNode(args.Node)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Every key of the cluster's metadata worth keeping, as of one index of the
+// metadata store. See backup.go.
+func (d *DotmeshRPC) BackupMetadata(
+	r *http.Request, args *struct{}, result *MetadataBackup) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+
+	backup, err := d.state.backupMetadata()
+	if err != nil {
+		return err
+	}
+	*result = backup
+	return nil
+}
+
+// Write back a backup taken with BackupMetadata, and reconcile the masters of
+// its dots with what the nodes have.
+func (d *DotmeshRPC) RestoreMetadata(
+	r *http.Request,
+	args *struct {
+		Backup MetadataBackup
+		Force  bool
+	},
+	result *RestoreResult,
+) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+	if node, ok := r.Context().Value("authenticated-node").(string); ok {
+		return fmt.Errorf("Node %s can't restore the cluster's metadata", node)
+	}
+
+	restored, err := d.state.restoreMetadata(args.Backup, args.Force)
+	if err != nil {
+		return err
+	}
+	*result = restored
+	return nil
+}
+
+// Move a branch of a dot to another node, making it the master. Poll its
+// progress with PollMove. See move.go.
+func (d *DotmeshRPC) Move(
+	r *http.Request,
+	args *struct {
+		Namespace, Name, Branch, Target string
+		StopContainers                  bool
+	},
+	result *MoveRequest,
+) error {
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{args.Namespace, args.Name})
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeOwner(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"You are not the owner of volume %s/%s. Only the owner can move it.",
+			args.Namespace, args.Name,
+		)
+	}
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{args.Namespace, args.Name},
+		args.Branch,
+	)
+	if err != nil {
+		return err
+	}
+	requestId, err := d.state.moveFilesystem(filesystemId, args.Target, args.StopContainers)
+	if err != nil {
+		return err
+	}
+	*result = MoveRequest{FilesystemId: filesystemId, RequestId: requestId}
+	return nil
+}
+
+func (d *DotmeshRPC) PollMove(
+	r *http.Request, args *MoveRequest, result *MovePollResult,
+) error {
+	tlf, _, err := d.state.registry.LookupFilesystemById(args.FilesystemId)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeOwner(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"You are not the owner of volume %s/%s. Only the owner can move it.",
+			tlf.MasterBranch.Name.Namespace, tlf.MasterBranch.Name.Name,
+		)
+	}
+	poll, err := d.state.pollMove(args.FilesystemId, args.RequestId)
+	if err != nil {
+		return err
+	}
+	*result = poll
+	return nil
+}
+
+// Set the number of copies of a dot and its branches to keep in the cluster,
+// or zero to go back to the cluster's default. See replicas.go.
+func (d *DotmeshRPC) SetReplicationFactor(
+	r *http.Request,
+	args *struct {
+		Namespace, Name string
+		Factor          int
+	},
+	result *bool,
+) error {
+	if args.Factor < 0 {
+		return fmt.Errorf("The replication factor can't be negative")
+	}
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{args.Namespace, args.Name})
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.AuthorizeOwner(r.Context())
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"You are not the owner of volume %s/%s. Only the owner can change how many copies of it are kept.",
+			args.Namespace, args.Name,
+		)
+	}
+	err = setReplicationFactor(tlf.MasterBranch.Id, args.Factor)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Every automatic failover so far, oldest first. See failover.go.
+func (d *DotmeshRPC) Failovers(
+	r *http.Request, args *struct{}, result *[]FailoverEvent) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+	events, err := failoverEvents()
+	if err != nil {
+		return err
+	}
+	*result = events
+	return nil
+}
+
 func (d *DotmeshRPC) registerFilesystemBecomeMaster(
 	ctx context.Context,
 	filesystemNamespace, filesystemName, cloneName, filesystemId string,
@@ -805,7 +1122,7 @@ func (d *DotmeshRPC) registerFilesystemBecomeMaster(
 	d.state.initFilesystemMachine(filesystemId)
 	log.Printf("[registerFilesystemBecomeMaster] done initFilesystemMachine for %s", filesystemId)
 
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -919,12 +1236,18 @@ func (d *DotmeshRPC) GetTransfer(
 	args *string,
 	result *TransferPollResult,
 ) error {
-	// Poll the status of a transfer by fetching it from our local cache.
-	res, ok := (*d.state.interclusterTransfers)[*args]
+	// Poll the status of a transfer by fetching it from our local cache,
+	// which is more up to date than etcd if we're running the transfer.
+	res, ok := latestPollResult(*args)
+	if ok {
+		*result = safePollResult(res)
+		return nil
+	}
+	res, ok = (*d.state.interclusterTransfers)[*args]
 	if !ok {
 		return fmt.Errorf("No such intercluster transfer %s", *args)
 	}
-	*result = res
+	*result = safePollResult(res)
 	return nil
 }
 
@@ -940,7 +1263,7 @@ func (d *DotmeshRPC) RegisterTransfer(
 	if err != nil {
 		return err
 	}
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -982,103 +1305,150 @@ func (d *DotmeshRPC) RegisterTransfer(
 	return nil
 }
 
-// Need both push and pull because one cluster will often be behind NAT.
-// Transfer will immediately return a transferId which can be queried until
-// completion
-func (d *DotmeshRPC) Transfer(
+// Called on the peer by the initiator of a forced push which found that the
+// peer has commits after LatestCommonSnapshotId that it doesn't. Moves those
+// commits onto a new branch, rolls the filesystem back to the latest common
+// snapshot and returns the name of the new branch.
+func (d *DotmeshRPC) PreserveDivergedCommits(
 	r *http.Request,
-	args *TransferRequest,
+	args *struct{ FilesystemId, LatestCommonSnapshotId string },
 	result *string,
 ) error {
-	client := NewJsonRpcClient(args.User, args.Peer, args.ApiKey)
-
-	log.Printf("[Transfer] starting with %+v", safeArgs(*args))
-
-	switch args.Direction {
-	case "push":
-		err := requireValidVolumeName(VolumeName{args.RemoteNamespace, args.RemoteName})
-		if err != nil {
-			return err
-		}
-	case "pull":
-		err := requireValidVolumeName(VolumeName{args.LocalNamespace, args.LocalName})
-		if err != nil {
-			return err
-		}
+	err := d.authorizeFilesystem(r.Context(), args.FilesystemId)
+	if err != nil {
+		return err
 	}
-
-	var remoteFilesystemId string
-	err := client.CallRemote(r.Context(),
-		"DotmeshRPC.Exists", map[string]string{
-			"Namespace": args.RemoteNamespace,
-			"Name":      args.RemoteName,
-			"Branch":    args.RemoteBranchName,
-		}, &remoteFilesystemId)
+	tlf, cloneName, err := d.state.registry.LookupFilesystemById(args.FilesystemId)
 	if err != nil {
 		return err
 	}
-
-	localFilesystemId := d.state.registry.Exists(
-		VolumeName{args.LocalNamespace, args.LocalName}, args.LocalBranchName,
+	newBranchName := conflictBranchName(cloneName, "diverged")
+	ctx, cancel := withRequestTimeout(r.Context())
+	defer cancel()
+	responseChan, err := d.state.globalFsRequestContext(
+		ctx,
+		args.FilesystemId,
+		&Event{Name: "preserve-diverged",
+			Args: &EventArgs{
+				"topLevelFilesystemId":   tlf.MasterBranch.Id,
+				"latestCommonSnapshotId": args.LatestCommonSnapshotId,
+				"newBranchName":          newBranchName,
+			},
+		},
 	)
-
-	remoteExists := remoteFilesystemId != ""
-	localExists := localFilesystemId != ""
-
-	if !remoteExists && !localExists {
-		return fmt.Errorf("Both local and remote filesystems don't exist. %+v", args)
-	}
-	if args.Direction == "push" && !localExists {
-		return fmt.Errorf("Can't push when local doesn't exist")
+	if err != nil {
+		return err
 	}
-	if args.Direction == "pull" && !remoteExists {
-		return fmt.Errorf("Can't pull when remote doesn't exist")
+	e := <-responseChan
+	if e.Name == "preserved-diverged" {
+		log.Printf(
+			"Preserved commits of %s after %s as branch %s",
+			args.FilesystemId, args.LatestCommonSnapshotId, newBranchName,
+		)
+		*result = newBranchName
+	} else {
+		return maybeError(e)
 	}
+	return nil
+}
 
-	var localPath, remotePath PathToTopLevelFilesystem
-	if args.Direction == "push" {
-		localPath, err = d.state.registry.deducePathToTopLevelFilesystem(
-			VolumeName{args.LocalNamespace, args.LocalName}, args.LocalBranchName,
-		)
-		if err != nil {
-			return fmt.Errorf(
-				"Can't deduce path to top level filesystem for %s/%s,%s: %s",
-				args.LocalNamespace, args.LocalName, args.LocalBranchName, err,
-			)
-		}
+// Need both push and pull because one cluster will often be behind NAT.
+// Transfer will immediately return a transferId which can be queried until
+// completion
+func (d *DotmeshRPC) Transfer(
+	r *http.Request,
+	args *TransferRequest,
+	result *string,
+) error {
+	responseChan, requestId, err := d.startTransfer(r.Context(), args)
+	if err != nil {
+		return err
+	}
+	go func() {
+		// asynchronously throw away the response, transfers can be polled via
+		// their own entries in etcd
+		e := <-responseChan
+		log.Printf("finished transfer of %+v, %+v", args, e)
+	}()
 
-		// Path is the same on the remote, except with a potentially different name
-		remotePath = localPath
-		remotePath.TopLevelFilesystemName = VolumeName{args.RemoteNamespace, args.RemoteName}
-	} else if args.Direction == "pull" {
-		err := client.CallRemote(r.Context(),
-			"DotmeshRPC.DeducePathToTopLevelFilesystem", map[string]interface{}{
-				"RemoteNamespace":      args.RemoteNamespace,
-				"RemoteFilesystemName": args.RemoteName,
-				"RemoteCloneName":      args.RemoteBranchName,
-			},
-			&remotePath,
-		)
+	*result = requestId
+	return nil
+}
+
+// Report what Transfer would do with the same arguments, without changing
+// anything here or on the peer.
+func (d *DotmeshRPC) PlanTransfer(
+	r *http.Request,
+	args *TransferRequest,
+	result *TransferPlan,
+) error {
+	client := NewJsonRpcClient(args.User, args.Peer, args.ApiKey, args.PeerTLS)
+
+	log.Printf("[PlanTransfer] starting with %+v", safeArgs(*args))
+
+	*result = d.planTransfer(r.Context(), client, args)
+	return nil
+}
+
+// Validate a transfer request and hand it to the master of the filesystem
+// being transferred, returning the channel on which the master's final
+// response will arrive and the transfer id which can be polled.
+func (d *DotmeshRPC) startTransfer(
+	ctx context.Context, args *TransferRequest,
+) (chan *Event, string, error) {
+	log.Printf("[Transfer] starting with %+v", safeArgs(*args))
+	if args.S3 != nil {
+		return d.startS3Transfer(ctx, args)
+	}
+	client := NewJsonRpcClient(args.User, args.Peer, args.ApiKey, args.PeerTLS)
+
+	ends, err := d.checkTransfer(ctx, client, args)
+	if err != nil {
+		return nil, "", err
+	}
+
+	filesystemId, err := d.registerTransferDestination(ctx, client, args, ends)
+	if err != nil {
+		return nil, "", err
+	}
+	if args.AllBranches {
+		err = d.registerAllBranches(ctx, client, args)
 		if err != nil {
-			return fmt.Errorf(
-				"Can't deduce path to top level filesystem for %s/%s,%s: %s",
-				args.RemoteNamespace, args.RemoteName, args.RemoteBranchName, err,
-			)
+			return nil, "", err
 		}
-		// Path is the same locally, except with a potentially different name
-		localPath = remotePath
-		localPath.TopLevelFilesystemName = VolumeName{args.LocalNamespace, args.LocalName}
 	}
 
-	log.Printf("[Transfer] got paths: local=%+v remote=%+v", localPath, remotePath)
+	// Now run globalFsRequest, returning the request id, to make the master of
+	// a (possibly nonexisting) filesystem start pulling or pushing it, and
+	// make it update status as it goes in a new pollable "transfers" object in
+	// etcd.
+
+	return d.state.globalFsRequestId(
+		filesystemId,
+		&Event{Name: "transfer",
+			Args: &EventArgs{
+				"Transfer": args,
+			},
+		},
+	)
+}
+
+// Create whichever end of a checked transfer doesn't exist yet, so that the
+// master of the filesystem on the receiving side is ready for it. Returns the
+// id of the filesystem being transferred.
+func (d *DotmeshRPC) registerTransferDestination(
+	ctx context.Context, client *JsonRpcClient, args *TransferRequest, ends transferEnds,
+) (string, error) {
+	localFilesystemId, remoteFilesystemId := ends.localFilesystemId, ends.remoteFilesystemId
+	localPath, remotePath := ends.localPath, ends.remotePath
 
 	var filesystemId string
-	if args.Direction == "push" && !remoteExists {
+	if args.Direction == "push" && remoteFilesystemId == "" {
 		// pre-create the remote registry entry and pick a master for it to
 		// land on on the remote
 		var result bool
 
-		err := client.CallRemote(r.Context(),
+		err := client.CallRemote(ctx,
 			"DotmeshRPC.RegisterFilesystem", map[string]interface{}{
 				"Namespace":              args.RemoteNamespace,
 				"TopLevelFilesystemName": args.RemoteName,
@@ -1092,14 +1462,14 @@ func (d *DotmeshRPC) Transfer(
 				"PathToTopLevelFilesystem": remotePath,
 			}, &result)
 		if err != nil {
-			return err
+			return "", err
 		}
 		filesystemId = localFilesystemId
-	} else if args.Direction == "pull" && !localExists {
+	} else if args.Direction == "pull" && localFilesystemId == "" {
 		// pre-create the local registry entry and pick a master for it to land
 		// on locally (me!)
-		err = d.registerFilesystemBecomeMaster(
-			r.Context(),
+		err := d.registerFilesystemBecomeMaster(
+			ctx,
 			args.LocalNamespace,
 			args.LocalName,
 			args.LocalBranchName,
@@ -1107,16 +1477,135 @@ func (d *DotmeshRPC) Transfer(
 			localPath,
 		)
 		if err != nil {
-			return err
+			return "", err
 		}
 		filesystemId = remoteFilesystemId
-	} else if remoteExists && localExists && remoteFilesystemId != localFilesystemId {
-		return fmt.Errorf(
+	} else {
+		// checkTransfer made sure both exist with the same id
+		filesystemId = localFilesystemId
+	}
+	return filesystemId, nil
+}
+
+// The filesystems at either end of a transfer. An id is empty if that end
+// doesn't exist yet.
+type transferEnds struct {
+	localFilesystemId, remoteFilesystemId string
+	localPath, remotePath                 PathToTopLevelFilesystem
+}
+
+// Work out what a transfer request refers to on each cluster, and refuse it
+// if it's bound to fail, without changing anything on either of them.
+func (d *DotmeshRPC) checkTransfer(
+	ctx context.Context, client *JsonRpcClient, args *TransferRequest,
+) (transferEnds, error) {
+	switch args.Direction {
+	case "push":
+		err := requireValidVolumeName(VolumeName{args.RemoteNamespace, args.RemoteName})
+		if err != nil {
+			return transferEnds{}, err
+		}
+	case "pull":
+		err := requireValidVolumeName(VolumeName{args.LocalNamespace, args.LocalName})
+		if err != nil {
+			return transferEnds{}, err
+		}
+	}
+
+	var remoteFilesystemId string
+	err := client.CallRemote(ctx,
+		"DotmeshRPC.Exists", map[string]string{
+			"Namespace": args.RemoteNamespace,
+			"Name":      args.RemoteName,
+			"Branch":    args.RemoteBranchName,
+		}, &remoteFilesystemId)
+	if err != nil {
+		return transferEnds{}, err
+	}
+
+	localFilesystemId := d.state.registry.Exists(
+		VolumeName{args.LocalNamespace, args.LocalName}, args.LocalBranchName,
+	)
+
+	remoteExists := remoteFilesystemId != ""
+	localExists := localFilesystemId != ""
+
+	if !remoteExists && !localExists {
+		return transferEnds{}, fmt.Errorf("Both local and remote filesystems don't exist. %+v", args)
+	}
+	if args.Direction == "push" && !localExists {
+		return transferEnds{}, fmt.Errorf("Can't push when local doesn't exist")
+	}
+	if args.Direction == "pull" && !remoteExists {
+		return transferEnds{}, fmt.Errorf("Can't pull when remote doesn't exist")
+	}
+	if (args.Depth != 0 || args.Since != "") && (args.Direction != "pull" || localExists) {
+		return transferEnds{}, fmt.Errorf(
+			"Only the first pull of a dot can be shallow, use 'dm clone' to make one",
+		)
+	}
+	if args.Depth < 0 {
+		return transferEnds{}, fmt.Errorf("Depth must be positive, not %d", args.Depth)
+	}
+	if args.AllBranches {
+		if (args.LocalBranchName != "" && args.LocalBranchName != DEFAULT_BRANCH) ||
+			(args.RemoteBranchName != "" && args.RemoteBranchName != DEFAULT_BRANCH) {
+			return transferEnds{}, fmt.Errorf(
+				"Transfers of all branches must be requested for %s, not %s/%s",
+				DEFAULT_BRANCH, args.LocalBranchName, args.RemoteBranchName,
+			)
+		}
+		if args.Depth != 0 || args.Since != "" {
+			return transferEnds{}, fmt.Errorf(
+				"Can't transfer all branches shallowly, as they may need older commits",
+			)
+		}
+	}
+
+	var localPath, remotePath PathToTopLevelFilesystem
+	if args.Direction == "push" {
+		localPath, err = d.state.registry.deducePathToTopLevelFilesystem(
+			VolumeName{args.LocalNamespace, args.LocalName}, args.LocalBranchName,
+		)
+		if err != nil {
+			return transferEnds{}, fmt.Errorf(
+				"Can't deduce path to top level filesystem for %s/%s,%s: %s",
+				args.LocalNamespace, args.LocalName, args.LocalBranchName, err,
+			)
+		}
+
+		// Path is the same on the remote, except with a potentially different name
+		remotePath = localPath
+		remotePath.TopLevelFilesystemName = VolumeName{args.RemoteNamespace, args.RemoteName}
+	} else if args.Direction == "pull" {
+		err := client.CallRemote(ctx,
+			"DotmeshRPC.DeducePathToTopLevelFilesystem", map[string]interface{}{
+				"RemoteNamespace":      args.RemoteNamespace,
+				"RemoteFilesystemName": args.RemoteName,
+				"RemoteCloneName":      args.RemoteBranchName,
+			},
+			&remotePath,
+		)
+		if err != nil {
+			return transferEnds{}, fmt.Errorf(
+				"Can't deduce path to top level filesystem for %s/%s,%s: %s",
+				args.RemoteNamespace, args.RemoteName, args.RemoteBranchName, err,
+			)
+		}
+		// Path is the same locally, except with a potentially different name
+		localPath = remotePath
+		localPath.TopLevelFilesystemName = VolumeName{args.LocalNamespace, args.LocalName}
+	}
+
+	log.Printf("[Transfer] got paths: local=%+v remote=%+v", localPath, remotePath)
+
+	if remoteExists && localExists && remoteFilesystemId != localFilesystemId {
+		return transferEnds{}, fmt.Errorf(
 			"Cannot reconcile filesystems with different ids, remote=%s, local=%s, args=%+v",
 			remoteFilesystemId, localFilesystemId, safeArgs(*args),
 		)
 	} else if remoteExists && localExists && remoteFilesystemId == localFilesystemId {
-		filesystemId = localFilesystemId
+		filesystemId := localFilesystemId
 
 		// This is an incremental update, not a new filesystem for the writer.
 		// Check whether there are uncommitted changes or containers running
@@ -1129,25 +1618,25 @@ func (d *DotmeshRPC) Transfer(
 		if args.Direction == "push" {
 			// Ask the remote
 			var v DotmeshVolume
-			err := client.CallRemote(r.Context(), "DotmeshRPC.Get", filesystemId, &v)
+			err := client.CallRemote(ctx, "DotmeshRPC.Get", filesystemId, &v)
 			if err != nil {
-				return err
+				return transferEnds{}, err
 			}
 			log.Printf("[TransferIt] for %s, got dotmesh volume: %s", filesystemId, v)
 			dirtyBytes = v.DirtyBytes
 			log.Printf("[TransferIt] got %d dirty bytes for %s from peer", dirtyBytes, filesystemId)
 
-			err = client.CallRemote(r.Context(), "DotmeshRPC.ContainersById", filesystemId, &cs)
+			err = client.CallRemote(ctx, "DotmeshRPC.ContainersById", filesystemId, &cs)
 			if err != nil {
-				return err
+				return transferEnds{}, err
 			}
 			log.Printf("[TransferIt] got %+v remote containers for %s from peer", cs, filesystemId)
 
 		} else if args.Direction == "pull" {
 			// Consult ourselves
-			v, err := d.state.getOne(r.Context(), filesystemId)
+			v, err := d.state.getOne(ctx, filesystemId)
 			if err != nil {
-				return err
+				return transferEnds{}, err
 			}
 			dirtyBytes = v.DirtyBytes
 			log.Printf("[TransferIt] got %d dirty bytes for %s from local", dirtyBytes, filesystemId)
@@ -1159,7 +1648,7 @@ func (d *DotmeshRPC) Transfer(
 		}
 
 		if dirtyBytes > 0 {
-			return fmt.Errorf(
+			return transferEnds{}, fmt.Errorf(
 				"Aborting because there are %.2f MiB of uncommitted changes on volume "+
 					"where data would be written. Use 'dm reset' to roll back.",
 				float64(dirtyBytes)/(1024*1024),
@@ -1171,52 +1660,345 @@ func (d *DotmeshRPC) Transfer(
 			for _, c := range cs {
 				containersRunning = append(containersRunning, string(c.Name))
 			}
-			return fmt.Errorf(
+			return transferEnds{}, fmt.Errorf(
 				"Aborting because there are active containers running on "+
 					"volume where data would be written: %s. Stop the containers.",
 				strings.Join(containersRunning, ", "),
 			)
 		}
+	}
 
-	} else {
-		return fmt.Errorf(
-			"Unexpected combination of factors: "+
-				"remoteExists: %t, localExists: %t, "+
-				"remoteFilesystemId: %s, localFilesystemId: %s",
-			remoteExists, localExists, remoteFilesystemId, localFilesystemId,
-		)
+	return transferEnds{
+		localFilesystemId:  localFilesystemId,
+		remoteFilesystemId: remoteFilesystemId,
+		localPath:          localPath,
+		remotePath:         remotePath,
+	}, nil
+}
+
+func safeArgs(t TransferRequest) TransferRequest {
+	t.ApiKey = "<redacted>"
+	if t.S3 != nil {
+		target := *t.S3
+		target.SecretAccessKey = "<redacted>"
+		t.S3 = &target
 	}
+	return t
+}
 
-	// Now run globalFsRequest, returning the request id, to make the master of
-	// a (possibly nonexisting) filesystem start pulling or pushing it, and
-	// make it update status as it goes in a new pollable "transfers" object in
-	// etcd.
+// The peer's API key is only for the cluster running the transfer, which may
+// not be the one whose user asked for it.
+func safePollResult(t TransferPollResult) TransferPollResult {
+	t.ApiKey = "<redacted>"
+	return t
+}
 
-	responseChan, requestId, err := d.state.globalFsRequestId(
-		filesystemId,
-		&Event{Name: "transfer",
-			Args: &EventArgs{
-				"Transfer": args,
-			},
-		},
+// Keep a remote dot up to date with a local one, by having the master push to
+// it whenever it gets new commits. Returns the id of the mirror.
+func (d *DotmeshRPC) AddMirror(
+	r *http.Request,
+	args *Mirror,
+	result *string,
+) error {
+	log.Printf("[AddMirror] starting with %+v", safeMirror(*args))
+
+	err := requireValidVolumeName(VolumeName{args.RemoteNamespace, args.RemoteName})
+	if err != nil {
+		return err
+	}
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{args.LocalNamespace, args.LocalName}, args.LocalBranchName,
 	)
 	if err != nil {
 		return err
 	}
-	go func() {
-		// asynchronously throw away the response, transfers can be polled via
-		// their own entries in etcd
-		e := <-responseChan
-		log.Printf("finished transfer of %+v, %+v", args, e)
-	}()
+	err = d.authorizeFilesystem(r.Context(), filesystemId)
+	if err != nil {
+		return err
+	}
 
-	*result = requestId
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	mirror := Mirror{
+		Id:               id.String(),
+		FilesystemId:     filesystemId,
+		Peer:             args.Peer,
+		User:             args.User,
+		ApiKey:           args.ApiKey,
+		LocalNamespace:   args.LocalNamespace,
+		LocalName:        args.LocalName,
+		LocalBranchName:  args.LocalBranchName,
+		RemoteNamespace:  args.RemoteNamespace,
+		RemoteName:       args.RemoteName,
+		RemoteBranchName: args.RemoteBranchName,
+		IntervalSeconds:  args.IntervalSeconds,
+		Status:           "idle",
+	}
+	serialized, err := json.Marshal(mirror)
+	if err != nil {
+		return err
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/mirrors/%s", ETCD_PREFIX, mirror.Id),
+		string(serialized),
+		&client.SetOptions{PrevExist: client.PrevNoExist},
+	)
+	if err != nil {
+		return err
+	}
+	*result = mirror.Id
 	return nil
 }
 
-func safeArgs(t TransferRequest) TransferRequest {
-	t.ApiKey = "<redacted>"
-	return t
+// List the mirrors of dots the current user can see, along with how far
+// behind they are and the last error, if any.
+func (d *DotmeshRPC) Mirrors(
+	r *http.Request,
+	args *struct{},
+	result *[]Mirror,
+) error {
+	d.state.mirrorsLock.Lock()
+	all := []Mirror{}
+	for _, m := range *d.state.mirrors {
+		all = append(all, m)
+	}
+	d.state.mirrorsLock.Unlock()
+
+	mirrors := []Mirror{}
+	for _, m := range all {
+		err := d.authorizeFilesystem(r.Context(), m.FilesystemId)
+		if err != nil {
+			switch err.(type) {
+			case PermissionDenied:
+				continue
+			}
+			return err
+		}
+		mirrors = append(mirrors, safeMirror(m))
+	}
+	sort.Slice(mirrors, func(i, j int) bool {
+		a, b := mirrors[i], mirrors[j]
+		if a.LocalNamespace != b.LocalNamespace {
+			return a.LocalNamespace < b.LocalNamespace
+		}
+		if a.LocalName != b.LocalName {
+			return a.LocalName < b.LocalName
+		}
+		if a.LocalBranchName != b.LocalBranchName {
+			return a.LocalBranchName < b.LocalBranchName
+		}
+		return a.Id < b.Id
+	})
+	*result = mirrors
+	return nil
+}
+
+// Stop mirroring. Any push which is already underway will run to completion.
+func (d *DotmeshRPC) RemoveMirror(
+	r *http.Request,
+	mirrorId *string,
+	result *bool,
+) error {
+	m, ok := d.state.getMirror(*mirrorId)
+	if !ok {
+		return fmt.Errorf("No such mirror %s", *mirrorId)
+	}
+	err := d.authorizeFilesystem(r.Context(), m.FilesystemId)
+	if err != nil {
+		return err
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return err
+	}
+	_, err = kapi.Delete(
+		context.Background(),
+		fmt.Sprintf("%s/filesystems/mirrors/%s", ETCD_PREFIX, *mirrorId),
+		&client.DeleteOptions{},
+	)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Record the commits on a remote dot without transferring any data, so that
+// it can be compared with the local one. See remotetracking.go.
+func (d *DotmeshRPC) Fetch(
+	r *http.Request,
+	args *FetchRequest,
+	result *RemoteTrackingBranch,
+) error {
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{args.LocalNamespace, args.LocalName}, args.LocalBranchName,
+	)
+	if err != nil {
+		return err
+	}
+	err = d.authorizeFilesystem(r.Context(), filesystemId)
+	if err != nil {
+		return err
+	}
+	b, err := d.state.fetchRemoteBranch(filesystemId, args)
+	if err != nil {
+		return err
+	}
+	err = saveRemoteTrackingBranch(b)
+	if err != nil {
+		return err
+	}
+	*result = b
+	return nil
+}
+
+// What was last fetched from each remote for a branch of a dot, and how far
+// ahead of and behind each one the branch is now.
+func (d *DotmeshRPC) RemoteTrackingBranches(
+	r *http.Request,
+	args *struct{ Namespace, Name, Branch string },
+	result *[]RemoteTrackingBranch,
+) error {
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{args.Namespace, args.Name}, args.Branch,
+	)
+	if err != nil {
+		return err
+	}
+	err = d.authorizeFilesystem(r.Context(), filesystemId)
+	if err != nil {
+		return err
+	}
+	branches, err := d.state.remoteTrackingBranchesFor(filesystemId)
+	if err != nil {
+		return err
+	}
+	*result = branches
+	return nil
+}
+
+// Start pushing or pulling every dot in a namespace, or resume the last such
+// transfer which didn't finish. See namespacetransfer.go.
+func (d *DotmeshRPC) TransferNamespace(
+	r *http.Request,
+	args *NamespaceTransfer,
+	result *NamespaceTransfer,
+) error {
+	log.Printf("[TransferNamespace] starting with %+v", safeNamespaceTransfer(*args))
+
+	if args.Direction != "push" && args.Direction != "pull" {
+		return fmt.Errorf("Direction must be push or pull, not %s", args.Direction)
+	}
+	for _, namespace := range []string{args.LocalNamespace, args.RemoteNamespace} {
+		if namespace == "" || strings.ContainsAny(namespace, ":/") {
+			return fmt.Errorf("Invalid namespace name %v - it must not contain : or /", namespace)
+		}
+	}
+	userId := r.Context().Value("authenticated-user-id").(string)
+
+	t := args
+	var resumedIndex uint64
+	if args.Resume {
+		unfinished, index, err := unfinishedNamespaceTransfer(args)
+		if err != nil {
+			return err
+		}
+		if unfinished == nil {
+			return fmt.Errorf(
+				"No unfinished %s of namespace %s to resume", args.Direction, args.LocalNamespace,
+			)
+		}
+		if unfinished.InitiatorId != userId && userId != ADMIN_USER_UUID {
+			return PermissionDenied{}
+		}
+		if unfinished.Status == "running" && unfinished.NodeId != d.state.myNodeId &&
+			d.state.liveServers()[unfinished.NodeId] {
+			return fmt.Errorf(
+				"Namespace transfer %s is still running on node %s", unfinished.Id, unfinished.NodeId,
+			)
+		}
+		// the user may have new credentials for the peer since
+		unfinished.User, unfinished.ApiKey = args.User, args.ApiKey
+		t, resumedIndex = unfinished, index
+	} else {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		t.Id = id.String()
+		t.InitiatorId = userId
+		t.StartedAt = time.Now().Unix()
+		t.Dots = []NamespaceTransferDot{}
+	}
+	t.Resume = false
+	t.NodeId = d.state.myNodeId
+	t.Status = "running"
+	t.FinishedAt = 0
+
+	names, err := d.state.namespaceDots(r.Context(), t)
+	if err != nil {
+		return err
+	}
+	addNamespaceDots(t, names)
+	if len(t.Dots) == 0 {
+		return fmt.Errorf("There are no dots in namespace %s to %s", args.LocalNamespace, args.Direction)
+	}
+	if !claimNamespaceTransfer(t.Id) {
+		return fmt.Errorf("Namespace transfer %s is still running", t.Id)
+	}
+	if resumedIndex != 0 {
+		err = claimResumedNamespaceTransfer(t, resumedIndex)
+	} else {
+		err = saveNamespaceTransfer(t)
+	}
+	if err != nil {
+		releaseNamespaceTransfer(t.Id)
+		return err
+	}
+	go d.state.runNamespaceTransfer(t)
+
+	*result = safeNamespaceTransfer(*t)
+	return nil
+}
+
+// How far a namespace transfer has got.
+func (d *DotmeshRPC) GetNamespaceTransfer(
+	r *http.Request,
+	id *string,
+	result *NamespaceTransfer,
+) error {
+	t, err := getNamespaceTransfer(*id)
+	if err != nil {
+		return err
+	}
+	userId := r.Context().Value("authenticated-user-id").(string)
+	if t.InitiatorId != userId && userId != ADMIN_USER_UUID {
+		return PermissionDenied{}
+	}
+	*result = safeNamespaceTransfer(*t)
+	return nil
+}
+
+func (d *DotmeshRPC) authorizeFilesystem(ctx context.Context, filesystemId string) error {
+	tlf, _, err := d.state.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.Authorize(ctx)
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return PermissionDenied{}
+	}
+	return nil
 }
 
 func (a ByAddress) Len() int      { return len(a) }
@@ -1382,7 +2164,8 @@ func (d *DotmeshRPC) PredictSize(
 	result *int64,
 ) error {
 	log.Printf("[PredictSize] got args %+v", args)
-	size, err := predictSize(
+	size, err := d.state.predictSizeOnMaster(
+		r.Context(),
 		args.FromFilesystemId, args.FromSnapshotId, args.ToFilesystemId, args.ToSnapshotId,
 	)
 	if err != nil {
@@ -1610,7 +2393,7 @@ func (d *DotmeshRPC) DumpEtcd(
 		return err
 	}
 
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,264 @@
+package main
+
+// A minimal client for S3-compatible object storage, just enough to keep
+// backups of dots in a bucket: getting and putting objects, and multipart
+// uploads for streams whose size we don't know in advance. Requests are
+// signed with AWS signature version 4, with unsigned payloads so that they
+// can be streamed.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const S3_DEFAULT_REGION = "us-east-1"
+
+// Streams are uploaded in parts of this many bytes, each of which is held in
+// memory while it's uploaded. S3 needs every part but the last to be at least
+// 5MiB.
+const S3_PART_SIZE = 16 * 1024 * 1024
+
+type S3Client struct {
+	target S3Target
+	http   *http.Client
+}
+
+func NewS3Client(target S3Target) *S3Client {
+	if target.Region == "" {
+		target.Region = S3_DEFAULT_REGION
+	}
+	return &S3Client{target: target, http: new(http.Client)}
+}
+
+// Objects are addressed path-style, which works with any S3-compatible
+// store, not just AWS.
+func (c *S3Client) objectUrl(key string, query url.Values) *url.URL {
+	u, _ := url.Parse(strings.TrimRight(c.target.Endpoint, "/"))
+	u.Path = "/" + c.target.Bucket + "/" + c.target.Prefix + key
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	return u
+}
+
+func (c *S3Client) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.objectUrl(key, query).String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, time.Now().UTC())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(resp.Body)
+		return nil, S3Error{StatusCode: resp.StatusCode, Message: string(message)}
+	}
+	return resp, nil
+}
+
+type S3Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e S3Error) Error() string {
+	return fmt.Sprintf("S3 request failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+func isS3NotFound(err error) bool {
+	e, ok := err.(S3Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// Fetch an object, which the caller must close.
+func (c *S3Client) GetObject(key string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *S3Client) PutObject(key string, body []byte) error {
+	resp, err := c.do("PUT", key, nil, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Upload everything read from r as one object, in parts, returning how many
+// bytes it was. The upload is abandoned if reading or uploading fails.
+func (c *S3Client) UploadObject(key string, r io.Reader) (int64, error) {
+	resp, err := c.do("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	initiated := struct {
+		UploadId string
+	}{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	completed := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	var size int64
+	err = func() error {
+		buffer := make([]byte, S3_PART_SIZE)
+		for {
+			n, readErr := io.ReadFull(r, buffer)
+			if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+				return readErr
+			}
+			// always upload at least one part, even if it's empty
+			if n > 0 || len(completed.Parts) == 0 {
+				number := len(completed.Parts) + 1
+				resp, err := c.do("PUT", key, url.Values{
+					"partNumber": {fmt.Sprintf("%d", number)},
+					"uploadId":   {initiated.UploadId},
+				}, buffer[:n])
+				if err != nil {
+					return err
+				}
+				resp.Body.Close()
+				completed.Parts = append(completed.Parts, part{number, resp.Header.Get("ETag")})
+				size += int64(n)
+			}
+			if readErr != nil {
+				return nil
+			}
+		}
+	}()
+	if err == nil {
+		var body []byte
+		body, err = xml.Marshal(completed)
+		if err == nil {
+			resp, err = c.do("POST", key, url.Values{"uploadId": {initiated.UploadId}}, body)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	if err != nil {
+		resp, abortErr := c.do("DELETE", key, url.Values{"uploadId": {initiated.UploadId}}, nil)
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// Add AWS signature version 4 headers to a request.
+func (c *S3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": "UNSIGNED-PAYLOAD",
+		"x-amz-date":           amzDate,
+	}
+	names := []string{}
+	for name, _ := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, c.target.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hexSha256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+c.target.SecretAccessKey), date)
+	key = hmacSha256(key, c.target.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.target.AccessKeyId, scope, signedHeaders, signature,
+	))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := []string{}
+	for key, _ := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// URI-encode everything but unreserved characters, and slashes unless
+// escapeSlash is set, as signature version 4 requires.
+func s3Escape(s string, escapeSlash bool) string {
+	var escaped bytes.Buffer
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !escapeSlash) {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSha256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,705 @@
+package main
+
+// Pushing dots to, and pulling them from, S3-compatible buckets.
+//
+// A dot backed up to a bucket is kept as the same send streams that would
+// have been pushed to a cluster: each one is the (compressed) prelude plus
+// zfs send stream for a range of commits, stored as
+// filesystems/:filesystemId/:snapshotId.zfs under the bucket's prefix, named
+// after the commit it ends at. The index object dots/:namespace/:name.json
+// says which streams each filesystem has, the commits they add up to, and
+// the path of each branch which has been pushed, so that a pull can recreate
+// the dot and apply the streams in order. The index is written after each
+// stream is uploaded, so a push which fails part way through only leaves
+// unreferenced objects behind.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type S3DotIndex struct {
+	TopLevelFilesystemId string
+	// the path of each branch which has been pushed, master being ""
+	Branches    map[string]PathToTopLevelFilesystem
+	Filesystems map[string]*S3FilesystemIndex
+}
+
+type S3FilesystemIndex struct {
+	// every commit the streams add up to, in order
+	Commits []snapshot
+	Streams []S3Stream
+}
+
+// A send stream in the bucket, from the commit From (START for a full
+// stream, or filesystemId@snapshotId for the first stream of a branch) to
+// the commit To.
+type S3Stream struct {
+	From string
+	To   string
+	Key  string
+	Size int64
+}
+
+func s3IndexKey(name VolumeName) string {
+	return fmt.Sprintf("dots/%s/%s.json", name.Namespace, name.Name)
+}
+
+func s3StreamKey(filesystemId, snapshotId string) string {
+	return fmt.Sprintf("filesystems/%s/%s.zfs", filesystemId, snapshotId)
+}
+
+// Read a dot's index from the bucket, returning nil if it's not there.
+func loadS3Index(s3 *S3Client, name VolumeName) (*S3DotIndex, error) {
+	body, err := s3.GetObject(s3IndexKey(name))
+	if isS3NotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	index := &S3DotIndex{}
+	err = json.NewDecoder(body).Decode(index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func saveS3Index(s3 *S3Client, name VolumeName, index *S3DotIndex) error {
+	serialized, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return s3.PutObject(s3IndexKey(name), serialized)
+}
+
+// The id of the filesystem a path leads to.
+func pathFilesystemId(path PathToTopLevelFilesystem) string {
+	if len(path.Clones) == 0 {
+		return path.TopLevelFilesystemId
+	}
+	return path.Clones[len(path.Clones)-1].Clone.FilesystemId
+}
+
+// Like startTransfer, for transfers to and from buckets, which can't be
+// asked anything but what's in them.
+func (d *DotmeshRPC) startS3Transfer(
+	ctx context.Context, args *TransferRequest,
+) (chan *Event, string, error) {
+	if args.AllBranches || args.Force || args.BranchOnConflict ||
+		args.Depth != 0 || args.Since != "" {
+		return nil, "", fmt.Errorf(
+			"Transfers to and from S3 can only be of one branch, " +
+				"without --force, --branch-on-conflict, --depth or --since",
+		)
+	}
+	local := VolumeName{args.LocalNamespace, args.LocalName}
+	remote := VolumeName{args.RemoteNamespace, args.RemoteName}
+	for _, name := range []VolumeName{local, remote} {
+		err := requireValidVolumeName(name)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var filesystemId string
+	switch args.Direction {
+	case "push":
+		filesystemId = d.state.registry.Exists(local, args.LocalBranchName)
+		if filesystemId == "" {
+			return nil, "", fmt.Errorf("Can't push when local doesn't exist")
+		}
+		err := d.authorizeFilesystem(ctx, filesystemId)
+		if err != nil {
+			return nil, "", err
+		}
+	case "pull":
+		index, err := loadS3Index(NewS3Client(*args.S3), remote)
+		if err != nil {
+			return nil, "", err
+		}
+		if index == nil {
+			return nil, "", fmt.Errorf(
+				"Can't pull when remote doesn't exist: there's no %s/%s in bucket %s",
+				remote.Namespace, remote.Name, args.S3.Bucket,
+			)
+		}
+		path, ok := index.Branches[args.RemoteBranchName]
+		if !ok {
+			return nil, "", fmt.Errorf(
+				"Branch %s of %s/%s hasn't been pushed to bucket %s",
+				args.RemoteBranchName, remote.Namespace, remote.Name, args.S3.Bucket,
+			)
+		}
+		filesystemId = pathFilesystemId(path)
+		localFilesystemId := d.state.registry.Exists(local, args.LocalBranchName)
+		if localFilesystemId == "" {
+			path.TopLevelFilesystemName = local
+			err = d.registerFilesystemBecomeMaster(
+				ctx, local.Namespace, local.Name, args.LocalBranchName, filesystemId, path,
+			)
+			if err != nil {
+				return nil, "", err
+			}
+		} else if localFilesystemId != filesystemId {
+			return nil, "", fmt.Errorf(
+				"Cannot reconcile filesystems with different ids, remote=%s, local=%s",
+				filesystemId, localFilesystemId,
+			)
+		} else {
+			err = d.authorizeFilesystem(ctx, filesystemId)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	default:
+		return nil, "", fmt.Errorf("Unknown transfer direction %q", args.Direction)
+	}
+
+	return d.state.globalFsRequestId(
+		filesystemId,
+		&Event{Name: "transfer",
+			Args: &EventArgs{
+				"Transfer": args,
+			},
+		},
+	)
+}
+
+// The S3 equivalent of what follows deducing the path in pushInitiatorState:
+// upload each filesystem on the path in turn, then record the branch in the
+// index.
+func (f *fsMachine) s3PushInitiator(
+	path PathToTopLevelFilesystem, transferRequest TransferRequest, transferRequestId string,
+) stateFn {
+	s3 := NewS3Client(*transferRequest.S3)
+	remote := VolumeName{transferRequest.RemoteNamespace, transferRequest.RemoteName}
+
+	pollResult := TransferPollResultFromTransferRequest(
+		transferRequestId, transferRequest, f.state.myNodeId,
+		1, 1+len(path.Clones), "syncing metadata",
+	)
+	f.lastPollResult = &pollResult
+	err := updatePollResult(transferRequestId, pollResult)
+	if err != nil {
+		f.innerResponses <- &Event{
+			Name: "push-initiator-cant-write-to-etcd",
+			Args: &EventArgs{"err": err},
+		}
+		return backoffState
+	}
+
+	index, err := loadS3Index(s3, remote)
+	if err != nil {
+		return f.errorDuringTransfer("cant-load-s3-index", err)
+	}
+	if index == nil {
+		index = &S3DotIndex{
+			TopLevelFilesystemId: path.TopLevelFilesystemId,
+			Branches:             map[string]PathToTopLevelFilesystem{},
+			Filesystems:          map[string]*S3FilesystemIndex{},
+		}
+	}
+	if index.TopLevelFilesystemId != path.TopLevelFilesystemId {
+		return f.errorDuringTransfer("s3-index-for-different-dot", fmt.Errorf(
+			"%s/%s in bucket %s is a different dot",
+			remote.Namespace, remote.Name, transferRequest.S3.Bucket,
+		))
+	}
+
+	push := func(f *fsMachine,
+		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+		transferRequestId string, pollResult *TransferPollResult,
+		client *JsonRpcClient, transferRequest *TransferRequest,
+	) (*Event, stateFn) {
+		return f.retryS3(func() (*Event, stateFn) {
+			return f.s3Push(
+				s3, index, remote,
+				fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+				transferRequestId, pollResult, transferRequest,
+			)
+		})
+	}
+	responseEvent, nextState := f.applyPath(
+		path, push, transferRequestId, &pollResult, nil, &transferRequest,
+	)
+	if responseEvent.Name == "finished-push" || responseEvent.Name == "peer-up-to-date" {
+		remotePath := path
+		remotePath.TopLevelFilesystemName = remote
+		index.Branches[transferRequest.RemoteBranchName] = remotePath
+		err = saveS3Index(s3, remote, index)
+		if err != nil {
+			return f.errorDuringTransfer("cant-save-s3-index", err)
+		}
+	}
+	f.innerResponses <- responseEvent
+	return nextState
+}
+
+// The S3 equivalent of pullInitiatorState, once it's made sure nothing is
+// using the filesystem.
+func (f *fsMachine) s3PullInitiator(
+	transferRequest TransferRequest, transferRequestId string,
+) stateFn {
+	s3 := NewS3Client(*transferRequest.S3)
+	remote := VolumeName{transferRequest.RemoteNamespace, transferRequest.RemoteName}
+	index, err := loadS3Index(s3, remote)
+	if err == nil && index == nil {
+		err = fmt.Errorf("%s/%s has gone from the bucket", remote.Namespace, remote.Name)
+	}
+	if err != nil {
+		f.innerResponses <- &Event{
+			Name: "cant-load-s3-index",
+			Args: &EventArgs{"err": err},
+		}
+		return backoffState
+	}
+	path := index.Branches[transferRequest.RemoteBranchName]
+
+	pollResult := TransferPollResultFromTransferRequest(
+		transferRequestId, transferRequest, f.state.myNodeId,
+		1, 1+len(path.Clones), "syncing metadata",
+	)
+	f.lastPollResult = &pollResult
+	err = updatePollResult(transferRequestId, pollResult)
+	if err != nil {
+		f.innerResponses <- &Event{
+			Name: "pull-initiator-cant-write-to-etcd",
+			Args: &EventArgs{"err": err},
+		}
+		return backoffState
+	}
+
+	pull := func(f *fsMachine,
+		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+		transferRequestId string, pollResult *TransferPollResult,
+		client *JsonRpcClient, transferRequest *TransferRequest,
+	) (*Event, stateFn) {
+		return f.retryS3(func() (*Event, stateFn) {
+			return f.s3Pull(
+				s3, index, toFilesystemId, toSnapshotId, transferRequestId, pollResult,
+			)
+		})
+	}
+	responseEvent, nextState := f.applyPath(
+		path, pull, transferRequestId, &pollResult, nil, &transferRequest,
+	)
+	f.innerResponses <- responseEvent
+	return nextState
+}
+
+// Try a transfer to or from a bucket a few times, as retryPush and
+// retryPull do.
+func (f *fsMachine) retryS3(transfer func() (*Event, stateFn)) (*Event, stateFn) {
+	var retry int
+	var responseEvent *Event
+	var nextState stateFn
+	for retry < 5 {
+		responseEvent, nextState = transfer()
+		if responseEvent.Name == "finished-push" || responseEvent.Name == "finished-pull" ||
+			responseEvent.Name == "peer-up-to-date" {
+			return responseEvent, nextState
+		}
+		retry++
+		f.updateTransfer(
+			fmt.Sprintf("retry %d", retry),
+			fmt.Sprintf("Attempting to transfer %s got %s", f.filesystemId, responseEvent),
+		)
+		log.Printf(
+			"[retryS3 attempt %d] retrying in %ds because we got a %s",
+			retry, retry, responseEvent,
+		)
+		time.Sleep(time.Duration(retry) * time.Second)
+	}
+	return responseEvent, nextState
+}
+
+// Upload the commits of toFilesystemId up to toSnapshotId (or its latest
+// commit) which aren't in the bucket yet, as one stream.
+func (f *fsMachine) s3Push(
+	s3 *S3Client, index *S3DotIndex, remote VolumeName,
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	transferRequestId string, pollResult *TransferPollResult,
+	transferRequest *TransferRequest,
+) (*Event, stateFn) {
+	fsMachine, err := f.state.maybeFilesystem(toFilesystemId)
+	if err != nil {
+		return &Event{
+			Name: "retry-push-cant-find-filesystem-id",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	fsMachine.snapshotsLock.Lock()
+	snaps := fsMachine.filesystem.snapshots
+	fsMachine.snapshotsLock.Unlock()
+	localSnaps, err := restrictSnapshots(snaps, toSnapshotId)
+	if err != nil {
+		return &Event{
+			Name: "restrict-snapshots-error",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+
+	fsIndex, ok := index.Filesystems[toFilesystemId]
+	if !ok {
+		fsIndex = &S3FilesystemIndex{Commits: []snapshot{}, Streams: []S3Stream{}}
+	}
+	snapRange, err := canApply(localSnaps, pointers(fsIndex.Commits))
+	if err != nil {
+		switch err.(type) {
+		case *ToSnapsUpToDate:
+			pollResult.Status = "finished"
+			pollResult.Message = "remote already up-to-date, nothing to do"
+			e := updatePollResult(transferRequestId, *pollResult)
+			if e != nil {
+				return &Event{
+					Name: "push-initiator-cant-write-to-etcd", Args: &EventArgs{"err": e},
+				}, backoffState
+			}
+			return &Event{
+				Name: "peer-up-to-date",
+			}, backoffState
+		}
+		return &Event{
+			Name: "error-in-canapply-when-pushing", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+
+	fromSnap := "START"
+	if snapRange.fromSnap != nil {
+		fromSnap = snapRange.fromSnap.Id
+	} else if fromFilesystemId != "" {
+		// This is a send from a clone origin
+		fromSnap = fmt.Sprintf("%s@%s", fromFilesystemId, fromSnapshotId)
+	}
+	toSnapshotId = snapRange.toSnap.Id
+
+	pollResult.FilesystemId = toFilesystemId
+	pollResult.StartingCommit = fromSnap
+	pollResult.TargetCommit = toSnapshotId
+	size, err := predictSize(fromFilesystemId, fromSnap, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return &Event{
+			Name: "error-predicting",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	pollResult.Size = size
+	pollResult.Status = "pushing"
+	err = updatePollResult(transferRequestId, *pollResult)
+	if err != nil {
+		return &Event{
+			Name: "push-initiator-cant-write-to-etcd", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+
+	prelude, err := f.state.calculatePrelude(toFilesystemId, toSnapshotId)
+	if err != nil {
+		return &Event{
+			Name: "error-calculating-prelude",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	preludeEncoded, err := encodePrelude(prelude)
+	if err != nil {
+		return &Event{
+			Name: "cant-encode-prelude",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+
+	sendArgs := calculateSendArgs(fromFilesystemId, fromSnap, toFilesystemId, toSnapshotId)
+	cmd := exec.Command("zfs", append([]string{"send"}, sendArgs...)...)
+	sendReader, sendWriter := io.Pipe()
+	defer sendReader.Close()
+	defer sendWriter.Close()
+	uploadReader, uploadWriter := io.Pipe()
+	defer uploadReader.Close()
+	defer uploadWriter.Close()
+	cmd.Stdout = sendWriter
+	cmd.Stderr = getLogfile("zfs-send-errors")
+
+	finished := make(chan bool)
+	go pipe(
+		sendReader, fmt.Sprintf("stdout of zfs send for %s", toFilesystemId),
+		uploadWriter, "S3 upload",
+		finished,
+		make(chan *Event),
+		func(e *Event, c chan *Event) {},
+		func(bytes int64, t int64) {
+			pollResult.Sent = bytes
+			pollResult.NanosecondsElapsed = t
+			err := updatePollResultProgress(transferRequestId, *pollResult)
+			if err != nil {
+				log.Printf("Error updating poll result: %s", err)
+			}
+		},
+		"compress",
+	)
+	sendWriter.Write(preludeEncoded)
+
+	errch := make(chan error)
+	go func() {
+		runErr := cmd.Run()
+		sendWriter.Close()
+		errch <- runErr
+	}()
+
+	key := s3StreamKey(toFilesystemId, toSnapshotId)
+	log.Printf("[s3Push] uploading %s from %s to %s as %s", toFilesystemId, fromSnap, toSnapshotId, key)
+	uploaded, err := s3.UploadObject(key, uploadReader)
+	// stop zfs send, if it's still going, before waiting for it
+	uploadReader.Close()
+	_ = <-finished
+	runErr := <-errch
+	if err != nil {
+		return &Event{
+			Name: "error-uploading-to-s3",
+			Args: &EventArgs{"err": err, "key": key},
+		}, backoffState
+	}
+	if runErr != nil {
+		log.Printf(
+			"[s3Push] Error from zfs send of %s from %s => %s: %s, check zfs-send-errors.log",
+			toFilesystemId, fromSnap, toSnapshotId, runErr,
+		)
+		return &Event{
+			Name: "error-from-zfs-send",
+			Args: &EventArgs{"err": runErr},
+		}, backoffState
+	}
+
+	// record the new stream, and the commits it adds
+	start := 0
+	for i, snap := range localSnaps {
+		if snapRange.fromSnap != nil && snap.Id == snapRange.fromSnap.Id {
+			start = i + 1
+		}
+	}
+	for _, snap := range localSnaps[start:] {
+		fsIndex.Commits = append(fsIndex.Commits, *snap)
+	}
+	fsIndex.Streams = append(fsIndex.Streams, S3Stream{
+		From: fromSnap, To: toSnapshotId, Key: key, Size: uploaded,
+	})
+	index.Filesystems[toFilesystemId] = fsIndex
+	err = saveS3Index(s3, remote, index)
+	if err != nil {
+		return &Event{
+			Name: "cant-save-s3-index",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+
+	pollResult.Status = "finished"
+	err = updatePollResult(transferRequestId, *pollResult)
+	if err != nil {
+		return &Event{
+			Name: "error-updating-poll-result",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	return &Event{
+		Name: "finished-push",
+		Args: &EventArgs{},
+	}, discoveringState
+}
+
+// Receive the streams of toFilesystemId which we don't have yet, in order,
+// stopping after the one which ends at toSnapshotId, if it's given.
+func (f *fsMachine) s3Pull(
+	s3 *S3Client, index *S3DotIndex,
+	toFilesystemId, toSnapshotId string,
+	transferRequestId string, pollResult *TransferPollResult,
+) (*Event, stateFn) {
+	fsIndex, ok := index.Filesystems[toFilesystemId]
+	if !ok || len(fsIndex.Streams) == 0 {
+		return &Event{
+			Name: "no-snapshots-of-remote-filesystem",
+			Args: &EventArgs{"filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	remoteSnaps, err := restrictSnapshots(pointers(fsIndex.Commits), toSnapshotId)
+	if err != nil {
+		return &Event{
+			Name: "restrict-snapshots-error",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	fsMachine, err := f.state.maybeFilesystem(toFilesystemId)
+	if err != nil {
+		return &Event{
+			Name: "retry-pull-cant-find-filesystem-id",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	fsMachine.snapshotsLock.Lock()
+	localSnaps := fsMachine.filesystem.snapshots
+	fsMachine.snapshotsLock.Unlock()
+
+	snapRange, err := canApply(remoteSnaps, localSnaps)
+	if err != nil {
+		switch err.(type) {
+		case *ToSnapsUpToDate:
+			pollResult.Status = "finished"
+			pollResult.Message = "remote already up-to-date, nothing to do"
+			e := updatePollResult(transferRequestId, *pollResult)
+			if e != nil {
+				return &Event{
+					Name: "pull-initiator-cant-write-to-etcd", Args: &EventArgs{"err": e},
+				}, backoffState
+			}
+			return &Event{
+				Name: "peer-up-to-date",
+			}, backoffState
+		}
+		return &Event{
+			Name: "error-in-canapply-when-pulling", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+
+	// the streams to receive: all of them if we have nothing, otherwise the
+	// ones after the one which ends at our latest commit
+	streams := fsIndex.Streams
+	if snapRange.fromSnap != nil {
+		streams = nil
+		for i, stream := range fsIndex.Streams {
+			if stream.To == snapRange.fromSnap.Id {
+				streams = fsIndex.Streams[i+1:]
+			}
+		}
+		if streams == nil {
+			return &Event{
+				Name: "no-s3-stream-from-commit",
+				Args: &EventArgs{"filesystemId": toFilesystemId, "commit": snapRange.fromSnap.Id},
+			}, backoffState
+		}
+	}
+	// a stream can't be received in part, so there has to be one which ends
+	// exactly at the commit we're pulling to, or we'd go past it
+	end := -1
+	for i, stream := range streams {
+		if stream.To == snapRange.toSnap.Id {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return &Event{
+			Name: "no-s3-stream-to-commit",
+			Args: &EventArgs{
+				"err": fmt.Errorf(
+					"Can't pull exactly to commit %s, it was pushed to the bucket along with later commits",
+					snapRange.toSnap.Id,
+				),
+				"filesystemId": toFilesystemId, "commit": snapRange.toSnap.Id,
+			},
+		}, backoffState
+	}
+	streams = streams[:end+1]
+
+	pollResult.FilesystemId = toFilesystemId
+	pollResult.StartingCommit = streams[0].From
+	pollResult.TargetCommit = streams[len(streams)-1].To
+	pollResult.Size = 0
+	for _, stream := range streams {
+		pollResult.Size += stream.Size
+	}
+	pollResult.Status = "pulling"
+	err = updatePollResult(transferRequestId, *pollResult)
+	if err != nil {
+		return &Event{
+			Name: "pull-initiator-cant-write-to-etcd", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+
+	var received int64
+	for _, stream := range streams {
+		err := f.receiveS3Stream(s3, stream, toFilesystemId, func(bytes int64, t int64) {
+			pollResult.Sent = received + bytes
+			pollResult.NanosecondsElapsed = t
+			err := updatePollResultProgress(transferRequestId, *pollResult)
+			if err != nil {
+				log.Printf("Error updating poll result: %s", err)
+			}
+		})
+		if err != nil {
+			return &Event{
+				Name: "get-failed-pull",
+				Args: &EventArgs{"err": err, "filesystemId": toFilesystemId, "key": stream.Key},
+			}, backoffState
+		}
+		received += stream.Size
+	}
+
+	pollResult.Status = "finished"
+	err = updatePollResult(transferRequestId, *pollResult)
+	if err != nil {
+		return &Event{
+			Name: "error-updating-poll-result",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	return &Event{
+		Name: "finished-pull",
+	}, discoveringState
+}
+
+// Download one stream and zfs recv it, as pull does for a stream from a
+// cluster.
+func (f *fsMachine) receiveS3Stream(
+	s3 *S3Client, stream S3Stream, filesystemId string, notify func(int64, int64),
+) error {
+	log.Printf("[receiveS3Stream] receiving %s from %s to %s", stream.Key, stream.From, stream.To)
+	body, err := s3.GetObject(stream.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	cmd := exec.Command("zfs", "recv", fq(filesystemId))
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	defer pipeWriter.Close()
+	cmd.Stdin = pipeReader
+	cmd.Stdout = getLogfile("zfs-recv-stdout")
+	cmd.Stderr = getLogfile("zfs-recv-stderr")
+
+	finished := make(chan bool)
+	go pipe(
+		body, fmt.Sprintf("S3 object %s", stream.Key),
+		pipeWriter, "stdin of zfs recv",
+		finished,
+		make(chan *Event),
+		func(e *Event, c chan *Event) {},
+		notify,
+		"decompress",
+	)
+
+	prelude, err := consumePrelude(pipeReader)
+	if err != nil {
+		pipeReader.Close()
+		_ = <-finished
+		return err
+	}
+	err = cmd.Run()
+	pipeReader.Close()
+	pipeWriter.Close()
+	_ = <-finished
+	if err != nil {
+		log.Printf(
+			"Got error %s when running zfs recv for %s, check zfs-recv-stderr.log",
+			err, filesystemId,
+		)
+		return err
+	}
+	return applyPrelude(prelude, fq(filesystemId))
+}
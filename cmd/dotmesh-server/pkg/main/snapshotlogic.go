@@ -44,6 +44,10 @@ import "fmt"
 //
 // ToSnapsUpToDate: there are no new snapshots in fromSnaps to apply to
 //     toSnaps: toSnaps is already up-to-date.
+//
+// toSnaps needn't start at the beginning of fromSnaps' history: after a
+// shallow transfer (see shallowBase) it starts part way through, and that's
+// fine, only the latest common snapshot matters.
 
 func canApply(fromSnaps []*snapshot, toSnaps []*snapshot) (*snapshotRange, error) {
 	// fromSnaps and toSnaps are in-order.
@@ -187,3 +191,28 @@ type ToSnapsUpToDate struct{}
 func (e *ToSnapsUpToDate) Error() string {
 	return "toSnaps is up-to-date"
 }
+
+// The snapshot a shallow transfer of fromSnaps starts from: the depth'th from
+// the end or, if since isn't empty, the snapshot with that id. The receiver
+// gets a full stream of just that snapshot (BASE_SNAPSHOT) and then the ones
+// after it incrementally.
+func shallowBase(fromSnaps []*snapshot, depth int, since string) (*snapshot, error) {
+	if len(fromSnaps) == 0 {
+		return nil, &NoFromSnaps{}
+	}
+	if since != "" {
+		for _, snap := range fromSnaps {
+			if snap.Id == since {
+				return snap, nil
+			}
+		}
+		return nil, fmt.Errorf("No commit %s to start a shallow transfer from", since)
+	}
+	if depth < 1 {
+		return nil, fmt.Errorf("Can't do a shallow transfer of depth %d", depth)
+	}
+	if depth > len(fromSnaps) {
+		depth = len(fromSnaps)
+	}
+	return fromSnaps[len(fromSnaps)-depth], nil
+}
@@ -137,7 +137,7 @@ func (f *fsMachine) run() {
 }
 
 func (f *fsMachine) pollDirty() error {
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -202,7 +202,7 @@ func (f *fsMachine) markFilesystemAsLive() error {
 
 func (f *fsMachine) updateEtcdAboutSnapshots() error {
 	// attempt to connect to etcd
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -278,7 +278,7 @@ func (f *fsMachine) transitionedTo(state string, status string) {
 	f.lastTransitionTimestamp = now
 	f.transitionObserver.Publish("transitions", state)
 	// update etcd
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		log.Printf("error connecting to etcd while trying to update states: %s", err)
 		return
@@ -317,10 +317,11 @@ func handoffState(f *fsMachine) stateFn {
 	// I got put into this state in response to a "move" event on f.requests,
 	// so it's my responsibility to put something onto f.responses, because
 	// there'll be someone out there listening for my response...
-	// I assume that previous states stopped any containers that were running
-	// on this filesystem, so the filesystem is quiescent.
+	// Containers may still be using the filesystem if we were asked to stop
+	// them, which we put off until we've pre-copied as much as we can.
 	// TODO stop any containers being able to get started here.
 	target := (*f.handoffRequest.Args)["target"].(string)
+	stopContainers, _ := (*f.handoffRequest.Args)["stopContainers"].(bool)
 	log.Printf("Found target node %s", target)
 
 	// subscribe for snapshot updates before we start sending, in case of races...
@@ -328,6 +329,65 @@ func handoffState(f *fsMachine) stateFn {
 	f.newSnapsOnServers.Subscribe(target, newSnapsChan)
 	defer f.newSnapsOnServers.Unsubscribe(target, newSnapsChan)
 
+	// pre-copy: while the filesystem is still in use, keep snapshotting it and
+	// waiting for the target to catch up, until there's little enough left to
+	// send that the downtime for the rest will be short
+	for round := 1; ; round++ {
+		f.transitionedTo(
+			"handoff", fmt.Sprintf("pre-copying to %s, round %d", target, round),
+		)
+		if f.latestSnapshot() != "" {
+			f.waitForHandoffTarget(target, newSnapsChan)
+		}
+		dirty, _, err := getDirtyDelta(f.filesystemId, f.latestSnapshot())
+		if err != nil {
+			log.Printf("[handoffState] Unable to tell how much is left to pre-copy: %s", err)
+			break
+		}
+		if dirty <= PRECOPY_DIRTY_THRESHOLD || round == PRECOPY_MAX_ROUNDS {
+			break
+		}
+		// hidden, as the user didn't ask for it and the snapshot at the end
+		// of the move has everything it has
+		response, _ := f.snapshot(&Event{
+			Name: "snapshot",
+			Args: &EventArgs{"metadata": metadata{
+				"author": "system",
+				"message": fmt.Sprintf(
+					"Automatic snapshot while pre-copying for migration from %s to %s.",
+					f.state.myNodeId, target,
+				),
+				HIDDEN_COMMIT: "true"},
+			},
+		})
+		if response.Name != "snapshotted" {
+			f.innerResponses <- response
+			return backoffState
+		}
+	}
+
+	// the downtime starts here
+	downtimeStart := time.Now()
+	if stopContainers {
+		err := f.stopContainers()
+		if err != nil {
+			f.innerResponses <- &Event{
+				Name: "failed-to-stop-containers-during-move",
+				Args: &EventArgs{"err": err},
+			}
+			return backoffState
+		}
+	}
+	// one may have been started while we were pre-copying
+	containers, err := f.containersRunning()
+	if err != nil || len(containers) > 0 {
+		f.innerResponses <- &Event{
+			Name: "cannot-move-while-containers-running",
+			Args: &EventArgs{"containers": containers, "err": err},
+		}
+		return backoffState
+	}
+
 	// unmount the filesystem immediately, so that the filesystem doesn't get
 	// dirtied by being unmounted
 	event, _ := f.unmount()
@@ -357,6 +417,51 @@ func handoffState(f *fsMachine) stateFn {
 		f.innerResponses <- response
 		return backoffState
 	}
+	f.waitForHandoffTarget(target, newSnapsChan)
+	// cool, fs is quiesced and latest snap is on target. switch!
+
+	// if we can't switch, we're still the master, so carry on serving it
+	remount := func(response *Event) stateFn {
+		f.innerResponses <- response
+		event, _ := f.mount()
+		if event.Name != "mounted" {
+			log.Printf("[handoffState] Unable to remount %s after failing to move it: %s", f.filesystemId, event)
+		}
+		return backoffState
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return remount(&Event{
+			Name: "failed-to-connect-to-etcd",
+			Args: &EventArgs{"err": err.Error()},
+		})
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf(
+			"%s/filesystems/masters/%s", ETCD_PREFIX, f.filesystemId,
+		),
+		target,
+		// only modify current master if I am indeed still the master
+		&client.SetOptions{PrevValue: f.state.myNodeId},
+	)
+	if err != nil {
+		return remount(&Event{
+			Name: "failed-to-switch-master",
+			Args: &EventArgs{"err": err.Error()},
+		})
+	}
+	downtime := time.Since(downtimeStart).Seconds()
+	f.transitionedTo(
+		"handoff", fmt.Sprintf("moved to %s after %.2fs of downtime", target, downtime),
+	)
+	f.innerResponses <- &Event{Name: "moved", Args: &EventArgs{"downtime": downtime}}
+	return inactiveState
+}
+
+// Wait for the target of a handoff to have all our snapshots, rejecting any
+// requests in the meantime.
+func (f *fsMachine) waitForHandoffTarget(target string, newSnapsChan chan interface{}) {
 	slaveUpToDate := false
 
 waitingForSlaveSnapshot:
@@ -447,23 +552,6 @@ waitingForSlaveSnapshot:
 			}
 		}
 	}
-	// cool, fs is quiesced and latest snap is on target. switch!
-
-	kapi, err := getEtcdKeysApi()
-	if err != nil {
-		f.innerResponses <- &Event{Name: "failed-to-connect-to-etcd"}
-	}
-	_, err = kapi.Set(
-		context.Background(),
-		fmt.Sprintf(
-			"%s/filesystems/masters/%s", ETCD_PREFIX, f.filesystemId,
-		),
-		target,
-		// only modify current master if I am indeed still the master
-		&client.SetOptions{PrevValue: f.state.myNodeId},
-	)
-	f.innerResponses <- &Event{Name: "moved"}
-	return inactiveState
 }
 
 func (f *fsMachine) unmount() (responseEvent *Event, nextState stateFn) {
@@ -573,6 +661,15 @@ func activeState(f *fsMachine) stateFn {
 	log.Printf("entering active state for %s", f.filesystemId)
 	select {
 	case e := <-f.innerRequests:
+		switch e.Name {
+		case "snapshot", "rollback", "transfer", "peer-transfer", "clone",
+			"preserve-diverged", "delete":
+			// these change the filesystem, or send it as the master's copy
+			if response, state := f.checkMasterEpoch(e); response != nil {
+				f.innerResponses <- response
+				return state
+			}
+		}
 		if e.Name == "delete" {
 			err := f.state.deleteFilesystem(f.filesystemId)
 			if err != nil {
@@ -645,7 +742,10 @@ func activeState(f *fsMachine) stateFn {
 		} else if e.Name == "move" {
 			// move straight into a state which doesn't allow us to take
 			// snapshots or do rollbacks
-			// refuse to move if we have any containers running
+			// refuse to move if we have any containers running, unless we've
+			// been asked to stop them (which handoffState does once it's
+			// pre-copied as much as it can while they run)
+			stop, _ := (*e.Args)["stopContainers"].(bool)
 			containers, err := f.containersRunning()
 			if err != nil {
 				log.Printf(
@@ -657,7 +757,7 @@ func activeState(f *fsMachine) stateFn {
 				}
 				return backoffState
 			}
-			if len(containers) > 0 {
+			if len(containers) > 0 && !stop {
 				log.Printf("Can't move filesystem while containers are using it")
 				f.innerResponses <- &Event{
 					Name: "cannot-move-while-containers-running",
@@ -760,77 +860,51 @@ func activeState(f *fsMachine) stateFn {
 			originSnapshotId := (*e.Args)["originSnapshotId"].(string)
 			newBranchName := (*e.Args)["newBranchName"].(string)
 
-			uuid, err := uuid.NewV4()
-			if err != nil {
-				f.innerResponses <- &Event{
-					Name: "failed-uuid", Args: &EventArgs{"err": err},
-				}
-				return backoffState
-			}
-			newCloneFilesystemId := uuid.String()
-
-			// RegisterClone(name string, topLevelFilesystemId string, clone Clone)
-			err = f.state.registry.RegisterClone(
-				newBranchName, topLevelFilesystemId,
-				Clone{
-					newCloneFilesystemId,
-					Origin{
-						originFilesystemId, originSnapshotId,
-					},
-				},
+			responseEvent, nextState := f.createClone(
+				topLevelFilesystemId, originFilesystemId, originSnapshotId,
+				newBranchName,
 			)
-			if err != nil {
-				f.innerResponses <- &Event{
-					Name: "failed-clone-registration", Args: &EventArgs{"err": err},
-				}
-				return backoffState
-			}
-
-			out, err := exec.Command(
-				ZFS, "clone",
-				fq(f.filesystemId)+"@"+originSnapshotId,
-				fq(newCloneFilesystemId),
-			).CombinedOutput()
-			if err != nil {
-				log.Printf("%v while trying to clone %s", err, fq(f.filesystemId))
-				f.innerResponses <- &Event{
-					Name: "failed-clone",
-					Args: &EventArgs{"err": err, "combined-output": string(out)},
-				}
-				return backoffState
+			if responseEvent.Name == "cloned" {
+				responseEvent, nextState = f.startClone(
+					(*responseEvent.Args)["filesystemId"].(string),
+				)
 			}
-			// spin off a state machine
-			f.state.initFilesystemMachine(newCloneFilesystemId)
-			kapi, err := getEtcdKeysApi()
+			f.innerResponses <- responseEvent
+			return nextState
+		} else if e.Name == "predict-size" {
+			// only the master is sure to have the snapshots to ask zfs about
+			size, err := predictSize(
+				(*e.Args)["fromFilesystemId"].(string), (*e.Args)["fromSnapshotId"].(string),
+				(*e.Args)["toFilesystemId"].(string), (*e.Args)["toSnapshotId"].(string),
+			)
 			if err != nil {
 				f.innerResponses <- &Event{
-					Name: "failed-get-etcd",
-					Args: &EventArgs{"err": err},
+					Name: "failed-predict-size", Args: &EventArgs{"err": err.Error()},
 				}
-				return backoffState
-			}
-			// claim the clone as mine, so that it can be mounted here
-			_, err = kapi.Set(
-				context.Background(),
-				fmt.Sprintf(
-					"%s/filesystems/masters/%s", ETCD_PREFIX, newCloneFilesystemId,
-				),
-				f.state.myNodeId,
-				// only modify current master if this is a new filesystem id
-				&client.SetOptions{PrevExist: client.PrevNoExist},
-			)
-			if err != nil {
+			} else {
 				f.innerResponses <- &Event{
-					Name: "failed-make-cloner-master",
-					Args: &EventArgs{"err": err},
+					Name: "predicted-size", Args: &EventArgs{"size": size},
 				}
-				return backoffState
-			}
-			f.innerResponses <- &Event{
-				Name: "cloned",
-				Args: &EventArgs{},
 			}
 			return activeState
+		} else if e.Name == "fence" {
+			// we were the master, but another node's replica has been
+			// promoted in our place
+			response, state := f.fence()
+			f.innerResponses <- response
+			return state
+		} else if e.Name == "preserve-diverged" {
+			// a forced push is about to overwrite commits which only exist
+			// here, keep them on a new branch first.
+			topLevelFilesystemId := (*e.Args)["topLevelFilesystemId"].(string)
+			latestCommonSnapshotId := (*e.Args)["latestCommonSnapshotId"].(string)
+			newBranchName := (*e.Args)["newBranchName"].(string)
+
+			response, state := f.preserveDivergedCommits(
+				topLevelFilesystemId, latestCommonSnapshotId, newBranchName,
+			)
+			f.innerResponses <- response
+			return state
 		} else if e.Name == "unmount" {
 			// fail if any containers running
 			containers, err := f.containersRunning()
@@ -865,6 +939,350 @@ func activeState(f *fsMachine) stateFn {
 	return backoffState
 }
 
+// Create a new branch newBranchName of topLevelFilesystemId as a zfs clone of
+// originFilesystemId@originSnapshotId, and register it once it exists. The
+// "cloned" event carries the new branch's filesystem id; nothing looks after
+// it until it is passed to startClone, or discardClone if that can't happen.
+func (f *fsMachine) createClone(
+	topLevelFilesystemId, originFilesystemId, originSnapshotId, newBranchName string,
+) (*Event, stateFn) {
+	uuid, err := uuid.NewV4()
+	if err != nil {
+		return &Event{
+			Name: "failed-uuid", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	newCloneFilesystemId := uuid.String()
+
+	out, err := exec.Command(
+		ZFS, "clone",
+		fq(originFilesystemId)+"@"+originSnapshotId,
+		fq(newCloneFilesystemId),
+	).CombinedOutput()
+	if err != nil {
+		log.Printf("%v while trying to clone %s", err, fq(originFilesystemId))
+		return &Event{
+			Name: "failed-clone",
+			Args: &EventArgs{"err": err, "combined-output": string(out)},
+		}, backoffState
+	}
+
+	// RegisterClone(name string, topLevelFilesystemId string, clone Clone)
+	err = f.state.registry.RegisterClone(
+		newBranchName, topLevelFilesystemId,
+		Clone{
+			newCloneFilesystemId,
+			Origin{
+				originFilesystemId, originSnapshotId,
+			},
+		},
+	)
+	if err != nil {
+		f.discardClone(topLevelFilesystemId, newBranchName, newCloneFilesystemId)
+		return &Event{
+			Name: "failed-clone-registration", Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	return &Event{
+		Name: "cloned",
+		Args: &EventArgs{"filesystemId": newCloneFilesystemId},
+	}, activeState
+}
+
+// Undo createClone, when the new branch can't be finished off.
+func (f *fsMachine) discardClone(topLevelFilesystemId, newBranchName, newCloneFilesystemId string) {
+	err := f.state.registry.UnregisterClone(newBranchName, topLevelFilesystemId)
+	if err != nil {
+		log.Printf("%v while trying to unregister clone %s", err, newBranchName)
+	}
+	out, err := exec.Command(ZFS, "destroy", "-r", fq(newCloneFilesystemId)).CombinedOutput()
+	if err != nil {
+		log.Printf("%v while trying to destroy %s: %s", err, fq(newCloneFilesystemId), out)
+	}
+}
+
+// Spin off a state machine for a clone made by createClone, and claim it as
+// ours so that it can be mounted here.
+func (f *fsMachine) startClone(newCloneFilesystemId string) (*Event, stateFn) {
+	f.state.initFilesystemMachine(newCloneFilesystemId)
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return &Event{
+			Name: "failed-get-etcd",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	_, err = kapi.Set(
+		context.Background(),
+		fmt.Sprintf(
+			"%s/filesystems/masters/%s", ETCD_PREFIX, newCloneFilesystemId,
+		),
+		f.state.myNodeId,
+		// only modify current master if this is a new filesystem id
+		&client.SetOptions{PrevExist: client.PrevNoExist},
+	)
+	if err != nil {
+		return &Event{
+			Name: "failed-make-cloner-master",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	return &Event{
+		Name: "cloned",
+		Args: &EventArgs{"filesystemId": newCloneFilesystemId},
+	}, activeState
+}
+
+// Name for a new branch which keeps commits that conflicted with a transfer
+// into the branch cloneName ("" for master), e.g. master-diverged-20180101-120000
+func conflictBranchName(cloneName, reason string) string {
+	if cloneName == "" {
+		cloneName = DEFAULT_BRANCH
+	}
+	return fmt.Sprintf(
+		"%s-%s-%s", cloneName, reason, time.Now().UTC().Format("20060102-150405"),
+	)
+}
+
+// Move the commits after latestCommonSnapshotId onto a new branch which is
+// cloned at latestCommonSnapshotId, then roll back to latestCommonSnapshotId.
+// We can't just clone the latest snapshot, because zfs won't roll back past a
+// snapshot that a clone depends on, so the commits are copied into the new
+// branch with an incremental send instead.
+func (f *fsMachine) preserveDivergedCommits(
+	topLevelFilesystemId, latestCommonSnapshotId, newBranchName string,
+) (*Event, stateFn) {
+	sliceIndex, errorEvent := f.firstDivergedCommit(latestCommonSnapshotId)
+	if errorEvent != nil {
+		return errorEvent, backoffState
+	}
+
+	err := f.stopContainers()
+	defer func() {
+		err := f.startContainers()
+		if err != nil {
+			log.Printf(
+				"[preserveDivergedCommits] unable to start containers in deferred func: %s",
+				err,
+			)
+		}
+	}()
+	if err != nil {
+		log.Printf(
+			"%v while trying to stop containers during preserve-diverged %s",
+			err, fq(f.filesystemId),
+		)
+		return &Event{
+			Name: "failed-stop-containers-during-preserve-diverged",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	return f.branchDivergedCommits(
+		topLevelFilesystemId, latestCommonSnapshotId, sliceIndex, newBranchName,
+	)
+}
+
+// The index of the first of our snapshots after latestCommonSnapshotId, or an
+// event saying why there isn't one.
+func (f *fsMachine) firstDivergedCommit(latestCommonSnapshotId string) (int, *Event) {
+	f.snapshotsLock.Lock()
+	snaps := f.filesystem.snapshots
+	f.snapshotsLock.Unlock()
+	// the first snapshot which will be rolled back
+	sliceIndex := -1
+	for i, snapshot := range snaps {
+		if snapshot.Id == latestCommonSnapshotId {
+			sliceIndex = i + 1
+		}
+	}
+	if sliceIndex < 0 {
+		return -1, &Event{
+			Name: "no-such-snapshot",
+			Args: &EventArgs{"snapshotId": latestCommonSnapshotId},
+		}
+	}
+	if sliceIndex == len(snaps) {
+		return -1, &Event{
+			Name: "no-diverged-commits",
+			Args: &EventArgs{"latestCommonSnapshotId": latestCommonSnapshotId},
+		}
+	}
+	return sliceIndex, nil
+}
+
+// The guts of preserveDivergedCommits, for when nothing's using the
+// filesystem.
+func (f *fsMachine) branchDivergedCommits(
+	topLevelFilesystemId, latestCommonSnapshotId string, sliceIndex int, newBranchName string,
+) (*Event, stateFn) {
+	f.snapshotsLock.Lock()
+	latestSnapshotId := f.filesystem.snapshots[len(f.filesystem.snapshots)-1].Id
+	f.snapshotsLock.Unlock()
+
+	responseEvent, nextState := f.createClone(
+		topLevelFilesystemId, f.filesystemId, latestCommonSnapshotId,
+		newBranchName,
+	)
+	if responseEvent.Name != "cloned" {
+		return responseEvent, nextState
+	}
+	newCloneFilesystemId := (*responseEvent.Args)["filesystemId"].(string)
+
+	// the clone's origin is latestCommonSnapshotId, so it can receive an
+	// incremental stream starting there.
+	sendCmd := exec.Command(
+		ZFS, "send", "-p", "-I",
+		fq(f.filesystemId)+"@"+latestCommonSnapshotId,
+		fq(f.filesystemId)+"@"+latestSnapshotId,
+	)
+	sendCmd.Stderr = getLogfile("zfs-send-errors")
+	recvCmd := exec.Command(ZFS, "recv", fq(newCloneFilesystemId))
+	recvCmd.Stdout = getLogfile("zfs-recv-stdout")
+	recvCmd.Stderr = getLogfile("zfs-recv-stderr")
+	var err error
+	recvCmd.Stdin, err = sendCmd.StdoutPipe()
+	if err == nil {
+		err = recvCmd.Start()
+	}
+	if err == nil {
+		err = sendCmd.Run()
+		e := recvCmd.Wait()
+		if err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Printf(
+			"%v while copying %s to %s, check zfs-send-errors.log and zfs-recv-stderr.log",
+			err, fq(f.filesystemId), fq(newCloneFilesystemId),
+		)
+		f.discardClone(topLevelFilesystemId, newBranchName, newCloneFilesystemId)
+		return &Event{
+			Name: "failed-copy-diverged-commits",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+
+	responseEvent, nextState = f.startClone(newCloneFilesystemId)
+	if responseEvent.Name != "cloned" {
+		return responseEvent, nextState
+	}
+
+	// only now that the commits are safe, throw them away here
+	out, err := exec.Command(ZFS, "rollback",
+		"-r", fq(f.filesystemId)+"@"+latestCommonSnapshotId).CombinedOutput()
+	if err != nil {
+		log.Printf("%v while trying to rollback %s", err, fq(f.filesystemId))
+		return &Event{
+			Name: "failed-rollback",
+			Args: &EventArgs{"err": err, "combined-output": string(out)},
+		}, backoffState
+	}
+	f.snapshotsLock.Lock()
+	f.filesystem.snapshots = f.filesystem.snapshots[:sliceIndex]
+	f.snapshotsLock.Unlock()
+	f.snapshotsModified <- true
+
+	return &Event{
+		Name: "preserved-diverged",
+		Args: &EventArgs{"newBranchName": newBranchName},
+	}, activeState
+}
+
+// Stop using a filesystem which was failed over to another node while we were
+// gone (see failover.go), or given to another node at a newer master epoch
+// than ours (see epochs.go): stop the containers using it, keep any commits
+// the new master doesn't have on a new branch, and unmount it, so that we can
+// carry on as a replica.
+func (f *fsMachine) fence() (*Event, stateFn) {
+	err := f.stopContainers()
+	if err != nil {
+		log.Printf("%v while trying to stop containers during fence %s", err, fq(f.filesystemId))
+		return &Event{
+			Name: "failed-stop-containers-during-fence",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	master := f.state.masterFor(f.filesystemId)
+
+	if f.filesystem.mounted {
+		dirtyBytes, _, err := getDirtyDelta(f.filesystemId, f.latestSnapshot())
+		if err != nil {
+			return &Event{
+				Name: "failed-get-dirty-during-fence",
+				Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		if dirtyBytes > 0 {
+			// keep the uncommitted changes along with the commits
+			response, _ := f.snapshot(&Event{
+				Name: "snapshot",
+				Args: &EventArgs{"metadata": metadata{
+					"author": "system",
+					"message": fmt.Sprintf(
+						"Automatic snapshot of uncommitted changes on %s after %s took over as master.",
+						f.state.myNodeId, master,
+					)},
+				},
+			})
+			if response.Name != "snapshotted" {
+				return response, backoffState
+			}
+		}
+	}
+
+	masterSnaps, err := f.state.snapshotsFor(master, f.filesystemId)
+	if err != nil {
+		return &Event{
+			Name: "failed-get-master-snapshots-during-fence",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
+	f.snapshotsLock.Lock()
+	localSnaps := f.filesystem.snapshots
+	f.snapshotsLock.Unlock()
+	var latestCommon *snapshot
+	_, err = canApply(pointers(masterSnaps), localSnaps)
+	switch err := err.(type) {
+	case *ToSnapsDiverged:
+		latestCommon = &err.latestCommonSnapshot
+	case *ToSnapsAhead:
+		latestCommon = &err.latestCommonSnapshot
+	}
+	newBranchName := ""
+	if latestCommon != nil {
+		tlf, cloneName, err := f.state.registry.LookupFilesystemById(f.filesystemId)
+		if err != nil {
+			return &Event{
+				Name: "fence-cant-find-branch",
+				Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		sliceIndex, errorEvent := f.firstDivergedCommit(latestCommon.Id)
+		if errorEvent != nil {
+			return errorEvent, backoffState
+		}
+		newBranchName = conflictBranchName(cloneName, "fenced")
+		responseEvent, nextState := f.branchDivergedCommits(
+			tlf.MasterBranch.Id, latestCommon.Id, sliceIndex, newBranchName,
+		)
+		if responseEvent.Name != "preserved-diverged" {
+			return responseEvent, nextState
+		}
+	}
+
+	if f.filesystem.mounted {
+		responseEvent, nextState := f.unmount()
+		if responseEvent.Name != "unmounted" {
+			return responseEvent, nextState
+		}
+	}
+	return &Event{
+		Name: "fenced",
+		Args: &EventArgs{"master": master, "newBranchName": newBranchName},
+	}, inactiveState
+}
+
 // probably the wrong way to do it
 func pointers(snapshots []snapshot) []*snapshot {
 	newList := []*snapshot{}
@@ -928,6 +1346,11 @@ func inactiveState(f *fsMachine) stateFn {
 			event, nextState := f.mount()
 			f.innerResponses <- event
 			return true, nextState
+		} else if e.Name == "fence" {
+			f.transitionedTo("inactive", "fencing")
+			event, nextState := f.fence()
+			f.innerResponses <- event
+			return true, nextState
 		} else {
 			f.innerResponses <- &Event{
 				Name: "unhandled",
@@ -990,6 +1413,11 @@ func (f *fsMachine) plausibleSnapRange() (*snapshotRange, error) {
 }
 
 func (f *fsMachine) attemptReceive() bool {
+	if !f.state.replicates(f.filesystemId) {
+		// other nodes are keeping the copies of this one, see replicas.go
+		return false
+	}
+
 	// Check whether there are any pull-able snaps of this filesystem on its
 	// current master
 
@@ -1026,19 +1454,18 @@ func transferRequestify(in interface{}) (TransferRequest, error) {
 			"Unable to cast %s to map[string]interface{}", in,
 		)
 	}
-	return TransferRequest{
-		Peer:             typed["Peer"].(string),
-		User:             typed["User"].(string),
-		ApiKey:           typed["ApiKey"].(string),
-		Direction:        typed["Direction"].(string),
-		LocalNamespace:   typed["LocalNamespace"].(string),
-		LocalName:        typed["LocalName"].(string),
-		LocalBranchName:  typed["LocalBranchName"].(string),
-		RemoteNamespace:  typed["RemoteNamespace"].(string),
-		RemoteName:       typed["RemoteName"].(string),
-		RemoteBranchName: typed["RemoteBranchName"].(string),
-		TargetCommit:     typed["TargetCommit"].(string),
-	}, nil
+	// go back through JSON, so that every field of the request survives the
+	// trip through etcd, however it's typed
+	serialized, err := json.Marshal(typed)
+	if err != nil {
+		return TransferRequest{}, err
+	}
+	var transferRequest TransferRequest
+	err = json.Unmarshal(serialized, &transferRequest)
+	if err != nil {
+		return TransferRequest{}, err
+	}
+	return transferRequest, nil
 }
 
 // either missing because you're about to be locally created or because the
@@ -1264,6 +1691,9 @@ func discoveringState(f *fsMachine) stateFn {
 func receivingState(f *fsMachine) stateFn {
 	f.transitionedTo("receiving", "calculating")
 	log.Printf("entering receiving state for %s", f.filesystemId)
+	if !f.state.replicates(f.filesystemId) {
+		return discoveringState
+	}
 	snapRange, err := f.plausibleSnapRange()
 
 	// by judiciously reading from f.innerRequests, we implicitly take a lock on not
@@ -1333,25 +1763,27 @@ func receivingState(f *fsMachine) stateFn {
 		fromSnap = snapRange.fromSnap.Id
 	}
 
-	addresses := f.state.addressesFor(
-		f.state.masterFor(f.filesystemId),
-	)
-	if len(addresses) == 0 {
-		log.Printf("No known address for current master of %s", f.filesystemId)
+	// only receive from the master as of the latest epoch (see epochs.go)
+	master := f.state.masterFor(f.filesystemId)
+	confirmed, _, err := f.state.confirmMaster(f.filesystemId)
+	if err != nil {
+		log.Printf("Can't confirm the master of %s: %s", f.filesystemId, err)
 		return backoffState
 	}
-	// XXX hack, IPv4 happens to come before IPv6 and happens to be routeable
-	// on my network (whereas IPv6 isn't), but this depends on the enumeration
-	// order of network cards in servers :/
-	// TODO we should really attempt each address in turn until we find one
-	// that works.
-	peerAddress := addresses[0]
+	if confirmed != master {
+		log.Printf(
+			"Master of %s is now %s rather than %s, starting again",
+			f.filesystemId, confirmed, master,
+		)
+		return discoveringState
+	}
 
-	_, _, apiKey, err := getPasswords("admin")
+	peerAddress, err := f.state.reachableAddressFor(master)
 	if err != nil {
-		log.Printf("Attempting to pull %s got %s", f.filesystemId, err)
+		log.Printf("Can't reach current master of %s: %s", f.filesystemId, err)
 		return backoffState
 	}
+
 	req, err := http.NewRequest(
 		"GET",
 		fmt.Sprintf(
@@ -1366,9 +1798,12 @@ func receivingState(f *fsMachine) stateFn {
 		log.Printf("Attempting to pull %s got %s", f.filesystemId, err)
 		return backoffState
 	}
-	req.SetBasicAuth("admin", apiKey)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	err = authenticateInternal(req)
+	if err != nil {
+		log.Printf("Attempting to pull %s got %s", f.filesystemId, err)
+		return backoffState
+	}
+	resp, err := internalHttpClient.Do(req)
 	if err != nil {
 		log.Printf("Attempting to pull %s got %s", f.filesystemId, err)
 		return backoffState
@@ -1447,7 +1882,12 @@ func updatePollResult(transferRequestId string, pollResult TransferPollResult) e
 		"[updatePollResult] attempting to update poll result for %s: %+v",
 		transferRequestId, pollResult,
 	)
-	kapi, err := getEtcdKeysApi()
+	publishPollResult(transferRequestId, pollResult, true)
+	transferProgress.Lock()
+	transferProgress.written[transferRequestId] = time.Now()
+	transferProgress.Unlock()
+
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -1536,10 +1976,36 @@ func pushInitiatorState(f *fsMachine) stateFn {
 		}
 		return backoffState
 	}
+	if transferRequest.S3 != nil {
+		return f.s3PushInitiator(path, transferRequest, transferRequestId)
+	}
+
+	// Also RPC to remote cluster to set up a similar record there.
+	// TODO retries
+	client := NewJsonRpcClient(
+		transferRequest.User,
+		transferRequest.Peer,
+		transferRequest.ApiKey,
+		transferRequest.PeerTLS,
+	)
+
+	total := 1 + len(path.Clones)
+	var branches []branchPath
+	if transferRequest.AllBranches {
+		branches, err = f.state.sendingBranches(context.Background(), client, &transferRequest)
+		if err != nil {
+			f.innerResponses <- &Event{
+				Name: "cant-find-branches",
+				Args: &EventArgs{"err": err},
+			}
+			return backoffState
+		}
+		total = len(branches)
+	}
 
 	pollResult := TransferPollResultFromTransferRequest(
 		transferRequestId, transferRequest, f.state.myNodeId,
-		1, 1+len(path.Clones), "syncing metadata",
+		1, total, "syncing metadata",
 	)
 	f.lastPollResult = &pollResult
 
@@ -1551,13 +2017,6 @@ func pushInitiatorState(f *fsMachine) stateFn {
 		}
 		return backoffState
 	}
-	// Also RPC to remote cluster to set up a similar record there.
-	// TODO retries
-	client := NewJsonRpcClient(
-		transferRequest.User,
-		transferRequest.Peer,
-		transferRequest.ApiKey,
-	)
 
 	// TODO should we wait for the remote to ack that it's gone into the right state?
 
@@ -1565,7 +2024,7 @@ func pushInitiatorState(f *fsMachine) stateFn {
 	// for "up to latest")
 
 	// TODO tidy up argument passing here.
-	responseEvent, nextState := f.applyPath(path, func(f *fsMachine,
+	push := func(f *fsMachine,
 		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
 		transferRequestId string, pollResult *TransferPollResult,
 		client *JsonRpcClient, transferRequest *TransferRequest,
@@ -1574,7 +2033,18 @@ func pushInitiatorState(f *fsMachine) stateFn {
 			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
 			transferRequestId, pollResult, client, transferRequest,
 		)
-	}, transferRequestId, &pollResult, client, &transferRequest)
+	}
+	var responseEvent *Event
+	var nextState stateFn
+	if transferRequest.AllBranches {
+		responseEvent, nextState = f.applyBranches(
+			branches, push, transferRequestId, &pollResult, client, &transferRequest,
+		)
+	} else {
+		responseEvent, nextState = f.applyPath(
+			path, push, transferRequestId, &pollResult, client, &transferRequest,
+		)
+	}
 
 	f.innerResponses <- responseEvent
 	if nextState == nil {
@@ -1656,6 +2126,45 @@ func (f *fsMachine) retryPush(
 				}, backoffState
 			}
 			snapRange, err := canApply(localSnaps, remoteSnaps)
+			if err != nil && transferRequest.Force {
+				var latestCommon *snapshot
+				switch err := err.(type) {
+				case *ToSnapsDiverged:
+					latestCommon = &err.latestCommonSnapshot
+				case *ToSnapsAhead:
+					latestCommon = &err.latestCommonSnapshot
+				}
+				if latestCommon != nil {
+					// ask the peer to move its extra commits out of the way,
+					// after which it ends at the latest common snapshot.
+					var newBranchName string
+					e := client.CallRemote(
+						context.Background(),
+						"DotmeshRPC.PreserveDivergedCommits",
+						map[string]string{
+							"FilesystemId":           toFilesystemId,
+							"LatestCommonSnapshotId": latestCommon.Id,
+						},
+						&newBranchName,
+					)
+					if e != nil {
+						return &Event{
+							Name: "push-initiator-cant-preserve-diverged-commits",
+							Args: &EventArgs{"err": e},
+						}, backoffState
+					}
+					pollResult.PreservedBranches = append(
+						pollResult.PreservedBranches, newBranchName,
+					)
+					for i, s := range remoteSnaps {
+						if s.Id == latestCommon.Id {
+							remoteSnaps = remoteSnaps[:i+1]
+							break
+						}
+					}
+					snapRange, err = canApply(localSnaps, remoteSnaps)
+				}
+			}
 			if err != nil {
 				switch err.(type) {
 				case *ToSnapsUpToDate:
@@ -1779,6 +2288,7 @@ func (f *fsMachine) updateTransfer(status, message string) {
 
 func (f *fsMachine) pull(
 	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	localFilesystemId string,
 	snapRange *snapshotRange,
 	transferRequest *TransferRequest,
 	transferRequestId *string,
@@ -1796,6 +2306,10 @@ func (f *fsMachine) pull(
 	// filesystem being pulled here IS the one we're the fsmachine for
 	// may fail in interesting cases.
 
+	// localFilesystemId is where the snapshots end up here. It's the same as
+	// toFilesystemId unless we're pulling into a new branch because the pull
+	// conflicted with local commits.
+
 	// TODO if we just created the filesystem, become the master for it. (or
 	// maybe this belongs in the metadata prenegotiation phase)
 	pollResult.Status = "calculating size"
@@ -1849,7 +2363,7 @@ func (f *fsMachine) pull(
 		"%s/filesystems/%s/%s/%s",
 		// pulls are between clusters, so use external address where
 		// appropriate
-		deduceUrl(transferRequest.Peer, "external"),
+		deduceUrl(transferRequest.Peer, transferRequest.PeerTLS.urlMode()),
 		toFilesystemId,
 		fromSnapshotId,
 		toSnapshotId,
@@ -1862,7 +2376,14 @@ func (f *fsMachine) pull(
 		transferRequest.User,
 		transferRequest.ApiKey,
 	)
-	getClient := new(http.Client)
+	getClient, err := peerHttpClient(transferRequest.PeerTLS)
+	if err != nil {
+		log.Printf("Attempting to pull %s got %s", toFilesystemId, err)
+		return &Event{
+			Name: "get-failed-pull",
+			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
 	resp, err := getClient.Do(req)
 	if err != nil {
 		log.Printf("Attempting to pull %s got %s", toFilesystemId, err)
@@ -1890,7 +2411,7 @@ func (f *fsMachine) pull(
 	// 2) Pulling node is trying to mount the master fsid and failing.
 
 	// cmd := exec.Command("zfs", "recv", fq(f.filesystemId))
-	cmd := exec.Command("zfs", "recv", fq(toFilesystemId))
+	cmd := exec.Command("zfs", "recv", fq(localFilesystemId))
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 	defer pipeWriter.Close()
@@ -1912,7 +2433,7 @@ func (f *fsMachine) pull(
 		func(bytes int64, t int64) {
 			pollResult.Sent = bytes
 			pollResult.NanosecondsElapsed = t
-			err = updatePollResult(*transferRequestId, *pollResult)
+			err = updatePollResultProgress(*transferRequestId, *pollResult)
 			if err != nil {
 				log.Printf("Error updating poll result: %s", err)
 			}
@@ -1957,7 +2478,7 @@ func (f *fsMachine) pull(
 		}, backoffState
 	}
 	log.Printf("[pull] about to start applying prelude on %v", pipeReader)
-	err = applyPrelude(prelude, fq(toFilesystemId))
+	err = applyPrelude(prelude, fq(localFilesystemId))
 	if err != nil {
 		return &Event{
 			Name: "failed-applying-prelude",
@@ -2005,6 +2526,10 @@ func calculateSendArgs(
 		sendArgs = []string{
 			"-p", "-R", fq(toFilesystemId) + "@" + toSnapshotId,
 		}
+	} else if fromSnap == BASE_SNAPSHOT {
+		sendArgs = []string{
+			"-p", fq(toFilesystemId) + "@" + toSnapshotId,
+		}
 	} else {
 		// in clone case, fromSnap must be fully qualified
 		if strings.Contains(fromSnap, "@") {
@@ -2107,7 +2632,7 @@ func (f *fsMachine) push(
 		// pushes are between clusters, so use external address where
 		// appropriate
 		"%s/filesystems/%s/%s/%s",
-		deduceUrl(transferRequest.Peer, "external"),
+		deduceUrl(transferRequest.Peer, transferRequest.PeerTLS.urlMode()),
 		filesystemId,
 		fromSnapshotId,
 		snapRange.toSnap.Id,
@@ -2204,7 +2729,7 @@ func (f *fsMachine) push(
 		func(bytes int64, t int64) {
 			pollResult.Sent = bytes
 			pollResult.NanosecondsElapsed = t
-			err = updatePollResult(*transferRequestId, *pollResult)
+			err = updatePollResultProgress(*transferRequestId, *pollResult)
 			if err != nil {
 				log.Printf("Error updating poll result: %s", err)
 			}
@@ -2231,7 +2756,14 @@ func (f *fsMachine) push(
 		transferRequest.User,
 		transferRequest.ApiKey,
 	)
-	postClient := new(http.Client)
+	postClient, err := peerHttpClient(transferRequest.PeerTLS)
+	if err != nil {
+		log.Printf("[actualPush] error setting up TLS for %s: %s", transferRequest.Peer, err)
+		return &Event{
+			Name: "error-starting-post-when-pushing",
+			Args: &EventArgs{"err": err},
+		}, backoffState
+	}
 
 	log.Printf("About to postClient.Do with req %s", req)
 
@@ -2568,12 +3100,16 @@ func pullInitiatorState(f *fsMachine) stateFn {
 
 	transferRequest := f.lastTransferRequest
 	transferRequestId := f.lastTransferRequestId
+	if transferRequest.S3 != nil {
+		return f.s3PullInitiator(transferRequest, transferRequestId)
+	}
 
 	// TODO dedupe what follows wrt pushInitiatorState!
 	client := NewJsonRpcClient(
 		transferRequest.User,
 		transferRequest.Peer,
 		transferRequest.ApiKey,
+		transferRequest.PeerTLS,
 	)
 
 	var path PathToTopLevelFilesystem
@@ -2595,10 +3131,24 @@ func pullInitiatorState(f *fsMachine) stateFn {
 		return backoffState
 	}
 
+	total := 1 + len(path.Clones)
+	var branches []branchPath
+	if transferRequest.AllBranches {
+		branches, err = f.state.sendingBranches(context.Background(), client, &transferRequest)
+		if err != nil {
+			f.innerResponses <- &Event{
+				Name: "cant-find-branches",
+				Args: &EventArgs{"err": err},
+			}
+			return backoffState
+		}
+		total = len(branches)
+	}
+
 	// register a poll result object.
 	pollResult := TransferPollResultFromTransferRequest(
 		transferRequestId, transferRequest, f.state.myNodeId,
-		1, 1+len(path.Clones), "syncing metadata",
+		1, total, "syncing metadata",
 	)
 	f.lastPollResult = &pollResult
 
@@ -2612,7 +3162,7 @@ func pullInitiatorState(f *fsMachine) stateFn {
 	}
 
 	// iterate over the path, attempting to pull each clone in turn.
-	responseEvent, nextState := f.applyPath(path, func(f *fsMachine,
+	pull := func(f *fsMachine,
 		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
 		transferRequestId string, pollResult *TransferPollResult,
 		client *JsonRpcClient, transferRequest *TransferRequest,
@@ -2621,7 +3171,18 @@ func pullInitiatorState(f *fsMachine) stateFn {
 			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
 			transferRequestId, pollResult, client, transferRequest,
 		)
-	}, transferRequestId, &pollResult, client, &transferRequest)
+	}
+	var responseEvent *Event
+	var nextState stateFn
+	if transferRequest.AllBranches {
+		responseEvent, nextState = f.applyBranches(
+			branches, pull, transferRequestId, &pollResult, client, &transferRequest,
+		)
+	} else {
+		responseEvent, nextState = f.applyPath(
+			path, pull, transferRequestId, &pollResult, client, &transferRequest,
+		)
+	}
 
 	f.innerResponses <- responseEvent
 	return nextState
@@ -2631,7 +3192,7 @@ func (f *fsMachine) retryPull(
 	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
 	transferRequestId string, pollResult *TransferPollResult,
 	client *JsonRpcClient, transferRequest *TransferRequest,
-) (*Event, stateFn) {
+) (result *Event, resultState stateFn) {
 	// TODO refactor the following with respect to retryPush!
 
 	// Let's go!
@@ -2683,7 +3244,73 @@ func (f *fsMachine) retryPull(
 			Args: &EventArgs{"err": err, "filesystemId": toFilesystemId},
 		}, backoffState
 	}
+	localFilesystemId := toFilesystemId
 	snapRange, err := canApply(remoteSnaps, localSnaps)
+	if err != nil && transferRequest.BranchOnConflict {
+		var latestCommon *snapshot
+		switch err := err.(type) {
+		case *ToSnapsDiverged:
+			latestCommon = &err.latestCommonSnapshot
+		case *ToSnapsAhead:
+			latestCommon = &err.latestCommonSnapshot
+		}
+		if latestCommon != nil {
+			// leave the local commits alone and pull into a new branch
+			// cloned at the latest common snapshot instead.
+			tlf, cloneName, e := f.state.registry.LookupFilesystemById(toFilesystemId)
+			if e != nil {
+				return &Event{
+					Name: "retry-pull-cant-find-branch",
+					Args: &EventArgs{"err": e, "filesystemId": toFilesystemId},
+				}, backoffState
+			}
+			newBranchName := conflictBranchName(cloneName, "pulled")
+			responseEvent, nextState := f.createClone(
+				tlf.MasterBranch.Id, toFilesystemId, latestCommon.Id, newBranchName,
+			)
+			if responseEvent.Name != "cloned" {
+				return responseEvent, nextState
+			}
+			localFilesystemId = (*responseEvent.Args)["filesystemId"].(string)
+			pollResult.ConflictBranches = append(
+				pollResult.ConflictBranches, newBranchName,
+			)
+			// if the pull doesn't make it, don't leave a branch with nothing
+			// in it and no master behind, for the next attempt to add another
+			started := false
+			defer func() {
+				if started || result.Name == "finished-pull" || result.Name == "peer-up-to-date" {
+					return
+				}
+				f.discardClone(tlf.MasterBranch.Id, newBranchName, localFilesystemId)
+				pollResult.ConflictBranches = pollResult.ConflictBranches[:len(pollResult.ConflictBranches)-1]
+			}()
+
+			remoteLatest := remoteSnaps[len(remoteSnaps)-1]
+			if remoteLatest.Id == latestCommon.Id {
+				// we're only ahead, so the new branch is already where the
+				// remote is and there's nothing to receive.
+				responseEvent, nextState = f.startClone(localFilesystemId)
+				if responseEvent.Name != "cloned" {
+					return responseEvent, nextState
+				}
+				started = true
+				pollResult.Status = "finished"
+				pollResult.Message = "local branch is ahead of remote, nothing to pull"
+				e := updatePollResult(transferRequestId, *pollResult)
+				if e != nil {
+					return &Event{
+						Name: "pull-initiator-cant-write-to-etcd", Args: &EventArgs{"err": e},
+					}, backoffState
+				}
+				return &Event{
+					Name: "peer-up-to-date",
+				}, backoffState
+			}
+			snapRange = &snapshotRange{fromSnap: latestCommon, toSnap: remoteLatest}
+			err = nil
+		}
+	}
 	if err != nil {
 		switch err.(type) {
 		case *ToSnapsUpToDate:
@@ -2720,6 +3347,48 @@ func (f *fsMachine) retryPull(
 	}
 
 	pollResult.FilesystemId = toFilesystemId
+
+	if fromSnap == "START" && (transferRequest.Depth > 0 || transferRequest.Since != "") {
+		// a shallow pull: start with a full stream of just the base snapshot
+		// instead of the whole history before it.
+		base, err := shallowBase(remoteSnaps, transferRequest.Depth, transferRequest.Since)
+		if err != nil {
+			return &Event{
+				Name: "cant-find-shallow-base", Args: &EventArgs{"err": err},
+			}, backoffState
+		}
+		fromSnap = BASE_SNAPSHOT
+		if base.Id != snapRange.toSnap.Id {
+			// receive the base on its own, as an extra step of the transfer,
+			// then the rest incrementally from it.
+			pollResult.Total++
+			pollResult.StartingCommit = BASE_SNAPSHOT
+			pollResult.TargetCommit = base.Id
+			err = updatePollResult(transferRequestId, *pollResult)
+			if err != nil {
+				return &Event{
+					Name: "pull-initiator-cant-write-to-etcd", Args: &EventArgs{"err": err},
+				}, backoffState
+			}
+			responseEvent, nextState := f.retryPullRange(
+				fromFilesystemId, fromSnapshotId, toFilesystemId, base.Id,
+				localFilesystemId, &snapshotRange{fromSnap: nil, toSnap: base},
+				transferRequestId, pollResult, client, transferRequest,
+			)
+			if responseEvent.Name != "finished-pull" {
+				return responseEvent, nextState
+			}
+			err = f.incrementPollResultIndex(transferRequestId, pollResult)
+			if err != nil {
+				return &Event{
+					Name: "error-incrementing-poll-result", Args: &EventArgs{"err": err},
+				}, backoffState
+			}
+			fromSnap = base.Id
+			snapRange = &snapshotRange{fromSnap: base, toSnap: snapRange.toSnap}
+		}
+	}
+
 	pollResult.StartingCommit = fromSnap
 	pollResult.TargetCommit = snapRange.toSnap.Id
 
@@ -2737,6 +3406,20 @@ func (f *fsMachine) retryPull(
 		}, backoffState
 	}
 
+	return f.retryPullRange(
+		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+		localFilesystemId, snapRange,
+		transferRequestId, pollResult, client, transferRequest,
+	)
+}
+
+// Pull snapRange, as already recorded in pollResult, retrying if it fails.
+func (f *fsMachine) retryPullRange(
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+	localFilesystemId string, snapRange *snapshotRange,
+	transferRequestId string, pollResult *TransferPollResult,
+	client *JsonRpcClient, transferRequest *TransferRequest,
+) (*Event, stateFn) {
 	var retry int
 	var responseEvent *Event
 	var nextState stateFn
@@ -2744,10 +3427,18 @@ func (f *fsMachine) retryPull(
 		// XXX XXX XXX REFACTOR (retryPush)
 		responseEvent, nextState = f.pull(
 			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+			localFilesystemId,
 			snapRange, transferRequest, &transferRequestId, pollResult, client,
 		)
 		if responseEvent.Name == "finished-pull" || responseEvent.Name == "peer-up-to-date" {
 			log.Printf("[actualPull] Successful pull!")
+			if localFilesystemId != toFilesystemId {
+				// now the new branch has its snapshots, let it be discovered
+				e, s := f.startClone(localFilesystemId)
+				if e.Name != "cloned" {
+					return e, s
+				}
+			}
 			return responseEvent, nextState
 		}
 		retry++
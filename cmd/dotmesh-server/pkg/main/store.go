@@ -0,0 +1,95 @@
+package main
+
+// The metadata store.
+//
+// Everything dotmesh knows about the cluster besides the filesystems
+// themselves (the registry of dots and branches, users, which node is master
+// of what, requests to the masters and their responses, and so on) lives in
+// a MetadataStore. Its semantics are those of etcd's v2 keys API, which it
+// borrows the types of: keys in a tree of directories, a single index which
+// every change increments, compare-and-swap on a key's previous value or
+// index, TTLs, and watching for changes after a given index.
+//
+// DOTMESH_METADATA_STORE picks the implementation: "etcd" (the default), or
+// "memory" for a memoryStore, which needs no etcd but forgets everything when
+// the server stops, so is only any good for single-node setups and tests.
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// The parts of etcd's client.KeysAPI that dotmesh uses, and how healthy the
+// store is (for `dm cluster status`).
+type MetadataStore interface {
+	Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error)
+	Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error)
+	Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error)
+	CreateInOrder(
+		ctx context.Context, dir, value string, opts *client.CreateInOrderOptions,
+	) (*client.Response, error)
+	Watcher(key string, opts *client.WatcherOptions) client.Watcher
+	Status(ctx context.Context) EtcdStatus
+}
+
+// etcd's own keys API, and its members API to tell how it is.
+type etcdStore struct {
+	client.KeysAPI
+	members client.MembersAPI
+}
+
+func (e etcdStore) Status(ctx context.Context) EtcdStatus {
+	status := EtcdStatus{Members: []string{}}
+	// a quorum read is the best test of whether etcd can do its job
+	_, err := e.Get(ctx, ETCD_PREFIX, &client.GetOptions{Quorum: true})
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Healthy = true
+	members, err := e.members.List(ctx)
+	if err == nil {
+		for _, member := range members {
+			status.Members = append(status.Members, member.Name)
+		}
+		sort.Strings(status.Members)
+	}
+	leader, err := e.members.Leader(ctx)
+	if err == nil && leader != nil {
+		status.Leader = leader.Name
+	}
+	return status
+}
+
+// nil unless DOTMESH_METADATA_STORE asks for one other than etcd
+var metadataStore MetadataStore
+
+func loadMetadataStore() error {
+	setting := os.Getenv("DOTMESH_METADATA_STORE")
+	switch setting {
+	case "", "etcd":
+		metadataStore = nil
+	case "memory":
+		metadataStore = newMemoryStore()
+	default:
+		return fmt.Errorf(
+			"Invalid DOTMESH_METADATA_STORE %q, expected etcd or memory", setting,
+		)
+	}
+	return nil
+}
+
+func getMetadataStore() (MetadataStore, error) {
+	if metadataStore != nil {
+		return metadataStore, nil
+	}
+	c, err := getEtcd()
+	if err != nil {
+		return nil, err
+	}
+	return etcdStore{KeysAPI: client.NewKeysAPI(c), members: client.NewMembersAPI(c)}, nil
+}
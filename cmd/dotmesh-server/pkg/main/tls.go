@@ -0,0 +1,384 @@
+package main
+
+// TLS on the API and replication port.
+//
+// Port 6969 serves HTTPS with the certificate and key named by
+// DOTMESH_TLS_CERT and DOTMESH_TLS_KEY if they're set, otherwise with one
+// installed by `dm cluster init --tls-cert`, otherwise with the apiserver
+// certificate which `dm cluster init` and `dm cluster join` generate for each
+// node, signed by the cluster's own CA. Plain HTTP is still accepted on the
+// same port, so that older clients and nodes keep working, unless
+// DOTMESH_REQUIRE_TLS is set. With no certificate at all (e.g. on Kubernetes
+// without one supplied) it's plain HTTP only, as before.
+//
+// Nodes check each other's certificates against the cluster's CA and any in
+// DOTMESH_TLS_CA_BUNDLE, ignoring the hostname, since only members of the
+// cluster have certificates signed by its CA. During a rolling upgrade, some
+// nodes don't serve HTTPS yet: checkAddress notices when a node answers a TLS
+// handshake with plain HTTP, and we talk plain HTTP to it until it stops,
+// unless DOTMESH_REQUIRE_TLS is set or the node has a node certificate, so
+// that whatever answers can't be sent the admin API key in the clear.
+// Other clusters' certificates are checked according to the PeerTLS which dm
+// sends along with the credentials for them.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what a certificate installed with `dm cluster init --tls-cert` is called in
+// the PKI directory. MUST MATCH USER_CERTIFICATE_NAME in
+// cmd/dm/pkg/commands/cluster.go.
+const USER_CERTIFICATE_NAME = "dotmesh-api"
+
+// how long a new connection has to say whether it's TLS or not
+const PROTOCOL_SNIFF_TIMEOUT = 10 * time.Second
+
+// nil if there's no certificate to serve
+var apiTLSConfig *tls.Config
+
+// whether to refuse plain HTTP connections
+var requireTLS bool
+
+// the CAs which other nodes' certificates must be signed by
+var clusterCAs *x509.CertPool
+
+// the contents of DOTMESH_TLS_CA_BUNDLE, trusted for other nodes and clusters
+var extraCAs []byte
+
+func getPkiPath() string {
+	pkiPath := os.Getenv("DOTMESH_PKI_PATH")
+	if pkiPath == "" {
+		pkiPath = "/pki"
+	}
+	return pkiPath
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// The certificate and key to serve, if any.
+func apiCertificatePaths() (string, string) {
+	cert, key := os.Getenv("DOTMESH_TLS_CERT"), os.Getenv("DOTMESH_TLS_KEY")
+	if cert != "" && key != "" {
+		return cert, key
+	}
+	for _, name := range []string{USER_CERTIFICATE_NAME, "apiserver"} {
+		cert = fmt.Sprintf("%s/%s.pem", getPkiPath(), name)
+		key = fmt.Sprintf("%s/%s-key.pem", getPkiPath(), name)
+		if fileExists(cert) && fileExists(key) {
+			return cert, key
+		}
+	}
+	return "", ""
+}
+
+// Read the TLS settings, which are checked once at startup.
+func loadTLSConfig() error {
+	requireTLS = os.Getenv("DOTMESH_REQUIRE_TLS") != ""
+
+	clusterCAs = x509.NewCertPool()
+	caPath := fmt.Sprintf("%s/ca.pem", getPkiPath())
+	if fileExists(caPath) {
+		caCert, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return err
+		}
+		clusterCAs.AppendCertsFromPEM(caCert)
+	}
+	if bundle := os.Getenv("DOTMESH_TLS_CA_BUNDLE"); bundle != "" {
+		var err error
+		extraCAs, err = ioutil.ReadFile(bundle)
+		if err != nil {
+			return fmt.Errorf("Unable to read DOTMESH_TLS_CA_BUNDLE: %s", err)
+		}
+		if !clusterCAs.AppendCertsFromPEM(extraCAs) {
+			return fmt.Errorf("No certificates found in DOTMESH_TLS_CA_BUNDLE %s", bundle)
+		}
+	}
+
+	certPath, keyPath := apiCertificatePaths()
+	if certPath == "" {
+		if requireTLS {
+			return fmt.Errorf("DOTMESH_REQUIRE_TLS is set, but there's no certificate to serve")
+		}
+		log.Printf("[loadTLSConfig] No certificate found, serving plain HTTP only")
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("Unable to load certificate %s: %s", certPath, err)
+	}
+	apiTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	log.Printf("[loadTLSConfig] Serving HTTPS with %s (plain HTTP refused: %t)", certPath, requireTLS)
+	return loadNodeCertificate()
+}
+
+// Serve the API on addr, with TLS if we have a certificate.
+func serveApi(addr string, handler http.Handler) error {
+	if apiTLSConfig == nil {
+		return http.ListenAndServe(addr, handler)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: addr, Handler: handler}
+	return server.Serve(newSniffingListener(listener))
+}
+
+// A listener which hands out TLS connections for clients which start with a
+// TLS handshake, and plain ones (unless requireTLS) for those that don't.
+type sniffingListener struct {
+	net.Listener
+	conns chan net.Conn
+	errs  chan error
+}
+
+func newSniffingListener(listener net.Listener) *sniffingListener {
+	l := &sniffingListener{
+		Listener: listener,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+	}
+	go l.acceptForever()
+	return l
+}
+
+func (l *sniffingListener) acceptForever() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.errs <- err
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		// sniff in the background, so that a client which doesn't say
+		// anything doesn't hold up everyone else
+		go l.sniff(conn)
+	}
+}
+
+func (l *sniffingListener) sniff(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(PROTOCOL_SNIFF_TIMEOUT))
+	first, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	sniffed := &sniffedConn{Conn: conn, reader: reader}
+	// 0x16 is the record type of a TLS handshake
+	if first[0] == 0x16 {
+		l.conns <- tls.Server(sniffed, apiTLSConfig)
+	} else if !requireTLS {
+		l.conns <- sniffed
+	} else {
+		conn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\nThis dotmesh server only accepts HTTPS.\n"))
+		conn.Close()
+	}
+}
+
+func (l *sniffingListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+// A connection whose first bytes have already been read into reader.
+type sniffedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Check that a certificate chain leads to one of the cluster's CAs.
+func verifyClusterCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("No certificate presented")
+	}
+	certs := []*x509.Certificate{}
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         clusterCAs,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+var internalTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	TLSClientConfig: &tls.Config{
+		// the hostname isn't checked, just the CA, see
+		// verifyClusterCertificate
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyClusterCertificate,
+	},
+}
+
+// The HTTP client for talking to other nodes in the cluster.
+var internalHttpClient = &http.Client{Transport: internalTransport}
+
+// addresses of nodes which only serve plain HTTP, because they're running a
+// version of dotmesh from before TLS
+var plainHttpAddresses = struct {
+	sync.Mutex
+	addresses map[string]bool
+}{addresses: map[string]bool{}}
+
+// Whether we may fall back to plain HTTP to talk to a node, which is only
+// while a cluster is being upgraded to TLS: never if TLS is required, nor to
+// a node which has been issued a node certificate, which only upgraded nodes
+// ask for.
+func mayUsePlainHttpWith(server string) bool {
+	if requireTLS {
+		return false
+	}
+	kapi, err := getMetadataStore()
+	if err != nil {
+		return false
+	}
+	certs, _, err := getNodeCertificates(kapi, server)
+	return err == nil && len(certs.Certificates) == 0
+}
+
+func servesPlainHttpOnly(address string) bool {
+	plainHttpAddresses.Lock()
+	defer plainHttpAddresses.Unlock()
+	return plainHttpAddresses.addresses[address]
+}
+
+func recordPlainHttpOnly(address string, plain bool) {
+	plainHttpAddresses.Lock()
+	defer plainHttpAddresses.Unlock()
+	if plain != plainHttpAddresses.addresses[address] {
+		log.Printf("[recordPlainHttpOnly] %s serves plain HTTP only: %t", address, plain)
+	}
+	if plain {
+		plainHttpAddresses.addresses[address] = true
+	} else {
+		delete(plainHttpAddresses.addresses, address)
+	}
+}
+
+// Whether the node on address answers a TLS handshake with something which
+// isn't TLS at all, as nodes which predate TLS do. Any other failure, such as
+// a certificate we don't trust, is not a reason to fall back to plain HTTP.
+func answersWithoutTLS(address string) bool {
+	conn, err := net.DialTimeout(
+		"tcp", net.JoinHostPort(address, "6969"), ADDRESS_DIAL_TIMEOUT,
+	)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ADDRESS_DIAL_TIMEOUT))
+	err = tls.Client(conn, internalTransport.TLSClientConfig).Handshake()
+	_, notTLS := err.(tls.RecordHeaderError)
+	return notTLS
+}
+
+// The mode to pass to deduceUrl for connections to the peer.
+func (t PeerTLS) urlMode() string {
+	if t.Insecure {
+		return "insecure"
+	}
+	return "external"
+}
+
+func certificateFingerprint(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (t PeerTLS) config() (*tls.Config, error) {
+	if t.Fingerprint != "" {
+		fingerprint := strings.ToLower(strings.Replace(t.Fingerprint, ":", "", -1))
+		return &tls.Config{
+			// the pinned fingerprint is checked instead
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return fmt.Errorf("No certificate presented")
+				}
+				if got := certificateFingerprint(rawCerts[0]); got != fingerprint {
+					return fmt.Errorf(
+						"Certificate fingerprint %s doesn't match the pinned %s", got, fingerprint,
+					)
+				}
+				return nil
+			},
+		}, nil
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	roots.AppendCertsFromPEM(extraCAs)
+	if t.CACertificates != "" && !roots.AppendCertsFromPEM([]byte(t.CACertificates)) {
+		return nil, fmt.Errorf("No certificates found in the peer's CA bundle")
+	}
+	return &tls.Config{RootCAs: roots}, nil
+}
+
+// one client per set of TLS settings, so that their connections are reused
+var peerHttpClients = struct {
+	sync.Mutex
+	clients map[PeerTLS]*http.Client
+}{clients: map[PeerTLS]*http.Client{}}
+
+// The HTTP client for talking to another cluster, which tries each of its
+// addresses.
+func peerHttpClient(t PeerTLS) (*http.Client, error) {
+	peerHttpClients.Lock()
+	defer peerHttpClients.Unlock()
+	if client, ok := peerHttpClients.clients[t]; ok {
+		return client, nil
+	}
+	tlsConfig, err := t.config()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			DialContext:     dialFailover,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	peerHttpClients.clients[t] = client
+	return client, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+// Dry runs of transfers: work out what a push or pull would send, using the
+// same canApply/calculateSendArgs logic as the transfer state machines, but
+// only reading from either cluster.
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// Walk the sending side's path to its top level filesystem in the same order
+// as applyPath, planning the transfer of each filesystem on it. Anything which
+// would stop the transfer ends up in the plan's Error.
+func (d *DotmeshRPC) planTransfer(
+	ctx context.Context, client *JsonRpcClient, args *TransferRequest,
+) TransferPlan {
+	plan := TransferPlan{Direction: args.Direction}
+	if args.S3 != nil {
+		return failedPlan(plan, fmt.Errorf("Dry runs aren't supported for S3 remotes"))
+	}
+	if args.AllBranches {
+		return d.planAllBranches(ctx, client, args)
+	}
+
+	ends, err := d.checkTransfer(ctx, client, args)
+	if err != nil {
+		return failedPlan(plan, err)
+	}
+	if args.Direction == "push" && ends.remoteFilesystemId == "" {
+		// the push would register the dot on the remote, which only a
+		// namespace administrator is allowed to do
+		var user SafeUser
+		err = client.CallRemote(ctx, "DotmeshRPC.CurrentUser", struct{}{}, &user)
+		if err != nil {
+			return failedPlan(plan, err)
+		}
+		if user.Id != ADMIN_USER_UUID && user.Name != args.RemoteNamespace {
+			return failedPlan(plan, PermissionDenied{})
+		}
+	}
+
+	var receiverExists bool
+	if args.Direction == "push" {
+		plan.Path = ends.localPath
+		receiverExists = ends.remoteFilesystemId != ""
+	} else {
+		plan.Path = ends.remotePath
+		receiverExists = ends.localFilesystemId != ""
+	}
+
+	// the same segments as applyPath hands to its transferFn
+	type segment struct {
+		branchName                   string
+		fromFilesystemId, fromSnapId string
+		toFilesystemId, toSnapId     string
+	}
+	segments := []segment{}
+	var firstSnapId string
+	if len(plan.Path.Clones) > 0 {
+		firstSnapId = plan.Path.Clones[0].Clone.Origin.SnapshotId
+	}
+	segments = append(segments, segment{
+		"", "", "", plan.Path.TopLevelFilesystemId, firstSnapId,
+	})
+	for i, c := range plan.Path.Clones {
+		var nextSnapId string
+		if i+1 < len(plan.Path.Clones) {
+			nextSnapId = plan.Path.Clones[i+1].Clone.Origin.SnapshotId
+		}
+		segments = append(segments, segment{
+			c.Name,
+			c.Clone.Origin.FilesystemId, c.Clone.Origin.SnapshotId,
+			c.Clone.FilesystemId, nextSnapId,
+		})
+	}
+	if args.TargetCommit != "" {
+		segments[len(segments)-1].toSnapId = args.TargetCommit
+	}
+
+	for _, seg := range segments {
+		var senderSnaps, receiverSnaps []*snapshot
+		var senderErr, receiverErr error
+		if args.Direction == "push" {
+			var snaps []snapshot
+			snaps, senderErr = d.state.snapshotsForCurrentMaster(seg.toFilesystemId)
+			senderSnaps = pointers(snaps)
+			receiverErr = client.CallRemote(ctx,
+				"DotmeshRPC.CommitsById", seg.toFilesystemId, &receiverSnaps,
+			)
+		} else {
+			senderErr = client.CallRemote(ctx,
+				"DotmeshRPC.CommitsById", seg.toFilesystemId, &senderSnaps,
+			)
+			var snaps []snapshot
+			snaps, receiverErr = d.state.snapshotsForCurrentMaster(seg.toFilesystemId)
+			receiverSnaps = pointers(snaps)
+		}
+		if senderErr != nil {
+			return failedPlan(plan, senderErr)
+		}
+		if receiverErr != nil {
+			if receiverExists {
+				return failedPlan(plan, receiverErr)
+			}
+			// it would be created by the transfer
+			receiverSnaps = []*snapshot{}
+		}
+		senderSnaps, err = restrictSnapshots(senderSnaps, seg.toSnapId)
+		if err != nil {
+			return failedPlan(plan, err)
+		}
+
+		step := TransferPlanStep{
+			FilesystemId: seg.toFilesystemId,
+			BranchName:   seg.branchName,
+		}
+		snapRange, err := canApply(senderSnaps, receiverSnaps)
+		switch err := err.(type) {
+		case nil:
+			step.Outcome = "transfer"
+		case *ToSnapsUpToDate:
+			step.Outcome = "up-to-date"
+		case *ToSnapsDiverged:
+			step.Outcome = "diverged"
+			step.LatestCommonCommit = err.latestCommonSnapshot.Id
+		case *ToSnapsAhead:
+			step.Outcome = "ahead"
+			step.LatestCommonCommit = err.latestCommonSnapshot.Id
+		case *NoCommonSnapshots:
+			step.Outcome = "no-common-commits"
+		case *NoFromSnaps:
+			step.Outcome = "no-commits"
+		default:
+			return failedPlan(plan, err)
+		}
+		if step.Outcome != "transfer" {
+			plan.Steps = append(plan.Steps, step)
+			if step.Outcome != "up-to-date" && plan.Error == "" {
+				plan.Error = planOutcomeError(step, args)
+			}
+			continue
+		}
+
+		var fromSnapId string
+		step.StartingCommit = "START"
+		if snapRange.fromSnap != nil {
+			fromSnapId = snapRange.fromSnap.Id
+			step.StartingCommit = fromSnapId
+		} else if seg.fromFilesystemId != "" {
+			// a send from a clone origin
+			fromSnapId = fmt.Sprintf("%s@%s", seg.fromFilesystemId, seg.fromSnapId)
+			step.StartingCommit = fromSnapId
+		}
+		step.TargetCommit = snapRange.toSnap.Id
+
+		// the (from, to) snapshots of each stream that would be sent, which
+		// is just one unless this is a shallow pull
+		streams := [][2]string{{fromSnapId, step.TargetCommit}}
+		if step.StartingCommit == "START" && (args.Depth > 0 || args.Since != "") {
+			base, err := shallowBase(senderSnaps, args.Depth, args.Since)
+			if err != nil {
+				return failedPlan(plan, err)
+			}
+			step.StartingCommit = BASE_SNAPSHOT
+			streams = [][2]string{{BASE_SNAPSHOT, base.Id}}
+			if base.Id != step.TargetCommit {
+				streams = append(streams, [2]string{base.Id, step.TargetCommit})
+			}
+		}
+
+		// the commits after the one an incremental stream starts from, or
+		// from the base of a shallow pull
+		start := 0
+		for i, snap := range senderSnaps {
+			if snap.Id == streams[0][0] {
+				start = i + 1
+			} else if streams[0][0] == BASE_SNAPSHOT && snap.Id == streams[0][1] {
+				start = i
+			}
+		}
+		for _, snap := range senderSnaps[start:] {
+			step.Commits = append(step.Commits, *snap)
+		}
+		for _, stream := range streams {
+			step.SendArgs = append(step.SendArgs, calculateSendArgs(
+				seg.fromFilesystemId, stream[0], seg.toFilesystemId, stream[1],
+			))
+			var size int64
+			if args.Direction == "push" {
+				size, err = d.state.predictSizeOnMaster(
+					ctx, seg.fromFilesystemId, stream[0], seg.toFilesystemId, stream[1],
+				)
+			} else {
+				err = client.CallRemote(ctx,
+					"DotmeshRPC.PredictSize", map[string]interface{}{
+						"FromFilesystemId": seg.fromFilesystemId,
+						"FromSnapshotId":   stream[0],
+						"ToFilesystemId":   seg.toFilesystemId,
+						"ToSnapshotId":     stream[1],
+					},
+					&size,
+				)
+			}
+			if err != nil {
+				return failedPlan(plan, err)
+			}
+			step.Size += size
+		}
+		plan.Size += step.Size
+		plan.Steps = append(plan.Steps, step)
+	}
+	return plan
+}
+
+// Record why a transfer would fail in its plan. Permission errors, from us or
+// from the peer (see CallRemote), all look the same.
+func failedPlan(plan TransferPlan, err error) TransferPlan {
+	if _, ok := err.(PermissionDenied); ok {
+		plan.Error = "permission denied"
+	} else {
+		plan.Error = err.Error()
+	}
+	return plan
+}
+
+// Why a step which can't simply be applied would make the transfer fail, or
+// "" if the request says what to do about it instead.
+func planOutcomeError(step TransferPlanStep, args *TransferRequest) string {
+	branch := step.BranchName
+	if branch == "" {
+		branch = DEFAULT_BRANCH
+	}
+	switch step.Outcome {
+	case "diverged", "ahead":
+		if args.Direction == "push" && args.Force {
+			return ""
+		}
+		if args.Direction == "pull" && args.BranchOnConflict {
+			return ""
+		}
+		return fmt.Sprintf(
+			"%s: the receiving side has commits after %s which the sending side doesn't",
+			branch, step.LatestCommonCommit,
+		)
+	case "no-common-commits":
+		return fmt.Sprintf("%s: no commits in common with the receiving side", branch)
+	case "no-commits":
+		return fmt.Sprintf("%s: nothing has been committed yet", branch)
+	}
+	return ""
+}
+
+// Ask the master of toFilesystemId, which has its snapshots, how much a send
+// would transfer.
+func (s *InMemoryState) predictSizeOnMaster(
+	ctx context.Context,
+	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
+) (int64, error) {
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+	responseChan, err := s.globalFsRequestContext(
+		ctx,
+		toFilesystemId,
+		&Event{Name: "predict-size",
+			Args: &EventArgs{
+				"fromFilesystemId": fromFilesystemId,
+				"fromSnapshotId":   fromSnapshotId,
+				"toFilesystemId":   toFilesystemId,
+				"toSnapshotId":     toSnapshotId,
+			},
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	e := <-responseChan
+	switch e.Name {
+	case "predicted-size":
+		// having been through json
+		size, _ := (*e.Args)["size"].(float64)
+		return int64(size), nil
+	case "failed-predict-size":
+		return 0, fmt.Errorf(
+			"Unable to predict the size of %s: %s", toFilesystemId, (*e.Args)["err"],
+		)
+	}
+	return 0, maybeError(e)
+}
@@ -0,0 +1,237 @@
+package main
+
+// Streaming transfer progress.
+//
+// Every change to a transfer's poll result is published on transferUpdates as
+// soon as it's made, and clients can follow them with a server-sent events
+// stream from /transfers/:transferId/stream on any node. The node running the
+// transfer publishes its own updates; other nodes publish what they see in
+// etcd.
+//
+// Progress updates (bytes sent so far) only go to etcd every
+// TRANSFER_PROGRESS_INTERVAL, rather than every BUF_LEN, so that a fast
+// transfer doesn't turn into a storm of etcd writes. Status changes still go
+// to etcd straight away.
+//
+// Transfers which fail or are abandoned may never be deleted from etcd, so
+// results which haven't changed for TRANSFER_RESULT_EXPIRY are forgotten by
+// expirePollResults.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const TRANSFER_PROGRESS_INTERVAL = time.Second
+
+// how often to send something down an idle stream, so that proxies don't
+// give up on it
+const TRANSFER_STREAM_KEEPALIVE = 15 * time.Second
+
+// how long a transfer's latest result is kept after it last changed
+const TRANSFER_RESULT_EXPIRY = time.Hour
+
+// how often to look for results to expire
+const TRANSFER_EXPIRY_INTERVAL = 5 * time.Minute
+
+// Published on with the transfer id as the event whenever its latest poll
+// result changes. Publish doesn't preserve ordering, so subscribers should
+// read the result itself with latestPollResult.
+var transferUpdates *Observer = NewObserver()
+
+var transferProgress = struct {
+	sync.Mutex
+	latest  map[string]TransferPollResult
+	updated map[string]time.Time // when the latest result last changed
+	written map[string]time.Time // when we last wrote progress to etcd
+	local   map[string]bool      // transfers this node is running
+}{
+	latest:  map[string]TransferPollResult{},
+	updated: map[string]time.Time{},
+	written: map[string]time.Time{},
+	local:   map[string]bool{},
+}
+
+// Record a new poll result for a transfer and tell anyone streaming it. Only
+// the node running a transfer knows about all of its updates, so it ignores
+// the (older) ones it sees in etcd.
+func publishPollResult(transferRequestId string, pollResult TransferPollResult, local bool) {
+	transferProgress.Lock()
+	if !local && transferProgress.local[transferRequestId] {
+		transferProgress.Unlock()
+		return
+	}
+	if local {
+		transferProgress.local[transferRequestId] = true
+	}
+	if transferOver(pollResult) {
+		delete(transferProgress.local, transferRequestId)
+		delete(transferProgress.written, transferRequestId)
+	}
+	transferProgress.latest[transferRequestId] = pollResult
+	transferProgress.updated[transferRequestId] = time.Now()
+	transferProgress.Unlock()
+
+	transferUpdates.Publish(transferRequestId, true)
+}
+
+// Each filesystem on a transfer's path is "finished" in turn, only the last
+// one finishes the transfer. When transferring all branches, one failing
+// doesn't stop the others.
+func transferOver(pollResult TransferPollResult) bool {
+	for _, branch := range pollResult.Branches {
+		if branch.Status == "waiting" {
+			return false
+		}
+	}
+	return pollResult.Status == "error" ||
+		(pollResult.Status == "finished" && pollResult.Index == pollResult.Total)
+}
+
+func latestPollResult(transferRequestId string) (TransferPollResult, bool) {
+	transferProgress.Lock()
+	defer transferProgress.Unlock()
+	pollResult, ok := transferProgress.latest[transferRequestId]
+	return pollResult, ok
+}
+
+// Forget a transfer which has been deleted from etcd, ending its streams.
+func forgetPollResult(transferRequestId string) {
+	transferProgress.Lock()
+	forgetPollResultLocked(transferRequestId)
+	transferProgress.Unlock()
+
+	transferUpdates.UnsubscribeAll(transferRequestId)
+}
+
+func forgetPollResultLocked(transferRequestId string) {
+	delete(transferProgress.latest, transferRequestId)
+	delete(transferProgress.updated, transferRequestId)
+	delete(transferProgress.written, transferRequestId)
+	delete(transferProgress.local, transferRequestId)
+}
+
+// Forget the results of transfers which haven't changed for
+// TRANSFER_RESULT_EXPIRY, ending their streams.
+func expirePollResults() error {
+	expired := []string{}
+	transferProgress.Lock()
+	for transferRequestId, updated := range transferProgress.updated {
+		if time.Since(updated) > TRANSFER_RESULT_EXPIRY {
+			forgetPollResultLocked(transferRequestId)
+			expired = append(expired, transferRequestId)
+		}
+	}
+	transferProgress.Unlock()
+
+	for _, transferRequestId := range expired {
+		log.Printf("[expirePollResults] forgetting transfer %s", transferRequestId)
+		transferUpdates.UnsubscribeAll(transferRequestId)
+	}
+	return nil
+}
+
+// Like updatePollResult, for the frequent updates to Sent and
+// NanosecondsElapsed during a send or receive. Streams get all of them, etcd
+// only gets one every TRANSFER_PROGRESS_INTERVAL.
+func updatePollResultProgress(transferRequestId string, pollResult TransferPollResult) error {
+	transferProgress.Lock()
+	last, ok := transferProgress.written[transferRequestId]
+	recent := ok && time.Since(last) < TRANSFER_PROGRESS_INTERVAL
+	transferProgress.Unlock()
+
+	if recent {
+		publishPollResult(transferRequestId, pollResult, true)
+		return nil
+	}
+	return updatePollResult(transferRequestId, pollResult)
+}
+
+type TransferStreamer struct {
+	state *InMemoryState
+}
+
+func (s *InMemoryState) NewTransferStreamingServer() http.Handler {
+	return TransferStreamer{
+		state: s,
+	}
+}
+
+// Stream a transfer's poll results as server-sent events, one JSON
+// TransferPollResult per event, until the whole transfer finishes or fails.
+func (t TransferStreamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	transferId := mux.Vars(r)["transferId"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe before looking at the latest result, so as not to miss an
+	// update in between
+	updates := make(chan interface{})
+	transferUpdates.Subscribe(transferId, updates)
+	defer transferUpdates.Unsubscribe(transferId, updates)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var lastSent []byte
+	// send the latest result if it's changed, returning whether the transfer
+	// is over
+	send := func() (bool, error) {
+		pollResult, ok := latestPollResult(transferId)
+		if !ok {
+			// the transfer may not have started yet
+			return false, nil
+		}
+		serialized, err := json.Marshal(safePollResult(pollResult))
+		if err != nil {
+			return false, err
+		}
+		if string(serialized) != string(lastSent) {
+			_, err = fmt.Fprintf(w, "data: %s\n\n", serialized)
+			if err != nil {
+				return false, err
+			}
+			flusher.Flush()
+			lastSent = serialized
+		}
+		return transferOver(pollResult), nil
+	}
+
+	for {
+		done, err := send()
+		if err != nil {
+			log.Printf("[TransferStreamer] error streaming %s: %s", transferId, err)
+			return
+		}
+		if done {
+			return
+		}
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				// the transfer was forgotten
+				return
+			}
+		case <-time.After(TRANSFER_STREAM_KEEPALIVE):
+			_, err = fmt.Fprintf(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Start streaming a transfer, returning a channel of the poll results
+// streamed, which is closed when the stream ends.
+func streamTransfer(t *testing.T, transferId string) (chan TransferPollResult, func()) {
+	router := mux.NewRouter()
+	router.Handle("/transfers/{transferId}/stream", TransferStreamer{})
+	server := httptest.NewServer(router)
+
+	resp, err := http.Get(server.URL + "/transfers/" + transferId + "/stream")
+	if err != nil {
+		server.Close()
+		t.Fatalf("error starting stream: %s", err)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %q", contentType)
+	}
+
+	results := make(chan TransferPollResult, 10)
+	go func() {
+		defer close(results)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var pollResult TransferPollResult
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &pollResult)
+			if err != nil {
+				t.Errorf("error decoding %q: %s", line, err)
+				return
+			}
+			results <- pollResult
+		}
+	}()
+	return results, server.Close
+}
+
+func nextResult(t *testing.T, results chan TransferPollResult) TransferPollResult {
+	select {
+	case pollResult, ok := <-results:
+		if !ok {
+			t.Fatalf("stream ended early")
+		}
+		return pollResult
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a poll result")
+	}
+	return TransferPollResult{}
+}
+
+func expectEnd(t *testing.T, results chan TransferPollResult) {
+	select {
+	case pollResult, ok := <-results:
+		if ok {
+			t.Fatalf("expected the stream to end, got %+v", pollResult)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the stream to end")
+	}
+}
+
+func TestTransferStreamerStreamsUntilFinished(t *testing.T) {
+	transferId := "streams-until-finished"
+	defer forgetPollResult(transferId)
+
+	publishPollResult(transferId, TransferPollResult{
+		TransferRequestId: transferId, ApiKey: "secret", Status: "running", Index: 1, Total: 2,
+	}, true)
+
+	results, stop := streamTransfer(t, transferId)
+	defer stop()
+
+	pollResult := nextResult(t, results)
+	if pollResult.Status != "running" || pollResult.Index != 1 {
+		t.Errorf("expected the latest result first, got %+v", pollResult)
+	}
+	if pollResult.ApiKey != "<redacted>" {
+		t.Errorf("expected the API key to be redacted, got %q", pollResult.ApiKey)
+	}
+
+	// the first filesystem finishing doesn't finish the transfer
+	publishPollResult(transferId, TransferPollResult{
+		TransferRequestId: transferId, Status: "finished", Index: 1, Total: 2,
+	}, true)
+	pollResult = nextResult(t, results)
+	if pollResult.Status != "finished" || pollResult.Index != 1 {
+		t.Errorf("expected the first filesystem to finish, got %+v", pollResult)
+	}
+
+	publishPollResult(transferId, TransferPollResult{
+		TransferRequestId: transferId, Status: "finished", Index: 2, Total: 2,
+	}, true)
+	pollResult = nextResult(t, results)
+	if pollResult.Status != "finished" || pollResult.Index != 2 {
+		t.Errorf("expected the transfer to finish, got %+v", pollResult)
+	}
+	expectEnd(t, results)
+}
+
+func TestTransferStreamerWaitsForTransferToStart(t *testing.T) {
+	transferId := "waits-for-start"
+	defer forgetPollResult(transferId)
+
+	results, stop := streamTransfer(t, transferId)
+	defer stop()
+
+	publishPollResult(transferId, TransferPollResult{
+		TransferRequestId: transferId, Status: "error", Message: "oops",
+	}, false)
+	pollResult := nextResult(t, results)
+	if pollResult.Status != "error" || pollResult.Message != "oops" {
+		t.Errorf("expected the error, got %+v", pollResult)
+	}
+	expectEnd(t, results)
+}
+
+func TestTransferStreamerEndsWhenResultExpires(t *testing.T) {
+	transferId := "ends-when-expired"
+	defer forgetPollResult(transferId)
+
+	publishPollResult(transferId, TransferPollResult{
+		TransferRequestId: transferId, Status: "running", Index: 1, Total: 1,
+	}, true)
+
+	results, stop := streamTransfer(t, transferId)
+	defer stop()
+	nextResult(t, results)
+
+	// a result which has just changed is kept
+	expirePollResults()
+	if _, ok := latestPollResult(transferId); !ok {
+		t.Fatalf("expected a recent result to be kept")
+	}
+
+	transferProgress.Lock()
+	transferProgress.updated[transferId] = time.Now().Add(-2 * TRANSFER_RESULT_EXPIRY)
+	transferProgress.Unlock()
+	expirePollResults()
+
+	if _, ok := latestPollResult(transferId); ok {
+		t.Errorf("expected an abandoned result to be forgotten")
+	}
+	transferProgress.Lock()
+	_, local := transferProgress.local[transferId]
+	transferProgress.Unlock()
+	if local {
+		t.Errorf("expected an abandoned transfer to be forgotten")
+	}
+	expectEnd(t, results)
+}
@@ -68,9 +68,14 @@ type containerInfo struct {
 }
 
 type PermissionDenied struct {
+	// what to do about it, if anything
+	Reason string
 }
 
 func (e PermissionDenied) Error() string {
+	if e.Reason != "" {
+		return "Permission denied. " + e.Reason
+	}
 	return "Permission denied."
 }
 
@@ -102,6 +107,10 @@ type DotmeshVolume struct {
 	DirtyBytes     int64
 	CommitCount    int64
 	ServerStatuses map[string]string // serverId => status
+	// the number of copies to keep, or zero for one on every node
+	ReplicationFactor int
+	// the number of live nodes, the master included, with every commit
+	UpToDateCopies int
 }
 
 type TransferPollResult struct {
@@ -142,6 +151,22 @@ type TransferPollResult struct {
 	Size               int64 // size of current segment in bytes
 	Sent               int64 // number of bytes of current segment sent so far
 	Message            string
+
+	// Branches created on the peer by a forced push to keep the commits it
+	// overwrote.
+	PreservedBranches []string
+	// Branches created locally by a pull with BranchOnConflict to hold the
+	// commits which couldn't be applied to the branch being pulled.
+	ConflictBranches []string
+	// How each branch went, for an AllBranches transfer, in the order they
+	// were transferred.
+	Branches []BranchTransferResult
+}
+
+type BranchTransferResult struct {
+	Name    string
+	Status  string // "waiting", "finished", "error" or "skipped" because its origin failed
+	Message string
 }
 
 // A container for some state that is truly global to this process.
@@ -151,6 +176,7 @@ type InMemoryState struct {
 	filesystemsLock            *sync.Mutex
 	myNodeId                   string
 	mastersCache               *map[string]string
+	masterEpochsCache          *map[string]uint64
 	mastersCacheLock           *sync.Mutex
 	serverAddressesCache       *map[string]string
 	serverAddressesCacheLock   *sync.Mutex
@@ -170,6 +196,15 @@ type InMemoryState struct {
 	interclusterTransfersLock  *sync.Mutex
 	globalDirtyCacheLock       *sync.Mutex
 	globalDirtyCache           *map[string]dirtyInfo
+	mirrors                    *map[string]Mirror
+	mirrorsLock                *sync.Mutex
+	replicationFactors         *map[string]int
+	replicationFactorsLock     *sync.Mutex
+	replicasCache              *map[string][]string
+	replicasCacheLock          *sync.Mutex
+	drainingServers            *map[string]bool
+	drainingServersLock        *sync.Mutex
+	leaderElection             *leaderElection
 
 	debugPartialFailCreateFilesystem bool
 	versionInfo                      *VersionInfo
@@ -232,10 +267,130 @@ type fsMachine struct {
 	lastPollResult           *TransferPollResult
 }
 
+// A standing request for the master of a filesystem to keep a remote dot up
+// to date with it by pushing to it whenever it gets new commits.
+type Mirror struct {
+	Id           string
+	FilesystemId string
+	Peer         string // hostname
+	User         string
+	ApiKey       string
+	PeerTLS      PeerTLS
+
+	LocalNamespace   string
+	LocalName        string
+	LocalBranchName  string
+	RemoteNamespace  string
+	RemoteName       string
+	RemoteBranchName string
+
+	// How often to check the remote even if no new commits show up, 0 means
+	// DEFAULT_MIRROR_INTERVAL_SECONDS.
+	IntervalSeconds int64
+
+	// Written by the master as it goes.
+	Status           string // one of "idle", "pushing", "error"
+	CommitsBehind    int
+	LastSyncedCommit string
+	LastSyncedAt     int64 // unix timestamp
+	LastTransferId   string
+	LastError        string
+	LastErrorAt      int64 // unix timestamp
+}
+
+// A push or pull of every dot in a namespace, one dot at a time. Stored in etcd
+// as it goes, so that it can be resumed from the first dot which didn't make
+// it if it fails or the node running it goes away.
+type NamespaceTransfer struct {
+	Id        string
+	Peer      string // hostname
+	User      string
+	ApiKey    string
+	PeerTLS   PeerTLS
+	Direction string // "push" or "pull"
+
+	LocalNamespace  string
+	RemoteNamespace string
+
+	// Only in requests: carry on with the latest unfinished transfer between
+	// the same namespaces, rather than starting a new one.
+	Resume bool
+
+	InitiatorId string // the user who started it, and whose dots they are
+	NodeId      string // the node running it
+	Status      string // one of "running", "finished", "error"
+	StartedAt   int64  // unix timestamp
+	FinishedAt  int64  // unix timestamp
+	Dots        []NamespaceTransferDot
+}
+
+type NamespaceTransferDot struct {
+	Name       string
+	Status     string // one of "waiting", "transferring", "finished", "error"
+	TransferId string
+	Message    string
+}
+
+// What a branch of a dot on another cluster looked like when it was last
+// fetched, so that we can tell whether a pull is needed without doing one.
+type RemoteTrackingBranch struct {
+	FilesystemId string // of the local branch
+	Remote       string // the user's name for the peer, e.g. "origin"
+	Peer         string // hostname
+	User         string
+
+	RemoteNamespace    string
+	RemoteName         string
+	RemoteBranchName   string
+	RemoteFilesystemId string
+
+	Commits       []snapshot
+	PredictedSize int64 // bytes a pull would have transferred as of FetchedAt
+	FetchedAt     int64 // unix timestamp
+
+	// Not stored, worked out against the local branch whenever asked for.
+	Ahead  int // local commits the remote doesn't have
+	Behind int // remote commits we don't have
+}
+
+// Which remote dot to fetch, and the name to record it under.
+type FetchRequest struct {
+	Remote string
+	TransferRequest
+}
+
+// What a transfer would do, worked out without doing it.
+type TransferPlan struct {
+	Direction string
+	Path      PathToTopLevelFilesystem // of the dot on the sending side
+	// One per filesystem on Path, in the order they'd be transferred.
+	Steps []TransferPlanStep
+	Size  int64 // predicted bytes for all the steps
+	// Why the transfer would fail, "" if it wouldn't.
+	Error string
+}
+
+type TransferPlanStep struct {
+	FilesystemId string
+	BranchName   string // "" for master
+	// "transfer", "up-to-date", "diverged", "ahead" (the receiving side has
+	// commits the sending side doesn't), "no-common-commits" or "no-commits"
+	Outcome            string
+	LatestCommonCommit string // for "diverged" and "ahead"
+	// The rest are only set when Outcome is "transfer", as they would be in
+	// TransferPollResult.
+	StartingCommit string
+	TargetCommit   string
+	Commits        []snapshot // which would be sent
+	SendArgs       [][]string // for zfs send, one per stream
+	Size           int64
+}
+
 type TransferRequest struct {
 	Peer             string // hostname
 	User             string
 	ApiKey           string
+	PeerTLS          PeerTLS
 	Direction        string // "push" or "pull"
 	LocalNamespace   string
 	LocalName        string
@@ -245,6 +400,42 @@ type TransferRequest struct {
 	RemoteBranchName string
 	// TODO could also include SourceSnapshot here
 	TargetCommit string // optional, "" means "latest"
+	// push only: if the remote has commits we don't, move them to a new
+	// branch on the remote rather than failing
+	Force bool
+	// pull only: if we have commits the remote doesn't, pull the remote's
+	// commits into a new branch rather than failing
+	BranchOnConflict bool
+	// pull only, when we have nothing yet: only pull the last Depth commits,
+	// or the commits from Since onwards (see shallowBase). 0 and "" mean the
+	// whole history.
+	Depth int
+	Since string
+	// transfer every branch of the dot, not just the one named, which must be
+	// master
+	AllBranches bool
+	// push to or pull from a bucket instead of a cluster, in which case Peer,
+	// User and ApiKey aren't used
+	S3 *S3Target
+}
+
+// How to check the certificate of another cluster we connect to. With none of
+// these set, it must be signed by a CA in the system bundle or in
+// DOTMESH_TLS_CA_BUNDLE.
+type PeerTLS struct {
+	CACertificates string // PEM, trusted as well as the usual CAs
+	Fingerprint    string // hex SHA-256 of the only certificate to accept
+	Insecure       bool   // connect over plain HTTP
+}
+
+// An S3-compatible bucket which dots are backed up to, under Prefix.
+type S3Target struct {
+	Endpoint        string // e.g. "https://s3.amazonaws.com"
+	Region          string // defaults to S3_DEFAULT_REGION
+	Bucket          string
+	Prefix          string
+	AccessKeyId     string
+	SecretAccessKey string
 }
 
 type EventArgs map[string]interface{}
@@ -266,6 +457,11 @@ func (e Event) String() string {
 }
 
 type metadata map[string]string
+
+// Set in the metadata of the commits dotmesh makes for its own purposes,
+// which aren't part of the history users see.
+const HIDDEN_COMMIT = "hidden"
+
 type snapshot struct {
 	// exported for json serialization
 	Id       string
@@ -157,7 +157,7 @@ func CheckPassword(username, password string) (bool, bool, error) {
 
 // Write the user object to etcd
 func (u User) Save() error {
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return err
 	}
@@ -177,7 +177,7 @@ func (u User) Save() error {
 func AllUsers() ([]User, error) {
 	users := []User{}
 
-	kapi, err := getEtcdKeysApi()
+	kapi, err := getMetadataStore()
 	if err != nil {
 		return users, err
 	}
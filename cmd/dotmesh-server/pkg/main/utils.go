@@ -20,11 +20,18 @@ import (
 
 func deduceUrl(hostname, mode string) string {
 	// "mode" is "internal" if you're trying to connect within a cluster (e.g.
-	// directly to another node's IP address), or "external" if you're trying
-	// to connect an external cluster.
-	scheme := "http"
+	// directly to another node's IP address), "external" if you're trying to
+	// connect an external cluster, or "insecure" for an external cluster which
+	// doesn't do TLS. Within a cluster, we use TLS if we have a certificate,
+	// unless checkAddress has found that the other node doesn't do TLS yet.
+	scheme := "https"
 	port := "6969"
 
+	if (mode == "internal" && (apiTLSConfig == nil || (!requireTLS && servesPlainHttpOnly(hostname)))) ||
+		mode == "insecure" {
+		scheme = "http"
+	}
+
 	if mode == "external" && (hostname == "saas.dotmesh.io" || hostname == "dothub.com") {
 		scheme = "https"
 		port = "443"
@@ -44,7 +44,7 @@ POOL=$(echo $POOL |sed s/\#HOSTNAME\#/$(hostname)/)
 MOUNTPOINT=${MOUNTPOINT:-$DIR/mnt}
 DOTMESH_INNER_SERVER_NAME=${DOTMESH_INNER_SERVER_NAME:-dotmesh-server-inner}
 FLEXVOLUME_DRIVER_DIR=${FLEXVOLUME_DRIVER_DIR:-/usr/libexec/kubernetes/kubelet-plugins/volume/exec}
-INHERIT_ENVIRONMENT_NAMES=( "FILESYSTEM_METADATA_TIMEOUT" "DOTMESH_UPGRADES_URL" "DOTMESH_UPGRADES_INTERVAL_SECONDS")
+INHERIT_ENVIRONMENT_NAMES=( "FILESYSTEM_METADATA_TIMEOUT" "DOTMESH_UPGRADES_URL" "DOTMESH_UPGRADES_INTERVAL_SECONDS" "DOTMESH_PREFERRED_SUBNETS" "DOTMESH_REQUIRE_TLS" "DOTMESH_FAILOVER_GRACE_PERIOD" "DOTMESH_REPLICATION_FACTOR" "DOTMESH_METADATA_STORE" "DOTMESH_REQUEST_TIMEOUT")
 
 echo "=== Using mountpoint $MOUNTPOINT"
 
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -23,11 +26,91 @@ func TestTeardownFinished(t *testing.T) {
 	citools.TeardownFinishedTestRuns()
 }
 
+// citools.Federation.Start adds a remote on every node for every cluster and
+// node in the federation, without saying how to check their certificates,
+// which dm won't do without a terminal to confirm them on. The clusters of a
+// pinnedFederation add those remotes themselves once the last of them has
+// started, with the certificates' fingerprints pinned, so that Start finds
+// them already there.
+func pinnedFederation(clusters ...citools.Startable) citools.Federation {
+	pinner := &remotePinner{}
+	for _, c := range clusters {
+		pinner.federation = append(pinner.federation, pinningCluster{c, pinner})
+	}
+	return pinner.federation
+}
+
+type remotePinner struct {
+	federation citools.Federation
+	started    int
+}
+
+type pinningCluster struct {
+	citools.Startable
+	pinner *remotePinner
+}
+
+func (c pinningCluster) Start(t *testing.T, now int64, i int) error {
+	err := c.Startable.Start(t, now, i)
+	if err != nil {
+		return err
+	}
+	c.pinner.started++
+	if c.pinner.started < len(c.pinner.federation) {
+		return nil
+	}
+	return c.pinner.addRemotes(t)
+}
+
+// Add the remotes citools.Federation.Start would, named as it names them.
+func (p *remotePinner) addRemotes(t *testing.T) error {
+	for _, c := range p.federation {
+		for _, node := range c.GetNodes() {
+			for _, other := range p.federation {
+				first := other.GetNode(0)
+				remotes := map[string]citools.Node{first.ClusterName: first}
+				for i, oNode := range other.GetNodes() {
+					remotes[fmt.Sprintf("%s_node_%d", first.ClusterName, i)] = oNode
+				}
+				for name, to := range remotes {
+					check := "--insecure"
+					// clusters with no certificate, e.g. on Kubernetes, only
+					// speak plain HTTP
+					if fingerprint, err := apiFingerprint(to.IP); err == nil {
+						check = "--fingerprint " + fingerprint
+					}
+					citools.RunOnNode(t, node.Container, fmt.Sprintf(
+						"echo %s |dm remote add %s %s admin@%s", to.ApiKey, check, name, to.IP,
+					))
+				}
+			}
+			citools.RunOnNode(t, node.Container, "dm remote switch local")
+		}
+	}
+	return nil
+}
+
+// The SHA-256 fingerprint of the certificate a node serves its API with, to
+// pin when adding it as a remote.
+func apiFingerprint(hostname string) (string, error) {
+	conn, err := tls.Dial("tcp", hostname+":6969", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("%s presented no certificate", hostname)
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 func TestDefaultDot(t *testing.T) {
 	// Test default dot select on a totally fresh cluster
 	citools.TeardownFinishedTestRuns()
 
-	f := citools.Federation{citools.NewCluster(1)}
+	f := pinnedFederation(citools.NewCluster(1))
 
 	citools.StartTiming()
 	err := f.Start(t)
@@ -88,7 +171,7 @@ func TestSingleNode(t *testing.T) {
 	// single node tests
 	citools.TeardownFinishedTestRuns()
 
-	f := citools.Federation{citools.NewCluster(1)}
+	f := pinnedFederation(citools.NewCluster(1))
 
 	citools.StartTiming()
 	err := f.Start(t)
@@ -494,6 +577,32 @@ func TestSingleNode(t *testing.T) {
 		}
 	})
 
+	t.Run("BackupAndRestore", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, "dm init "+fsname)
+		citools.RunOnNode(t, node1, "dm cluster backup -o /tmp/"+fsname+".backup")
+
+		resp := citools.OutputFromRunOnNode(t, node1, "grep -c "+fsname+" /tmp/"+fsname+".backup")
+		if strings.TrimSpace(resp) == "0" {
+			t.Error(fmt.Sprintf("Expected %s in the backup, got '%s'", fsname, resp))
+		}
+
+		resp = citools.OutputFromRunOnNode(t, node1,
+			"if dm cluster restore /tmp/"+fsname+".backup; then false; else true; fi")
+		if !strings.Contains(resp, "already has dots") {
+			t.Error(fmt.Sprintf("Expected restoring over existing dots to be refused, got '%s'", resp))
+		}
+
+		resp = citools.OutputFromRunOnNode(t, node1, "dm cluster restore --force /tmp/"+fsname+".backup")
+		if !strings.Contains(resp, "Restored") || strings.Contains(resp, "No node has") {
+			t.Error(fmt.Sprintf("Expected every dot to be restored, got '%s'", resp))
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm list")
+		if !strings.Contains(resp, fsname) {
+			t.Error(fmt.Sprintf("Expected %s to still be listed after restoring, got '%s'", fsname, resp))
+		}
+	})
+
 	t.Run("ApiKeys", func(t *testing.T) {
 		apiKey := f[0].GetNode(0).ApiKey
 		password := f[0].GetNode(0).Password
@@ -629,7 +738,7 @@ func TestDeletionSimple(t *testing.T) {
 	clusterEnv["FILESYSTEM_METADATA_TIMEOUT"] = "5"
 
 	// Our cluster gets a metadata timeout of 5s
-	f := citools.Federation{citools.NewClusterWithEnv(2, clusterEnv)}
+	f := pinnedFederation(citools.NewClusterWithEnv(2, clusterEnv))
 
 	citools.StartTiming()
 	err := f.Start(t)
@@ -760,7 +869,7 @@ func TestDeletionComplex(t *testing.T) {
 	clusterEnv["FILESYSTEM_METADATA_TIMEOUT"] = "5"
 
 	// Our cluster gets a metadata timeout of 5s
-	f := citools.Federation{citools.NewClusterWithEnv(2, clusterEnv)}
+	f := pinnedFederation(citools.NewClusterWithEnv(2, clusterEnv))
 
 	citools.StartTiming()
 	err := f.Start(t)
@@ -801,7 +910,7 @@ func TestDeletionComplex(t *testing.T) {
 func TestTwoNodesSameCluster(t *testing.T) {
 	citools.TeardownFinishedTestRuns()
 
-	f := citools.Federation{citools.NewCluster(2)}
+	f := pinnedFederation(citools.NewCluster(2))
 
 	citools.StartTiming()
 	err := f.Start(t)
@@ -823,14 +932,391 @@ func TestTwoNodesSameCluster(t *testing.T) {
 			t.Error(fmt.Sprintf("Unable to find world in transported data capsule, got '%s'", st))
 		}
 	})
+
+	t.Run("ExplicitMove", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo WORLD > /foo/HELLO'")
+		node1Id := strings.TrimSpace(
+			citools.OutputFromRunOnNode(t, node1, "dm list -H |grep "+fsname+" |cut -f 3"),
+		)
+
+		// procure it on node2, then move it back by hand
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" cat /foo/HELLO")
+		st := citools.OutputFromRunOnNode(t, node2, "dm dot move "+fsname+" --to "+node1Id)
+		if !strings.Contains(st, "of downtime") {
+			t.Error(fmt.Sprintf("Expected the downtime to be reported, got '%s'", st))
+		}
+
+		st = strings.TrimSpace(
+			citools.OutputFromRunOnNode(t, node2, "dm list -H |grep "+fsname+" |cut -f 3"),
+		)
+		if st != node1Id {
+			t.Error(fmt.Sprintf("Expected %s to be on %s, got '%s'", fsname, node1Id, st))
+		}
+
+		// the snapshots taken while pre-copying aren't in the dot's history
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		st = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if strings.Contains(st, "pre-copying") {
+			t.Error(fmt.Sprintf("Expected no pre-copy snapshots in the log, got '%s'", st))
+		}
+	})
+
+	t.Run("MoveBusyDot", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo WORLD > /foo/HELLO'")
+		node1Id := strings.TrimSpace(
+			citools.OutputFromRunOnNode(t, node1, "dm list -H |grep "+fsname+" |cut -f 3"),
+		)
+
+		// keep writing to it on node2 while it's moved back to node1
+		citools.RunOnNode(t, node2, citools.DockerRunDetached(
+			fsname, "--name writer-"+fsname,
+		)+" sh -c 'i=0; while true; do i=$((i+1)); head -c 102400 /dev/urandom > /foo/data-$i; sleep 0.1; done'")
+		citools.RunOnNode(t, node2, "sleep 5")
+		st := citools.OutputFromRunOnNode(t, node2, "dm dot move "+fsname+" --to "+node1Id+" --stop-containers")
+
+		// the writer is only stopped for the last round of copying
+		matches := regexp.MustCompile(`with ([0-9.]+)s of downtime`).FindStringSubmatch(st)
+		if matches == nil {
+			t.Error(fmt.Sprintf("Expected the downtime to be reported, got '%s'", st))
+		} else if downtime, err := strconv.ParseFloat(matches[1], 64); err != nil || downtime > 10 {
+			t.Error(fmt.Sprintf("Expected a short downtime, got '%s'", matches[1]))
+		}
+
+		st = strings.TrimSpace(
+			citools.OutputFromRunOnNode(t, node2, "dm list -H |grep "+fsname+" |cut -f 3"),
+		)
+		if st != node1Id {
+			t.Error(fmt.Sprintf("Expected %s to be on %s, got '%s'", fsname, node1Id, st))
+		}
+		st = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'ls /foo |grep -c data-'")
+		if strings.TrimSpace(st) == "0" {
+			t.Error("Expected what was written on node2 to have been moved")
+		}
+
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		st = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if strings.Contains(st, "pre-copying") {
+			t.Error(fmt.Sprintf("Expected no pre-copy snapshots in the log, got '%s'", st))
+		}
+		citools.RunOnNode(t, node2, "docker rm -f writer-"+fsname)
+	})
+
+	t.Run("CommitAfterMove", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo WORLD > /foo/HELLO'")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'on node1'")
+
+		// procuring it on node2 makes node2 the master at a newer epoch, so
+		// node1 demotes itself, without keeping anything on a new branch
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" sh -c 'echo MOVED > /foo/HELLO'")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'on node2'")
+
+		st := citools.OutputFromRunOnNode(t, node2, "dm log")
+		if !strings.Contains(st, "on node2") {
+			t.Error(fmt.Sprintf("Expected the commit on node2 to be logged, got '%s'", st))
+		}
+		st = citools.OutputFromRunOnNode(t, node1, "dm branch")
+		if strings.Contains(st, "-fenced-") {
+			t.Error(fmt.Sprintf("Expected no fenced branch after a move, got '%s'", st))
+		}
+	})
+
+	t.Run("NodeCertificates", func(t *testing.T) {
+		// each node is issued its own certificate, which it uses to replicate
+		// from the others rather than the admin API key
+		waitForNodeCertificate := "for i in $(seq 60); do test -f ~/.dotmesh/pki/node.pem && exit 0; sleep 1; done; exit 1"
+		citools.RunOnNode(t, node1, waitForNodeCertificate)
+		citools.RunOnNode(t, node2, waitForNodeCertificate)
+
+		// only the node which issues them has the node CA's key
+		countNodeCAKeys := "ls ~/.dotmesh/pki/node-ca-key.pem 2>/dev/null | wc -l"
+		keys := strings.TrimSpace(citools.OutputFromRunOnNode(t, node1, countNodeCAKeys)) +
+			strings.TrimSpace(citools.OutputFromRunOnNode(t, node2, countNodeCAKeys))
+		if keys != "10" && keys != "01" {
+			t.Error(fmt.Sprintf("Expected exactly one node to have the node CA's key, got '%s'", keys))
+		}
+
+		// revoking some other node doesn't get in the way of these two
+		citools.RunOnNode(t, node1, "dm cluster revoke-node no-such-node")
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" sh -c 'echo WORLD > /foo/HELLO'")
+		st := citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" cat /foo/HELLO")
+
+		if !strings.Contains(st, "WORLD") {
+			t.Error(fmt.Sprintf("Unable to find world in transported data capsule, got '%s'", st))
+		}
+	})
+
+	t.Run("NoFailoversWhileNodesAreUp", func(t *testing.T) {
+		// dots only fail over when their master has been gone for the grace
+		// period, which neither node has
+		st := citools.OutputFromRunOnNode(t, node1, "dm cluster failovers -H")
+		if strings.TrimSpace(st) != "" {
+			t.Error(fmt.Sprintf("Unexpected failovers: '%s'", st))
+		}
+	})
+
+	t.Run("SetReplicationFactor", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node1, "dm dot set-replication-factor "+fsname+" 2")
+
+		// both nodes have a copy, so it isn't under-replicated
+		st := citools.OutputFromRunOnNode(t, node1, "dm dot show -H "+fsname)
+		if !strings.Contains(st, "replicationFactor\t2\n") {
+			t.Error(fmt.Sprintf("Replication factor not set: '%s'", st))
+		}
+
+		citools.RunOnNode(t, node1, "dm dot set-replication-factor "+fsname+" 0")
+		st = citools.OutputFromRunOnNode(t, node1, "dm dot show -H "+fsname)
+		if !strings.Contains(st, "replicationFactor\t0\n") {
+			t.Error(fmt.Sprintf("Replication factor not reset: '%s'", st))
+		}
+	})
+
+	t.Run("ClusterStatus", func(t *testing.T) {
+		st := citools.OutputFromRunOnNode(t, node1, "dm cluster status -H")
+		nodes := 0
+		for _, line := range strings.Split(st, "\n") {
+			if strings.HasPrefix(line, "node\t") {
+				nodes++
+				if !strings.Contains(line, "\ttrue\tfalse\t") {
+					t.Error(fmt.Sprintf("Expected node to be up and not draining: '%s'", line))
+				}
+			}
+		}
+		if nodes != 2 {
+			t.Error(fmt.Sprintf("Expected 2 nodes, got '%s'", st))
+		}
+		if !strings.Contains(st, "etcd\thealthy\t") {
+			t.Error(fmt.Sprintf("Expected etcd to be healthy, got '%s'", st))
+		}
+		if strings.Contains(st, "leader\t\n") || !strings.Contains(st, "leader\t") {
+			t.Error(fmt.Sprintf("Expected a node to be the leader, got '%s'", st))
+		}
+	})
+
+	// leaves node2 drained, so keep it last
+	t.Run("Drain", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" sh -c 'echo WORLD > /foo/HELLO'")
+		node2Id := strings.TrimSpace(
+			citools.OutputFromRunOnNode(t, node2, "dm list -H |grep "+fsname+" |cut -f 3"),
+		)
+
+		citools.RunOnNode(t, node1, "dm cluster drain "+node2Id)
+		st := strings.TrimSpace(
+			citools.OutputFromRunOnNode(t, node1, "dm list -H |grep "+fsname+" |cut -f 3"),
+		)
+		if st == node2Id || st == "" {
+			t.Error(fmt.Sprintf("Expected %s to have moved off %s, got '%s'", fsname, node2Id, st))
+		}
+		st = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" cat /foo/HELLO")
+		if !strings.Contains(st, "WORLD") {
+			t.Error(fmt.Sprintf("Unable to find world in drained data capsule, got '%s'", st))
+		}
+
+		// no new dots go on a drained node
+		citools.RunOnNode(t, node2, "if dm init "+citools.UniqName()+"; then exit 1; fi")
+	})
+}
+
+func TestMasterUnavailable(t *testing.T) {
+	citools.TeardownFinishedTestRuns()
+
+	clusterEnv := make(map[string]string)
+	clusterEnv["DOTMESH_REQUEST_TIMEOUT"] = "10s"
+
+	// Our cluster gives up waiting for a dot's master after 10s
+	f := pinnedFederation(citools.NewClusterWithEnv(2, clusterEnv))
+
+	citools.StartTiming()
+	err := f.Start(t)
+	defer citools.TestMarkForCleanup(f)
+	if err != nil {
+		t.Error(err)
+	}
+	citools.LogTiming("setup")
+
+	node1 := f[0].GetNode(0).Container
+	node2 := f[0].GetNode(1).Container
+
+	t.Run("CommitTimesOut", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" sh -c 'echo WORLD > /foo/HELLO'")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+
+		// freeze the master, so that nothing responds to the commit
+		citools.RunOnNode(t, node2, "docker pause dotmesh-server-inner")
+		st := citools.OutputFromRunOnNode(t, node1,
+			"if dm commit -m 'while frozen'; then false; else true; fi",
+		)
+		citools.RunOnNode(t, node2, "docker unpause dotmesh-server-inner")
+		if !strings.Contains(st, "didn't respond in time") {
+			t.Error(fmt.Sprintf("Expected the master to be reported unavailable, got '%s'", st))
+		}
+
+		// the master doesn't act on the abandoned request once it's back
+		time.Sleep(5 * time.Second)
+		citools.RunOnNode(t, node1, "dm commit -m 'once thawed'")
+		st = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if strings.Contains(st, "while frozen") {
+			t.Error(fmt.Sprintf("Expected the abandoned commit not to happen, got '%s'", st))
+		}
+		if !strings.Contains(st, "once thawed") {
+			t.Error(fmt.Sprintf("Expected the commit once thawed to happen, got '%s'", st))
+		}
+	})
+}
+
+func TestFailover(t *testing.T) {
+	citools.TeardownFinishedTestRuns()
+
+	// dots fail over once their master has been gone for 20s (after its
+	// addresses key expires)
+	f := pinnedFederation(citools.NewClusterWithArgs(3, map[string]string{}, " --failover-grace-period 20s"))
+
+	citools.StartTiming()
+	err := f.Start(t)
+	defer citools.TestMarkForCleanup(f)
+	if err != nil {
+		t.Error(err)
+	}
+	citools.LogTiming("setup")
+
+	node1 := f[0].GetNode(0).Container
+	node2 := f[0].GetNode(1).Container
+	node3 := f[0].GetNode(2).Container
+
+	// wait until the given number of nodes have node1's latest commit of the
+	// current dot
+	waitForCopies := func(t *testing.T, fsname string, copies int) {
+		citools.RunOnNode(t, node1, fmt.Sprintf(
+			"for i in $(seq 60); do dm dot show -H %s | grep -q '^upToDateCopies\t%d$' && exit 0; sleep 1; done; exit 1",
+			fsname, copies,
+		))
+	}
+
+	t.Run("PromoteBestReplicaAndFenceOldMaster", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo FIRST > /foo/HELLO'")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'first'")
+		waitForCopies(t, fsname, 3)
+
+		// node2 misses the second commit, and both replicas miss the third
+		citools.RunOnNode(t, node2, "docker pause dotmesh-server-inner")
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo SECOND > /foo/HELLO'")
+		citools.RunOnNode(t, node1, "dm commit -m 'second'")
+		waitForCopies(t, fsname, 2)
+		citools.RunOnNode(t, node3, "docker pause dotmesh-server-inner")
+		citools.RunOnNode(t, node1, citools.DockerRun(fsname)+" sh -c 'echo THIRD > /foo/HELLO'")
+		citools.RunOnNode(t, node1, "dm commit -m 'third'")
+
+		// then the master goes away
+		citools.RunOnNode(t, node1, "docker stop dotmesh-server dotmesh-server-inner")
+		citools.RunOnNode(t, node2, "docker unpause dotmesh-server-inner")
+		citools.RunOnNode(t, node3, "docker unpause dotmesh-server-inner")
+
+		citools.RunOnNode(t, node2, fmt.Sprintf(
+			"for i in $(seq 300); do dm cluster failovers -H | grep -q %s && exit 0; sleep 1; done; exit 1",
+			fsname,
+		))
+		st := citools.OutputFromRunOnNode(t, node2, "dm cluster failovers -H | grep "+fsname)
+		fields := strings.Fields(st)
+		if len(fields) != 5 || fields[4] != "1" {
+			t.Error(fmt.Sprintf("Expected the failover to lose one commit, got '%s'", st))
+		}
+
+		// node3's replica, which had the second commit, was promoted
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		st = citools.OutputFromRunOnNode(t, node2, "dm log")
+		if !strings.Contains(st, "second") || strings.Contains(st, "third") {
+			t.Error(fmt.Sprintf("Expected the most up-to-date replica to be promoted, got '%s'", st))
+		}
+		st = citools.OutputFromRunOnNode(t, node3, citools.DockerRun(fsname)+" cat /foo/HELLO")
+		if !strings.Contains(st, "SECOND") {
+			t.Error(fmt.Sprintf("Expected the new master to serve the second commit, got '%s'", st))
+		}
+		citools.RunOnNode(t, node3, citools.DockerRun(fsname)+" sh -c 'echo AFTER > /foo/HELLO'")
+		citools.RunOnNode(t, node3, "dm switch "+fsname)
+		citools.RunOnNode(t, node3, "dm commit -m 'after failover'")
+
+		// once the old master is back, it keeps the commit it alone had on a
+		// new branch, and follows the new master
+		citools.RunOnNode(t, node1, "docker start dotmesh-server")
+		citools.RunOnNode(t, node1,
+			"for i in $(seq 300); do dm branch 2>/dev/null | grep -q -- -fenced- && exit 0; sleep 1; done; exit 1",
+		)
+		fenced := ""
+		for _, line := range strings.Split(citools.OutputFromRunOnNode(t, node1, "dm branch"), "\n") {
+			if strings.Contains(line, "-fenced-") {
+				fenced = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "*"))
+			}
+		}
+		citools.RunOnNode(t, node1, "dm checkout "+fenced)
+		st = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(st, "third") {
+			t.Error(fmt.Sprintf("Expected the lost commit on the fenced branch, got '%s'", st))
+		}
+		citools.RunOnNode(t, node1, "dm checkout master")
+		st = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(st, "after failover") || strings.Contains(st, "third") {
+			t.Error(fmt.Sprintf("Expected the old master to follow the new one, got '%s'", st))
+		}
+	})
+
+	t.Run("OldMasterComesBackToAWriteRequest", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" sh -c 'echo BEFORE > /foo/HELLO'")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'before'")
+		node2Id := strings.TrimSpace(
+			citools.OutputFromRunOnNode(t, node2, "dm list -H |grep "+fsname+" |cut -f 3"),
+		)
+		waitForCopies(t, fsname, 3)
+
+		// frozen rather than stopped, so that when it thaws it still thinks
+		// it's the master, until it hears otherwise
+		citools.RunOnNode(t, node2, "docker pause dotmesh-server-inner")
+		citools.RunOnNode(t, node1, fmt.Sprintf(
+			"for i in $(seq 300); do dm cluster failovers -H | grep -q %s && exit 0; sleep 1; done; exit 1",
+			fsname,
+		))
+		citools.RunOnNode(t, node2, "docker unpause dotmesh-server-inner")
+
+		// the old master either refuses the commit or it's made on the new
+		// master, but never made on the old master alone
+		committed := strings.TrimSpace(citools.OutputFromRunOnNode(t, node2,
+			"if dm commit -m 'split brain'; then echo yes; else echo no; fi",
+		))
+		st := strings.TrimSpace(
+			citools.OutputFromRunOnNode(t, node1, "dm list -H |grep "+fsname+" |cut -f 3"),
+		)
+		if st == node2Id {
+			t.Error(fmt.Sprintf("Expected %s to have been failed over from %s", fsname, node2Id))
+		}
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		st = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if strings.HasSuffix(committed, "yes") != strings.Contains(st, "split brain") {
+			t.Error(fmt.Sprintf(
+				"Expected the commit (made: %s) to be on the new master if it was made, got '%s'",
+				committed, st,
+			))
+		}
+	})
 }
 
 func TestTwoDoubleNodeClusters(t *testing.T) {
 
-	f := citools.Federation{
+	f := pinnedFederation(
 		citools.NewCluster(2),
 		citools.NewCluster(2),
-	}
+	)
 	citools.StartTiming()
 	err := f.Start(t)
 	defer citools.TestMarkForCleanup(f)
@@ -915,10 +1401,10 @@ func TestTwoDoubleNodeClusters(t *testing.T) {
 func TestTwoSingleNodeClusters(t *testing.T) {
 	citools.TeardownFinishedTestRuns()
 
-	f := citools.Federation{
+	f := pinnedFederation(
 		citools.NewCluster(1), // cluster_0_node_0
 		citools.NewCluster(1), // cluster_1_node_0
-	}
+	)
 	citools.StartTiming()
 	err := f.Start(t)
 	defer citools.TestMarkForCleanup(f)
@@ -1074,6 +1560,165 @@ func TestTwoSingleNodeClusters(t *testing.T) {
 			)
 		}
 	})
+	t.Run("ForcePushDiverged", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'hello'")
+		citools.RunOnNode(t, node2, "dm push cluster_0")
+
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'node1 commit'")
+		citools.RunOnNode(t, node2, "dm commit -m 'node2 commit'")
+
+		result := citools.OutputFromRunOnNode(t, node2, "dm push cluster_0 --force")
+		if !strings.Contains(result, "master-diverged-") {
+			t.Error("force push didn't report the branch it preserved")
+		}
+
+		resp := citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "node2 commit") {
+			t.Error("unable to find pushed commit in remote's log output")
+		}
+		if strings.Contains(resp, "node1 commit") {
+			t.Error("overwritten commit still in remote's master branch")
+		}
+
+		resp = citools.OutputFromRunOnNode(t, node1, "dm branch")
+		if !strings.Contains(resp, "master-diverged-") {
+			t.Error("preserved branch not found on remote")
+		}
+		citools.RunOnNode(t, node1, "dm checkout $(dm branch | grep master-diverged- | tr -d ' *')")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "node1 commit") {
+			t.Error("unable to find overwritten commit on preserved branch")
+		}
+	})
+	t.Run("PullBranchOnConflict", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'hello'")
+		citools.RunOnNode(t, node2, "dm push cluster_0")
+
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'node1 commit'")
+		citools.RunOnNode(t, node2, "dm commit -m 'node2 commit'")
+
+		result := citools.OutputFromRunOnNode(t, node2, "dm pull cluster_0 --branch-on-conflict")
+		if !strings.Contains(result, "master-pulled-") {
+			t.Error("pull didn't report the branch it pulled into")
+		}
+
+		resp := citools.OutputFromRunOnNode(t, node2, "dm log")
+		if !strings.Contains(resp, "node2 commit") || strings.Contains(resp, "node1 commit") {
+			t.Error("local master branch changed by pull with --branch-on-conflict")
+		}
+
+		citools.RunOnNode(t, node2, "dm checkout $(dm branch | grep master-pulled- | tr -d ' *')")
+		resp = citools.OutputFromRunOnNode(t, node2, "dm log")
+		if !strings.Contains(resp, "node1 commit") {
+			t.Error("unable to find remote's commit on new branch")
+		}
+	})
+	t.Run("Fetch", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'hello'")
+		citools.RunOnNode(t, node2, "dm push cluster_0")
+
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'node1 commit'")
+
+		resp := citools.OutputFromRunOnNode(t, node2, "dm fetch cluster_0")
+		if !strings.Contains(resp, "1 commits behind") {
+			t.Error("fetch didn't report being behind the remote")
+		}
+
+		// fetching mustn't pull anything
+		resp = citools.OutputFromRunOnNode(t, node2, "dm log")
+		if strings.Contains(resp, "node1 commit") {
+			t.Error("fetch transferred commits")
+		}
+		resp = citools.OutputFromRunOnNode(t, node2, "dm log --remote cluster_0")
+		if !strings.Contains(resp, "node1 commit") {
+			t.Error("unable to find fetched commit in 'dm log --remote' output")
+		}
+
+		citools.RunOnNode(t, node2, "dm commit -m 'node2 commit'")
+		resp = citools.OutputFromRunOnNode(t, node2, "dm dot show -H")
+		if !strings.Contains(resp, "remoteTracking\tcluster_0\t1\t1\t") {
+			t.Error("'dm dot show' didn't report ahead/behind counts since the fetch")
+		}
+	})
+	t.Run("DryRun", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'hello'")
+
+		resp := citools.OutputFromRunOnNode(t, node2, "dm push cluster_0 --dry-run")
+		if !strings.Contains(resp, "master: 1 commits") || !strings.Contains(resp, "hello") {
+			t.Error("dry run didn't report the commit it would push")
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm list")
+		if strings.Contains(resp, fsname) {
+			t.Error("dry run created the dot on the remote")
+		}
+
+		citools.RunOnNode(t, node2, "dm push cluster_0")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		citools.RunOnNode(t, node1, "dm commit -m 'node1 commit'")
+		citools.RunOnNode(t, node2, "dm commit -m 'node2 commit'")
+
+		resp = citools.OutputFromRunOnNode(t, node2, "dm push cluster_0 --dry-run || true")
+		if !strings.Contains(resp, "would fail") {
+			t.Error("dry run didn't report that the push would fail")
+		}
+		resp = citools.OutputFromRunOnNode(t, node2, "dm pull cluster_0 --dry-run || true")
+		if !strings.Contains(resp, "would fail") {
+			t.Error("dry run didn't report that the pull would fail")
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if strings.Contains(resp, "node2 commit") {
+			t.Error("dry run transferred commits")
+		}
+	})
+	t.Run("Mirror", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'hello'")
+		citools.RunOnNode(t, node2, "dm mirror add cluster_0")
+
+		resp := citools.OutputFromRunOnNode(t, node2, "dm mirror ls -H")
+		if !strings.Contains(resp, fsname) {
+			t.Error("unable to find mirror in 'dm mirror ls' output")
+		}
+		mirrorId := strings.Fields(resp)[0]
+
+		// new commits should show up on the remote without any pushing
+		citools.RunOnNode(t, node2, "dm commit -m 'mirrored'")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		for i := 0; i < 10; i++ {
+			resp = citools.OutputFromRunOnNode(t, node1, "dm log || true")
+			if strings.Contains(resp, "mirrored") {
+				break
+			}
+			fmt.Printf("Not mirrored yet, waiting...\n")
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		if !strings.Contains(resp, "mirrored") {
+			t.Error("unable to find mirrored commit message in remote's log output")
+		}
+
+		citools.RunOnNode(t, node2, "dm mirror rm "+mirrorId)
+		resp = citools.OutputFromRunOnNode(t, node2, "dm mirror ls -H")
+		if strings.Contains(resp, fsname) {
+			t.Error("mirror still listed after 'dm mirror rm'")
+		}
+	})
 	t.Run("ResetAfterPushThenPushMySQL", func(t *testing.T) {
 		fsname := citools.UniqName()
 		citools.RunOnNode(t, node2, citools.DockerRun(
@@ -1162,6 +1807,75 @@ func TestTwoSingleNodeClusters(t *testing.T) {
 		}
 	})
 
+	t.Run("ShallowClone", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'old'")
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/Y")
+		citools.RunOnNode(t, node2, "dm commit -m 'new'")
+
+		citools.RunOnNode(t, node1, "dm clone cluster_1 "+fsname+" --depth=1")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		resp := citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "new") || strings.Contains(resp, "old") {
+			t.Error("shallow clone didn't copy only the latest commit")
+		}
+		resp = citools.OutputFromRunOnNode(t, node1, citools.DockerRun(fsname)+" ls /foo/")
+		if !strings.Contains(resp, "X") || !strings.Contains(resp, "Y") {
+			t.Error("shallow clone didn't have the latest commit's data")
+		}
+
+		// later pulls are incremental from the shallow base
+		citools.RunOnNode(t, node2, "dm commit -m 'newer'")
+		citools.RunOnNode(t, node1, "dm pull cluster_1 "+fsname)
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "newer") {
+			t.Error("unable to pull into a shallow clone")
+		}
+	})
+
+	t.Run("AllBranches", func(t *testing.T) {
+		fsname := citools.UniqName()
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/X")
+		citools.RunOnNode(t, node2, "dm switch "+fsname)
+		citools.RunOnNode(t, node2, "dm commit -m 'on master'")
+		citools.RunOnNode(t, node2, "dm checkout -b branch1")
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/Y")
+		citools.RunOnNode(t, node2, "dm commit -m 'on branch1'")
+		citools.RunOnNode(t, node2, "dm checkout -b branch2")
+		citools.RunOnNode(t, node2, citools.DockerRun(fsname)+" touch /foo/Z")
+		citools.RunOnNode(t, node2, "dm commit -m 'on branch2'")
+
+		citools.RunOnNode(t, node1, "dm clone cluster_1 "+fsname+" --all-branches")
+		citools.RunOnNode(t, node1, "dm switch "+fsname)
+		resp := citools.OutputFromRunOnNode(t, node1, "dm branch")
+		if !strings.Contains(resp, "branch1") || !strings.Contains(resp, "branch2") {
+			t.Error("clone --all-branches didn't copy every branch")
+		}
+		citools.RunOnNode(t, node1, "dm checkout branch2")
+		resp = citools.OutputFromRunOnNode(t, node1, "dm log")
+		if !strings.Contains(resp, "on branch2") {
+			t.Error("clone --all-branches didn't copy a branch of a branch")
+		}
+
+		// new commits on every branch go back in one push
+		citools.RunOnNode(t, node1, "dm commit -m 'more on branch2'")
+		citools.RunOnNode(t, node1, "dm checkout master")
+		citools.RunOnNode(t, node1, "dm commit -m 'more on master'")
+		citools.RunOnNode(t, node1, "dm push cluster_1 --all-branches")
+		citools.RunOnNode(t, node2, "dm checkout master")
+		resp = citools.OutputFromRunOnNode(t, node2, "dm log")
+		if !strings.Contains(resp, "more on master") {
+			t.Error("push --all-branches didn't push master")
+		}
+		citools.RunOnNode(t, node2, "dm checkout branch2")
+		resp = citools.OutputFromRunOnNode(t, node2, "dm log")
+		if !strings.Contains(resp, "more on branch2") {
+			t.Error("push --all-branches didn't push a branch")
+		}
+	})
+
 	t.Run("Bug74MissingMetadata", func(t *testing.T) {
 		fsname := citools.UniqName()
 
@@ -1223,11 +1937,11 @@ func TestTwoSingleNodeClusters(t *testing.T) {
 func TestThreeSingleNodeClusters(t *testing.T) {
 	citools.TeardownFinishedTestRuns()
 
-	f := citools.Federation{
+	f := pinnedFederation(
 		citools.NewCluster(1), // cluster_0_node_0 - common
 		citools.NewCluster(1), // cluster_1_node_0 - alice
 		citools.NewCluster(1), // cluster_2_node_0 - bob
-	}
+	)
 	citools.StartTiming()
 	err := f.Start(t)
 	defer citools.TestMarkForCleanup(f)
@@ -1241,6 +1955,13 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 	bobKey := "bob is great"
 	aliceKey := "alice is great"
 
+	// there's no terminal to confirm the common node's certificate on, so it
+	// has to be pinned up front
+	commonFingerprint, err := apiFingerprint(commonNode.IP)
+	if err != nil {
+		t.Error(err)
+	}
+
 	// Create users bob and alice on the common node
 	err = citools.RegisterUser(commonNode, "bob", "bob@bob.com", bobKey)
 	if err != nil {
@@ -1362,7 +2083,7 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 	t.Run("DefaultRemoteNamespace", func(t *testing.T) {
 		// Alice pushes to the common node with no explicit remote volume, should default to alice/pears
 		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("pears")+" touch /foo/alice")
-		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add common_pears alice@"+commonNode.IP)
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add --fingerprint "+commonFingerprint+" common_pears alice@"+commonNode.IP)
 		citools.RunOnNode(t, aliceNode.Container, "dm switch pears")
 		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
 		citools.RunOnNode(t, aliceNode.Container, "dm push common_pears") // local pears becomes alice/pears
@@ -1377,7 +2098,7 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 	t.Run("DefaultRemoteVolume", func(t *testing.T) {
 		// Alice pushes to the common node with no explicit remote volume, should default to alice/pears
 		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("bananas")+" touch /foo/alice")
-		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add common_bananas alice@"+commonNode.IP)
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add --fingerprint "+commonFingerprint+" common_bananas alice@"+commonNode.IP)
 		citools.RunOnNode(t, aliceNode.Container, "dm switch bananas")
 		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
 		citools.RunOnNode(t, aliceNode.Container, "dm push common_bananas bananas")
@@ -1395,7 +2116,7 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 		}
 
 		// Clone it back as bob
-		citools.RunOnNode(t, bobNode.Container, "echo '"+bobKey+"' | dm remote add common_bananas bob@"+commonNode.IP)
+		citools.RunOnNode(t, bobNode.Container, "echo '"+bobKey+"' | dm remote add --fingerprint "+commonFingerprint+" common_bananas bob@"+commonNode.IP)
 		// Clone should save admin/bananas@common => alice/bananas
 		citools.RunOnNode(t, bobNode.Container, "dm clone common_bananas alice/bananas --local-name bananas")
 		citools.RunOnNode(t, bobNode.Container, "dm switch bananas")
@@ -1419,7 +2140,7 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 	t.Run("DefaultRemoteNamespaceOverride", func(t *testing.T) {
 		// Alice pushes to the common node with no explicit remote volume, should default to alice/kiwis
 		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("kiwis")+" touch /foo/alice")
-		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add common_kiwis alice@"+commonNode.IP)
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add --fingerprint "+commonFingerprint+" common_kiwis alice@"+commonNode.IP)
 		citools.RunOnNode(t, aliceNode.Container, "dm switch kiwis")
 		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
 		citools.RunOnNode(t, aliceNode.Container, "dm push common_kiwis") // local kiwis becomes alice/kiwis
@@ -1445,13 +2166,13 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 
 		// Alice pushes to the common node with no explicit remote volume, should default to alice/fsname
 		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun(fsname)+" touch /foo/alice")
-		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add common_"+fsname+" alice@"+commonNode.IP)
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add --fingerprint "+commonFingerprint+" common_"+fsname+" alice@"+commonNode.IP)
 		citools.RunOnNode(t, aliceNode.Container, "dm switch "+fsname)
 		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
 		citools.RunOnNode(t, aliceNode.Container, "dm push common_"+fsname) // local fsname becomes alice/fsname
 
 		// Bob tries to delete it
-		citools.RunOnNode(t, bobNode.Container, "echo '"+bobKey+"' | dm remote add common_"+fsname+" bob@"+commonNode.IP)
+		citools.RunOnNode(t, bobNode.Container, "echo '"+bobKey+"' | dm remote add --fingerprint "+commonFingerprint+" common_"+fsname+" bob@"+commonNode.IP)
 		citools.RunOnNode(t, bobNode.Container, "dm remote switch common_"+fsname)
 		// We expect failure, so reverse the sense
 		resp := citools.OutputFromRunOnNode(t, bobNode.Container, "if dm dot delete -f alice/"+fsname+"; then false; else true; fi")
@@ -1462,7 +2183,7 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 
 	t.Run("NamespaceAuthorisationNonexistant", func(t *testing.T) {
 		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("grapes")+" touch /foo/alice")
-		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add common_grapes alice@"+commonNode.IP)
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add --fingerprint "+commonFingerprint+" common_grapes alice@"+commonNode.IP)
 		citools.RunOnNode(t, aliceNode.Container, "dm switch grapes")
 		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
 
@@ -1477,9 +2198,31 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 		}
 	})
 
+	t.Run("RemoteCertificatePinning", func(t *testing.T) {
+		// the common node's certificate is signed by its own cluster's CA,
+		// which alice's node doesn't trust, and there's no terminal to ask
+		// whether to trust it on, so it's refused unless we say how to check it
+		citools.RunOnNode(t, aliceNode.Container, "if echo '"+aliceKey+"' | dm remote add common_unpinned alice@"+commonNode.IP+"; then exit 1; else exit 0; fi")
+
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add --fingerprint "+commonFingerprint+" common_pinned alice@"+commonNode.IP)
+		resp := citools.OutputFromRunOnNode(t, aliceNode.Container, "cat ~/.dotmesh/config")
+		if !strings.Contains(resp, "\"Fingerprint\":\"") {
+			t.Error("The common node's certificate fingerprint wasn't pinned")
+		}
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch common_pinned")
+		citools.RunOnNode(t, aliceNode.Container, "dm list")
+		citools.RunOnNode(t, aliceNode.Container, "dm remote switch local")
+
+		// a fingerprint which doesn't match should be refused
+		citools.RunOnNode(t, aliceNode.Container, "if echo '"+aliceKey+"' | dm remote add common_wrong_pin --fingerprint 00 alice@"+commonNode.IP+"; then exit 1; else exit 0; fi")
+
+		// and so should being given the wrong CA
+		citools.RunOnNode(t, aliceNode.Container, "if echo '"+aliceKey+"' | dm remote add common_wrong_ca --ca-bundle ~/.dotmesh/pki/ca.pem alice@"+commonNode.IP+"; then exit 1; else exit 0; fi")
+	})
+
 	t.Run("NamespaceAuthorisation", func(t *testing.T) {
 		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("passionfruit")+" touch /foo/alice")
-		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add common_passionfruit alice@"+commonNode.IP)
+		citools.RunOnNode(t, aliceNode.Container, "echo '"+aliceKey+"' | dm remote add --fingerprint "+commonFingerprint+" common_passionfruit alice@"+commonNode.IP)
 		citools.RunOnNode(t, aliceNode.Container, "dm switch passionfruit")
 		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
 
@@ -1510,6 +2253,120 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 		}
 	})
 
+	t.Run("ThirdPartyPush", func(t *testing.T) {
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("sloe")+" touch /foo/alice")
+		citools.RunOnNode(t, aliceNode.Container, "dm switch sloe")
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
+
+		// the common node brokers a push from alice's cluster to bob's,
+		// without the data going through it
+		citools.RunOnNode(t, commonNode.Container, "dm push cluster_2 sloe --from cluster_1")
+
+		resp := citools.OutputFromRunOnNode(t, bobNode.Container, "dm list -H | cut -f 1 | sort")
+		if !strings.Contains(resp, "sloe") {
+			t.Error("Didn't find sloe on bob's node after pushing it there from alice's")
+		}
+		resp = citools.OutputFromRunOnNode(t, commonNode.Container, "dm list -H | cut -f 1 | sort")
+		if strings.Contains(resp, "sloe") {
+			t.Error("Found sloe on the common node, which should only have brokered the push")
+		}
+	})
+
+	t.Run("PullNamespace", func(t *testing.T) {
+		err := citools.RegisterUser(commonNode, "carol", "carol@bob.com", "carol is great")
+		if err != nil {
+			t.Error(err)
+		}
+		// alice fills carol's namespace on the common node, using her admin
+		// account
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("quince")+" touch /foo/alice")
+		citools.RunOnNode(t, aliceNode.Container, "dm switch quince")
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
+		citools.RunOnNode(t, aliceNode.Container, "dm checkout -b jelly")
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("quince")+" touch /foo/jelly")
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits jelly'")
+		citools.RunOnNode(t, aliceNode.Container, "dm push cluster_0 --remote-name carol/quince --all-branches")
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("rhubarb")+" touch /foo/alice")
+		citools.RunOnNode(t, aliceNode.Container, "dm switch rhubarb")
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Alice commits'")
+		citools.RunOnNode(t, aliceNode.Container, "dm push cluster_0 --remote-name carol/rhubarb")
+
+		// bob takes a copy of the whole namespace, branches and all
+		citools.RunOnNode(t, bobNode.Container, "dm pull cluster_0 --namespace carol")
+
+		resp := citools.OutputFromRunOnNode(t, bobNode.Container, "dm list -H | cut -f 1 | sort")
+		if !strings.Contains(resp, "carol/quince") || !strings.Contains(resp, "carol/rhubarb") {
+			t.Error("Didn't find carol/quince and carol/rhubarb on bob's node")
+		}
+		citools.RunOnNode(t, bobNode.Container, "dm switch carol/quince")
+		resp = citools.OutputFromRunOnNode(t, bobNode.Container, "dm branch")
+		if !strings.Contains(resp, "jelly") {
+			t.Error("Pulling carol's namespace didn't pull the jelly branch of carol/quince")
+		}
+
+		// it all finished, so there's nothing to resume
+		citools.RunOnNode(t, bobNode.Container,
+			"if dm pull cluster_0 --namespace carol --resume; then exit 1; else exit 0; fi")
+	})
+
+	t.Run("S3Remote", func(t *testing.T) {
+		// a MinIO server on alice's node stands in for S3
+		citools.RunOnNode(t, aliceNode.Container,
+			"docker run -d --name dotmesh-test-minio --net=host "+
+				"-e MINIO_ACCESS_KEY=dotmesh -e MINIO_SECRET_KEY=dotmesh-secret "+
+				"minio/minio server /data",
+		)
+		defer citools.RunOnNode(t, aliceNode.Container, "docker rm -f dotmesh-test-minio")
+		citools.RunOnNode(t, aliceNode.Container,
+			"docker run --rm --net=host --entrypoint sh minio/mc -c '"+
+				"for i in $(seq 30); do "+
+				"mc alias set local http://127.0.0.1:9000 dotmesh dotmesh-secret && break; "+
+				"sleep 1; done; mc mb local/backups'",
+		)
+		endpoints := map[string]string{
+			aliceNode.Container: "http://127.0.0.1:9000",
+			bobNode.Container:   fmt.Sprintf("http://%s:9000", aliceNode.IP),
+		}
+		for node, endpoint := range endpoints {
+			citools.RunOnNode(t, node,
+				"DOTMESH_S3_SECRET_ACCESS_KEY=dotmesh-secret dm remote add-s3 "+
+					"backups backups/dots --access-key-id dotmesh --endpoint "+endpoint,
+			)
+		}
+
+		// a full stream, then an incremental one
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("damson")+" touch /foo/first")
+		citools.RunOnNode(t, aliceNode.Container, "dm switch damson")
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'First damson'")
+		citools.RunOnNode(t, aliceNode.Container, "dm push backups damson")
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("damson")+" touch /foo/second")
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Second damson'")
+		citools.RunOnNode(t, aliceNode.Container, "dm push backups damson")
+
+		citools.RunOnNode(t, bobNode.Container, "dm clone backups damson")
+		citools.RunOnNode(t, bobNode.Container, "dm switch damson")
+		resp := citools.OutputFromRunOnNode(t, bobNode.Container, "dm log")
+		if !strings.Contains(resp, "First damson") || !strings.Contains(resp, "Second damson") {
+			t.Errorf("Cloning from the bucket didn't restore both commits: %s", resp)
+		}
+		resp = citools.OutputFromRunOnNode(t, bobNode.Container,
+			citools.DockerRun("damson")+" ls /foo/")
+		if !strings.Contains(resp, "first") || !strings.Contains(resp, "second") {
+			t.Errorf("Cloning from the bucket didn't restore the data: %s", resp)
+		}
+
+		// pulling again only fetches the new stream
+		citools.RunOnNode(t, aliceNode.Container, citools.DockerRun("damson")+" touch /foo/third")
+		citools.RunOnNode(t, aliceNode.Container, "dm commit -m'Third damson'")
+		citools.RunOnNode(t, aliceNode.Container, "dm push backups damson")
+		citools.RunOnNode(t, bobNode.Container, "dm pull backups damson")
+		resp = citools.OutputFromRunOnNode(t, bobNode.Container,
+			citools.DockerRun("damson")+" ls /foo/")
+		if !strings.Contains(resp, "third") {
+			t.Errorf("Pulling from the bucket didn't get the new commit: %s", resp)
+		}
+	})
+
 	// on alice's machine
 	// ------------------
 	// dm init foo
@@ -1560,7 +2417,7 @@ func TestThreeSingleNodeClusters(t *testing.T) {
 func TestKubernetes(t *testing.T) {
 	citools.TeardownFinishedTestRuns()
 
-	f := citools.Federation{citools.NewKubernetes(3)}
+	f := pinnedFederation(citools.NewKubernetes(3))
 
 	citools.StartTiming()
 	err := f.Start(t)
@@ -1810,9 +2667,9 @@ func TestStress(t *testing.T) {
 	// the cluster, and iterate over f[0].GetNodes, so that we can
 	// scale it to the test hardware we have. Might even pick up the
 	// cluster size from an env variable.
-	f := citools.Federation{
+	f := pinnedFederation(
 		citools.NewCluster(5),
-	}
+	)
 	citools.StartTiming()
 	err := f.Start(t)
 	defer citools.TestMarkForCleanup(f)